@@ -0,0 +1,147 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53targets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// API Gateway endpoint types of the custom domain
+const (
+	ApiGatewayEndpointRegional = "regional"
+	ApiGatewayEndpointEdge     = "edge"
+)
+
+// ApiGatewayConfig creates an API Gateway custom domain for the subdomain with its certificate
+type ApiGatewayConfig struct {
+	Enabled bool `json:"enabled"`
+	// "regional" (default), using the certificate in the main region, or "edge", using the one in us-east-1
+	EndpointType string `json:"endpoint_type,omitempty"`
+	// REST API in the main region mapped to the custom domain, by default none
+	RestApiID string `json:"rest_api_id,omitempty"`
+	// Stage of the REST API to map
+	Stage string `json:"stage,omitempty"`
+	// Path of the mapping under the custom domain, by default the root
+	BasePath string `json:"base_path,omitempty"`
+}
+
+// ApiGatewayDomainStackProps configures a stack with an API Gateway custom domain for the subdomain
+type ApiGatewayDomainStackProps struct {
+	awscdk.StackProps
+
+	// Domain hosted on Cloudflare
+	ParentDomain *string
+
+	// Subdomain hosted on Route53
+	Subdomain *string
+
+	// Hosted zone of the subdomain, for the alias record
+	HostedZoneId *string
+
+	// Certificate of the subdomain, in the stack's region for a regional endpoint and in us-east-1 for an edge one
+	CertificateArn *string
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+// NewApiGatewayDomainStack creates a stack with an API Gateway custom domain for the subdomain
+// using the certificate, the base path mapping of Config.ApiGateway.RestApiID if set and the
+// alias record in the hosted zone. The stack must be in the region of the REST API.
+func NewApiGatewayDomainStack(scope constructs.Construct, id string, props *ApiGatewayDomainStackProps) awscdk.Stack {
+	if props == nil {
+		props = &ApiGatewayDomainStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	provided := props.ParentDomain != nil && props.Subdomain != nil && props.HostedZoneId != nil && props.CertificateArn != nil && props.Config != nil && props.Config.ApiGateway != nil
+	if err := validateProps(props.Config, provided, "ParentDomain, Subdomain, HostedZoneId, CertificateArn and Config.ApiGateway"); err != nil {
+		panic(err)
+	}
+	settings := props.Config.ApiGateway
+	endpointType := awsapigateway.EndpointType_REGIONAL
+	if apiGatewayEndpointType(settings) == ApiGatewayEndpointEdge {
+		endpointType = awsapigateway.EndpointType_EDGE
+	}
+
+	// Full domain name for the subdomain (e.g., sub.example.com)
+	fullDomainName := jsii.String(*props.Subdomain + "." + *props.ParentDomain)
+
+	domainName := awsapigateway.NewDomainName(stack, jsii.String("DomainName"), &awsapigateway.DomainNameProps{
+		DomainName:     fullDomainName,
+		Certificate:    awscertificatemanager.Certificate_FromCertificateArn(stack, jsii.String("Certificate"), props.CertificateArn),
+		EndpointType:   endpointType,
+		SecurityPolicy: awsapigateway.SecurityPolicy_TLS_1_2,
+	})
+
+	// The REST API is not part of the app, so it is mapped by ID
+	if settings.RestApiID != "" {
+		var basePath *string
+		if path := strings.Trim(settings.BasePath, "/"); path != "" {
+			basePath = jsii.String(path)
+		}
+		awsapigateway.NewCfnBasePathMapping(stack, jsii.String("BasePathMapping"), &awsapigateway.CfnBasePathMappingProps{
+			DomainName: domainName.DomainName(),
+			RestApiId:  jsii.String(settings.RestApiID),
+			Stage:      jsii.String(settings.Stage),
+			BasePath:   basePath,
+		})
+	}
+
+	awsroute53.NewARecord(stack, jsii.String("AliasRecord"), &awsroute53.ARecordProps{
+		Zone: awsroute53.HostedZone_FromHostedZoneAttributes(stack, jsii.String("ImportedZone"), &awsroute53.HostedZoneAttributes{
+			HostedZoneId: props.HostedZoneId,
+			ZoneName:     fullDomainName,
+		}),
+		RecordName: fullDomainName,
+		Target:     awsroute53.RecordTarget_FromAlias(awsroute53targets.NewApiGatewayDomain(domainName)),
+	})
+
+	// Store the custom domain in SSM Parameter Store for mappings of other APIs
+	domainParamName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/apiGatewayDomainName"
+	awsssm.NewStringParameter(stack, jsii.String("ApiGatewayDomainNameSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(domainParamName),
+		StringValue:   domainName.DomainName(),
+		Description:   jsii.String("API Gateway custom domain for " + *fullDomainName),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("ApiGatewayDomainAliasOutput"), &awscdk.CfnOutputProps{
+		Value:       domainName.DomainNameAliasDomainName(),
+		Description: jsii.String("Target domain name of the API Gateway custom domain"),
+	})
+
+	return stack
+}
+
+// apiGatewayEndpointType returns the endpoint type of the custom domain, or "" for invalid ones
+func apiGatewayEndpointType(settings *ApiGatewayConfig) string {
+	switch settings.EndpointType {
+	case "", ApiGatewayEndpointRegional:
+		return ApiGatewayEndpointRegional
+	case ApiGatewayEndpointEdge:
+		return ApiGatewayEndpointEdge
+	}
+	return ""
+}
+
+// apiGatewayProblems returns the problems of the API Gateway settings
+func apiGatewayProblems(settings *ApiGatewayConfig) []string {
+	var problems []string
+	if apiGatewayEndpointType(settings) == "" {
+		problems = append(problems, "Invalid api_gateway.endpoint_type: "+settings.EndpointType)
+	}
+	if (settings.RestApiID == "") != (settings.Stage == "") {
+		problems = append(problems, "api_gateway.rest_api_id and api_gateway.stage must be set together")
+	}
+	if settings.BasePath != "" && settings.RestApiID == "" {
+		problems = append(problems, "api_gateway.base_path requires rest_api_id")
+	}
+	return problems
+}
@@ -0,0 +1,107 @@
+package cftor53
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatchactions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// CertificateAlarmConfig alarms before the certificate expires, e.g. because a broken
+// delegation keeps ACM from renewing it
+type CertificateAlarmConfig struct {
+	Enabled bool `json:"enabled"`
+	// Alarm when fewer days are left, by default 30. ACM renews 60 days before expiry.
+	DaysBeforeExpiry int `json:"days_before_expiry,omitempty"`
+	// SNS topic in the certificate's region to notify, by default a new topic
+	SnsTopicArn string `json:"sns_topic_arn,omitempty"`
+	// Email addresses subscribed to the new topic
+	Emails []string `json:"emails,omitempty"`
+}
+
+// alarmDaysBeforeExpiry returns the days left before the alarm goes off, by default 30
+func alarmDaysBeforeExpiry(alarm *CertificateAlarmConfig) int {
+	if alarm.DaysBeforeExpiry != 0 {
+		return alarm.DaysBeforeExpiry
+	}
+	return 30
+}
+
+// certificateAlarmProblems returns the problems of the expiry alarm of certificates in the
+// given regions
+func certificateAlarmProblems(alarm *CertificateAlarmConfig, regions []string) []string {
+	if alarm == nil || !alarm.Enabled {
+		return nil
+	}
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	if days := alarmDaysBeforeExpiry(alarm); days < 1 || days > 397 {
+		add("Invalid certificate.expiry_alarm.days_before_expiry: " + strconv.Itoa(days))
+	}
+	if alarm.SnsTopicArn != "" {
+		if len(alarm.Emails) > 0 {
+			add("certificate.expiry_alarm.emails cannot be combined with sns_topic_arn")
+		}
+		// CloudWatch only notifies topics in the alarm's region
+		arnParts := strings.Split(alarm.SnsTopicArn, ":")
+		if len(arnParts) != 6 || arnParts[2] != "sns" {
+			add("Invalid certificate.expiry_alarm.sns_topic_arn: " + alarm.SnsTopicArn)
+			return problems
+		}
+		for _, region := range regions {
+			if arnParts[3] != region {
+				add("certificate.expiry_alarm.sns_topic_arn must be in " + region)
+			}
+		}
+	}
+	return problems
+}
+
+// addCertificateExpiryAlarm adds an alarm on the certificate's DaysToExpiry metric
+// notifying an SNS topic, when enabled
+func addCertificateExpiryAlarm(stack awscdk.Stack, certificate awscertificatemanager.ICertificate, alarm *CertificateAlarmConfig) {
+	if alarm == nil || !alarm.Enabled {
+		return
+	}
+	days := alarmDaysBeforeExpiry(alarm)
+
+	var topic awssns.ITopic
+	if alarm.SnsTopicArn != "" {
+		topic = awssns.Topic_FromTopicArn(stack, jsii.String("CertificateExpiryTopic"), jsii.String(alarm.SnsTopicArn))
+	} else {
+		newTopic := awssns.NewTopic(stack, jsii.String("CertificateExpiryTopic"), &awssns.TopicProps{
+			DisplayName: jsii.String("cftor53 certificate expiry"),
+		})
+		for _, email := range alarm.Emails {
+			newTopic.AddSubscription(awssnssubscriptions.NewEmailSubscription(jsii.String(email), nil))
+		}
+		awscdk.NewCfnOutput(stack, jsii.String("CertificateExpiryTopicArn"), &awscdk.CfnOutputProps{
+			Value:       newTopic.TopicArn(),
+			Description: jsii.String("SNS topic notified before the certificate expires"),
+		})
+		topic = newTopic
+	}
+
+	// ACM publishes the metric once a day, and not before the certificate is issued
+	expiryAlarm := awscloudwatch.NewAlarm(stack, jsii.String("CertificateExpiryAlarm"), &awscloudwatch.AlarmProps{
+		AlarmDescription: jsii.String("The ACM certificate expires in less than " + strconv.Itoa(days) + " days, check that its DNS validation records still resolve"),
+		Metric: certificate.MetricDaysToExpiry(&awscloudwatch.MetricOptions{
+			Period:    awscdk.Duration_Days(jsii.Number(1)),
+			Statistic: jsii.String("Minimum"),
+		}),
+		Threshold:          jsii.Number(float64(days)),
+		ComparisonOperator: awscloudwatch.ComparisonOperator_LESS_THAN_THRESHOLD,
+		EvaluationPeriods:  jsii.Number(1),
+		TreatMissingData:   awscloudwatch.TreatMissingData_NOT_BREACHING,
+	})
+	expiryAlarm.AddAlarmAction(awscloudwatchactions.NewSnsAction(topic))
+}
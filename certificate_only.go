@@ -0,0 +1,63 @@
+package cftor53
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// addCloudflareValidatedCertificate adds a custom resource requesting an ACM certificate for
+// the subdomain and validating it with CNAMEs the Lambda creates in Cloudflare, for
+// Config.CertificateOnly. The certificate ARN is output and stored in SSM like the one of the
+// certificate stack. The stack must be in the certificate region.
+func addCloudflareValidatedCertificate(stack awscdk.Stack, provider *DelegationProvider, props *Cftor53StackProps, tokenProperties map[string]interface{}) {
+	settings := props.Config.Certificate
+	if settings == nil {
+		settings = &CertificateConfig{}
+	}
+
+	// ACM cannot scope certificate requests to names, and the ARNs are only known afterwards
+	provider.Function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("acm:RequestCertificate"),
+		Resources: jsii.Strings("*"),
+	}))
+	provider.Function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions: jsii.Strings("acm:DescribeCertificate", "acm:DeleteCertificate"),
+		Resources: jsii.Strings(*stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("acm"),
+			Resource:     jsii.String("certificate"),
+			ResourceName: jsii.String("*"),
+		})),
+	}))
+
+	properties := map[string]interface{}{
+		"Domain":    *props.ParentDomain,
+		"Subdomain": *props.Subdomain,
+		"Action":    "certificate",
+	}
+	for key, value := range tokenProperties {
+		properties[key] = value
+	}
+	if len(settings.SubjectAlternativeNames) > 0 {
+		properties["SubjectAlternativeNames"] = settings.SubjectAlternativeNames
+	}
+	if settings.KeyAlgorithm != "" {
+		properties["KeyAlgorithm"] = settings.KeyAlgorithm
+	}
+	if settings.TransparencyLogging != nil {
+		properties["TransparencyLogging"] = "ENABLED"
+		if !*settings.TransparencyLogging {
+			properties["TransparencyLogging"] = "DISABLED"
+		}
+	}
+
+	resource := awscdk.NewCustomResource(stack, jsii.String("CloudflareValidatedCertificate"), &awscdk.CustomResourceProps{
+		ServiceToken: provider.ServiceToken,
+		Properties:   &properties,
+	})
+	certificate := awscertificatemanager.Certificate_FromCertificateArn(stack, jsii.String("Certificate"), resource.GetAttString(jsii.String("CertificateArn")))
+
+	addCertificateOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, certificate.CertificateArn(), false)
+	addCertificateExpiryAlarm(stack, certificate, settings.ExpiryAlarm)
+}
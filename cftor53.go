@@ -1,42 +1,276 @@
-package main
+// Package cftor53 provides CDK constructs for delegating a Cloudflare subdomain to a
+// Route53 hosted zone, with ACM certificates validated through the delegated zone.
+package cftor53
 
 import (
-	"encoding/json"
-	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssigner"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
 
+// Token sources supported by the Lambda function
+const (
+	TokenSourceSecretsManager = "secretsmanager"
+	TokenSourceSSM            = "ssm"
+)
+
+// Modes of the NS record updates in Cloudflare
+const (
+	// Replace the NS records of the subdomain with the hosted zone's name servers
+	NSRecordModeReplace = "replace"
+	// Only add the missing name servers, leaving the other NS records in place
+	NSRecordModeAppend = "append"
+)
+
 // ConfigFile represents the structure of the config.json file
 type ConfigFile struct {
-	ApiToken       string                `json:"api_token"`
-	ParentDomain   string                `json:"parent_domain"`
-	Subdomain      string                `json:"subdomain"`
-	SecretName     string                `json:"secret_name,omitempty"`
-	SsmParamPrefix string                `json:"ssm_param_prefix,omitempty"`
-	LambdaSettings *LambdaSettingsConfig `json:"lambda_settings,omitempty"`
-	Regions        *RegionConfig         `json:"regions,omitempty"`
+	ApiToken           string   `json:"api_token"`
+	TokenSource        string   `json:"token_source,omitempty"`
+	TokenParameterName string   `json:"token_parameter_name,omitempty"`
+	ParentDomain       string   `json:"parent_domain"`
+	AccountID          string   `json:"account_id,omitempty"`
+	ZoneID             string   `json:"zone_id,omitempty"`
+	Subdomain          string   `json:"subdomain"`
+	SecretName         string   `json:"secret_name,omitempty"`
+	SecretArn          string   `json:"secret_arn,omitempty"`
+	SecretReplicas     []string `json:"secret_replica_regions,omitempty"`
+	// Account IDs and role ARNs allowed to read the token secret from other accounts
+	SecretReaders      []string              `json:"secret_readers,omitempty"`
+	ExistingSecretOnly bool                  `json:"existing_secret_only,omitempty"`
+	SecretVersion      *SecretVersionConfig  `json:"secret_version,omitempty"`
+	Rotation           *RotationConfig       `json:"rotation,omitempty"`
+	SsmParamPrefix     string                `json:"ssm_param_prefix,omitempty"`
+	LambdaSettings     *LambdaSettingsConfig `json:"lambda_settings,omitempty"`
+	Regions            *RegionConfig         `json:"regions,omitempty"`
+	CloudFormation     *CloudFormationConfig `json:"cloudformation,omitempty"`
+	// Role in the account of the hosted zone, when it differs from the Lambda's
+	AssumeRoleArn string `json:"assume_role_arn,omitempty"`
+	// Existing hosted zone to delegate instead of creating one
+	HostedZoneID string `json:"hosted_zone_id,omitempty"`
+	// Comment and tags of the hosted zone created for the subdomain, e.g. its owning team
+	HostedZoneComment string            `json:"hosted_zone_comment,omitempty"`
+	HostedZoneTags    map[string]string `json:"hosted_zone_tags,omitempty"`
+	// Reusable delegation set for the hosted zone's name servers
+	DelegationSet *DelegationSetConfig `json:"delegation_set,omitempty"`
+	// Private hosted zone for VPCs instead of a public delegation
+	PrivateZone *PrivateZoneConfig `json:"private_zone,omitempty"`
+	// Route53 query logging for the hosted zone
+	QueryLogging *QueryLoggingConfig `json:"query_logging,omitempty"`
+	// Records created in the hosted zone
+	Records []RecordConfig `json:"records,omitempty"`
+	// BIND zone file with more records for the hosted zone
+	ZoneFile string          `json:"zone_file,omitempty"`
+	Pipeline *PipelineConfig `json:"pipeline,omitempty"`
+	StackSet *StackSetConfig `json:"stack_set,omitempty"`
+	// "custom-resources" (default) or "step-functions"
+	Orchestration string `json:"orchestration,omitempty"`
+	// Managed policy set as the permissions boundary of every role, may contain ${AWS::AccountId}
+	PermissionsBoundaryArn string `json:"permissions_boundary_arn,omitempty"`
+	// Tags applied to every stack and its taggable resources
+	Tags map[string]string `json:"tags,omitempty"`
+	// Prefix of the stack IDs and default resource names, for several deployments per account
+	Namespace string `json:"namespace,omitempty"`
+	// Deployment stage, e.g. prod, naming the stacks and the default secret after the stage and the subdomain
+	Stage string `json:"stage,omitempty"`
+	// Stacks protected from deletion
+	TerminationProtection *TerminationProtectionConfig `json:"termination_protection,omitempty"`
+	// What happens to the hosted zone and the token secret on stack deletion
+	RemovalPolicy *RemovalPolicyConfig `json:"removal_policy,omitempty"`
+	// Several Cloudflare domains with their subdomains, instead of parent_domain and subdomain
+	Domains []DomainConfig `json:"domains,omitempty"`
+	// TTL of the NS records created in Cloudflare, by default 3600 seconds
+	NSRecordTTL int `json:"ns_record_ttl,omitempty"`
+	// How the NS records are updated, replace or append, by default replace
+	NSRecordMode string `json:"ns_record_mode,omitempty"`
+	// Pass the check despite proxied records at or below the subdomain, which Cloudflare
+	// stops proxying once the subdomain is delegated
+	AcceptProxiedRecords bool `json:"accept_proxied_records,omitempty"`
+	// ACM certificate for the subdomain
+	Certificate *CertificateConfig `json:"certificate,omitempty"`
+	// CloudFormation exports of the outputs for Fn::ImportValue
+	Exports *ExportsConfig `json:"exports,omitempty"`
+	// Only issue a certificate for the subdomain, validated in Cloudflare, without delegating it
+	CertificateOnly bool `json:"certificate_only,omitempty"`
+	// CloudFront distribution serving the subdomain
+	CloudFront *CloudFrontConfig `json:"cloudfront,omitempty"`
+	// Static website for the subdomain, served by CloudFront from S3
+	Website *WebsiteConfig `json:"website,omitempty"`
+	// API Gateway custom domain for the subdomain
+	ApiGateway *ApiGatewayConfig `json:"api_gateway,omitempty"`
+	// SES domain identity for the subdomain
+	Ses *SesConfig `json:"ses,omitempty"`
+	// Audit of the synthesized resources with cdk-nag rules
+	Nag *NagConfig `json:"nag,omitempty"`
+	// DynamoDB lock serializing the NS record updates of the subdomain
+	Lock *LockConfig `json:"lock,omitempty"`
+	// DynamoDB table recording the Cloudflare records the Lambda manages
+	State *StateConfig `json:"state,omitempty"`
+	// S3 bucket for the custom resource responses too large for CloudFormation
+	ResponseSpill *ResponseSpillConfig `json:"response_spill,omitempty"`
+	// CloudWatch dashboard with the health of the delegations
+	Dashboard *DashboardConfig `json:"dashboard,omitempty"`
+	// Verification that the delegation resolves through DNS-over-HTTPS resolvers
+	Propagation *PropagationConfig `json:"propagation,omitempty"`
+	// Retries of the Cloudflare API calls of the Lambda
+	CloudflareRetry *CloudflareRetryConfig `json:"cloudflare_retry,omitempty"`
+}
+
+// CloudflareRetryConfig tunes how the Lambda retries Cloudflare API calls that were rate
+// limited or failed on the server, with exponential backoff
+type CloudflareRetryConfig struct {
+	// Retries of a call, by default 2, 0 disables retrying
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// Milliseconds before the first retry, doubled for each further one, by default 500
+	BaseDelayMs int `json:"base_delay_ms,omitempty"`
+	// Longest delay between retries in milliseconds, by default 8000
+	MaxDelayMs int `json:"max_delay_ms,omitempty"`
+}
+
+// Defaults and limits of the retries of the Cloudflare API calls
+const (
+	defaultCloudflareBaseDelayMs = 500
+	defaultCloudflareMaxDelayMs  = 8000
+	maxCloudflareRetries         = 10
+	maxCloudflareRetryDelayMs    = 60000
+)
+
+// CertificateConfig configures the ACM certificate of the subdomain
+type CertificateConfig struct {
+	// Issue a certificate, by default true
+	Enabled *bool `json:"enabled,omitempty"`
+	// More names in the hosted zone for the certificate, e.g. *.api.example.com
+	SubjectAlternativeNames []string `json:"subject_alternative_names,omitempty"`
+	// Issue a second certificate in the main region for regional endpoints
+	Regional bool `json:"regional,omitempty"`
+	// "RSA_2048" (default), "EC_prime256v1" or "EC_secp384r1"
+	KeyAlgorithm string `json:"key_algorithm,omitempty"`
+	// Log the issued certificates to public certificate transparency logs, by default true
+	TransparencyLogging *bool `json:"transparency_logging,omitempty"`
+	// Existing certificates to publish instead of issuing them, in the certificate and main region
+	Arn         string `json:"arn,omitempty"`
+	RegionalArn string `json:"regional_arn,omitempty"`
+	// CloudWatch alarm before the certificates expire
+	ExpiryAlarm *CertificateAlarmConfig `json:"expiry_alarm,omitempty"`
+	// Hold the validation until resolvers no longer cache the new subdomain as missing, for
+	// at most the negative TTL of the parent zone
+	NegativeCacheWait bool `json:"negative_cache_wait,omitempty"`
+}
+
+// RemovalPolicyConfig sets the removal policies: "destroy" (default) or "retain"
+type RemovalPolicyConfig struct {
+	HostedZone string `json:"hosted_zone,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+}
+
+// TerminationProtectionConfig enables CloudFormation termination protection per stack
+type TerminationProtectionConfig struct {
+	Secrets bool `json:"secrets,omitempty"`
+	// The stacks with the hosted zone
+	Zone        bool `json:"zone,omitempty"`
+	Certificate bool `json:"certificate,omitempty"`
+}
+
+// PrivateZoneConfig creates a private hosted zone associated with VPCs, which is not
+// delegated from Cloudflare
+type PrivateZoneConfig struct {
+	Vpcs []PrivateZoneVpcConfig `json:"vpcs"`
+}
+
+// PrivateZoneVpcConfig associates a VPC with the private hosted zone
+type PrivateZoneVpcConfig struct {
+	VpcID string `json:"vpc_id"`
+	// Region of the VPC, by default the main region
+	Region string `json:"region,omitempty"`
+}
+
+// CloudFormationConfig synthesizes plain CloudFormation templates with assets in the
+// given bucket, so they can be deployed without CDK bootstrapping
+type CloudFormationConfig struct {
+	// May contain ${AWS::Region} and ${AWS::AccountId} placeholders
+	AssetBucket string `json:"asset_bucket"`
+	AssetPrefix string `json:"asset_prefix,omitempty"`
 }
 
 // RegionConfig represents the region configuration
 type RegionConfig struct {
-	Main        string `json:"main"`
-	Certificate string `json:"certificate"`
+	Main        string `json:"main,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// SecretVersionConfig pins the secret version read by the Lambda function
+type SecretVersionConfig struct {
+	Stage string `json:"stage,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// RotationConfig represents the configuration for rotating the Cloudflare API token
+type RotationConfig struct {
+	Enabled      bool `json:"enabled"`
+	ScheduleDays int  `json:"schedule_days,omitempty"`
 }
 
 // LambdaSettingsConfig represents the configuration for Lambda functions
 type LambdaSettingsConfig struct {
 	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
 	MemorySizeMB   int `json:"memory_size_mb,omitempty"`
+	// Seconds a warm Lambda caches the secret, 0 disables caching
+	SecretCacheTTLSeconds *int `json:"secret_cache_ttl_seconds,omitempty"`
+	// Instruction set architecture: "x86_64" or "arm64"
+	Architecture string `json:"architecture,omitempty"`
+	// Custom runtime: "provided.al2" or "provided.al2023"
+	Runtime string `json:"runtime,omitempty"`
+	// VPC to run the delegation Lambda in
+	Vpc *VpcConfig `json:"vpc,omitempty"`
+	// Concurrency limit and pre-initialized environments for the delegation Lambda
+	ReservedConcurrency    int `json:"reserved_concurrency,omitempty"`
+	ProvisionedConcurrency int `json:"provisioned_concurrency,omitempty"`
+	// AWS Signer code signing for the Lambda functions
+	CodeSigning *CodeSigningConfig `json:"code_signing,omitempty"`
+	// Structured logging, metrics and tracing for the delegation Lambda
+	Powertools *PowertoolsConfig `json:"powertools,omitempty"`
+	// Lowest level of the delegation Lambda's logs: "DEBUG", "INFO", "WARN" or "ERROR"
+	LogLevel string `json:"log_level,omitempty"`
+	// Directory of the Lambda module the functions are compiled from
+	SourceDir string `json:"-"`
+}
+
+// PowertoolsConfig configures the logger, metrics and tracer of the delegation Lambda
+type PowertoolsConfig struct {
+	ServiceName      string `json:"service_name,omitempty"`
+	MetricsNamespace string `json:"metrics_namespace,omitempty"`
+	Tracing          bool   `json:"tracing,omitempty"`
+}
+
+// CodeSigningConfig configures code signing for the Lambda functions. Without a
+// profile name, a new AWS Signer profile is created.
+type CodeSigningConfig struct {
+	SigningProfileName    string `json:"signing_profile_name,omitempty"`
+	SigningProfileVersion string `json:"signing_profile_version,omitempty"`
+	// "Warn" or "Enforce" for unsigned or untrusted code
+	UntrustedArtifactPolicy string `json:"untrusted_artifact_policy,omitempty"`
+}
+
+// VpcConfig places the delegation Lambda in existing VPC subnets
+type VpcConfig struct {
+	VpcID            string   `json:"vpc_id"`
+	SubnetIDs        []string `json:"subnet_ids"`
+	SecurityGroupIDs []string `json:"security_group_ids,omitempty"`
 }
 
 type Cftor53StackProps struct {
@@ -51,99 +285,415 @@ type Cftor53StackProps struct {
 	// Cloudflare API token secret
 	CloudflareApiTokenSecret awssecretsmanager.ISecret
 
+	// Shared delegation provider, by default the one of this stack
+	Provider *DelegationProvider
+
 	// Configuration settings
 	Config *ConfigFile
 }
 
 // Main stack for Route53 hosted zone
 func NewCftor53Stack(scope constructs.Construct, id string, props *Cftor53StackProps) (awscdk.Stack, *string) {
-	var sprops awscdk.StackProps
-	if props != nil {
-		sprops = props.StackProps
+	if props == nil {
+		props = &Cftor53StackProps{}
 	}
-	stack := awscdk.NewStack(scope, &id, &sprops)
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
 
-	// Validate required properties
-	if props.ParentDomain == nil || props.Subdomain == nil || props.Config == nil {
-		panic("ParentDomain, Subdomain and Config must be provided")
+	// Validate required properties and the configuration. Without a secret, the token is read
+	// from an SSM parameter, an existing secret or the configuration.
+	tokenProvided := props.CloudflareApiTokenSecret != nil || props.Config == nil || props.Config.PrivateZone != nil ||
+		props.Config.TokenSource == TokenSourceSSM || props.Config.SecretArn != "" || props.Config.ExistingSecretOnly || props.Config.ApiToken != ""
+	if err := validateProps(props.Config, props.ParentDomain != nil && props.Subdomain != nil && tokenProvided, "ParentDomain, Subdomain, Config and either CloudflareApiTokenSecret, Config.SecretArn or Config.ApiToken"); err != nil {
+		panic(err)
 	}
 
 	// Full domain name for the subdomain (e.g., sub.example.com)
 	fullDomainName := jsii.String(*props.Subdomain + "." + *props.ParentDomain)
 
-	// Create a secret for the Cloudflare API token if not provided from another stack
-	var cloudflareSecret awssecretsmanager.ISecret
-	if props.CloudflareApiTokenSecret != nil {
-		cloudflareSecret = props.CloudflareApiTokenSecret
-	} else if props.Config.ApiToken != "" {
-		// Create a local secret using the API token from config
-		cloudflareSecret = awssecretsmanager.NewSecret(stack, jsii.String("LocalCloudflareApiToken"), &awssecretsmanager.SecretProps{
-			Description: jsii.String("Cloudflare API Token for DNS management"),
-			SecretName:  jsii.String("cftor53/cloudflare/api-token-local"),
-			SecretObjectValue: &map[string]awscdk.SecretValue{
-				"api_token": awscdk.SecretValue_UnsafePlainText(jsii.String(props.Config.ApiToken)),
-			},
+	// A private hosted zone is not delegated, so the stack has no Cloudflare resources
+	if props.Config.PrivateZone != nil {
+		hostedZoneId := addPrivateHostedZone(stack, fullDomainName, props.Config)
+		addHostedZoneOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, hostedZoneId, nil)
+		addSeedRecords(stack, hostedZoneId, *fullDomainName, props.Config.Records)
+		return stack, hostedZoneId
+	}
+
+	// The delegation provider is shared by all delegations in the stack unless one is passed in
+	lambdaSettings := constructLambdaSettings(props.Config.LambdaSettings)
+	provider := props.Provider
+	if provider == nil {
+		provider = NewDelegationProvider(stack, lambdaSettings)
+	}
+	checkRecordsLambda := provider.Function
+	serviceToken := provider.ServiceToken
+
+	// Properties telling the Lambda where to read the Cloudflare API token from
+	// and, optionally, which Cloudflare account or zone and NS record TTL and mode to use
+	tokenProperties := map[string]interface{}{}
+	if props.Config.NSRecordTTL != 0 {
+		tokenProperties["NSRecordTTL"] = strconv.Itoa(props.Config.NSRecordTTL)
+	}
+	if props.Config.NSRecordMode == NSRecordModeAppend {
+		tokenProperties["Mode"] = NSRecordModeAppend
+	}
+	if props.Config.AcceptProxiedRecords {
+		tokenProperties["AcceptProxiedRecords"] = "true"
+	}
+	if retry := props.Config.CloudflareRetry; retry != nil {
+		if retry.MaxRetries != nil {
+			tokenProperties["MaxRetries"] = strconv.Itoa(*retry.MaxRetries)
+		}
+		if retry.BaseDelayMs != 0 {
+			tokenProperties["BaseDelayMs"] = strconv.Itoa(retry.BaseDelayMs)
+		}
+		if retry.MaxDelayMs != 0 {
+			tokenProperties["MaxDelayMs"] = strconv.Itoa(retry.MaxDelayMs)
+		}
+	}
+	if props.Config.AccountID != "" {
+		tokenProperties["AccountId"] = props.Config.AccountID
+	}
+	if props.Config.ZoneID != "" {
+		tokenProperties["ZoneId"] = props.Config.ZoneID
+	}
+	if props.Config.TokenSource == TokenSourceSSM {
+		// Grant permissions to read the SecureString parameter holding the token
+		parameterArn := awscdk.Stack_Of(stack).FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("ssm"),
+			Resource:     jsii.String("parameter"),
+			ResourceName: jsii.String(strings.TrimPrefix(props.Config.TokenParameterName, "/")),
 		})
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("ssm:GetParameter"),
+			Resources: jsii.Strings(*parameterArn),
+		}))
+
+		tokenProperties["TokenSource"] = TokenSourceSSM
+		tokenProperties["TokenParameterName"] = props.Config.TokenParameterName
 	} else {
-		panic("Either CloudflareApiTokenSecret or Config.ApiToken must be provided")
-	}
-
-	// Create a custom resource to check for colliding DNS records in Cloudflare
-	// but not make any changes yet
-	checkRecordsLambda := awslambda.NewFunction(stack, jsii.String("CloudflareCheckDNSLambda"), &awslambda.FunctionProps{
-		Runtime:      awslambda.Runtime_PROVIDED_AL2(),
-		Handler:      jsii.String("bootstrap"),
-		Code:         awslambda.Code_FromAsset(jsii.String("lambda/main.zip"), nil),
-		Timeout:      awscdk.Duration_Seconds(jsii.Number(float64(props.Config.LambdaSettings.TimeoutSeconds))),
-		MemorySize:   jsii.Number(float64(props.Config.LambdaSettings.MemorySizeMB)),
-		Architecture: awslambda.Architecture_X86_64(),
-	})
+		// Create a secret for the Cloudflare API token if not provided from another stack
+		var cloudflareSecret awssecretsmanager.ISecret
+		var secretId *string
+		partialArn := false // Secrets imported by name lack the random ARN suffix
+		if props.CloudflareApiTokenSecret != nil {
+			cloudflareSecret = props.CloudflareApiTokenSecret
+
+			// A secret from another region is read from its local replica, so
+			// only the secret name crosses the stack boundary
+			secretRegion := awscdk.Stack_Of(cloudflareSecret).Region()
+			if !*awscdk.Token_IsUnresolved(secretRegion) && !*awscdk.Token_IsUnresolved(stack.Region()) && *secretRegion != *stack.Region() {
+				cloudflareSecret = awssecretsmanager.Secret_FromSecretNameV2(stack, jsii.String("ReplicatedCloudflareApiToken"), cloudflareSecret.SecretName())
+				partialArn = true
+			}
+		} else if props.Config.SecretArn != "" {
+			// Import an existing secret instead of creating one from a plaintext token,
+			// and reference it by ARN since it may live outside this account or region
+			cloudflareSecret = awssecretsmanager.Secret_FromSecretCompleteArn(stack, jsii.String("ImportedCloudflareApiToken"), jsii.String(props.Config.SecretArn))
+			secretId = jsii.String(props.Config.SecretArn)
+			addTokenRotation(stack, cloudflareSecret, props.Config.Rotation, lambdaSettings)
+		} else if props.Config.ExistingSecretOnly {
+			// Import a pre-created secret by name, never synthesizing the token into the template
+			cloudflareSecret = awssecretsmanager.Secret_FromSecretNameV2(stack, jsii.String("ImportedCloudflareApiToken"), jsii.String(props.Config.SecretName))
+			partialArn = true
+			addTokenRotation(stack, cloudflareSecret, props.Config.Rotation, lambdaSettings)
+		} else {
+			// Create a local secret using the API token from config
+			localSecretName := "cftor53/cloudflare/api-token-local"
+			if props.Config.Namespace != "" {
+				localSecretName = "cftor53/" + props.Config.Namespace + "/cloudflare/api-token-local"
+			}
+			if props.Config.Stage != "" {
+				secretName, _ := resourceNames(&ConfigFile{Namespace: props.Config.Namespace, Stage: props.Config.Stage, ParentDomain: *props.ParentDomain, Subdomain: *props.Subdomain})
+				localSecretName = secretName + "-local"
+			}
+			cloudflareSecret = awssecretsmanager.NewSecret(stack, jsii.String("LocalCloudflareApiToken"), &awssecretsmanager.SecretProps{
+				Description: jsii.String("Cloudflare API Token for DNS management"),
+				SecretName:  jsii.String(localSecretName),
+				SecretObjectValue: &map[string]awscdk.SecretValue{
+					"api_token": awscdk.SecretValue_UnsafePlainText(jsii.String(props.Config.ApiToken)),
+				},
+			})
+			if props.Config.RemovalPolicy != nil {
+				applyRemovalPolicy(cloudflareSecret, props.Config.RemovalPolicy.Secret)
+			}
+		}
+
+		// Grant permissions to read the Cloudflare API token secret
+		// Create an explicit policy statement to grant read access to the secret
+		secretArn := cloudflareSecret.SecretArn()
+		if partialArn {
+			secretArn = jsii.String(*secretArn + "-??????")
+		}
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"),
+			Resources: jsii.Strings(*secretArn),
+		}))
+
+		// A secret shared from another account is encrypted with a key there, which the
+		// Lambda may only use through Secrets Manager
+		if props.Config.SecretArn != "" {
+			checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:   jsii.Strings("kms:Decrypt"),
+				Resources: jsii.Strings("*"),
+				Conditions: &map[string]interface{}{
+					"StringLike": map[string]interface{}{
+						"kms:ViaService": "secretsmanager.*.amazonaws.com",
+					},
+				},
+			}))
+		}
+
+		if secretId == nil {
+			secretId = cloudflareSecret.SecretName()
+		}
+		tokenProperties["SecretId"] = secretId
+		if props.Config.SecretVersion != nil {
+			if props.Config.SecretVersion.Stage != "" {
+				tokenProperties["SecretVersionStage"] = props.Config.SecretVersion.Stage
+			}
+			if props.Config.SecretVersion.ID != "" {
+				tokenProperties["SecretVersionId"] = props.Config.SecretVersion.ID
+			}
+		}
+	}
+
+	// Responses too large for CloudFormation are stored in full before they are truncated
+	if props.Config.ResponseSpill != nil && props.Config.ResponseSpill.Enabled {
+		tokenProperties["SpillBucket"] = addResponseSpillBucket(stack, checkRecordsLambda, props.Config.ResponseSpill)
+	}
 
-	// Grant permissions to read the Cloudflare API token secret
-	// Create an explicit policy statement to grant read access to the secret
-	secretArn := cloudflareSecret.SecretArn()
+	// Without a delegation the certificate is validated in Cloudflare
+	if props.Config.CertificateOnly {
+		addCloudflareValidatedCertificate(stack, provider, props, tokenProperties)
+		return stack, nil
+	}
+
+	// The Lambda removes the records of a renamed delegation, but not when the stack is deleted
 	checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
-		Actions:   jsii.Strings("secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"),
-		Resources: jsii.Strings(*secretArn),
+		Actions: jsii.Strings("cloudformation:DescribeStacks"),
+		Resources: jsii.Strings(*stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("cloudformation"),
+			Resource:     jsii.String("stack"),
+			ResourceName: jsii.String(*stack.StackName() + "/*"),
+		})),
 	}))
 
-	// First custom resource: only checks for colliding DNS records
-	checkDnsResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareDNSCollisionChecker"), &awscdk.CustomResourceProps{
-		ServiceToken: checkRecordsLambda.FunctionArn(),
-		Properties: &map[string]interface{}{
+	// Overlapping updates of the subdomain take turns on a lock
+	if props.Config.Lock != nil && props.Config.Lock.Enabled {
+		tokenProperties["LockTable"] = addLockTable(stack, checkRecordsLambda, props.Config.Lock)
+	}
+
+	// The managed records are recorded for precise deletes and the inventory
+	if props.Config.State != nil && props.Config.State.Enabled {
+		tokenProperties["StateTable"] = addStateTable(stack, checkRecordsLambda, props.Config, props.ParentDomain, props.Subdomain)
+	}
+
+	// A nested subdomain, e.g. a.b.example.com, is delegated in the Route53 zone of its
+	// parent subdomain when an earlier deployment created one in this account
+	if !*awscdk.Token_IsUnresolved(props.Subdomain) && strings.Contains(*props.Subdomain, ".") {
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("route53:ListHostedZonesByName"),
+			Resources: jsii.Strings("*"),
+		}))
+		parentZones := jsii.Strings(*stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("route53"),
+			Region:       jsii.String(""),
+			Account:      jsii.String(""),
+			Resource:     jsii.String("hostedzone"),
+			ResourceName: jsii.String("*"),
+		}))
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("route53:ListResourceRecordSets"),
+			Resources: parentZones,
+		}))
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("route53:ChangeResourceRecordSets"),
+			Resources: parentZones,
+			Conditions: &map[string]interface{}{
+				"ForAllValues:StringEquals": map[string]interface{}{
+					"route53:ChangeResourceRecordSetsNormalizedRecordNames": strings.ToLower(*fullDomainName),
+					"route53:ChangeResourceRecordSetsRecordTypes":           "NS",
+				},
+			},
+		}))
+	}
+
+	// The hosted zone exists or lives in another account, so only Cloudflare is updated here
+	if props.Config.AssumeRoleArn != "" || props.Config.HostedZoneID != "" {
+		nameServersString := addZoneLookupDelegation(stack, checkRecordsLambda, serviceToken, props, tokenProperties)
+		if props.Config.AssumeRoleArn != "" && props.Config.HostedZoneID == "" {
+			// The zone stack has the outputs
+			return stack, nil
+		}
+		hostedZoneId := jsii.String(props.Config.HostedZoneID)
+		addHostedZoneOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, hostedZoneId, nameServersString)
+		if props.Config.AssumeRoleArn == "" {
+			addSeedRecords(stack, hostedZoneId, *fullDomainName, props.Config.Records)
+		}
+		return stack, hostedZoneId
+	}
+
+	var hostedZoneId, nameServersString *string
+	if props.Config.Orchestration == OrchestrationStepFunctions {
+		// A state machine started by a single custom resource creates the hosted zone and delegates it
+		hostedZoneId, nameServersString = addDelegationWorkflow(stack, provider, props, tokenProperties, fullDomainName)
+	} else {
+		// First custom resource: only checks for colliding DNS records
+		checkProperties := map[string]interface{}{
 			"Domain":    *props.ParentDomain,
 			"Subdomain": *props.Subdomain,
-			"SecretId":  cloudflareSecret.SecretName(),
 			"Action":    "check", // Signal to Lambda to only check, not update
-		},
-	})
+		}
+		for key, value := range tokenProperties {
+			checkProperties[key] = value
+		}
+		checkDnsResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareDNSCollisionChecker"), &awscdk.CustomResourceProps{
+			ServiceToken: serviceToken,
+			Properties:   &checkProperties,
+		})
 
-	// Create a Route53 hosted zone for the subdomain - depends on the check
-	hostedZone := awsroute53.NewPublicHostedZone(stack, jsii.String("SubdomainHostedZone"), &awsroute53.PublicHostedZoneProps{
-		ZoneName: fullDomainName,
-		Comment:  jsii.String("Created by CDK for subdomain delegation from Cloudflare"),
-	})
+		// Create a Route53 hosted zone for the subdomain - depends on the check
+		hostedZone := awsroute53.NewPublicHostedZone(stack, jsii.String("SubdomainHostedZone"), &awsroute53.PublicHostedZoneProps{
+			ZoneName:             fullDomainName,
+			Comment:              jsii.String(hostedZoneComment(props.Config, defaultHostedZoneComment)),
+			QueryLogsLogGroupArn: zoneQueryLogsArn(stack, *fullDomainName, props.Config),
+		})
+		applyTags(hostedZone, props.Config.HostedZoneTags)
+
+		applyRemovalPolicy(hostedZone, hostedZoneRemovalPolicy(props.Config))
+
+		// Add explicit dependency to ensure the check happens before zone creation
+		hostedZone.Node().AddDependency(checkDnsResource)
+
+		// Output the Route53 name servers to be used in Cloudflare DNS setup
+		nameServers := hostedZone.HostedZoneNameServers()
+
+		// Using Fn.join to properly handle CDK tokens
+		nameServersString = awscdk.Fn_Join(jsii.String(", "), nameServers)
+		hostedZoneId = hostedZone.HostedZoneId()
+
+		// Second custom resource: updates NS records after Route53 zone is ready
+		updateProperties := map[string]interface{}{
+			"Domain":      *props.ParentDomain,
+			"Subdomain":   *props.Subdomain,
+			"NameServers": nameServers,
+			"Action":      "update", // Signal to Lambda to update NS records
+		}
+		for key, value := range tokenProperties {
+			updateProperties[key] = value
+		}
+		updateProperties["StatusParameter"] = addDelegationStatusParameter(stack, checkRecordsLambda, props.Config, props.ParentDomain, props.Subdomain)
+		updateServiceToken := serviceToken
+		if props.Config.Propagation != nil && props.Config.Propagation.Enabled {
+			// The update completes once the parent zone's name servers refer to the hosted zone
+			updateServiceToken = addPropagationProvider(stack, checkRecordsLambda, props.Config.Propagation)
+			updateProperties["ProviderFramework"] = "true"
+			for key, value := range propagationTimingProperties(props.Config.Propagation) {
+				updateProperties[key] = value
+			}
+		}
+		updateNsResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareDNSUpdater"), &awscdk.CustomResourceProps{
+			ServiceToken: updateServiceToken,
+			Properties:   &updateProperties,
+		})
+
+		// Ensure the update only happens after the hosted zone is created
+		updateNsResource.Node().AddDependency(hostedZone)
 
-	// Add explicit dependency to ensure the check happens before zone creation
-	hostedZone.Node().AddDependency(checkDnsResource)
+		// The certificate stacks deploy after this stack, so their validation starts once resolvers
+		// stop caching the subdomain as missing
+		if props.Config.Certificate != nil && props.Config.Certificate.NegativeCacheWait && certificateEnabled(props.Config.Certificate) {
+			waitProperties := propagationTimingProperties(props.Config.Propagation)
+			waitProperties["Domain"] = *props.ParentDomain
+			waitProperties["Subdomain"] = *props.Subdomain
+			waitProperties["NameServers"] = nameServers
+			waitProperties["DoHEndpoints"] = dohResolvers(props.Config.Propagation)
+			waitProperties["Action"] = "wait"
+			waitResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareNegativeCacheWait"), &awscdk.CustomResourceProps{
+				ServiceToken: serviceToken,
+				Properties:   &waitProperties,
+			})
+			waitResource.Node().AddDependency(updateNsResource)
+		}
+	}
 
-	// Output the Route53 name servers to be used in Cloudflare DNS setup
-	nameServers := hostedZone.HostedZoneNameServers()
+	addHostedZoneOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, hostedZoneId, nameServersString)
+	addSeedRecords(stack, hostedZoneId, *fullDomainName, props.Config.Records)
 
-	// Using Fn.join to properly handle CDK tokens
-	nameServersString := awscdk.Fn_Join(jsii.String(", "), nameServers)
+	// Return the stack and the hosted zone ID
+	return stack, hostedZoneId
+}
 
-	awscdk.NewCfnOutput(stack, jsii.String("NameServers"), &awscdk.CfnOutputProps{
-		Value:       nameServersString,
-		Description: jsii.String("Name servers for the Route53 hosted zone. Add these as NS records in Cloudflare for delegation."),
+// addPrivateHostedZone creates the private hosted zone associated with the configured VPCs
+func addPrivateHostedZone(stack awscdk.Stack, fullDomainName *string, config *ConfigFile) *string {
+	var vpcs []awsec2.IVpc
+	for i, vpcConfig := range config.PrivateZone.Vpcs {
+		var region *string
+		if vpcConfig.Region != "" {
+			region = jsii.String(vpcConfig.Region)
+		}
+		vpcs = append(vpcs, awsec2.Vpc_FromVpcAttributes(stack, jsii.String("PrivateZoneVpc"+strconv.Itoa(i)), &awsec2.VpcAttributes{
+			VpcId:             jsii.String(vpcConfig.VpcID),
+			AvailabilityZones: stack.AvailabilityZones(),
+			Region:            region,
+		}))
+	}
+
+	hostedZone := awsroute53.NewPrivateHostedZone(stack, jsii.String("SubdomainHostedZone"), &awsroute53.PrivateHostedZoneProps{
+		ZoneName: fullDomainName,
+		Comment:  jsii.String(hostedZoneComment(config, "Created by CDK as a private hosted zone for the subdomain")),
+		Vpc:      vpcs[0],
+	})
+	applyTags(hostedZone, config.HostedZoneTags)
+	for _, vpc := range vpcs[1:] {
+		hostedZone.AddVpc(vpc)
+	}
+	applyRemovalPolicy(hostedZone, hostedZoneRemovalPolicy(config))
+
+	return hostedZone.HostedZoneId()
+}
+
+// addHostedZoneOutputs outputs the hosted zone and its name servers, exported when
+// Config.Exports is enabled, and stores the hosted zone ID in SSM Parameter Store
+func addHostedZoneOutputs(stack awscdk.Stack, parentDomain, subdomain *string, config *ConfigFile, hostedZoneId, nameServersString *string) {
+	fullDomainName := *subdomain + "." + *parentDomain
+	if nameServersString != nil {
+		awscdk.NewCfnOutput(stack, jsii.String("NameServers"), &awscdk.CfnOutputProps{
+			Value:       nameServersString,
+			Description: jsii.String("Name servers for the Route53 hosted zone. Add these as NS records in Cloudflare for delegation."),
+			ExportName:  exportName(config.Exports, ExportNameServers, fullDomainName),
+		})
+	}
+	awscdk.NewCfnOutput(stack, jsii.String("HostedZoneIdOutput"), &awscdk.CfnOutputProps{
+		Value:       hostedZoneId,
+		Description: jsii.String("Route53 Hosted Zone ID"),
+		ExportName:  exportName(config.Exports, ExportHostedZoneID, fullDomainName),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("HostedZoneArnOutput"), &awscdk.CfnOutputProps{
+		Value: stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("route53"),
+			Region:       jsii.String(""),
+			Account:      jsii.String(""),
+			Resource:     jsii.String("hostedzone"),
+			ResourceName: hostedZoneId,
+		}),
+		Description: jsii.String("Route53 Hosted Zone ARN"),
+		ExportName:  exportName(config.Exports, ExportHostedZoneArn, fullDomainName),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("ZoneNameOutput"), &awscdk.CfnOutputProps{
+		Value:       jsii.String(fullDomainName),
+		Description: jsii.String("Route53 Hosted Zone name"),
+		ExportName:  exportName(config.Exports, ExportZoneName, fullDomainName),
 	})
 
 	// Store the hosted zone ID in SSM Parameter Store for reference
-	paramName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/hostedZoneId"
+	paramName := config.SsmParamPrefix + "/" + *subdomain + "/" + strings.ReplaceAll(*parentDomain, ".", "-") + "/hostedZoneId"
 	ssmParam := awsssm.NewStringParameter(stack, jsii.String("HostedZoneIdSSMParam"), &awsssm.StringParameterProps{
 		ParameterName: jsii.String(paramName),
-		StringValue:   hostedZone.HostedZoneId(),
-		Description:   jsii.String("Hosted Zone ID for " + *props.Subdomain + "." + *props.ParentDomain),
+		// Given explicitly, since the name contains a token when the subdomain is a parameter
+		SimpleName:  jsii.Bool(!strings.HasPrefix(paramName, "/")),
+		StringValue: hostedZoneId,
+		Description: jsii.String("Hosted Zone ID for " + fullDomainName),
 	})
 
 	// Output the SSM parameter name
@@ -151,26 +701,563 @@ func NewCftor53Stack(scope constructs.Construct, id string, props *Cftor53StackP
 		Value:       ssmParam.ParameterName(),
 		Description: jsii.String("SSM Parameter containing the Hosted Zone ID"),
 	})
+}
+
+// addZoneLookupDelegation adds the custom resources delegating a hosted zone the stack does
+// not create: an existing one given by Config.HostedZoneID, or one in the account of
+// Config.AssumeRoleArn. The Lambda reads the zone's name servers from Route53, assuming the
+// role if any, and the name servers are returned as an attribute of the update resource.
+func addZoneLookupDelegation(stack awscdk.Stack, checkRecordsLambda awslambda.IFunction, serviceToken *string, props *Cftor53StackProps, tokenProperties map[string]interface{}) *string {
+	if props.Config.AssumeRoleArn != "" {
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions:   jsii.Strings("sts:AssumeRole"),
+			Resources: jsii.Strings(props.Config.AssumeRoleArn),
+		}))
+	} else {
+		checkRecordsLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Actions: jsii.Strings("route53:GetHostedZone"),
+			Resources: jsii.Strings(*stack.FormatArn(&awscdk.ArnComponents{
+				Service:      jsii.String("route53"),
+				Region:       jsii.String(""),
+				Account:      jsii.String(""),
+				Resource:     jsii.String("hostedzone"),
+				ResourceName: jsii.String(props.Config.HostedZoneID),
+			})),
+		}))
+	}
 
-	// Second custom resource: updates NS records after Route53 zone is ready
+	// The zone already exists, so the check only guards the Cloudflare changes
+	checkProperties := map[string]interface{}{
+		"Domain":    *props.ParentDomain,
+		"Subdomain": *props.Subdomain,
+		"Action":    "check",
+	}
+	updateProperties := map[string]interface{}{
+		"Domain":    *props.ParentDomain,
+		"Subdomain": *props.Subdomain,
+		"Action":    "update",
+	}
+	if props.Config.AssumeRoleArn != "" {
+		updateProperties["AssumeRoleArn"] = props.Config.AssumeRoleArn
+	}
+	if props.Config.HostedZoneID != "" {
+		updateProperties["HostedZoneId"] = props.Config.HostedZoneID
+	}
+	for key, value := range tokenProperties {
+		checkProperties[key] = value
+		updateProperties[key] = value
+	}
+	updateProperties["StatusParameter"] = addDelegationStatusParameter(stack, checkRecordsLambda, props.Config, props.ParentDomain, props.Subdomain)
+	checkDnsResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareDNSCollisionChecker"), &awscdk.CustomResourceProps{
+		ServiceToken: serviceToken,
+		Properties:   &checkProperties,
+	})
 	updateNsResource := awscdk.NewCustomResource(stack, jsii.String("CloudflareDNSUpdater"), &awscdk.CustomResourceProps{
-		ServiceToken: checkRecordsLambda.FunctionArn(),
-		Properties: &map[string]interface{}{
-			"Domain":      *props.ParentDomain,
-			"Subdomain":   *props.Subdomain,
-			"NameServers": nameServers,
-			"SecretId":    cloudflareSecret.SecretName(),
-			"Action":      "update", // Signal to Lambda to update NS records
-		},
+		ServiceToken: serviceToken,
+		Properties:   &updateProperties,
 	})
+	updateNsResource.Node().AddDependency(checkDnsResource)
 
-	// Ensure the update only happens after the hosted zone is created
-	updateNsResource.Node().AddDependency(hostedZone)
+	return awscdk.Fn_Join(jsii.String(", "), awscdk.Fn_Split(jsii.String(","), updateNsResource.GetAttString(jsii.String("NameServers")), nil))
+}
+
+// HostedZoneStackProps configures a stack holding only the hosted zone for the subdomain
+type HostedZoneStackProps struct {
+	awscdk.StackProps
+
+	// Domain hosted on Cloudflare
+	ParentDomain *string
+
+	// Subdomain to be hosted on Route53
+	Subdomain *string
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+// Hosted zone stack for delegations whose Lambda runs in another account
+func NewHostedZoneStack(scope constructs.Construct, id string, props *HostedZoneStackProps) (awscdk.Stack, *string) {
+	if props == nil {
+		props = &HostedZoneStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	if err := validateProps(props.Config, props.ParentDomain != nil && props.Subdomain != nil, "ParentDomain, Subdomain and Config"); err != nil {
+		panic(err)
+	}
+
+	zoneName := *props.Subdomain + "." + *props.ParentDomain
+	hostedZone := awsroute53.NewPublicHostedZone(stack, jsii.String("SubdomainHostedZone"), &awsroute53.PublicHostedZoneProps{
+		ZoneName:             jsii.String(zoneName),
+		Comment:              jsii.String(hostedZoneComment(props.Config, defaultHostedZoneComment)),
+		QueryLogsLogGroupArn: zoneQueryLogsArn(stack, zoneName, props.Config),
+	})
+	applyTags(hostedZone, props.Config.HostedZoneTags)
+	applyRemovalPolicy(hostedZone, hostedZoneRemovalPolicy(props.Config))
+	nameServersString := awscdk.Fn_Join(jsii.String(", "), hostedZone.HostedZoneNameServers())
+	addHostedZoneOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, hostedZone.HostedZoneId(), nameServersString)
+	addSeedRecords(stack, hostedZone.HostedZoneId(), zoneName, props.Config.Records)
 
-	// Return the stack and the hosted zone ID
 	return stack, hostedZone.HostedZoneId()
 }
 
+// roleAccount returns the account ID of an IAM role ARN, or "" when it isn't one
+func roleAccount(roleArn string) string {
+	parts := strings.SplitN(roleArn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || parts[4] == "" || !strings.HasPrefix(parts[5], "role/") {
+		return ""
+	}
+	return parts[4]
+}
+
+// DelegationProvider is the Lambda function serving the delegation custom resources.
+// One provider can serve any number of delegations, including ones in other stacks.
+type DelegationProvider struct {
+	Function     awslambda.IFunction
+	ServiceToken *string
+}
+
+// NewDelegationProvider returns the delegation provider of the stack containing scope,
+// creating it on first use so that all delegations in the stack share one function
+func NewDelegationProvider(scope constructs.Construct, lambdaSettings *LambdaSettingsConfig) *DelegationProvider {
+	stack := awscdk.Stack_Of(scope)
+	if existing := stack.Node().TryFindChild(jsii.String("CloudflareCheckDNSLambda")); existing != nil {
+		function := existing.(awslambda.IFunction)
+		provider := &DelegationProvider{Function: function, ServiceToken: function.FunctionArn()}
+		if alias := stack.Node().TryFindChild(jsii.String("CloudflareCheckDNSLambdaAlias")); alias != nil {
+			provider.ServiceToken = alias.(awslambda.IFunction).FunctionArn()
+		}
+		return provider
+	}
+
+	lambdaSettings = constructLambdaSettings(lambdaSettings)
+	lambdaEnvironment := map[string]*string{
+		"POWERTOOLS_SERVICE_NAME":      jsii.String(lambdaSettings.Powertools.ServiceName),
+		"POWERTOOLS_METRICS_NAMESPACE": jsii.String(lambdaSettings.Powertools.MetricsNamespace),
+		"POWERTOOLS_TRACE_DISABLED":    jsii.String(strconv.FormatBool(!lambdaSettings.Powertools.Tracing)),
+		"LOG_LEVEL":                    jsii.String(lambdaLogLevel(lambdaSettings.LogLevel)),
+	}
+	if lambdaSettings.SecretCacheTTLSeconds != nil {
+		lambdaEnvironment["SECRET_CACHE_TTL_SECONDS"] = jsii.String(strconv.Itoa(*lambdaSettings.SecretCacheTTLSeconds))
+	}
+	// The function is compiled from source during synthesis
+	checkRecordsLambdaProps := &awscdklambdagoalpha.GoFunctionProps{
+		Entry:        jsii.String(lambdaSettings.SourceDir),
+		Runtime:      lambdaRuntime(lambdaSettings.Runtime),
+		Bundling:     lambdaBundlingOptions(),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(float64(lambdaSettings.TimeoutSeconds))),
+		MemorySize:   jsii.Number(float64(lambdaSettings.MemorySizeMB)),
+		Architecture: lambdaArchitecture(lambdaSettings.Architecture),
+		Environment:  &lambdaEnvironment,
+	}
+	if vpcConfig := lambdaSettings.Vpc; vpcConfig != nil {
+		checkRecordsLambdaProps.Vpc, checkRecordsLambdaProps.VpcSubnets, checkRecordsLambdaProps.SecurityGroups = lambdaVpc(stack, vpcConfig)
+	}
+	checkRecordsLambdaProps.CodeSigningConfig = lambdaCodeSigningConfig(stack, lambdaSettings.CodeSigning)
+	if lambdaSettings.Powertools.Tracing {
+		checkRecordsLambdaProps.Tracing = awslambda.Tracing_ACTIVE
+	}
+	if lambdaSettings.ReservedConcurrency > 0 {
+		checkRecordsLambdaProps.ReservedConcurrentExecutions = jsii.Number(float64(lambdaSettings.ReservedConcurrency))
+	}
+	checkRecordsLambda := awscdklambdagoalpha.NewGoFunction(stack, jsii.String("CloudflareCheckDNSLambda"), checkRecordsLambdaProps)
+
+	// Provisioned concurrency is configured on an alias, which then serves the custom resources
+	provider := &DelegationProvider{Function: checkRecordsLambda, ServiceToken: checkRecordsLambda.FunctionArn()}
+	if lambdaSettings.ProvisionedConcurrency > 0 {
+		checkRecordsAlias := awslambda.NewAlias(stack, jsii.String("CloudflareCheckDNSLambdaAlias"), &awslambda.AliasProps{
+			AliasName:                       jsii.String("live"),
+			Version:                         checkRecordsLambda.CurrentVersion(),
+			ProvisionedConcurrentExecutions: jsii.Number(float64(lambdaSettings.ProvisionedConcurrency)),
+		})
+		provider.ServiceToken = checkRecordsAlias.FunctionArn()
+	}
+
+	return provider
+}
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// stackID prefixes the stack ID with the namespace
+func stackID(namespace, id string) string {
+	if namespace == "" {
+		return id
+	}
+	return namespace + "-" + id
+}
+
+// stageStackID returns the stack ID of a delegation in Config.Stage, e.g. Cftor53-prod-app- for
+// the subdomain app in the stage prod
+func stageStackID(id string, config *ConfigFile) string {
+	return id + "-" + config.Stage + "-" + strings.ReplaceAll(strings.ToLower(config.Subdomain), ".", "-") + "-"
+}
+
+// resourceNames returns the secret name and SSM parameter prefix, by default within the
+// namespace and the stage
+func resourceNames(config *ConfigFile) (secretName, ssmParamPrefix string) {
+	path := "cftor53"
+	if config.Namespace != "" {
+		path += "/" + config.Namespace
+	}
+	if config.Stage != "" {
+		path += "/" + config.Stage
+	}
+	secretName = path + "/cloudflare/api-token"
+	ssmParamPrefix = "/" + path
+	// Each delegation of a stage has a secret of its own, named after it like those of domains
+	if config.Stage != "" && config.Subdomain != "" {
+		secretName = path + "/" + strings.ToLower(config.Subdomain+"."+config.ParentDomain) + "/cloudflare/api-token"
+	}
+	if config.SecretName != "" {
+		secretName = config.SecretName
+	}
+	if config.SsmParamPrefix != "" {
+		ssmParamPrefix = config.SsmParamPrefix
+	}
+	return secretName, ssmParamPrefix
+}
+
+// applyRemovalPolicy applies the configured removal policy to the resource, keeping the
+// construct's default when none is configured
+func applyRemovalPolicy(resource awscdk.IResource, policy string) {
+	if removal := removalPolicy(policy); removal != "" {
+		resource.ApplyRemovalPolicy(removal)
+	}
+}
+
+// removalPolicy returns the CDK removal policy of a configured one, or "" when none or an
+// invalid one is configured
+func removalPolicy(policy string) awscdk.RemovalPolicy {
+	switch policy {
+	case "destroy":
+		return awscdk.RemovalPolicy_DESTROY
+	case "retain":
+		return awscdk.RemovalPolicy_RETAIN
+	}
+	return ""
+}
+
+// removalPolicyProblem describes what is wrong with a configured removal policy, or returns ""
+func removalPolicyProblem(policy string) string {
+	switch policy {
+	case "", "destroy", "retain":
+		return ""
+	case "snapshot":
+		return "Invalid removal_policy: snapshot is not supported by hosted zones and secrets"
+	}
+	return "Invalid removal_policy: " + policy
+}
+
+// hostedZoneRemovalPolicy returns the configured removal policy of the hosted zone
+func hostedZoneRemovalPolicy(config *ConfigFile) string {
+	if config.RemovalPolicy == nil {
+		return ""
+	}
+	return config.RemovalPolicy.HostedZone
+}
+
+// stackSynthesizer returns the synthesizer for a stack, or nil for the default CDK synthesizer.
+// Each stack needs its own synthesizer instance.
+func stackSynthesizer(cloudFormation *CloudFormationConfig) awscdk.IStackSynthesizer {
+	if cloudFormation == nil || cloudFormation.AssetBucket == "" {
+		return nil
+	}
+
+	// Assets are published with the caller's credentials instead of the bootstrap roles,
+	// and the templates have no bootstrap version check
+	return awscdk.NewCliCredentialsStackSynthesizer(&awscdk.CliCredentialsStackSynthesizerProps{
+		FileAssetsBucketName: jsii.String(cloudFormation.AssetBucket),
+		BucketPrefix:         jsii.String(cloudFormation.AssetPrefix),
+	})
+}
+
+// applyPermissionsBoundary sets the managed policy as the permissions boundary of the roles
+// in the stack. Roles added during synthesis, like those of cross-region references, are not covered.
+func applyPermissionsBoundary(stack awscdk.Stack, boundaryArn string) {
+	if boundaryArn == "" {
+		return
+	}
+	arn := jsii.String(boundaryArn)
+	if strings.Contains(boundaryArn, "${") {
+		arn = awscdk.Fn_Sub(arn, nil)
+	}
+	boundary := awsiam.ManagedPolicy_FromManagedPolicyArn(stack, jsii.String("PermissionsBoundary"), arn)
+	awsiam.PermissionsBoundary_Of(stack).Apply(boundary)
+}
+
+// applyTags tags the stack or construct and all of its taggable resources
+func applyTags(scope constructs.IConstruct, tags map[string]string) {
+	for _, key := range tagKeys(tags) {
+		awscdk.Tags_Of(scope).Add(jsii.String(key), jsii.String(tags[key]), nil)
+	}
+}
+
+// tagKeys returns the sorted keys of the tags, so that templates don't change between syntheses
+func tagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tagProblems returns the problems of tag keys that AWS reserves
+func tagProblems(tags map[string]string) []string {
+	var problems []string
+	for _, key := range tagKeys(tags) {
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			problems = append(problems, "Invalid tag "+key+": the aws: prefix is reserved")
+		}
+	}
+	return problems
+}
+
+// lambdaArchitecture returns the Lambda architecture for the configured name, x86_64 unless
+// it is arm64. The Go bundling cross-compiles for the selected architecture.
+func lambdaArchitecture(name string) awslambda.Architecture {
+	if name == "arm64" {
+		return awslambda.Architecture_ARM_64()
+	}
+	return awslambda.Architecture_X86_64()
+}
+
+// lambdaRuntime returns the Lambda custom runtime for the configured name, provided.al2 unless
+// it is provided.al2023. This CDK version has no built-in provided.al2023, so it is defined
+// with the matching SAM build image used when bundling falls back to Docker.
+func lambdaRuntime(name string) awslambda.Runtime {
+	if name == "provided.al2023" {
+		return awslambda.NewRuntime(jsii.String("provided.al2023"), awslambda.RuntimeFamily_OTHER, &awslambda.LambdaRuntimeProps{
+			BundlingDockerImage: jsii.String("public.ecr.aws/sam/build-provided.al2023"),
+		})
+	}
+	return awslambda.Runtime_PROVIDED_AL2()
+}
+
+// lambdaLogLevel returns the log level of the delegation Lambda for the configured name,
+// INFO unless it is one of the levels the Lambda knows
+func lambdaLogLevel(name string) string {
+	switch level := strings.ToUpper(name); level {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+		return level
+	}
+	return "INFO"
+}
+
+// lambdaSettingsProblems returns the problems of the Lambda settings
+func lambdaSettingsProblems(settings *LambdaSettingsConfig) []string {
+	if settings == nil {
+		return nil
+	}
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	switch settings.Architecture {
+	case "", "x86_64", "arm64":
+	default:
+		add("Invalid Lambda architecture: " + settings.Architecture + " (must be x86_64 or arm64)")
+	}
+	switch settings.Runtime {
+	case "", "provided.al2", "provided.al2023":
+	default:
+		add("Invalid Lambda runtime: " + settings.Runtime + " (must be provided.al2 or provided.al2023)")
+	}
+	switch strings.ToUpper(settings.LogLevel) {
+	case "", "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		add("Invalid Lambda log level: " + settings.LogLevel + " (must be DEBUG, INFO, WARN or ERROR)")
+	}
+	if vpc := settings.Vpc; vpc != nil && (vpc.VpcID == "" || len(vpc.SubnetIDs) == 0) {
+		add("lambda_settings.vpc requires vpc_id and subnet_ids")
+	}
+	if codeSigning := settings.CodeSigning; codeSigning != nil {
+		if codeSigning.SigningProfileName != "" && codeSigning.SigningProfileVersion == "" {
+			add("lambda_settings.code_signing.signing_profile_version must be provided with signing_profile_name")
+		}
+		switch codeSigning.UntrustedArtifactPolicy {
+		case "", "Warn", "Enforce":
+		default:
+			add("Invalid untrusted_artifact_policy: " + codeSigning.UntrustedArtifactPolicy + " (must be Warn or Enforce)")
+		}
+	}
+
+	// Lambda rejects provisioned concurrency above the reserved limit
+	if settings.ReservedConcurrency < 0 || settings.ProvisionedConcurrency < 0 {
+		add("lambda_settings concurrency values must not be negative")
+	} else if settings.ReservedConcurrency > 0 && settings.ProvisionedConcurrency > settings.ReservedConcurrency {
+		add("lambda_settings.provisioned_concurrency cannot exceed reserved_concurrency")
+	}
+	return problems
+}
+
+// lambdaVpc imports the configured VPC, subnets and security groups for a Lambda function.
+// Without security groups, CDK creates one that allows all outbound traffic.
+func lambdaVpc(scope constructs.Construct, vpcConfig *VpcConfig) (awsec2.IVpc, *awsec2.SubnetSelection, *[]awsec2.ISecurityGroup) {
+	// The subnets are selected explicitly, so the availability zones are only informational
+	vpc := awsec2.Vpc_FromVpcAttributes(scope, jsii.String("LambdaVpc"), &awsec2.VpcAttributes{
+		VpcId:             jsii.String(vpcConfig.VpcID),
+		AvailabilityZones: awscdk.Stack_Of(scope).AvailabilityZones(),
+	})
+
+	subnets := make([]awsec2.ISubnet, 0, len(vpcConfig.SubnetIDs))
+	for i, subnetID := range vpcConfig.SubnetIDs {
+		subnets = append(subnets, awsec2.Subnet_FromSubnetId(scope, jsii.String("LambdaSubnet"+strconv.Itoa(i)), jsii.String(subnetID)))
+	}
+
+	var securityGroups *[]awsec2.ISecurityGroup
+	if len(vpcConfig.SecurityGroupIDs) > 0 {
+		groups := make([]awsec2.ISecurityGroup, 0, len(vpcConfig.SecurityGroupIDs))
+		for i, groupID := range vpcConfig.SecurityGroupIDs {
+			groups = append(groups, awsec2.SecurityGroup_FromSecurityGroupId(scope, jsii.String("LambdaSecurityGroup"+strconv.Itoa(i)), jsii.String(groupID), nil))
+		}
+		securityGroups = &groups
+	}
+
+	return vpc, &awsec2.SubnetSelection{Subnets: &subnets}, securityGroups
+}
+
+// lambdaCodeSigningConfig returns the code signing config shared by the Lambda functions in
+// a stack, creating it on first use. It returns nil when code signing is not configured.
+func lambdaCodeSigningConfig(scope constructs.Construct, codeSigning *CodeSigningConfig) awslambda.ICodeSigningConfig {
+	if codeSigning == nil {
+		return nil
+	}
+
+	stack := awscdk.Stack_Of(scope)
+	if existing := stack.Node().TryFindChild(jsii.String("LambdaCodeSigningConfig")); existing != nil {
+		return existing.(awslambda.ICodeSigningConfig)
+	}
+
+	var profile awssigner.ISigningProfile
+	if codeSigning.SigningProfileName != "" {
+		profile = awssigner.SigningProfile_FromSigningProfileAttributes(stack, jsii.String("LambdaSigningProfile"), &awssigner.SigningProfileAttributes{
+			SigningProfileName:    jsii.String(codeSigning.SigningProfileName),
+			SigningProfileVersion: jsii.String(codeSigning.SigningProfileVersion),
+		})
+	} else {
+		profile = awssigner.NewSigningProfile(stack, jsii.String("LambdaSigningProfile"), &awssigner.SigningProfileProps{
+			Platform: awssigner.Platform_AWS_LAMBDA_SHA384_ECDSA(),
+		})
+	}
+
+	policy := awslambda.UntrustedArtifactOnDeployment_WARN
+	if codeSigning.UntrustedArtifactPolicy == "Enforce" {
+		policy = awslambda.UntrustedArtifactOnDeployment_ENFORCE
+	}
+
+	return awslambda.NewCodeSigningConfig(stack, jsii.String("LambdaCodeSigningConfig"), &awslambda.CodeSigningConfigProps{
+		SigningProfiles:               &[]awssigner.ISigningProfile{profile},
+		UntrustedArtifactOnDeployment: policy,
+		Description:                   jsii.String("Code signing for the cftor53 Lambda functions"),
+	})
+}
+
+// lambdaBundlingOptions returns the options for compiling the Lambda functions from source.
+// Go is used locally when available, otherwise the build runs in Docker.
+func lambdaBundlingOptions() *awscdklambdagoalpha.BundlingOptions {
+	return &awscdklambdagoalpha.BundlingOptions{
+		GoBuildFlags: jsii.Strings(`-ldflags "-s -w"`),
+	}
+}
+
+// addTokenRotation attaches a rotation function and schedule to the Cloudflare API token secret if enabled
+func addTokenRotation(scope constructs.Construct, secret awssecretsmanager.ISecret, rotation *RotationConfig, lambdaSettings *LambdaSettingsConfig) {
+	if rotation == nil || !rotation.Enabled {
+		return
+	}
+
+	scheduleDays := float64(30) // Default schedule: every 30 days
+	if rotation.ScheduleDays > 0 {
+		scheduleDays = float64(rotation.ScheduleDays)
+	}
+
+	// The rotation function rolls the token through the Cloudflare API
+	rotationLambda := awscdklambdagoalpha.NewGoFunction(scope, jsii.String("CloudflareTokenRotationLambda"), &awscdklambdagoalpha.GoFunctionProps{
+		Entry:             jsii.String(filepath.Join(lambdaSettings.SourceDir, "rotation")),
+		Runtime:           lambdaRuntime(lambdaSettings.Runtime),
+		Bundling:          lambdaBundlingOptions(),
+		Timeout:           awscdk.Duration_Seconds(jsii.Number(60)),
+		Architecture:      lambdaArchitecture(lambdaSettings.Architecture),
+		CodeSigningConfig: lambdaCodeSigningConfig(scope, lambdaSettings.CodeSigning),
+	})
+
+	// The rotation schedule grants the function access to the secret
+	secret.AddRotationSchedule(jsii.String("CloudflareTokenRotation"), &awssecretsmanager.RotationScheduleOptions{
+		RotationLambda:     rotationLambda,
+		AutomaticallyAfter: awscdk.Duration_Days(jsii.Number(scheduleDays)),
+	})
+}
+
+// secretReplicaRegions returns the regions the token secret is replicated to, skipping its own region
+func secretReplicaRegions(secretRegion string, regions []string) *[]*awssecretsmanager.ReplicaRegion {
+	var replicas []*awssecretsmanager.ReplicaRegion
+	seen := map[string]bool{secretRegion: true}
+	for _, region := range regions {
+		if seen[region] {
+			continue
+		}
+		seen[region] = true
+		replicas = append(replicas, &awssecretsmanager.ReplicaRegion{Region: jsii.String(region)})
+	}
+	if len(replicas) == 0 {
+		return nil
+	}
+	return &replicas
+}
+
+// secretReaderPrincipals returns the principals for account IDs and role ARNs allowed to read
+// the token secret, skipping invalid entries
+func secretReaderPrincipals(readers []string) []awsiam.IPrincipal {
+	var principals []awsiam.IPrincipal
+	for _, reader := range readers {
+		if accountID.MatchString(reader) {
+			principals = append(principals, awsiam.NewAccountPrincipal(jsii.String(reader)))
+		} else if validSecretReader(reader) {
+			principals = append(principals, awsiam.NewArnPrincipal(jsii.String(reader)))
+		}
+	}
+	return principals
+}
+
+// validSecretReader reports whether a secret_readers entry is an account ID or an ARN
+func validSecretReader(reader string) bool {
+	return accountID.MatchString(reader) || strings.HasPrefix(reader, "arn:")
+}
+
+var accountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+// newSecretReadersKey creates the KMS key for a token secret read from other accounts, since
+// the default Secrets Manager key cannot be used outside the secret's account
+func newSecretReadersKey(scope constructs.Construct, principals []awsiam.IPrincipal) awskms.IKey {
+	key := awskms.NewKey(scope, jsii.String("CloudflareApiTokenKey"), &awskms.KeyProps{
+		Description:       jsii.String("Encrypts the Cloudflare API token shared with other accounts"),
+		EnableKeyRotation: jsii.Bool(true),
+	})
+	key.AddToResourcePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:    jsii.Strings("kms:Decrypt"),
+		Principals: &principals,
+		Resources:  jsii.Strings("*"),
+		Conditions: &map[string]interface{}{
+			"StringEquals": map[string]interface{}{
+				"kms:ViaService": "secretsmanager." + *awscdk.Stack_Of(scope).Region() + ".amazonaws.com",
+			},
+		},
+	}), nil)
+	return key
+}
+
+// grantSecretReaders adds a resource policy to the token secret allowing the principals to read it
+func grantSecretReaders(secret awssecretsmanager.ISecret, principals []awsiam.IPrincipal) {
+	secret.AddToResourcePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:    jsii.Strings("secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"),
+		Principals: &principals,
+		Resources:  jsii.Strings("*"),
+	}))
+}
+
 // Separate stack for ACM certificate in us-east-1 (required for CloudFront)
 type CertificateStackProps struct {
 	awscdk.StackProps
@@ -184,174 +1271,176 @@ type CertificateStackProps struct {
 	// Hosted Zone ID (direct reference, not from SSM)
 	HostedZoneId *string
 
+	// Certificate for regional endpoints, published as regionalCertificateArn
+	Regional bool
+
 	// Configuration settings
 	Config *ConfigFile
 }
 
-// Certificate stack for ACM certificate
-func NewCertificateStack(scope constructs.Construct, id string, props *CertificateStackProps) awscdk.Stack {
-	var sprops awscdk.StackProps
-	if props != nil {
-		sprops = props.StackProps
+// Key algorithms ACM issues certificates with
+var certificateKeyAlgorithms = map[string]bool{
+	"RSA_2048":      true,
+	"EC_prime256v1": true,
+	"EC_secp384r1":  true,
+}
+
+// Certificate stack for ACM certificate, returning the stack and the certificate ARN
+func NewCertificateStack(scope constructs.Construct, id string, props *CertificateStackProps) (awscdk.Stack, *string) {
+	if props == nil {
+		props = &CertificateStackProps{}
 	}
-	stack := awscdk.NewStack(scope, &id, &sprops)
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
 
-	// Validate required properties
-	if props.ParentDomain == nil || props.Subdomain == nil || props.HostedZoneId == nil || props.Config == nil {
-		panic("ParentDomain, Subdomain, HostedZoneId and Config must be provided")
+	// Validate required properties and the configuration
+	if err := validateProps(props.Config, props.ParentDomain != nil && props.Subdomain != nil && props.HostedZoneId != nil, "ParentDomain, Subdomain, HostedZoneId and Config"); err != nil {
+		panic(err)
 	}
 
 	// Full domain name for the subdomain (e.g., sub.example.com)
 	fullDomainName := jsii.String(*props.Subdomain + "." + *props.ParentDomain)
 
-	// Import the Route53 hosted zone using the hosted zone ID
-	importedZone := awsroute53.HostedZone_FromHostedZoneId(stack, jsii.String("ImportedZone"), props.HostedZoneId)
+	settings := props.Config.Certificate
+	if settings == nil {
+		settings = &CertificateConfig{}
+	}
+	importArn := settings.Arn
+	if props.Regional {
+		importArn = settings.RegionalArn
+	}
+
+	var certificate awscertificatemanager.ICertificate
+	if importArn != "" {
+		// An existing certificate is published under the same names instead of issuing one
+		certificate = awscertificatemanager.Certificate_FromCertificateArn(stack, jsii.String("ImportedCertificate"), jsii.String(importArn))
+	} else {
+		// Import the Route53 hosted zone using the hosted zone ID
+		importedZone := awsroute53.HostedZone_FromHostedZoneId(stack, jsii.String("ImportedZone"), props.HostedZoneId)
 
-	certificate := awscertificatemanager.NewCertificate(stack, jsii.String("Certificate"), &awscertificatemanager.CertificateProps{
-		DomainName: fullDomainName,
-		Validation: awscertificatemanager.CertificateValidation_FromDns(importedZone),
-	})
+		var subjectAlternativeNames *[]*string
+		if len(settings.SubjectAlternativeNames) > 0 {
+			subjectAlternativeNames = jsii.Strings(settings.SubjectAlternativeNames...)
+		}
+
+		issued := awscertificatemanager.NewCertificate(stack, jsii.String("Certificate"), &awscertificatemanager.CertificateProps{
+			DomainName:              fullDomainName,
+			SubjectAlternativeNames: subjectAlternativeNames,
+			Validation:              awscertificatemanager.CertificateValidation_FromDns(importedZone),
+			// Certificates of internal-only names may be kept out of the public logs
+			TransparencyLoggingEnabled: settings.TransparencyLogging,
+		})
+
+		// CertificateProps has no key algorithm in this CDK version, so it is set on the CloudFormation resource
+		if settings.KeyAlgorithm != "" {
+			issued.Node().DefaultChild().(awscertificatemanager.CfnCertificate).AddPropertyOverride(jsii.String("KeyAlgorithm"), settings.KeyAlgorithm)
+		}
+		certificate = issued
+	}
+
+	addCertificateOutputs(stack, props.ParentDomain, props.Subdomain, props.Config, certificate.CertificateArn(), props.Regional)
+	addCertificateExpiryAlarm(stack, certificate, settings.ExpiryAlarm)
+
+	return stack, certificate.CertificateArn()
+}
 
+// addCertificateOutputs outputs the certificate ARN, exported when Config.Exports is enabled,
+// and stores it in SSM Parameter Store, as regionalCertificateArn for the regional certificate
+func addCertificateOutputs(stack awscdk.Stack, parentDomain, subdomain *string, config *ConfigFile, certificateArn *string, regional bool) {
 	// Store the certificate ARN in SSM Parameter Store for reference by other stacks
-	certificateParamName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/certificateArn"
+	parameter, description, export := "certificateArn", "ACM Certificate ARN for ", ExportCertificateArn
+	if regional {
+		parameter, description, export = "regionalCertificateArn", "Regional ACM Certificate ARN for ", ExportRegionalCertificateArn
+	}
+	certificateParamName := config.SsmParamPrefix + "/" + *subdomain + "/" + strings.ReplaceAll(*parentDomain, ".", "-") + "/" + parameter
 	ssmParam := awsssm.NewStringParameter(stack, jsii.String("CertificateArnSSMParam"), &awsssm.StringParameterProps{
 		ParameterName: jsii.String(certificateParamName),
-		StringValue:   certificate.CertificateArn(),
-		Description:   jsii.String("ACM Certificate ARN for " + *props.Subdomain + "." + *props.ParentDomain),
+		StringValue:   certificateArn,
+		Description:   jsii.String(description + *subdomain + "." + *parentDomain),
 	})
 
 	// Output the certificate ARN and SSM parameter name
 	awscdk.NewCfnOutput(stack, jsii.String("CertificateArnOutput"), &awscdk.CfnOutputProps{
-		Value:       certificate.CertificateArn(),
+		Value:       certificateArn,
 		Description: jsii.String("ACM Certificate ARN"),
+		ExportName:  exportName(config.Exports, export, *subdomain+"."+*parentDomain),
 	})
 
 	awscdk.NewCfnOutput(stack, jsii.String("CertificateArnParamOutput"), &awscdk.CfnOutputProps{
 		Value:       ssmParam.ParameterName(),
 		Description: jsii.String("SSM Parameter containing the Certificate ARN"),
 	})
-
-	return stack
 }
 
-func main() {
-	defer jsii.Close()
-
-	// Create an app with cross-region references enabled through context
-	app := awscdk.NewApp(&awscdk.AppProps{
-		Context: &map[string]interface{}{
-			"@aws-cdk/core:enableCrossAccountRegion": true,
-		},
-	})
-
-	// Read the config.json file
-	configBytes, err := os.ReadFile("config.json")
-	if err != nil {
-		panic("Failed to read config.json: " + err.Error())
-	}
-
-	// Parse the configuration
-	var config ConfigFile
-	if err := json.Unmarshal(configBytes, &config); err != nil {
-		panic("Failed to parse config.json: " + err.Error())
+// certificateSettingsProblems returns the problems of the certificate settings of a subdomain in
+// the certificate region and the main region: additional names outside of the subdomain,
+// where they could not be validated, key algorithms ACM does not issue certificates with and
+// imported certificates in another region than the stack using them
+func certificateSettingsProblems(settings *CertificateConfig, fullDomainName, certRegion, mainRegion string) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
 	}
 
-	// Set default regions if not provided
-	mainRegion := "eu-north-1" // Default main region
-	certRegion := "us-east-1"  // Default cert region (needed for CloudFront)
-	if config.Regions != nil {
-		if config.Regions.Main != "" {
-			mainRegion = config.Regions.Main
-		}
-		if config.Regions.Certificate != "" {
-			certRegion = config.Regions.Certificate
+	for _, name := range settings.SubjectAlternativeNames {
+		name = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(name, ".")), "*.")
+		if name != fullDomainName && !strings.HasSuffix(name, "."+fullDomainName) {
+			add("Invalid certificate.subject_alternative_names: " + name + " is not in " + fullDomainName)
 		}
 	}
-
-	// Domain configuration from config.json
-	parentDomain := jsii.String(config.ParentDomain)
-	subdomain := jsii.String(config.Subdomain)
-
-	// Get secret name (default: "cftor53/cloudflare/api-token")
-	secretName := "cftor53/cloudflare/api-token"
-	if config.SecretName != "" {
-		secretName = config.SecretName
+	if settings.KeyAlgorithm != "" && !certificateKeyAlgorithms[settings.KeyAlgorithm] {
+		add("Invalid certificate.key_algorithm: " + settings.KeyAlgorithm)
 	}
-
-	// Get SSM parameter prefix (default: "/cftor53")
-	ssmParamPrefix := "/cftor53"
-	if config.SsmParamPrefix != "" {
-		ssmParamPrefix = config.SsmParamPrefix
+	if (settings.Arn != "" || settings.RegionalArn != "") && len(settings.SubjectAlternativeNames) > 0 {
+		add("certificate.subject_alternative_names cannot be combined with an imported certificate")
 	}
-
-	// Get Lambda settings with defaults
-	lambdaTimeout := float64(120) // Default timeout: 120 seconds
-	lambdaMemory := float64(256)  // Default memory: 256 MB
-	if config.LambdaSettings != nil {
-		if config.LambdaSettings.TimeoutSeconds > 0 {
-			lambdaTimeout = float64(config.LambdaSettings.TimeoutSeconds)
+	for _, imported := range []struct{ arn, region string }{{settings.Arn, certRegion}, {settings.RegionalArn, mainRegion}} {
+		if imported.arn == "" {
+			continue
 		}
-		if config.LambdaSettings.MemorySizeMB > 0 {
-			lambdaMemory = float64(config.LambdaSettings.MemorySizeMB)
+		arnParts := strings.Split(imported.arn, ":")
+		if len(arnParts) != 6 || arnParts[0] != "arn" || arnParts[2] != "acm" || !strings.HasPrefix(arnParts[5], "certificate/") {
+			add("Invalid ACM certificate ARN: " + imported.arn)
+		} else if arnParts[3] != imported.region {
+			add("Certificate " + imported.arn + " must be in " + imported.region)
 		}
 	}
+	return problems
+}
 
-	// Create a secret in Secrets Manager for the Cloudflare API token (in the main region)
-	secretsStack := awscdk.NewStack(app, jsii.String("CfCloudflareSecretsStack"), &awscdk.StackProps{
-		Env: &awscdk.Environment{
-			Region: jsii.String(mainRegion),
-		},
-		CrossRegionReferences: jsii.Bool(true),
-	})
-
-	// Create a secret for the Cloudflare API token
-	cloudflareSecret := awssecretsmanager.NewSecret(secretsStack, jsii.String("CloudflareApiToken"), &awssecretsmanager.SecretProps{
-		Description: jsii.String("Cloudflare API Token for DNS management"),
-		SecretName:  jsii.String(secretName),
-		SecretObjectValue: &map[string]awscdk.SecretValue{
-			"api_token": awscdk.SecretValue_UnsafePlainText(jsii.String(config.ApiToken)),
-		},
-	})
+// cloudflareRetryProblem describes what is wrong with the retry settings, or returns ""
+func cloudflareRetryProblem(retry *CloudflareRetryConfig) string {
+	if retry == nil {
+		return ""
+	}
+	if retry.MaxRetries != nil && (*retry.MaxRetries < 0 || *retry.MaxRetries > maxCloudflareRetries) {
+		return "Invalid cloudflare_retry.max_retries: " + strconv.Itoa(*retry.MaxRetries) + " (must be 0 to " + strconv.Itoa(maxCloudflareRetries) + ")"
+	}
+	base, max := defaultCloudflareBaseDelayMs, defaultCloudflareMaxDelayMs
+	if retry.BaseDelayMs != 0 {
+		base = retry.BaseDelayMs
+	}
+	if retry.MaxDelayMs != 0 {
+		max = retry.MaxDelayMs
+	}
+	if base < 1 || base > maxCloudflareRetryDelayMs {
+		return "Invalid cloudflare_retry.base_delay_ms: " + strconv.Itoa(base) + " (must be 1 to " + strconv.Itoa(maxCloudflareRetryDelayMs) + ")"
+	}
+	if max < base || max > maxCloudflareRetryDelayMs {
+		return "Invalid cloudflare_retry.max_delay_ms: " + strconv.Itoa(max) + " (must be base_delay_ms to " + strconv.Itoa(maxCloudflareRetryDelayMs) + ")"
+	}
+	return ""
+}
 
-	// Create the main stack with Route53 hosted zone and get the hosted zone ID
-	_, hostedZoneId := NewCftor53Stack(app, "Cftor53Stack", &Cftor53StackProps{
-		StackProps: awscdk.StackProps{
-			CrossRegionReferences: jsii.Bool(true),
-			Env: &awscdk.Environment{
-				Region: jsii.String(mainRegion),
-			},
-		},
-		ParentDomain:             parentDomain,
-		Subdomain:                subdomain,
-		CloudflareApiTokenSecret: cloudflareSecret,
-		Config: &ConfigFile{
-			SsmParamPrefix: ssmParamPrefix,
-			LambdaSettings: &LambdaSettingsConfig{
-				TimeoutSeconds: int(lambdaTimeout),
-				MemorySizeMB:   int(lambdaMemory),
-			},
-			// Include the API token directly for cross-region deployments
-			ApiToken: config.ApiToken,
-		},
-	})
+// defaultHostedZoneComment is the comment of the public hosted zones without hosted_zone_comment
+const defaultHostedZoneComment = "Created by CDK for subdomain delegation from Cloudflare"
 
-	// Create the certificate stack in us-east-1 with direct reference to the hosted zone ID
-	NewCertificateStack(app, "Cftor53CertificateStack", &CertificateStackProps{
-		StackProps: awscdk.StackProps{
-			Env: &awscdk.Environment{
-				Region: jsii.String(certRegion),
-			},
-			CrossRegionReferences: jsii.Bool(true),
-		},
-		ParentDomain: parentDomain,
-		Subdomain:    subdomain,
-		HostedZoneId: hostedZoneId,
-		Config: &ConfigFile{
-			SsmParamPrefix: ssmParamPrefix,
-			// Include the API token directly for cross-region deployments
-			ApiToken: config.ApiToken,
-		},
-	})
+// maxHostedZoneCommentLength is the longest comment Route53 accepts
+const maxHostedZoneCommentLength = 256
 
-	app.Synth(nil)
+// hostedZoneComment returns the configured comment of the hosted zone, or the default
+func hostedZoneComment(config *ConfigFile, fallback string) string {
+	if config.HostedZoneComment == "" {
+		return fallback
+	}
+	return config.HostedZoneComment
 }
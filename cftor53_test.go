@@ -1,35 +1,116 @@
-package main
+package cftor53
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudfront"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/jsii-runtime-go"
 )
 
-// import (
-// 	"testing"
+// templateApp returns an app that skips bundling the Lambda functions, so that tests need
+// neither Go cross-compilation nor Docker
+func templateApp() awscdk.App {
+	return awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{"aws:cdk:bundling-stacks": []string{}},
+	})
+}
 
-// 	"github.com/aws/aws-cdk-go/awscdk/v2"
-// 	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
-// 	"github.com/aws/jsii-runtime-go"
-// )
+func TestDelegatedSubdomainTemplates(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api"},
+	})
 
-// example tests. To run these tests, uncomment this file along with the
-// example resource in cftor53_test.go
-// func TestCftor53Stack(t *testing.T) {
-// 	// GIVEN
-// 	app := awscdk.NewApp(nil)
+	// The token secret, in the main region
+	secrets := assertions.Template_FromStack(delegation.SecretsStack, nil)
+	secrets.ResourceCountIs(jsii.String("AWS::SecretsManager::Secret"), jsii.Number(1))
+	secrets.HasResourceProperties(jsii.String("AWS::SecretsManager::Secret"), map[string]interface{}{
+		"Name":         "cftor53/cloudflare/api-token",
+		"SecretString": `{"api_token":"test-token"}`,
+	})
 
-// 	// WHEN
-// 	stack := NewCftor53Stack(app, "MyStack", nil)
+	// The hosted zone and the custom resources checking and creating the NS records
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.ResourceCountIs(jsii.String("AWS::Route53::HostedZone"), jsii.Number(1))
+	main.HasResourceProperties(jsii.String("AWS::Route53::HostedZone"), map[string]interface{}{
+		"Name": "api.example.com.",
+	})
+	main.ResourceCountIs(jsii.String("AWS::CloudFormation::CustomResource"), jsii.Number(2))
+	main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":    "check",
+		"Domain":    "example.com",
+		"Subdomain": "api",
+		"SecretId":  assertions.Match_AnyValue(),
+	})
+	main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":      "update",
+		"Domain":      "example.com",
+		"Subdomain":   "api",
+		"NameServers": map[string]interface{}{"Fn::GetAtt": []interface{}{assertions.Match_StringLikeRegexp(jsii.String("^SubdomainHostedZone")), "NameServers"}},
+	})
+	main.HasResourceProperties(jsii.String("AWS::SSM::Parameter"), map[string]interface{}{
+		"Name":  "/cftor53/api/example-com/delegationStatus",
+		"Type":  "String",
+		"Value": `{"status":"PENDING"}`,
+	})
+	main.HasResourceProperties(jsii.String("AWS::SSM::Parameter"), map[string]interface{}{
+		"Name":  "/cftor53/api/example-com/hostedZoneId",
+		"Type":  "String",
+		"Value": map[string]interface{}{"Ref": assertions.Match_StringLikeRegexp(jsii.String("^SubdomainHostedZone"))},
+	})
 
-// 	// THEN
-// 	template := assertions.Template_FromStack(stack, nil)
+	// The Lambda only reads the token secret, describes its own stack and writes the delegation
+	// status, and nothing else
+	main.HasResourceProperties(jsii.String("AWS::IAM::Policy"), map[string]interface{}{
+		"PolicyDocument": map[string]interface{}{
+			"Statement": []interface{}{map[string]interface{}{
+				"Action":   []interface{}{"secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"},
+				"Effect":   "Allow",
+				"Resource": map[string]interface{}{"Fn::ImportValue": assertions.Match_StringLikeRegexp(jsii.String("CloudflareApiToken"))},
+			}, map[string]interface{}{
+				"Action": "cloudformation:DescribeStacks",
+				"Effect": "Allow",
+				"Resource": map[string]interface{}{"Fn::Join": []interface{}{"", assertions.Match_ArrayWith(&[]interface{}{
+					":stack/Cftor53Stack/*",
+				})}},
+			}, map[string]interface{}{
+				"Action": "ssm:PutParameter",
+				"Effect": "Allow",
+				"Resource": map[string]interface{}{"Fn::Join": []interface{}{"", assertions.Match_ArrayWith(&[]interface{}{
+					map[string]interface{}{"Ref": assertions.Match_StringLikeRegexp(jsii.String("^DelegationStatusSSMParam"))},
+				})}},
+			}},
+		},
+	})
+	for id, policy := range *main.FindResources(jsii.String("AWS::IAM::Policy"), nil) {
+		document, _ := json.Marshal(policy)
+		if strings.Contains(string(document), `"*"`) {
+			t.Errorf("Expected policy %s to be scoped without wildcards, got %s", id, document)
+		}
+	}
 
-// 	template.HasResourceProperties(jsii.String("AWS::SQS::Queue"), map[string]interface{}{
-// 		"VisibilityTimeout": 300,
-// 	})
-// }
+	// The certificate, validated through the hosted zone
+	certificate := assertions.Template_FromStack(delegation.CertificateStack, nil)
+	certificate.HasResourceProperties(jsii.String("AWS::CertificateManager::Certificate"), map[string]interface{}{
+		"DomainName":       "api.example.com",
+		"ValidationMethod": "DNS",
+	})
+	certificate.HasResourceProperties(jsii.String("AWS::SSM::Parameter"), map[string]interface{}{
+		"Name": "/cftor53/api/example-com/certificateArn",
+		"Type": "String",
+	})
+}
 
 func TestConfigFileParsing(t *testing.T) {
 	// Create a temporary test config
@@ -150,3 +231,1081 @@ func TestDefaultValues(t *testing.T) {
 		t.Errorf("Expected default ssmParamPrefix to be /cftor53, got %s", ssmParamPrefix)
 	}
 }
+
+func TestSecretReplicaRegions(t *testing.T) {
+	// The secret's own region and duplicates are skipped
+	replicas := secretReplicaRegions("eu-north-1", []string{"us-east-1", "eu-north-1", "us-east-1", "eu-west-1"})
+	if replicas == nil || len(*replicas) != 2 {
+		t.Fatalf("Expected 2 replica regions, got %v", replicas)
+	}
+	if *(*replicas)[0].Region != "us-east-1" || *(*replicas)[1].Region != "eu-west-1" {
+		t.Errorf("Unexpected replica regions: %s, %s", *(*replicas)[0].Region, *(*replicas)[1].Region)
+	}
+
+	// No replicas at all when nothing is configured
+	if replicas := secretReplicaRegions("eu-north-1", nil); replicas != nil {
+		t.Errorf("Expected no replica regions, got %v", replicas)
+	}
+}
+
+func TestStageDelegationConfig(t *testing.T) {
+	base := ConfigFile{ParentDomain: "example.com", Subdomain: "api", SecretArn: "arn:aws:secretsmanager:eu-north-1:111111111111:secret:cf-AbCdEf"}
+
+	// Overrides replace the base settings without modifying them
+	stage := stageDelegationConfig(base, PipelineStageConfig{Name: "Dev", Subdomain: "dev-api", SsmParamPrefix: "/cftor53-dev"})
+	if stage.Subdomain != "dev-api" || stage.SsmParamPrefix != "/cftor53-dev" || stage.ParentDomain != "example.com" || stage.SecretArn != base.SecretArn {
+		t.Errorf("Unexpected stage config: %+v", stage)
+	}
+	if base.Subdomain != "api" {
+		t.Errorf("Expected the base config to be unchanged, got subdomain %s", base.Subdomain)
+	}
+}
+
+func TestRoleAccount(t *testing.T) {
+	if account := roleAccount("arn:aws:iam::222222222222:role/cftor53-zone"); account != "222222222222" {
+		t.Errorf("Expected account 222222222222, got %s", account)
+	}
+
+	for _, arn := range []string{"", "arn:aws:iam::222222222222:user/someone", "arn:aws:s3:::bucket", "arn:aws:iam:::role/x"} {
+		if account := roleAccount(arn); account != "" {
+			t.Errorf("Expected no account for %q, got %s", arn, account)
+		}
+	}
+	err := ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", AssumeRoleArn: "arn:aws:s3:::bucket"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid assume_role_arn: arn:aws:s3:::bucket") {
+		t.Errorf("Expected the assume_role_arn to be rejected, got %v", err)
+	}
+}
+
+func TestSecretReaderPrincipals(t *testing.T) {
+	if principals := secretReaderPrincipals([]string{"222222222222", "arn:aws:iam::333333333333:role/cftor53"}); len(principals) != 2 {
+		t.Errorf("Expected 2 principals, got %d", len(principals))
+	}
+	if principals := secretReaderPrincipals(nil); len(principals) != 0 {
+		t.Errorf("Expected no principals, got %d", len(principals))
+	}
+
+	if principals := secretReaderPrincipals([]string{"12345"}); len(principals) != 0 {
+		t.Errorf("Expected the invalid reader to be skipped, got %d principals", len(principals))
+	}
+	err := ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", SecretReaders: []string{"12345"}})
+	if err == nil || !strings.Contains(err.Error(), "Invalid secret_readers entry, expected an account ID or ARN: 12345") {
+		t.Errorf("Expected the invalid reader to be rejected, got %v", err)
+	}
+}
+
+func TestResourceNames(t *testing.T) {
+	tests := []struct {
+		config         ConfigFile
+		secretName     string
+		ssmParamPrefix string
+	}{
+		{ConfigFile{}, "cftor53/cloudflare/api-token", "/cftor53"},
+		{ConfigFile{Namespace: "blog"}, "cftor53/blog/cloudflare/api-token", "/cftor53/blog"},
+		{ConfigFile{Namespace: "blog", SecretName: "dns/token", SsmParamPrefix: "/dns"}, "dns/token", "/dns"},
+		{ConfigFile{Stage: "prod", ParentDomain: "example.com", Subdomain: "App"}, "cftor53/prod/app.example.com/cloudflare/api-token", "/cftor53/prod"},
+		{ConfigFile{Namespace: "blog", Stage: "prod"}, "cftor53/blog/prod/cloudflare/api-token", "/cftor53/blog/prod"},
+	}
+	for _, tt := range tests {
+		secretName, ssmParamPrefix := resourceNames(&tt.config)
+		if secretName != tt.secretName || ssmParamPrefix != tt.ssmParamPrefix {
+			t.Errorf("resourceNames(%+v) = %s, %s, expected %s, %s", tt.config, secretName, ssmParamPrefix, tt.secretName, tt.ssmParamPrefix)
+		}
+	}
+
+	if id := stackID("blog", "Cftor53Stack"); id != "blog-Cftor53Stack" {
+		t.Errorf("Expected blog-Cftor53Stack, got %s", id)
+	}
+	if id := stageStackID("Cftor53", &ConfigFile{Stage: "prod", Subdomain: "api.eu"}) + "Stack"; id != "Cftor53-prod-api-eu-Stack" {
+		t.Errorf("Expected Cftor53-prod-api-eu-Stack, got %s", id)
+	}
+	for _, namespace := range []string{"Blog", "-blog", "blog_2", "blog-"} {
+		err := ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", Namespace: namespace})
+		if err == nil || !strings.Contains(err.Error(), "Invalid namespace: "+namespace) {
+			t.Errorf("Expected the namespace %q to be rejected, got %v", namespace, err)
+		}
+	}
+}
+
+func TestTxtRecordValue(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"v=spf1 -all", `"v=spf1 -all"`},
+		{`"already quoted"`, `"already quoted"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{long, `"` + long[:255] + `" "` + long[255:] + `"`},
+	}
+	for _, tt := range tests {
+		if got := txtRecordValue(tt.value); got != tt.expected {
+			t.Errorf("txtRecordValue(%q) = %s, expected %s", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	zoneFile := `$ORIGIN aws.example.com.
+$TTL 1h
+@       IN SOA ns1.example.net. hostmaster.example.com. (
+            2024010101 ; serial
+            3600 900 604800 300 )
+        IN NS  ns1.example.net.
+        IN MX  10 mail          ; relative to the origin
+        IN MX  20 mx.example.net.
+        IN TXT "v=spf1 include:_spf.example.net -all"
+www 300 IN CNAME @
+_dmarc  TXT    "v=DMARC1; p=none"
+sub     IN NS  ns1.example.net.
+$ORIGIN api.aws.example.com.
+@       60 A   192.0.2.1
+        60 A   192.0.2.2
+`
+	records, err := parseZoneFile(zoneFile, "aws.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []RecordConfig{
+		{Name: "", Type: "MX", Values: []string{"10 mail.aws.example.com.", "20 mx.example.net."}, TTL: 3600},
+		{Name: "", Type: "TXT", Values: []string{`"v=spf1 include:_spf.example.net -all"`}, TTL: 3600},
+		{Name: "www", Type: "CNAME", Values: []string{"aws.example.com."}, TTL: 300},
+		{Name: "_dmarc", Type: "TXT", Values: []string{`"v=DMARC1; p=none"`}, TTL: 3600},
+		{Name: "sub", Type: "NS", Values: []string{"ns1.example.net."}, TTL: 3600},
+		{Name: "api", Type: "A", Values: []string{"192.0.2.1", "192.0.2.2"}, TTL: 60},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d: %+v", len(expected), len(records), records)
+	}
+	for i := range expected {
+		got, want := records[i], expected[i]
+		if got.Name != want.Name || got.Type != want.Type || got.TTL != want.TTL || strings.Join(got.Values, "|") != strings.Join(want.Values, "|") {
+			t.Errorf("Record %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	for _, invalid := range []string{
+		"www IN CNAME other.example.org.\nexample.org. IN A 192.0.2.1",
+		"@ IN SOA ns1. host. ( 1 2 3 4 5",
+		`@ IN TXT "unterminated`,
+		"$INCLUDE other.zone",
+		"@ CH TXT \"chaos\"",
+		"@ IN HINFO cpu os",
+	} {
+		if _, err := parseZoneFile(invalid, "aws.example.com"); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDomainDelegationConfig(t *testing.T) {
+	config := ConfigFile{ApiToken: "global", AccountID: "account", Namespace: "blog"}
+	domainConfig := domainDelegationConfig(config, DomainConfig{ApiToken: "domain"}, "example.org")
+	if domainConfig.ParentDomain != "example.org" || domainConfig.ApiToken != "domain" || domainConfig.AccountID != "account" {
+		t.Errorf("Unexpected domain config %+v", domainConfig)
+	}
+	if domainConfig.SecretName != "cftor53/blog/example.org/cloudflare/api-token" {
+		t.Errorf("Unexpected secret name %s", domainConfig.SecretName)
+	}
+	if domainConfig := domainDelegationConfig(ConfigFile{}, DomainConfig{SecretName: "dns/token"}, "example.org"); domainConfig.SecretName != "dns/token" {
+		t.Errorf("Expected the domain's secret name, got %s", domainConfig.SecretName)
+	}
+
+	if id := domainStackID("my-app.example.com"); id != "My-appExampleCom" {
+		t.Errorf("Expected My-appExampleCom, got %s", id)
+	}
+}
+
+func TestSubdomainDelegationConfig(t *testing.T) {
+	base := ConfigFile{
+		Regions:        &RegionConfig{Main: "eu-north-1", Certificate: "us-east-1"},
+		LambdaSettings: &LambdaSettingsConfig{TimeoutSeconds: 60, MemorySizeMB: 256},
+		NSRecordTTL:    300,
+	}
+	config := subdomainDelegationConfig(base, SubdomainConfig{
+		Name:           "api",
+		Regions:        &RegionConfig{Main: "eu-west-1"},
+		LambdaSettings: &LambdaSettingsConfig{MemorySizeMB: 512},
+	})
+	if config.Regions.Main != "eu-west-1" || config.Regions.Certificate != "us-east-1" {
+		t.Errorf("Unexpected regions %+v", config.Regions)
+	}
+	if config.LambdaSettings.TimeoutSeconds != 60 || config.LambdaSettings.MemorySizeMB != 512 || config.NSRecordTTL != 300 {
+		t.Errorf("Unexpected settings %+v, TTL %d", config.LambdaSettings, config.NSRecordTTL)
+	}
+	if base.Regions.Main != "eu-north-1" || base.LambdaSettings.MemorySizeMB != 256 {
+		t.Errorf("Expected the base config to be unchanged, got %+v, %+v", base.Regions, base.LambdaSettings)
+	}
+
+	if config := subdomainDelegationConfig(base, SubdomainConfig{Name: "www"}); config.Regions != base.Regions || config.LambdaSettings != base.LambdaSettings {
+		t.Errorf("Expected the base settings without overrides")
+	}
+}
+
+func TestCertificateEnabled(t *testing.T) {
+	disabled := false
+	if !certificateEnabled(nil) || !certificateEnabled(&CertificateConfig{}) {
+		t.Errorf("Expected a certificate by default")
+	}
+	if certificateEnabled(&CertificateConfig{Enabled: &disabled}) {
+		t.Errorf("Expected no certificate with enabled false")
+	}
+
+	// A subdomain can turn off the certificate of the top-level settings
+	config := subdomainDelegationConfig(ConfigFile{Certificate: &CertificateConfig{SubjectAlternativeNames: []string{"*.api.example.com"}}}, SubdomainConfig{Certificate: &CertificateConfig{Enabled: &disabled}})
+	if certificateEnabled(config.Certificate) || len(config.Certificate.SubjectAlternativeNames) != 1 {
+		t.Errorf("Unexpected certificate settings %+v", config.Certificate)
+	}
+}
+
+func TestCloudFrontPriceClass(t *testing.T) {
+	if class := cloudFrontPriceClass(""); class != awscloudfront.PriceClass_PRICE_CLASS_ALL {
+		t.Errorf("Expected all edge locations by default, got %s", class)
+	}
+	if class := cloudFrontPriceClass("PriceClass_100"); class != awscloudfront.PriceClass_PRICE_CLASS_100 {
+		t.Errorf("Expected PRICE_CLASS_100, got %s", class)
+	}
+	if problem := priceClassProblem("cloudfront.price_class", "PriceClass_100"); problem != "" {
+		t.Errorf("Expected PriceClass_100 to be valid, got %s", problem)
+	}
+	if problem := priceClassProblem("cloudfront.price_class", "PriceClass_50"); problem != "Invalid cloudfront.price_class: PriceClass_50" {
+		t.Errorf("Expected the unknown price class to be rejected, got %q", problem)
+	}
+}
+
+func TestWebsiteErrorResponses(t *testing.T) {
+	responses := *websiteErrorResponses("/index.html", 200)
+	if len(responses) != 2 {
+		t.Fatalf("Expected responses for 403 and 404, got %d", len(responses))
+	}
+	for _, response := range responses {
+		if *response.ResponseHttpStatus != 200 || *response.ResponsePagePath != "/index.html" {
+			t.Errorf("Unexpected response for %v: %v %s", *response.HttpStatus, *response.ResponseHttpStatus, *response.ResponsePagePath)
+		}
+	}
+	if *responses[0].HttpStatus != 403 || *responses[1].HttpStatus != 404 {
+		t.Errorf("Expected responses for 403 and 404, got %v and %v", *responses[0].HttpStatus, *responses[1].HttpStatus)
+	}
+}
+
+func TestApiGatewayEndpointType(t *testing.T) {
+	if endpointType := apiGatewayEndpointType(&ApiGatewayConfig{}); endpointType != ApiGatewayEndpointRegional {
+		t.Errorf("Expected a regional endpoint by default, got %s", endpointType)
+	}
+	if endpointType := apiGatewayEndpointType(&ApiGatewayConfig{EndpointType: "edge"}); endpointType != ApiGatewayEndpointEdge {
+		t.Errorf("Expected an edge endpoint, got %s", endpointType)
+	}
+
+	if problems := apiGatewayProblems(&ApiGatewayConfig{EndpointType: "private"}); len(problems) != 1 || problems[0] != "Invalid api_gateway.endpoint_type: private" {
+		t.Errorf("Expected the private endpoint to be rejected, got %v", problems)
+	}
+}
+
+func TestExportName(t *testing.T) {
+	if name := exportName(nil, ExportHostedZoneID, "api.example.com"); name != nil {
+		t.Errorf("Expected no export without exports, got %s", *name)
+	}
+	exports := &ExportsConfig{Enabled: true}
+	if name := exportName(exports, ExportHostedZoneID, "API.example.com"); *name != "cftor53-api-example-com-HostedZoneId" {
+		t.Errorf("Unexpected default export name %s", *name)
+	}
+	exports = &ExportsConfig{Enabled: true, Prefix: "shared-api", Names: map[string]string{ExportCertificateArn: "api-cert"}}
+	if name := exportName(exports, ExportZoneName, "api.example.com"); *name != "shared-api-ZoneName" {
+		t.Errorf("Unexpected prefixed export name %s", *name)
+	}
+	if name := exportName(exports, ExportCertificateArn, "api.example.com"); *name != "api-cert" {
+		t.Errorf("Unexpected configured export name %s", *name)
+	}
+
+	if problems := exportsProblems(&ExportsConfig{Names: map[string]string{"zone_id": "api-zone"}}); len(problems) != 1 || problems[0] != "Invalid exports.names key: zone_id" {
+		t.Errorf("Expected the unknown output to be rejected, got %v", problems)
+	}
+}
+
+func TestDefaultDashboardName(t *testing.T) {
+	single := &ConfigFile{Namespace: "blog", ParentDomain: "Example.com", Subdomain: "api"}
+	if name := defaultDashboardName(single, Delegations(single)); name != "cftor53-blog-api-example-com" {
+		t.Errorf("Unexpected dashboard name %s", name)
+	}
+	domains := &ConfigFile{Stage: "prod", Domains: []DomainConfig{{ParentDomain: "example.com", Subdomains: []SubdomainConfig{{Name: "api"}}}}}
+	if name := defaultDashboardName(domains, Delegations(domains)); name != "cftor53-prod" {
+		t.Errorf("Unexpected dashboard name of domains %s", name)
+	}
+}
+
+func TestDelegations(t *testing.T) {
+	single := Delegations(&ConfigFile{ParentDomain: "example.com", Subdomain: "sub", Namespace: "blog"})
+	if len(single) != 1 || single[0].FullDomainName() != "sub.example.com" || single[0].MainRegion != "eu-north-1" || single[0].SecretName != "cftor53/blog/cloudflare/api-token" {
+		t.Errorf("Unexpected delegation %+v", single)
+	}
+	if name := single[0].ParameterName("hostedZoneId"); name != "/cftor53/blog/sub/example-com/hostedZoneId" {
+		t.Errorf("Unexpected parameter name %s", name)
+	}
+
+	delegations := Delegations(&ConfigFile{
+		Regions: &RegionConfig{Main: "eu-west-1"},
+		Domains: []DomainConfig{
+			{ParentDomain: "Example.com.", Subdomains: []SubdomainConfig{{Name: "a"}, {Name: "b", Regions: &RegionConfig{Main: "us-west-2"}}}},
+			{ParentDomain: "example.org", SecretName: "org/token", Subdomains: []SubdomainConfig{{Name: "c"}}},
+		},
+	})
+	expected := []struct{ name, region, secretName string }{
+		{"a.example.com", "eu-west-1", "cftor53/example.com/cloudflare/api-token"},
+		{"b.example.com", "us-west-2", "cftor53/example.com/cloudflare/api-token"},
+		{"c.example.org", "eu-west-1", "org/token"},
+	}
+	if len(delegations) != len(expected) {
+		t.Fatalf("Expected %d delegations, got %d", len(expected), len(delegations))
+	}
+	for i, want := range expected {
+		got := delegations[i]
+		if got.FullDomainName() != want.name || got.MainRegion != want.region || got.SecretName != want.secretName || got.Config.Domains != nil {
+			t.Errorf("Expected %+v, got %s in %s with %s", want, got.FullDomainName(), got.MainRegion, got.SecretName)
+		}
+	}
+}
+
+func TestASCIIDomainName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		{name: "example.com", expected: "example.com"},
+		{name: "Example.com.", expected: "Example.com."},
+		{name: "münchen", expected: "xn--mnchen-3ya"},
+		{name: "München.example.com", expected: "xn--mnchen-3ya.example.com"},
+		{name: "bücher.example.", expected: "xn--bcher-kva.example."},
+		{name: "xn--mnchen-3ya.example.com", expected: "xn--mnchen-3ya.example.com"},
+		{name: "例え.テスト", expected: "xn--r8jz45g.xn--zckzah"},
+		{name: "mün chen", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ASCIIDomainName(tt.name)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got != tt.expected {
+				t.Errorf("Expected %s, got %s (%v)", tt.expected, got, err)
+			}
+		})
+	}
+
+	// The stacks, the Cloudflare lookups and the Route53 zone use the punycode of the names
+	delegations := Delegations(&ConfigFile{Domains: []DomainConfig{{ParentDomain: "Bücher.example", Subdomains: []SubdomainConfig{{Name: "München"}}}}})
+	if len(delegations) != 1 || delegations[0].FullDomainName() != "xn--mnchen-3ya.xn--bcher-kva.example" {
+		t.Errorf("Expected the delegation in punycode, got %+v", delegations)
+	}
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "münchen", Stage: "prod"},
+	})
+	if *delegation.Stack.StackName() != "Cftor53-prod-xn--mnchen-3ya-Stack" {
+		t.Errorf("Expected the stack to be named after the punycode, got %s", *delegation.Stack.StackName())
+	}
+	assertions.Template_FromStack(delegation.Stack, nil).HasResourceProperties(jsii.String("AWS::Route53::HostedZone"), map[string]interface{}{
+		"Name": "xn--mnchen-3ya.example.com.",
+	})
+
+	err := ValidateConfig(&ConfigFile{ApiToken: "token", ParentDomain: "example.com", Subdomain: "mün chen"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid subdomain: mün chen") {
+		t.Errorf("Expected the invalid subdomain to be reported, got %v", err)
+	}
+}
+
+func TestValidateConfigDocument(t *testing.T) {
+	validate := func(config string) error {
+		var document interface{}
+		if err := json.Unmarshal([]byte(config), &document); err != nil {
+			t.Fatal(err)
+		}
+		return ValidateConfigDocument(document)
+	}
+
+	if err := validate(`{
+		"api_token": "token",
+		"parent_domain": "example.com",
+		"subdomain": "api",
+		"regions": {"main": "eu-north-1", "certificate": "us-east-1"},
+		"lambda_settings": {"timeout_seconds": 120, "memory_size_mb": 256},
+		"domains": [{"parent_domain": "example.org", "subdomains": [{"name": "app", "ns_record_ttl": 300}]}]
+	}`); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+
+	err := validate(`{
+		"parent_domain": "example..com",
+		"regions": {"main": "eu-north"},
+		"lambda_settings": {"timeout_seconds": 1200, "memory_size_mb": "256"},
+		"ns_record_ttl": 30,
+		"token_source": "vault",
+		"subdomian": "api",
+		"hosted_zone_comment": "` + strings.Repeat("x", 300) + `",
+		"domains": [{"subdomains": []}]
+	}`)
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	expected := []string{
+		`domains[0]: missing field parent_domain`,
+		`domains[0].subdomains: must not be empty`,
+		`hosted_zone_comment: must be at most 256 characters`,
+		`lambda_settings.memory_size_mb: must be an integer, not "256"`,
+		`lambda_settings.timeout_seconds: 1200 is out of range, Lambda functions run for up to 900 seconds`,
+		`ns_record_ttl: 30 is out of range, Cloudflare accepts 60 to 86400 seconds`,
+		`parent_domain: "example..com" is not valid, expected a domain name such as example.com`,
+		`regions.main: "eu-north" is not valid, expected an AWS region such as eu-north-1`,
+		`subdomian: unknown field`,
+		`token_source: "vault" is not one of "secretsmanager", "ssm"`,
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+
+	if err := validate(`{"parent_domain": "example.com"}`); err == nil || !strings.Contains(err.Error(), "config: requires parent_domain and subdomain, or domains") {
+		t.Errorf("Expected the subdomain to be required, got %v", err)
+	}
+}
+
+func TestCloudflareRetryProperties(t *testing.T) {
+	retries := 0
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", CloudflareRetry: &CloudflareRetryConfig{MaxRetries: &retries, MaxDelayMs: 2000}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	for _, action := range []string{"check", "update"} {
+		main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+			"Action":      action,
+			"MaxRetries":  "0",
+			"BaseDelayMs": assertions.Match_Absent(),
+			"MaxDelayMs":  "2000",
+		})
+	}
+}
+
+func TestHostedZoneCommentAndTags(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", HostedZoneComment: "Owned by the platform team", HostedZoneTags: map[string]string{"Team": "platform", "Owner": "dns@example.com"}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::Route53::HostedZone"), map[string]interface{}{
+		"HostedZoneConfig": map[string]interface{}{"Comment": "Owned by the platform team"},
+		"HostedZoneTags": []interface{}{
+			map[string]interface{}{"Key": "Owner", "Value": "dns@example.com"},
+			map[string]interface{}{"Key": "Team", "Value": "platform"},
+		},
+	})
+
+	// The workflow creates the zone with the comment and tags it afterwards
+	workflow := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", Orchestration: OrchestrationStepFunctions, HostedZoneComment: "Owned by the platform team", HostedZoneTags: map[string]string{"Team": "platform", "Owner": "dns@example.com"}},
+	})
+	definition := stateMachineDefinition(t, assertions.Template_FromStack(workflow.Stack, nil))
+	for _, want := range []string{
+		`"HostedZoneConfig":{"Comment":"Owned by the platform team"}`,
+		`"CreateHostedZone":{"Next":"TagHostedZone"`,
+		`"TagHostedZone":{"Next":"UpdateNSRecords"`,
+		`:states:::aws-sdk:route53:changeTagsForResource","Parameters":{"AddTags":[{"Key":"Owner","Value":"dns@example.com"},{"Key":"Team","Value":"platform"}],`,
+	} {
+		if !strings.Contains(definition, want) {
+			t.Errorf("Expected the state machine definition to contain %s", want)
+		}
+	}
+}
+
+func TestLockTable(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", Lock: &LockConfig{Enabled: true}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema":               []interface{}{map[string]interface{}{"AttributeName": "LockId", "KeyType": "HASH"}},
+		"BillingMode":             "PAY_PER_REQUEST",
+		"TimeToLiveSpecification": map[string]interface{}{"AttributeName": "ExpiresAt", "Enabled": true},
+	})
+	for _, action := range []string{"check", "update"} {
+		main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+			"Action":    action,
+			"LockTable": map[string]interface{}{"Ref": assertions.Match_AnyValue()},
+		})
+	}
+}
+
+func TestStateTable(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", State: &StateConfig{Enabled: true}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"KeySchema": []interface{}{
+			map[string]interface{}{"AttributeName": "Name", "KeyType": "HASH"},
+			map[string]interface{}{"AttributeName": "RecordId", "KeyType": "RANGE"},
+		},
+		"BillingMode": "PAY_PER_REQUEST",
+	})
+	main.HasResourceProperties(jsii.String("AWS::SSM::Parameter"), map[string]interface{}{
+		"Name":  "/cftor53/api/example-com/stateTable",
+		"Value": map[string]interface{}{"Ref": assertions.Match_AnyValue()},
+	})
+	for _, action := range []string{"check", "update"} {
+		main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+			"Action":     action,
+			"StateTable": map[string]interface{}{"Ref": assertions.Match_AnyValue()},
+		})
+	}
+}
+
+func TestResponseSpillBucket(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", ResponseSpill: &ResponseSpillConfig{Enabled: true}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::S3::Bucket"), map[string]interface{}{
+		"LifecycleConfiguration": map[string]interface{}{
+			"Rules": []interface{}{map[string]interface{}{"ExpirationInDays": 30, "Status": "Enabled"}},
+		},
+		"PublicAccessBlockConfiguration": map[string]interface{}{
+			"BlockPublicAcls":       true,
+			"BlockPublicPolicy":     true,
+			"IgnorePublicAcls":      true,
+			"RestrictPublicBuckets": true,
+		},
+	})
+	for _, action := range []string{"check", "update"} {
+		main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+			"Action":      action,
+			"SpillBucket": map[string]interface{}{"Ref": assertions.Match_AnyValue()},
+		})
+	}
+}
+
+func TestDashboardStack(t *testing.T) {
+	delegations := NewDelegatedDomains(templateApp(), "Cftor53", &DelegatedDomainsProps{
+		Config: &ConfigFile{
+			ApiToken:  "test-token",
+			Dashboard: &DashboardConfig{Enabled: true, Canaries: []string{"api-health"}},
+			Domains: []DomainConfig{{ParentDomain: "example.com", Subdomains: []SubdomainConfig{
+				{Name: "api"},
+				{Name: "www", Regions: &RegionConfig{Main: "eu-west-1"}},
+			}}},
+		},
+	})
+	stack := delegations[0].DashboardStack
+	if stack == nil || *stack.Region() != "eu-north-1" {
+		t.Fatalf("Expected a dashboard stack in eu-north-1, got %v", stack)
+	}
+	if delegations[1].DashboardStack != nil {
+		t.Error("Expected a single dashboard stack")
+	}
+
+	dashboard := assertions.Template_FromStack(stack, nil)
+	dashboard.ResourceCountIs(jsii.String("AWS::CloudWatch::Dashboard"), jsii.Number(1))
+	dashboard.HasResourceProperties(jsii.String("AWS::CloudWatch::Dashboard"), map[string]interface{}{
+		"DashboardName": "cftor53",
+	})
+	body, err := json.Marshal((*dashboard.ToJSON())["Resources"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`\"CustomResourceFailures\",\"delegation\",\"api.example.com\"`,
+		`\"NSRecordDrift\",\"delegation\",\"www.example.com\",\"service\",\"cftor53\",{\"label\":\"www.example.com drift\",\"region\":\"eu-west-1\"`,
+		`\"CanaryName\",\"api-health\"`,
+		`DaysToExpiry`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected the dashboard body to contain %s", want)
+		}
+	}
+}
+
+func TestPropagationWorkflow(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", Orchestration: OrchestrationStepFunctions, Propagation: &PropagationConfig{Enabled: true}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":          "workflow",
+		"StateMachineArn": map[string]interface{}{"Ref": assertions.Match_AnyValue()},
+	})
+	definition := stateMachineDefinition(t, main)
+	for _, want := range []string{
+		`"UpdateNSRecords":{"Next":"VerifyNSRecords"`,
+		`"ResourceProperties":{"Action":"verify","DoHEndpoints":["https://cloudflare-dns.com/dns-query","https://dns.google/resolve"],"Domain":"example.com","NameServers.$":"$.Zone.NameServers","PollIntervalSeconds":"10","PropagationTimeoutSeconds":"1800"`,
+	} {
+		if !strings.Contains(definition, want) {
+			t.Errorf("Expected the state machine definition to contain %s", want)
+		}
+	}
+}
+
+// stateMachineDefinition returns the definition of the template's only state machine, with
+// its references left out
+func stateMachineDefinition(t *testing.T, template assertions.Template) string {
+	machines := template.FindResources(jsii.String("AWS::StepFunctions::StateMachine"), nil)
+	if len(*machines) != 1 {
+		t.Fatalf("Expected one state machine, got %d", len(*machines))
+	}
+	var definition strings.Builder
+	for _, machine := range *machines {
+		data, err := json.Marshal(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resource struct {
+			Properties struct {
+				DefinitionString struct {
+					Join []json.RawMessage `json:"Fn::Join"`
+				}
+			}
+		}
+		if err := json.Unmarshal(data, &resource); err != nil || len(resource.Properties.DefinitionString.Join) != 2 {
+			t.Fatalf("Unexpected state machine definition %s: %v", data, err)
+		}
+		var parts []interface{}
+		if err := json.Unmarshal(resource.Properties.DefinitionString.Join[1], &parts); err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range parts {
+			if s, ok := part.(string); ok {
+				definition.WriteString(s)
+			}
+		}
+	}
+	return definition.String()
+}
+
+func TestNegativeCacheWait(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", Certificate: &CertificateConfig{NegativeCacheWait: true}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResource(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Properties": map[string]interface{}{
+			"Action":                    "wait",
+			"DoHEndpoints":              []interface{}{"https://cloudflare-dns.com/dns-query", "https://dns.google/resolve"},
+			"NameServers":               map[string]interface{}{"Fn::GetAtt": []interface{}{assertions.Match_AnyValue(), "NameServers"}},
+			"PollIntervalSeconds":       "10",
+			"PropagationTimeoutSeconds": "1800",
+		},
+		"DependsOn": []interface{}{"CloudflareDNSUpdater"},
+	})
+}
+
+func TestPropagationProvider(t *testing.T) {
+	delegation := NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+		Config: &ConfigFile{ApiToken: "test-token", ParentDomain: "example.com", Subdomain: "api", Propagation: &PropagationConfig{Enabled: true, TimeoutSeconds: 3600, PollIntervalSeconds: 30}},
+	})
+	main := assertions.Template_FromStack(delegation.Stack, nil)
+	main.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":                    "update",
+		"ProviderFramework":         "true",
+		"PollIntervalSeconds":       "30",
+		"PropagationTimeoutSeconds": "3600",
+		"ServiceToken": map[string]interface{}{
+			"Fn::GetAtt": []interface{}{assertions.Match_StringLikeRegexp(jsii.String("^CloudflarePropagationProviderframeworkonEvent")), "Arn"},
+		},
+	})
+	main.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Handler": "framework.onEvent",
+		"Environment": map[string]interface{}{"Variables": map[string]interface{}{
+			"USER_IS_COMPLETE_FUNCTION_ARN": map[string]interface{}{"Fn::GetAtt": []interface{}{assertions.Match_StringLikeRegexp(jsii.String("^CloudflareCheckDNSLambda")), "Arn"}},
+		}},
+	})
+	// isComplete is polled every 30 seconds for the hour of the timeout
+	definition := stateMachineDefinition(t, main)
+	if want := `"Retry":[{"ErrorEquals":["States.ALL"],"IntervalSeconds":30,"MaxAttempts":120,"BackoffRate":1}]`; !strings.Contains(definition, want) {
+		t.Errorf("Expected the waiter state machine to contain %s, got %s", want, definition)
+	}
+}
+
+func TestCftor53StackDefaults(t *testing.T) {
+	// Without NewDelegatedSubdomain, the stack applies the defaults of the Lambda settings itself
+	for _, orchestration := range []string{OrchestrationCustomResources, OrchestrationStepFunctions} {
+		stack, _ := NewCftor53Stack(templateApp(), "Cftor53Stack", &Cftor53StackProps{
+			ParentDomain: jsii.String("example.com"),
+			Subdomain:    jsii.String("api"),
+			Config:       &ConfigFile{ApiToken: "token", Orchestration: orchestration},
+		})
+		assertions.Template_FromStack(stack, nil).HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+			"Timeout":    120,
+			"MemorySize": 256,
+			"Environment": map[string]interface{}{
+				"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+					"POWERTOOLS_SERVICE_NAME": "cftor53",
+					"LOG_LEVEL":               "INFO",
+				}),
+			},
+		})
+	}
+}
+
+func TestConstructorValidation(t *testing.T) {
+	// The constructors panic with the ValidationError, also for missing properties
+	validationPanic := func(construct func()) (validationErr *ValidationError) {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.As(err, &validationErr) {
+				t.Errorf("Expected a panic with a ValidationError, got %v", err)
+			}
+		}()
+		construct()
+		return nil
+	}
+
+	err := validationPanic(func() { NewCftor53Stack(templateApp(), "Cftor53Stack", nil) })
+	if err != nil && (len(err.Problems) != 1 || !strings.HasPrefix(err.Problems[0], "ParentDomain, Subdomain, Config and either CloudflareApiTokenSecret")) {
+		t.Errorf("Expected the missing properties, got %v", err.Problems)
+	}
+	err = validationPanic(func() {
+		NewDelegatedSubdomain(templateApp(), "Cftor53", &DelegatedSubdomainProps{
+			Config: &ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", NSRecordMode: "merge", Namespace: "Blog"},
+		})
+	})
+	expected := []string{"Invalid ns_record_mode: merge (must be replace or append)", "Invalid namespace: Blog (lowercase letters, digits and hyphens)"}
+	if err != nil && strings.Join(err.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(err.Problems, "\n"))
+	}
+}
+
+func TestDelegationStackSetMemberSettings(t *testing.T) {
+	stack := NewDelegationStackSet(templateApp(), "Cftor53StackSet", &DelegationStackSetProps{
+		Config: &ConfigFile{
+			ParentDomain:         "example.com",
+			Subdomain:            "api",
+			SecretArn:            "arn:aws:secretsmanager:eu-north-1:111111111111:secret:cftor53-AbCdEf",
+			NSRecordTTL:          300,
+			NSRecordMode:         NSRecordModeAppend,
+			AcceptProxiedRecords: true,
+			Lock:                 &LockConfig{Enabled: true},
+			State:                &StateConfig{Enabled: true},
+			ResponseSpill:        &ResponseSpillConfig{Enabled: true},
+			Propagation:          &PropagationConfig{Enabled: true},
+			CloudflareRetry:      &CloudflareRetryConfig{BaseDelayMs: 250},
+			HostedZoneComment:    "Delegated by the platform team",
+			HostedZoneTags:       map[string]string{"team": "platform"},
+			CloudFormation:       &CloudFormationConfig{AssetBucket: "cftor53-assets"},
+			StackSet: &StackSetConfig{
+				Account:   "111111111111",
+				Instances: []StackSetInstanceConfig{{Accounts: []string{"222222222222"}}},
+			},
+		},
+	})
+
+	// The member accounts delegate with the settings of the configuration
+	member := stack.Node().FindChild(jsii.String("Template")).Node().FindChild(jsii.String("Cftor53Stack")).(awscdk.Stack)
+	template := assertions.Template_FromStack(member, nil)
+	template.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":               "check",
+		"NSRecordTTL":          "300",
+		"Mode":                 NSRecordModeAppend,
+		"AcceptProxiedRecords": "true",
+		"BaseDelayMs":          "250",
+		"LockTable":            assertions.Match_AnyValue(),
+		"StateTable":           assertions.Match_AnyValue(),
+		"SpillBucket":          assertions.Match_AnyValue(),
+	})
+	template.ResourceCountIs(jsii.String("AWS::S3::Bucket"), jsii.Number(1))
+	template.HasResourceProperties(jsii.String("AWS::Route53::HostedZone"), map[string]interface{}{
+		"HostedZoneConfig": map[string]interface{}{"Comment": "Delegated by the platform team"},
+		"HostedZoneTags":   assertions.Match_ArrayWith(&[]interface{}{map[string]interface{}{"Key": "team", "Value": "platform"}}),
+	})
+	template.HasResourceProperties(jsii.String("AWS::CloudFormation::CustomResource"), map[string]interface{}{
+		"Action":            "update",
+		"ProviderFramework": "true",
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token"}); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+
+	err := ValidateConfig(&ConfigFile{
+		ParentDomain:    "example.com",
+		Subdomain:       "api",
+		Orchestration:   OrchestrationStepFunctions,
+		HostedZoneID:    "Z0123456789",
+		HostedZoneTags:  map[string]string{"Team": "dns"},
+		DelegationSet:   &DelegationSetConfig{},
+		Tags:            map[string]string{"aws:team": "dns"},
+		NSRecordMode:    "merge",
+		LambdaSettings:  &LambdaSettingsConfig{LogLevel: "verbose"},
+		CloudFront:      &CloudFrontConfig{Enabled: true},
+		Website:         &WebsiteConfig{Enabled: true},
+		Lock:            &LockConfig{Enabled: true, TableName: "a"},
+		State:           &StateConfig{Enabled: true},
+		ResponseSpill:   &ResponseSpillConfig{Enabled: true, BucketName: "Spill", ExpirationDays: 7},
+		Dashboard:       &DashboardConfig{Enabled: true, Name: "delegation health", Canaries: []string{"API"}},
+		Propagation:     &PropagationConfig{Enabled: true, Resolvers: []string{"http://dns.example.com/resolve"}, PollIntervalSeconds: 3600},
+		Certificate:     &CertificateConfig{NegativeCacheWait: true},
+		CloudflareRetry: &CloudflareRetryConfig{BaseDelayMs: 10000, MaxDelayMs: 5000},
+	})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	expected := []string{
+		"Invalid ns_record_mode: merge (must be replace or append)",
+		"Invalid tag aws:team: the aws: prefix is reserved",
+		"Invalid Lambda log level: verbose (must be DEBUG, INFO, WARN or ERROR)",
+		"hosted_zone_id is not supported with step-functions orchestration",
+		"hosted_zone_comment and hosted_zone_tags only apply to a hosted zone created by the stack, without hosted_zone_id",
+		"delegation_set requires exactly one of id and create",
+		"lock requires a delegation by custom resources, without private_zone, certificate_only or step-functions orchestration",
+		"Invalid lock.table_name: a",
+		"state requires a delegation by custom resources, without private_zone, certificate_only or step-functions orchestration",
+		"Invalid response_spill.bucket_name: Spill",
+		"response_spill.expiration_days must be positive and only applies to the bucket created by the stack",
+		"Invalid dashboard.name: delegation health",
+		"Invalid dashboard.canaries: API",
+		"certificate.negative_cache_wait requires a delegation by custom resources, without private_zone, certificate_only, assume_role_arn, hosted_zone_id or step-functions orchestration",
+		"propagation requires a delegation by custom resources or step-functions orchestration, without private_zone, certificate_only, assume_role_arn or hosted_zone_id",
+		"Invalid propagation.resolvers: http://dns.example.com/resolve",
+		"Invalid propagation.poll_interval_seconds: 3600 (must be 1 to the timeout)",
+		"Invalid cloudflare_retry.max_delay_ms: 5000 (must be base_delay_ms to 60000)",
+		"Only one of cloudfront, website and api_gateway can serve the subdomain",
+		"cloudfront.origin_domain_name must be provided",
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+
+	// The parent zone's name servers can't be polled on port 53 from a VPC
+	vpc := &LambdaSettingsConfig{Vpc: &VpcConfig{VpcID: "vpc-0123456789abcdef0", SubnetIDs: []string{"subnet-0123456789abcdef0"}}}
+	err = ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", LambdaSettings: vpc, Propagation: &PropagationConfig{Enabled: true}})
+	if err == nil || !strings.Contains(err.Error(), "propagation with lambda_settings.vpc requires step-functions orchestration") {
+		t.Errorf("Expected propagation in a VPC to be rejected, got %v", err)
+	}
+	if err := ValidateConfig(&ConfigFile{ParentDomain: "example.com", Subdomain: "api", ApiToken: "token", LambdaSettings: vpc, Orchestration: OrchestrationStepFunctions, Propagation: &PropagationConfig{Enabled: true}}); err != nil {
+		t.Errorf("Expected propagation in a VPC with step-functions orchestration, got %v", err)
+	}
+
+	// A problem shared by the subdomains of domains is reported once
+	err = ValidateConfig(&ConfigFile{
+		SecretName:  "shared",
+		TokenSource: "vault",
+		Domains: []DomainConfig{{
+			ParentDomain: "example.com",
+			Subdomains:   []SubdomainConfig{{Name: "a"}, {Name: "b", NSRecordTTL: 30}, {Name: "a"}},
+		}},
+	})
+	validationErr, ok = err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	expected = []string{
+		"secret_name cannot be combined with domains, set domains[].secret_name instead",
+		"Duplicate subdomain in domains[]: a.example.com",
+		"a.example.com: Invalid token_source: vault",
+		"b.example.com: Invalid ns_record_ttl: 30 (60 to 86400 seconds)",
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+
+	// The settings of the pipeline and its stages are checked along with the configuration
+	t.Setenv("CDK_DEFAULT_ACCOUNT", "")
+	err = ValidateConfig(&ConfigFile{
+		ParentDomain: "example.com",
+		Subdomain:    "api",
+		Pipeline: &PipelineConfig{
+			Repository: "ferrix/dns",
+			Stages:     []PipelineStageConfig{{Name: "dev", SecretArn: "arn:aws:secretsmanager:eu-north-1:111111111111:secret:token"}, {Name: "dev", Subdomain: "ä_b"}},
+		},
+	})
+	validationErr, ok = err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	expected = []string{
+		"pipeline.connection_arn and pipeline.repository must be provided",
+		"pipeline.account must be provided when the CLI account is unknown",
+		"Duplicate pipeline stage: dev",
+		"Pipeline stage dev requires secret_arn, existing_secret_only or token_source ssm",
+		"Pipeline stage dev: Invalid subdomain: ä_b (idna: disallowed rune U+005F)",
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+
+	// As are those of the StackSet
+	err = ValidateConfig(&ConfigFile{
+		ParentDomain: "example.com",
+		Subdomain:    "api",
+		ApiToken:     "token",
+		StackSet: &StackSetConfig{
+			Account:   "111111111111",
+			Instances: []StackSetInstanceConfig{{Accounts: []string{"222222222222"}}, {OrganizationalUnitIDs: []string{"ou-abcd-12345678"}}, {}},
+		},
+		HostedZoneID: "Z0123456789ABCDEFGHIJ",
+		Exports:      &ExportsConfig{},
+		Dashboard:    &DashboardConfig{},
+	})
+	validationErr, ok = err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	expected = []string{
+		"stack_set requires cloudformation.asset_bucket for the Lambda assets of member accounts",
+		"api_token must not be set in config.json when deploying with a StackSet",
+		"stack_set requires secret_arn, existing_secret_only or token_source ssm",
+		"stack_set.instances[] must target accounts or organizational_unit_ids",
+		"stack_set.instances[] cannot mix accounts with organizational_unit_ids",
+		"hosted_zone_id is not supported with stack_set",
+		"exports is not supported with stack_set",
+		"dashboard is not supported with stack_set",
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+}
+
+func TestNagChecks(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := awscdk.NewStack(app, jsii.String("NagStack"), nil)
+	role := awsiam.NewRole(stack, jsii.String("Role"), &awsiam.RoleProps{
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String("lambda.amazonaws.com"), nil),
+	})
+	role.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("route53:ChangeResourceRecordSets"),
+		Resources: jsii.Strings("arn:aws:route53:::hostedzone/*"),
+	}))
+	awssecretsmanager.NewSecret(stack, jsii.String("Secret"), &awssecretsmanager.SecretProps{
+		SecretStringValue: awscdk.SecretValue_UnsafePlainText(jsii.String("token")),
+	})
+	AddNagChecks(app, &NagConfig{Suppressions: []NagSuppressionConfig{
+		{ID: NagSecretRotation, Reason: "The token is rotated in Cloudflare"},
+	}})
+
+	annotations := assertions.Annotations_FromStack(stack)
+	findings := func(rule string) int {
+		return len(*annotations.FindWarning(jsii.String("*"), assertions.Match_StringLikeRegexp(jsii.String(`^\[`+rule+`\]`))))
+	}
+	if n := findings(NagWildcard); n != 1 {
+		t.Errorf("Expected a wildcard finding, got %d", n)
+	}
+	if n := findings(NagSecretValue); n != 1 {
+		t.Errorf("Expected a plain text secret finding, got %d", n)
+	}
+	if n := findings(NagSecretRotation); n != 0 {
+		t.Errorf("Expected the rotation finding to be suppressed, got %d", n)
+	}
+
+	for _, suppression := range []NagSuppressionConfig{{ID: "AwsSolutions-XYZ1", Reason: "Not a rule at all"}, {ID: NagWildcard}} {
+		if problems := nagProblems(&NagConfig{Suppressions: []NagSuppressionConfig{suppression}}); len(problems) != 1 {
+			t.Errorf("Expected a problem for %+v, got %v", suppression, problems)
+		}
+	}
+}
+
+var updateSnapshots = flag.Bool("update", false, "rewrite the template snapshots in testdata/snapshots")
+
+// assetHashPattern matches the content hashes of the Lambda assets, which change with every
+// change of the Lambda source
+var assetHashPattern = regexp.MustCompile(`"[0-9a-f]{64}\.zip"`)
+
+// TestTemplateSnapshots synthesizes the stacks of each fixture config in testdata/snapshots
+// and compares their templates with the snapshots next to it. Run
+// `go test -run TestTemplateSnapshots -update` to accept intended changes.
+func TestTemplateSnapshots(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "snapshots", "*.json"))
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("No fixture configs found: %v", err)
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config ConfigFile
+			if err := json.Unmarshal(data, &config); err != nil {
+				t.Fatalf("Invalid fixture config: %v", err)
+			}
+
+			// The stacks as the cftor53 app adds them
+			app := templateApp()
+			if len(config.Domains) > 0 {
+				NewDelegatedDomains(app, "Cftor53", &DelegatedDomainsProps{Config: &config})
+			} else {
+				NewDelegatedSubdomain(app, "Cftor53", &DelegatedSubdomainProps{Config: &config, SecretsStackID: "CfCloudflareSecretsStack"})
+			}
+
+			dir := filepath.Join("testdata", "snapshots", name)
+			if *updateSnapshots {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			synthesized := map[string]bool{}
+			for _, stack := range *app.Synth(nil).Stacks() {
+				file := *stack.StackName() + ".template.json"
+				synthesized[file] = true
+				template, err := json.MarshalIndent(stack.Template(), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				template = append(assetHashPattern.ReplaceAll(template, []byte(`"<asset hash>.zip"`)), '\n')
+
+				path := filepath.Join(dir, file)
+				if *updateSnapshots {
+					if err := os.WriteFile(path, template, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				snapshot, err := os.ReadFile(path)
+				if err != nil {
+					t.Errorf("Missing snapshot of %s, run go test -run TestTemplateSnapshots -update: %v", *stack.StackName(), err)
+					continue
+				}
+				if diff := firstDifference(string(snapshot), string(template)); diff != "" {
+					t.Errorf("The template of %s differs from %s, run go test -run TestTemplateSnapshots -update to accept the change:\n%s", *stack.StackName(), path, diff)
+				}
+			}
+
+			// Snapshots of stacks that are gone
+			snapshots, _ := filepath.Glob(filepath.Join(dir, "*.template.json"))
+			for _, snapshot := range snapshots {
+				if !synthesized[filepath.Base(snapshot)] {
+					t.Errorf("Snapshot %s has no stack, run go test -run TestTemplateSnapshots -update", snapshot)
+				}
+			}
+		})
+	}
+}
+
+// firstDifference returns the first differing line of two texts with its line number and the
+// lines around it, or "" when they are equal
+func firstDifference(expected, actual string) string {
+	if expected == actual {
+		return ""
+	}
+	expectedLines := strings.Split(expected, "\n")
+	actualLines := strings.Split(actual, "\n")
+	line := 0
+	for line < len(expectedLines) && line < len(actualLines) && expectedLines[line] == actualLines[line] {
+		line++
+	}
+	excerpt := func(lines []string) string {
+		end := line + 3
+		if end > len(lines) {
+			end = len(lines)
+		}
+		return strings.Join(lines[line:end], "\n")
+	}
+	return fmt.Sprintf("line %d\n--- snapshot\n%s\n+++ synthesized\n%s", line+1, excerpt(expectedLines), excerpt(actualLines))
+}
@@ -0,0 +1,198 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudfront"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudfrontorigins"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53targets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// CloudFront only uses certificates in us-east-1
+const cloudFrontCertificateRegion = "us-east-1"
+
+// CloudFrontConfig creates a CloudFront distribution serving the subdomain with its certificate
+type CloudFrontConfig struct {
+	Enabled bool `json:"enabled"`
+	// Domain name of the HTTP origin, e.g. a load balancer
+	OriginDomainName string `json:"origin_domain_name,omitempty"`
+	// "https-only" (default), "http-only" or "match-viewer"
+	OriginProtocolPolicy string `json:"origin_protocol_policy,omitempty"`
+	// "CachingOptimized" (default) or "CachingDisabled", which forwards all viewer headers but Host
+	CachePolicy string `json:"cache_policy,omitempty"`
+	// "PriceClass_All" (default), "PriceClass_200" or "PriceClass_100"
+	PriceClass string `json:"price_class,omitempty"`
+	// Serve IPv6 with an AAAA alias record, by default true
+	IPv6 *bool `json:"ipv6,omitempty"`
+}
+
+// CloudFrontStackProps configures a stack with a CloudFront distribution for the subdomain
+type CloudFrontStackProps struct {
+	awscdk.StackProps
+
+	// Domain hosted on Cloudflare
+	ParentDomain *string
+
+	// Subdomain hosted on Route53
+	Subdomain *string
+
+	// Hosted zone of the subdomain, for the alias records
+	HostedZoneId *string
+
+	// Certificate of the subdomain in us-east-1
+	CertificateArn *string
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+var originProtocolPolicies = map[string]awscloudfront.OriginProtocolPolicy{
+	"https-only":   awscloudfront.OriginProtocolPolicy_HTTPS_ONLY,
+	"http-only":    awscloudfront.OriginProtocolPolicy_HTTP_ONLY,
+	"match-viewer": awscloudfront.OriginProtocolPolicy_MATCH_VIEWER,
+}
+
+var priceClasses = map[string]awscloudfront.PriceClass{
+	"PriceClass_All": awscloudfront.PriceClass_PRICE_CLASS_ALL,
+	"PriceClass_200": awscloudfront.PriceClass_PRICE_CLASS_200,
+	"PriceClass_100": awscloudfront.PriceClass_PRICE_CLASS_100,
+}
+
+// NewCloudFrontStack creates a stack with a CloudFront distribution for the subdomain in
+// front of Config.CloudFront.OriginDomainName, using the certificate and creating the
+// alias records in the hosted zone
+func NewCloudFrontStack(scope constructs.Construct, id string, props *CloudFrontStackProps) awscdk.Stack {
+	if props == nil {
+		props = &CloudFrontStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	provided := props.ParentDomain != nil && props.Subdomain != nil && props.HostedZoneId != nil && props.CertificateArn != nil && props.Config != nil && props.Config.CloudFront != nil
+	if err := validateProps(props.Config, provided, "ParentDomain, Subdomain, HostedZoneId, CertificateArn and Config.CloudFront"); err != nil {
+		panic(err)
+	}
+	settings := props.Config.CloudFront
+
+	protocolPolicy := awscloudfront.OriginProtocolPolicy_HTTPS_ONLY
+	if policy, ok := originProtocolPolicies[settings.OriginProtocolPolicy]; ok {
+		protocolPolicy = policy
+	}
+	behavior := &awscloudfront.BehaviorOptions{
+		Origin: awscloudfrontorigins.NewHttpOrigin(jsii.String(settings.OriginDomainName), &awscloudfrontorigins.HttpOriginProps{
+			ProtocolPolicy: protocolPolicy,
+		}),
+		ViewerProtocolPolicy: awscloudfront.ViewerProtocolPolicy_REDIRECT_TO_HTTPS,
+	}
+	if settings.CachePolicy == "CachingDisabled" {
+		// The origin sees its own name as Host, so it need not serve the subdomain's
+		behavior.AllowedMethods = awscloudfront.AllowedMethods_ALLOW_ALL()
+		behavior.CachePolicy = awscloudfront.CachePolicy_CACHING_DISABLED()
+		behavior.OriginRequestPolicy = awscloudfront.OriginRequestPolicy_ALL_VIEWER_EXCEPT_HOST_HEADER()
+	}
+
+	addDistribution(stack, props, &awscloudfront.DistributionProps{
+		DefaultBehavior: behavior,
+		PriceClass:      cloudFrontPriceClass(settings.PriceClass),
+	}, settings.IPv6)
+
+	return stack
+}
+
+// cloudFrontProblems returns the problems of the CloudFront settings
+func cloudFrontProblems(settings *CloudFrontConfig) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	if settings.OriginDomainName == "" {
+		add("cloudfront.origin_domain_name must be provided")
+	}
+	if _, ok := originProtocolPolicies[settings.OriginProtocolPolicy]; settings.OriginProtocolPolicy != "" && !ok {
+		add("Invalid cloudfront.origin_protocol_policy: " + settings.OriginProtocolPolicy)
+	}
+	switch settings.CachePolicy {
+	case "", "CachingOptimized", "CachingDisabled":
+	default:
+		add("Invalid cloudfront.cache_policy: " + settings.CachePolicy)
+	}
+	if problem := priceClassProblem("cloudfront.price_class", settings.PriceClass); problem != "" {
+		add(problem)
+	}
+	return problems
+}
+
+// addDistribution adds a distribution for the subdomain with the given settings, its alias
+// records and its outputs, and stores its ID in SSM Parameter Store
+func addDistribution(stack awscdk.Stack, props *CloudFrontStackProps, distributionProps *awscloudfront.DistributionProps, ipv6 *bool) awscloudfront.Distribution {
+	// Full domain name for the subdomain (e.g., sub.example.com)
+	fullDomainName := jsii.String(*props.Subdomain + "." + *props.ParentDomain)
+
+	enableIpv6 := ipv6 == nil || *ipv6
+	distributionProps.DomainNames = jsii.Strings(*fullDomainName)
+	distributionProps.Certificate = awscertificatemanager.Certificate_FromCertificateArn(stack, jsii.String("Certificate"), props.CertificateArn)
+	distributionProps.EnableIpv6 = jsii.Bool(enableIpv6)
+	distributionProps.Comment = jsii.String("cftor53 " + *fullDomainName)
+	distribution := awscloudfront.NewDistribution(stack, jsii.String("Distribution"), distributionProps)
+
+	// Alias records for the subdomain itself, which a CNAME could not point to
+	zone := awsroute53.HostedZone_FromHostedZoneAttributes(stack, jsii.String("ImportedZone"), &awsroute53.HostedZoneAttributes{
+		HostedZoneId: props.HostedZoneId,
+		ZoneName:     fullDomainName,
+	})
+	target := awsroute53.RecordTarget_FromAlias(awsroute53targets.NewCloudFrontTarget(distribution))
+	awsroute53.NewARecord(stack, jsii.String("AliasRecord"), &awsroute53.ARecordProps{
+		Zone:       zone,
+		RecordName: fullDomainName,
+		Target:     target,
+	})
+	if enableIpv6 {
+		awsroute53.NewAaaaRecord(stack, jsii.String("AliasRecordIpv6"), &awsroute53.AaaaRecordProps{
+			Zone:       zone,
+			RecordName: fullDomainName,
+			Target:     target,
+		})
+	}
+
+	// Store the distribution ID in SSM Parameter Store, e.g. for cache invalidations
+	distributionParamName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/distributionId"
+	awsssm.NewStringParameter(stack, jsii.String("DistributionIdSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(distributionParamName),
+		StringValue:   distribution.DistributionId(),
+		Description:   jsii.String("CloudFront distribution ID for " + *fullDomainName),
+	})
+
+	awscdk.NewCfnOutput(stack, jsii.String("DistributionIdOutput"), &awscdk.CfnOutputProps{
+		Value:       distribution.DistributionId(),
+		Description: jsii.String("CloudFront distribution ID"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("DistributionDomainNameOutput"), &awscdk.CfnOutputProps{
+		Value:       distribution.DistributionDomainName(),
+		Description: jsii.String("CloudFront distribution domain name"),
+	})
+
+	return distribution
+}
+
+// cloudFrontPriceClass returns the price class of a setting, by default all edge locations
+func cloudFrontPriceClass(priceClass string) awscloudfront.PriceClass {
+	if class, ok := priceClasses[priceClass]; ok {
+		return class
+	}
+	return awscloudfront.PriceClass_PRICE_CLASS_ALL
+}
+
+// priceClassProblem describes an unknown price class of a setting, if any
+func priceClassProblem(field, priceClass string) string {
+	if _, ok := priceClasses[priceClass]; priceClass != "" && !ok {
+		return "Invalid " + field + ": " + priceClass
+	}
+	return ""
+}
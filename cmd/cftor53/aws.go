@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/ferrix/cftor53"
+)
+
+// awsSession creates an AWS session from the environment and the shared config files
+func awsSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return sess, nil
+}
+
+// route53Client returns a Route53 client, using the role's credentials if one is given.
+// Route53 is global, so the client works without a region configured.
+func route53Client(sess *session.Session, roleArn string) *route53.Route53 {
+	config := aws.NewConfig().WithRegion("us-east-1")
+	if roleArn != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, roleArn))
+	}
+	return route53.New(sess, config)
+}
+
+// delegationNameServers returns the name servers the delegation's hosted zone has or will
+// have, or nil when they are only known once the hosted zone is created
+func delegationNameServers(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) ([]string, error) {
+	config := delegation.Config
+	client := route53Client(sess, config.AssumeRoleArn)
+
+	zoneID := config.HostedZoneID
+	if zoneID == "" {
+		var err error
+		zoneID, err = findPublicHostedZone(ctx, client, delegation.FullDomainName())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if zoneID != "" {
+		return hostedZoneNameServers(ctx, client, zoneID)
+	}
+
+	// A new hosted zone gets the name servers of its reusable delegation set
+	if config.DelegationSet != nil && config.DelegationSet.ID != "" {
+		set, err := client.GetReusableDelegationSetWithContext(ctx, &route53.GetReusableDelegationSetInput{Id: aws.String(config.DelegationSet.ID)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get delegation set %s: %v", config.DelegationSet.ID, err)
+		}
+		return aws.StringValueSlice(set.DelegationSet.NameServers), nil
+	}
+	return nil, nil
+}
+
+// hostedZoneNameServers returns the name servers of the hosted zone
+func hostedZoneNameServers(ctx context.Context, client *route53.Route53, zoneID string) ([]string, error) {
+	zone, err := client.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hosted zone %s: %v", zoneID, err)
+	}
+	if zone.DelegationSet == nil {
+		return nil, fmt.Errorf("hosted zone %s has no name servers", zoneID)
+	}
+	return aws.StringValueSlice(zone.DelegationSet.NameServers), nil
+}
+
+// findPublicHostedZone returns the ID of the public hosted zone named name, or "" if there is none
+func findPublicHostedZone(ctx context.Context, client *route53.Route53, name string) (string, error) {
+	zones, err := client.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{
+		DNSName:  aws.String(name),
+		MaxItems: aws.String("10"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list hosted zones for %s: %v", name, err)
+	}
+	for _, zone := range zones.HostedZones {
+		if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSuffix(aws.StringValue(zone.Name), "."), name) {
+			return strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/"), nil
+		}
+	}
+	return "", nil
+}
+
+// parentZone returns the nearest public hosted zone a nested subdomain is delegated in, like
+// the Lambda function does, or "" for direct subdomains of the Cloudflare domain
+func parentZone(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (zoneID, zoneName string, err error) {
+	labels := strings.Split(delegation.Config.Subdomain, ".")
+	client := route53Client(sess, "")
+	for i := 1; i < len(labels); i++ {
+		name := strings.Join(labels[i:], ".") + "." + delegation.Config.ParentDomain
+		zoneID, err := findPublicHostedZone(ctx, client, name)
+		if err != nil || zoneID != "" {
+			return zoneID, name, err
+		}
+	}
+	return "", "", nil
+}
+
+// parentZoneNameServers returns the NS records of the delegation in its parent zone
+func parentZoneNameServers(ctx context.Context, sess *session.Session, parentZoneID, name string) ([]string, error) {
+	record, err := parentZoneNSRecordSet(ctx, sess, parentZoneID, name)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	var nameServers []string
+	for _, value := range record.ResourceRecords {
+		nameServers = append(nameServers, aws.StringValue(value.Value))
+	}
+	return nameServers, nil
+}
+
+// parentZoneNSRecordSet returns the NS record set of the delegation in its parent zone, or nil
+func parentZoneNSRecordSet(ctx context.Context, sess *session.Session, parentZoneID, name string) (*route53.ResourceRecordSet, error) {
+	output, err := route53Client(sess, "").ListResourceRecordSetsWithContext(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(parentZoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String(route53.RRTypeNs),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records of hosted zone %s: %v", parentZoneID, err)
+	}
+	for _, record := range output.ResourceRecordSets {
+		if aws.StringValue(record.Type) == route53.RRTypeNs && strings.EqualFold(strings.TrimSuffix(aws.StringValue(record.Name), "."), name) {
+			return record, nil
+		}
+	}
+	return nil, nil
+}
+
+// tokenSecretValue returns the value of the delegation's token secret or SSM parameter
+func tokenSecretValue(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (string, error) {
+	config := delegation.Config
+	regional := &aws.Config{Region: aws.String(delegation.MainRegion)}
+
+	if config.TokenSource == cftor53.TokenSourceSSM {
+		parameter, err := ssm.New(sess, regional).GetParameterWithContext(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(config.TokenParameterName),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get parameter %s: %v", config.TokenParameterName, err)
+		}
+		return aws.StringValue(parameter.Parameter.Value), nil
+	}
+
+	secretID := delegation.SecretName
+	if config.SecretArn != "" {
+		secretID = config.SecretArn
+	}
+	secret, err := secretsmanager.New(sess, regional).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %v", secretID, err)
+	}
+	return aws.StringValue(secret.SecretString), nil
+}
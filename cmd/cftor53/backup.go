@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/ferrix/cftor53"
+)
+
+const defaultBackupFile = "cloudflare-backup.json"
+
+// recordBackup is a DNS record in the format of the Cloudflare API, without the fields
+// Cloudflare sets itself, so that it can be posted back as is
+type recordBackup struct {
+	ID       string          `json:"id,omitempty"`
+	Type     string          `json:"type"`
+	Name     string          `json:"name"`
+	Content  string          `json:"content,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	TTL      float64         `json:"ttl,omitempty"`
+	Proxied  bool            `json:"proxied"`
+	Priority *float64        `json:"priority,omitempty"`
+	Comment  string          `json:"comment,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+}
+
+// delegationBackup holds the Cloudflare records of one delegation
+type delegationBackup struct {
+	Name    string         `json:"name"`
+	Zone    string         `json:"zone"`
+	ZoneID  string         `json:"zone_id"`
+	Records []recordBackup `json:"records"`
+}
+
+// runBackup writes the Cloudflare records of the delegations of config.json to a file
+func runBackup(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	file := flags.String("file", defaultBackupFile, "file to write the records to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	var backups []delegationBackup
+	for _, delegation := range cftor53.Delegations(config) {
+		backup, err := backupDelegation(ctx, sess, delegation)
+		if err != nil {
+			return fmt.Errorf("%s: %v", delegation.FullDomainName(), err)
+		}
+		fmt.Printf("%s: %d records\n", backup.Name, len(backup.Records))
+		backups = append(backups, backup)
+	}
+
+	data, err := json.MarshalIndent(backups, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup: %v", err)
+	}
+	if err := os.WriteFile(*file, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *file, err)
+	}
+	fmt.Printf("Wrote %s\n", *file)
+	return nil
+}
+
+// backupDelegation returns the records of the delegated subdomain and its subdomains in the
+// Cloudflare zone of the parent domain
+func backupDelegation(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (delegationBackup, error) {
+	name := strings.ToLower(delegation.FullDomainName())
+	backup := delegationBackup{Name: name, Zone: delegation.Config.ParentDomain, Records: []recordBackup{}}
+
+	api, err := cloudflareClient(ctx, sess, delegation)
+	if err != nil {
+		return backup, err
+	}
+	backup.ZoneID, err = cloudflareZoneID(ctx, api, delegation.Config)
+	if err != nil {
+		return backup, err
+	}
+
+	iter := api.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{ZoneID: cloudflare.F(backup.ZoneID)})
+	for iter.Next() {
+		record := iter.Current()
+		if !inSubdomain(record.Name, name) {
+			continue
+		}
+		var entry recordBackup
+		if err := json.Unmarshal([]byte(record.JSON.RawJSON()), &entry); err != nil {
+			return backup, fmt.Errorf("failed to unmarshal record %s: %v", record.ID, err)
+		}
+		backup.Records = append(backup.Records, entry)
+	}
+	if err := iter.Err(); err != nil {
+		return backup, fmt.Errorf("failed to list DNS records of zone %s: %v", backup.Zone, err)
+	}
+	return backup, nil
+}
+
+// runRestore recreates the records of a backup that are missing from Cloudflare
+func runRestore(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	file := flags.String("file", defaultBackupFile, "file to read the records from")
+	dryRun := flags.Bool("dry-run", false, "print the records to create without creating them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", *file, err)
+	}
+	var backups []delegationBackup
+	if err := json.Unmarshal(data, &backups); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", *file, err)
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	delegations := map[string]cftor53.Delegation{}
+	for _, delegation := range cftor53.Delegations(config) {
+		delegations[strings.ToLower(delegation.FullDomainName())] = delegation
+	}
+
+	created := 0
+	for _, backup := range backups {
+		delegation, ok := delegations[backup.Name]
+		if !ok {
+			return fmt.Errorf("%s is not a delegation of config.json", backup.Name)
+		}
+		api, err := cloudflareClient(ctx, sess, delegation)
+		if err != nil {
+			return fmt.Errorf("%s: %v", backup.Name, err)
+		}
+		n, err := restoreDelegation(ctx, api, backup, *dryRun, os.Stdout)
+		created += n
+		if err != nil {
+			return fmt.Errorf("%s: %v", backup.Name, err)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("%d records to create.\n", created)
+	} else {
+		fmt.Printf("Created %d records.\n", created)
+	}
+	return nil
+}
+
+// restoreDelegation creates the records of the backup that the zone doesn't have and returns
+// how many it created
+func restoreDelegation(ctx context.Context, api *cloudflare.Client, backup delegationBackup, dryRun bool, w io.Writer) (int, error) {
+	existing := map[string]bool{}
+	iter := api.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{ZoneID: cloudflare.F(backup.ZoneID)})
+	for iter.Next() {
+		record := iter.Current()
+		existing[recordKey(string(record.Type), record.Name, recordContent(record))] = true
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list DNS records of zone %s: %v", backup.Zone, err)
+	}
+
+	created := 0
+	for _, record := range missingRecords(backup.Records, existing) {
+		fmt.Fprintf(w, "  + %s %s %s\n", record.Type, record.Name, record.Content)
+		if dryRun {
+			created++
+			continue
+		}
+		// Cloudflare derives the content of records with structured data
+		body := record
+		body.ID = ""
+		if len(body.Data) > 0 {
+			body.Content = ""
+		}
+		if err := api.Post(ctx, "zones/"+backup.ZoneID+"/dns_records", body, nil); err != nil {
+			return created, fmt.Errorf("failed to create %s record %s: %v", record.Type, record.Name, err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// missingRecords returns the records whose type, name and content are not in existing
+func missingRecords(records []recordBackup, existing map[string]bool) []recordBackup {
+	var missing []recordBackup
+	for _, record := range records {
+		if !existing[recordKey(record.Type, record.Name, record.Content)] {
+			missing = append(missing, record)
+		}
+	}
+	return missing
+}
+
+// recordKey identifies a record by its type, name and content, ignoring case and trailing dots
+func recordKey(recordType, name, content string) string {
+	return strings.ToUpper(recordType) + " " + strings.ToLower(strings.TrimSuffix(name, ".")) + " " + strings.TrimSuffix(content, ".")
+}
+
+// recordContent returns the content of a DNS record as a string
+func recordContent(record dns.Record) string {
+	if content, ok := record.Content.(string); ok {
+		return content
+	}
+	return fmt.Sprint(record.Content)
+}
+
+// inSubdomain reports whether the record name is the subdomain or one of its subdomains
+func inSubdomain(recordName, subdomain string) bool {
+	recordName = strings.ToLower(strings.TrimSuffix(recordName, "."))
+	return recordName == subdomain || strings.HasSuffix(recordName, "."+subdomain)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+	"github.com/cloudflare/cloudflare-go/v2/zones"
+	"github.com/ferrix/cftor53"
+)
+
+// cloudflareSecret is the token secret, holding an API token or the Global API key with its email
+type cloudflareSecret struct {
+	ApiToken string `json:"api_token"`
+	ApiKey   string `json:"api_key"`
+	Email    string `json:"email"`
+}
+
+// parseSecret parses a secret value that is either a JSON object or the bare API token
+func parseSecret(value string) (*cloudflareSecret, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("secret value is empty")
+	}
+	if !strings.HasPrefix(value, "{") {
+		return &cloudflareSecret{ApiToken: value}, nil
+	}
+	var secret cloudflareSecret
+	if err := json.Unmarshal([]byte(value), &secret); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal secret: %v", err)
+	}
+	return &secret, nil
+}
+
+// cloudflareClient returns a Cloudflare client for the delegation, with the token of
+// CLOUDFLARE_API_TOKEN, the api_token of config.json or the deployed secret, in that order
+func cloudflareClient(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (*cloudflare.Client, error) {
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if token == "" {
+		token = delegation.Config.ApiToken
+	}
+	if token != "" {
+		return cloudflare.NewClient(option.WithAPIToken(token)), nil
+	}
+
+	value, err := tokenSecretValue(ctx, sess, delegation)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := parseSecret(value)
+	if err != nil {
+		return nil, err
+	}
+	if secret.ApiToken != "" {
+		return cloudflare.NewClient(option.WithAPIToken(secret.ApiToken)), nil
+	}
+	if secret.ApiKey != "" && secret.Email != "" {
+		return cloudflare.NewClient(option.WithAPIKey(secret.ApiKey), option.WithAPIEmail(secret.Email)), nil
+	}
+	return nil, fmt.Errorf("no API token or API key and email found in secret")
+}
+
+// cloudflareZoneID returns the configured zone ID of the delegation's domain, or looks it up
+// by name, restricted to the configured account if any
+func cloudflareZoneID(ctx context.Context, api *cloudflare.Client, config cftor53.ConfigFile) (string, error) {
+	if config.ZoneID != "" {
+		return config.ZoneID, nil
+	}
+	params := zones.ZoneListParams{Name: cloudflare.F(config.ParentDomain)}
+	if config.AccountID != "" {
+		params.Account = cloudflare.F(zones.ZoneListParamsAccount{ID: cloudflare.F(config.AccountID)})
+	}
+	page, err := api.Zones.List(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up zone %s: %v", config.ParentDomain, err)
+	}
+	if len(page.Result) != 1 {
+		return "", fmt.Errorf("found %d zones named %s, set account_id or zone_id", len(page.Result), config.ParentDomain)
+	}
+	return page.Result[0].ID, nil
+}
+
+// cloudflareNSRecords returns the NS records named name in the zone
+func cloudflareNSRecords(ctx context.Context, api *cloudflare.Client, zoneID, name string) ([]nsRecord, error) {
+	iter := api.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
+		ZoneID: cloudflare.F(zoneID),
+		Name:   cloudflare.F(name),
+		Type:   cloudflare.F(dns.RecordListParamsTypeNS),
+	})
+	var records []nsRecord
+	for iter.Next() {
+		record := iter.Current()
+		records = append(records, nsRecord{ID: record.ID, NameServer: recordContent(record)})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list DNS records of %s: %v", name, err)
+	}
+	return records, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: cftor53 [-config file] [command] [flags]
+
+Without a command, the stacks of config.json are synthesized for the CDK CLI. The file
+of -config or CFTOR53_CONFIG is read instead if set, or when synthesizing, the file of
+the config context value.
+
+Commands:
+  backup     Write the Cloudflare records of the subdomains to a file
+  init       Write a starter config.json
+  inventory  List the recorded Cloudflare records and their drift
+  plan       Show the NS record changes a deployment would make
+  restore    Recreate the Cloudflare records of a backup that are missing
+  status     Show the deployed hosted zones, certificates and NS records
+  teardown   Remove the NS records and delete the stacks
+  verify     Check that the delegations resolve to their hosted zones
+`
+
+// errChanges is returned by commands that succeeded and found changes to report
+var errChanges = errors.New("changes found")
+
+// runCommand runs a command of the CLI and returns its exit code
+func runCommand(name string, args []string) int {
+	ctx := context.Background()
+
+	var err error
+	switch name {
+	case "backup":
+		err = runBackup(ctx, args)
+	case "init":
+		err = runInit(ctx, args)
+	case "inventory":
+		err = runInventory(ctx, args)
+	case "plan":
+		err = runPlan(ctx, args)
+	case "restore":
+		err = runRestore(ctx, args)
+	case "status":
+		err = runStatus(ctx, args)
+	case "teardown":
+		err = runTeardown(ctx, args)
+	case "verify":
+		err = runVerify(ctx, args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "cftor53: unknown command %q\n\n%s", name, usage)
+		return 2
+	}
+
+	if errors.Is(err, errChanges) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cftor53 %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
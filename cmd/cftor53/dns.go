@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTimeout bounds each DNS query, including its retry
+const dnsTimeout = 5 * time.Second
+
+// queryDNS sends a query to the DNS server over UDP and returns its response. Recursion is
+// requested from resolvers, while authoritative servers are asked without it.
+func queryDNS(ctx context.Context, server, name string, qtype dnsmessage.Type, recursive bool) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %s: %v", name, err)
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: recursive},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", server, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// UDP queries get lost, so the query is sent again once halfway through the timeout
+	buf := make([]byte, 4096)
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, fmt.Errorf("failed to query %s: %v", server, err)
+		}
+		if attempt == 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(dnsTimeout / 2)); err != nil {
+				return nil, err
+			}
+		} else if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no answer from %s: %v", server, err)
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil {
+			return nil, fmt.Errorf("invalid answer from %s: %v", server, err)
+		}
+		if response.ID != id {
+			return nil, fmt.Errorf("mismatched answer from %s", server)
+		}
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("%s answered %s", server, strings.TrimPrefix(response.RCode.String(), "RCode"))
+		}
+		return &response, nil
+	}
+}
+
+// answerNameServers returns the name servers in the answer section of a response, sorted
+// and without trailing dots
+func answerNameServers(response *dnsmessage.Message) []string {
+	var nameServers []string
+	for _, answer := range response.Answers {
+		if ns, ok := answer.Body.(*dnsmessage.NSResource); ok {
+			nameServers = append(nameServers, strings.ToLower(strings.TrimSuffix(ns.NS.String(), ".")))
+		}
+	}
+	sort.Strings(nameServers)
+	return nameServers
+}
+
+// hasAnswerSOA reports whether the response answers with the SOA record of the zone name
+func hasAnswerSOA(response *dnsmessage.Message, name string) bool {
+	for _, answer := range response.Answers {
+		if _, ok := answer.Body.(*dnsmessage.SOAResource); ok && strings.EqualFold(strings.TrimSuffix(answer.Header.Name.String(), "."), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/ferrix/cftor53"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	domainPattern    = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+	subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+	regionPattern    = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]$`)
+)
+
+// initOptions are the settings of a starter config.json
+type initOptions struct {
+	ParentDomain      string
+	Subdomain         string
+	MainRegion        string
+	CertificateRegion string
+	Namespace         string
+	ApiToken          string
+	// Store the token in a secret created up front instead of config.json
+	CreateSecret bool
+}
+
+// runInit writes a starter config.json from the flags, asking for missing settings on a terminal
+func runInit(ctx context.Context, args []string) error {
+	opts := initOptions{}
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.StringVar(&opts.ParentDomain, "parent-domain", "", "domain managed in Cloudflare, e.g. example.com")
+	flags.StringVar(&opts.Subdomain, "subdomain", "", "subdomain to delegate to Route53, e.g. api")
+	flags.StringVar(&opts.MainRegion, "main-region", "eu-north-1", "AWS region of the hosted zone and the Lambda function")
+	flags.StringVar(&opts.CertificateRegion, "certificate-region", "us-east-1", "AWS region of the certificate")
+	flags.StringVar(&opts.Namespace, "namespace", "", "prefix of the stack IDs and resource names")
+	flags.BoolVar(&opts.CreateSecret, "create-secret", false, "create the token secret in Secrets Manager instead of writing the token to config.json")
+	force := flags.Bool("force", false, "overwrite an existing config.json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	createSecretSet := false
+	flags.Visit(func(f *flag.Flag) { createSecretSet = createSecretSet || f.Name == "create-secret" })
+
+	path := configPath()
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	}
+
+	// The token is read from the environment, or asked for, so it doesn't end up in the shell
+	// history. Without the domain flags the settings are asked for on a terminal.
+	opts.ApiToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	if opts.ParentDomain == "" && opts.Subdomain == "" && isTerminal(os.Stdin) {
+		in := bufio.NewReader(os.Stdin)
+		opts.ParentDomain = ask(in, "Cloudflare domain", opts.ParentDomain)
+		opts.Subdomain = ask(in, "Subdomain to delegate", opts.Subdomain)
+		opts.MainRegion = ask(in, "Main AWS region", opts.MainRegion)
+		opts.CertificateRegion = ask(in, "Certificate AWS region", opts.CertificateRegion)
+		if opts.ApiToken == "" {
+			opts.ApiToken = ask(in, "Cloudflare API token (shown as typed, empty to add it later)", "")
+		}
+		if opts.ApiToken != "" && !createSecretSet {
+			opts.CreateSecret = ask(in, "Store the token in Secrets Manager instead of config.json? (yes/no)", "yes") == "yes"
+		}
+	}
+
+	config, err := initConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.CreateSecret {
+		sess, err := awsSession()
+		if err != nil {
+			return err
+		}
+		delegation := cftor53.Delegations(config)[0]
+		if err := createTokenSecret(ctx, sess, delegation.MainRegion, delegation.SecretName, opts.ApiToken); err != nil {
+			return err
+		}
+		fmt.Printf("Created secret %s in %s\n", delegation.SecretName, delegation.MainRegion)
+	}
+
+	data, err := marshalConfig(path, config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", path, err)
+	}
+	// The file may hold the token
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	fmt.Printf("Wrote %s. Run `go run ./cmd/cftor53 plan` to preview the delegation, then `npx cdk deploy --all`.\n", path)
+	return nil
+}
+
+// initConfig validates the options and returns the configuration they describe
+func initConfig(opts initOptions) (*cftor53.ConfigFile, error) {
+	// Internationalized names are written in punycode, as Cloudflare and Route53 know them
+	parentDomain, err := cftor53.ASCIIDomainName(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(opts.ParentDomain), ".")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent domain: %s (%v)", opts.ParentDomain, err)
+	}
+	subdomain, err := cftor53.ASCIIDomainName(strings.ToLower(strings.Trim(strings.TrimSpace(opts.Subdomain), ".")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid subdomain: %s (%v)", opts.Subdomain, err)
+	}
+	switch {
+	case parentDomain == "" || subdomain == "":
+		return nil, fmt.Errorf("-parent-domain and -subdomain are required")
+	case !domainPattern.MatchString(parentDomain):
+		return nil, fmt.Errorf("invalid parent domain: %s", opts.ParentDomain)
+	case !subdomainPattern.MatchString(subdomain):
+		return nil, fmt.Errorf("invalid subdomain: %s", opts.Subdomain)
+	case !regionPattern.MatchString(opts.MainRegion):
+		return nil, fmt.Errorf("invalid main region: %s", opts.MainRegion)
+	case !regionPattern.MatchString(opts.CertificateRegion):
+		return nil, fmt.Errorf("invalid certificate region: %s", opts.CertificateRegion)
+	case opts.CreateSecret && opts.ApiToken == "":
+		return nil, fmt.Errorf("-create-secret requires the token in CLOUDFLARE_API_TOKEN")
+	}
+
+	config := &cftor53.ConfigFile{
+		ParentDomain: parentDomain,
+		Subdomain:    subdomain,
+		Namespace:    opts.Namespace,
+		Regions: &cftor53.RegionConfig{
+			Main:        opts.MainRegion,
+			Certificate: opts.CertificateRegion,
+		},
+	}
+	if opts.CreateSecret {
+		// The stacks import the secret instead of creating it from api_token
+		config.SecretName = cftor53.Delegations(config)[0].SecretName
+		config.ExistingSecretOnly = true
+	} else {
+		config.ApiToken = opts.ApiToken
+	}
+	return config, nil
+}
+
+// marshalConfig returns the configuration as JSON, or as YAML for a YAML file
+func marshalConfig(path string, config *cftor53.ConfigFile) ([]byte, error) {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil || !isYAML(path) {
+		return append(data, '\n'), err
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(document)
+}
+
+// createTokenSecret creates the token secret in the format the Lambda function reads
+func createTokenSecret(ctx context.Context, sess *session.Session, region, name, token string) error {
+	value, err := json.Marshal(map[string]string{"api_token": token})
+	if err != nil {
+		return err
+	}
+	_, err = secretsmanager.New(sess, &aws.Config{Region: aws.String(region)}).CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String("Cloudflare API Token for DNS management"),
+		SecretString: aws.String(string(value)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceExistsException {
+		return fmt.Errorf("secret %s already exists in %s, update its value instead", name, region)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create secret %s: %v", name, err)
+	}
+	return nil
+}
+
+// isTerminal reports whether the file is a character device, as terminals are
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ask prompts for a setting on the terminal, returning the default for an empty answer
+func ask(in *bufio.Reader, label, defaultValue string) string {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", label, defaultValue)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+	answer, err := in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" || (err != nil && err != io.EOF) {
+		return defaultValue
+	}
+	return answer
+}
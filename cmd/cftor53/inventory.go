@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/ferrix/cftor53"
+)
+
+// stateItem is a Cloudflare record the Lambda function recorded in a state table
+type stateItem struct {
+	Name      string `dynamodbav:"Name"`
+	RecordId  string `dynamodbav:"RecordId"`
+	Type      string `dynamodbav:"Type"`
+	Content   string `dynamodbav:"Content"`
+	ZoneId    string `dynamodbav:"ZoneId"`
+	StackId   string `dynamodbav:"StackId"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+	UpdatedAt string `dynamodbav:"UpdatedAt"`
+}
+
+// stateTable is a state table in a region
+type stateTable struct {
+	Region string
+	Name   string
+}
+
+// runInventory lists every delegation recorded in the state tables of config.json, and
+// reports the drift of the delegations of config.json from their recorded records
+func runInventory(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	var tables []stateTable
+	seen := map[stateTable]bool{}
+	configured := map[string]cftor53.Delegation{}
+	for _, delegation := range cftor53.Delegations(config) {
+		if delegation.Config.State == nil || !delegation.Config.State.Enabled {
+			continue
+		}
+		name, err := ssmParameter(ctx, sess, delegation.MainRegion, delegation.ParameterName("stateTable"))
+		if err != nil {
+			return fmt.Errorf("%s: %v", delegation.FullDomainName(), err)
+		}
+		if name == "" {
+			continue
+		}
+		configured[strings.ToLower(delegation.FullDomainName())] = delegation
+		if table := (stateTable{Region: delegation.MainRegion, Name: name}); !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("no deployed state table, set state.enabled in config.json and deploy")
+	}
+
+	drifted := false
+	for _, table := range tables {
+		items, err := scanStateTable(ctx, sess, table)
+		if err != nil {
+			return err
+		}
+		byName := map[string][]stateItem{}
+		for _, item := range items {
+			byName[item.Name] = append(byName[item.Name], item)
+		}
+		var names []string
+		for name := range byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			lines := inventoryLines(table, byName[name])
+			delegation, ok := configured[name]
+			if !ok {
+				lines = append(lines, statusLine{"Drift", "not in config.json, not checked"})
+				writeStatus(os.Stdout, name, lines)
+				continue
+			}
+			problems, err := delegationDrift(ctx, sess, delegation, byName[name])
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if len(problems) > 0 {
+				drifted = true
+				lines = append(lines, statusLine{"Drift", strings.Join(problems, "; ")})
+			} else {
+				lines = append(lines, statusLine{"Drift", "none"})
+			}
+			writeStatus(os.Stdout, name, lines)
+		}
+	}
+	if drifted {
+		return errChanges
+	}
+	return nil
+}
+
+// scanStateTable returns the items of the state table
+func scanStateTable(ctx context.Context, sess *session.Session, table stateTable) ([]stateItem, error) {
+	client := dynamodb.New(sess, &aws.Config{Region: aws.String(table.Region)})
+	var items []stateItem
+	var unmarshalErr error
+	err := client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(table.Name)}, func(page *dynamodb.ScanOutput, _ bool) bool {
+		var pageItems []stateItem
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageItems); unmarshalErr != nil {
+			return false
+		}
+		items = append(items, pageItems...)
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan state table %s: %v", table.Name, err)
+	}
+	return items, nil
+}
+
+// inventoryLines describes the recorded records of a delegation
+func inventoryLines(table stateTable, items []stateItem) []statusLine {
+	sort.Slice(items, func(i, j int) bool { return items[i].Content < items[j].Content })
+	lines := []statusLine{{"State table", table.Name + " (" + table.Region + ")"}}
+	if len(items) > 0 {
+		lines = append(lines, statusLine{"Stack", items[0].StackId})
+	}
+	for _, item := range items {
+		lines = append(lines, statusLine{item.Type + " record " + item.RecordId, item.Content + " (created " + item.CreatedAt + ", updated " + item.UpdatedAt + ")"})
+	}
+	return lines
+}
+
+// delegationDrift compares the recorded records of the delegation with its NS records in Cloudflare
+func delegationDrift(ctx context.Context, sess *session.Session, delegation cftor53.Delegation, items []stateItem) ([]string, error) {
+	api, err := cloudflareClient(ctx, sess, delegation)
+	if err != nil {
+		return nil, err
+	}
+	zoneID, err := cloudflareZoneID(ctx, api, delegation.Config)
+	if err != nil {
+		return nil, err
+	}
+	records, err := cloudflareNSRecords(ctx, api, zoneID, delegation.FullDomainName())
+	if err != nil {
+		return nil, err
+	}
+	return recordDrift(items, records), nil
+}
+
+// recordDrift describes the differences between the recorded records and the NS records in
+// Cloudflare: recorded records that are gone or changed, and records nobody recorded
+func recordDrift(items []stateItem, records []nsRecord) []string {
+	current := map[string]string{}
+	for _, record := range records {
+		current[record.ID] = strings.ToLower(strings.TrimSuffix(record.NameServer, "."))
+	}
+	recorded := map[string]bool{}
+	var problems []string
+	for _, item := range items {
+		recorded[item.RecordId] = true
+		content, ok := current[item.RecordId]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("record %s (%s) is missing from Cloudflare", item.RecordId, item.Content))
+		case content != strings.ToLower(strings.TrimSuffix(item.Content, ".")):
+			problems = append(problems, fmt.Sprintf("record %s changed from %s to %s", item.RecordId, item.Content, content))
+		}
+	}
+	for _, record := range records {
+		if !recorded[record.ID] {
+			problems = append(problems, fmt.Sprintf("NS record %s (%s) is not recorded", record.ID, strings.TrimSuffix(record.NameServer, ".")))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,285 @@
+// Command cftor53 synthesizes the delegation stacks configured in config.json or config.yaml,
+// or the file of -config or CFTOR53_CONFIG. Given a
+// command, such as plan, it looks the delegations up in Cloudflare and Route53 instead.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/jsii-runtime-go"
+	"github.com/ferrix/cftor53"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the configuration file given with -config or CFTOR53_CONFIG
+var configFile string
+
+func main() {
+	flags := flag.NewFlagSet("cftor53", flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", "", "configuration file, config.json by default")
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if configFile == "" {
+		configFile = os.Getenv("CFTOR53_CONFIG")
+	}
+
+	// The CDK CLI runs the app without arguments
+	if flags.NArg() > 0 {
+		os.Exit(runCommand(flags.Arg(0), flags.Args()[1:]))
+	}
+	synth()
+}
+
+// configPath returns the configuration file to use: the one given, or config.json,
+// config.yaml or config.yml, whichever exists first
+func configPath() string {
+	if configFile != "" {
+		return configFile
+	}
+	for _, path := range []string{"config.json", "config.yaml", "config.yml"} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "config.json"
+}
+
+// readConfig reads and parses the configuration file. Without one, the configuration is
+// read from the CFTOR53_ environment variables if any are set.
+func readConfig() (*cftor53.ConfigFile, error) {
+	path := configPath()
+	var configBytes []byte
+	if _, err := os.Stat(path); os.IsNotExist(err) && configFile == "" {
+		document, err := environmentConfig(os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		if len(document) > 0 {
+			path = "environment"
+			configBytes, err = json.Marshal(document)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal the environment configuration: %v", err)
+			}
+		}
+	}
+	if configBytes == nil {
+		var err error
+		if configBytes, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	config, err := parseConfig(path, configBytes)
+	if _, ok := err.(*cftor53.ValidationError); ok {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// environmentConfig returns the configuration fields set in the environment, each in the
+// variable CFTOR53_ followed by its config.json name in upper case, e.g. CFTOR53_PARENT_DOMAIN.
+// CFTOR53_MAIN_REGION and CFTOR53_CERTIFICATE_REGION set the regions.
+func environmentConfig(getenv func(string) string) (map[string]interface{}, error) {
+	document, err := configValues(func(key string) interface{} {
+		if value := getenv("CFTOR53_" + strings.ToUpper(key)); value != "" {
+			return value
+		}
+		return nil
+	}, "environment variable")
+	if err != nil {
+		return nil, err
+	}
+
+	regions, _ := document["regions"].(map[string]interface{})
+	for key, name := range map[string]string{"main": "CFTOR53_MAIN_REGION", "certificate": "CFTOR53_CERTIFICATE_REGION"} {
+		if value := getenv(name); value != "" {
+			if regions == nil {
+				regions = map[string]interface{}{}
+			}
+			regions[key] = value
+		}
+	}
+	if regions != nil {
+		document["regions"] = regions
+	}
+	return document, nil
+}
+
+// configValues looks up every configuration field by its config.json name. Strings found for
+// fields that aren't strings are parsed as JSON, e.g. 300 or {"main":"eu-west-1"}.
+func configValues(lookup func(key string) interface{}, source string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	configType := reflect.TypeOf(cftor53.ConfigFile{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		value := lookup(key)
+		if value == nil {
+			continue
+		}
+		if text, ok := value.(string); ok && field.Type.Kind() != reflect.String {
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(text), &parsed); err != nil {
+				return nil, fmt.Errorf("failed to parse %s of %s: %v", source, key, err)
+			}
+			value = parsed
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// isYAML reports whether the configuration file is YAML rather than JSON
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// parseConfig parses and validates a JSON or YAML configuration. YAML is converted to JSON
+// first, so both formats share the field names and the schema of config.json.
+func parseConfig(path string, data []byte) (*cftor53.ConfigFile, error) {
+	if isYAML(path) {
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(document); err != nil {
+			return nil, err
+		}
+	}
+	// All problems are reported at once, before the stacks fail on the first
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if err := cftor53.ValidateConfigDocument(document); err != nil {
+		return nil, err
+	}
+	var config cftor53.ConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// synth synthesizes the stacks of the configuration file
+func synth() {
+	defer jsii.Close()
+
+	app := newApp(nil)
+	// Without -config or CFTOR53_CONFIG, the file can be given with `cdk deploy -c config=prod.json`
+	if path, ok := app.Node().TryGetContext(jsii.String("config")).(string); ok && configFile == "" {
+		configFile = path
+	}
+	config, err := readConfig()
+	if err == nil {
+		err = addStacks(app, config)
+	}
+	if err != nil {
+		// A readable report instead of a stack trace
+		fmt.Fprintln(os.Stderr, err)
+		jsii.Close()
+		os.Exit(1)
+	}
+	app.Synth(nil)
+}
+
+// newApp returns an app with the context given added
+func newApp(context map[string]interface{}) awscdk.App {
+	// Create an app with cross-region references enabled through context
+	appContext := map[string]interface{}{
+		"@aws-cdk/core:enableCrossAccountRegion": true,
+	}
+	for key, value := range context {
+		appContext[key] = value
+	}
+	return awscdk.NewApp(&awscdk.AppProps{
+		Context: &appContext,
+	})
+}
+
+// addStacks adds the stacks of the configuration to the app. Configuration fields set in the
+// context, e.g. with `cdk deploy -c subdomain=api`, override those of the configuration.
+// Every problem of the configuration is returned before any stack is added.
+func addStacks(app awscdk.App, config *cftor53.ConfigFile) error {
+	if err := applyContextOverrides(app, config); err != nil {
+		return err
+	}
+	if err := cftor53.ValidateConfig(config); err != nil {
+		return err
+	}
+	cftor53.AddNagChecks(app, config.Nag)
+
+	// With pipeline settings, the pipeline deploys the stacks instead
+	if config.Pipeline != nil {
+		cftor53.NewDelegationPipeline(app, "Cftor53Pipeline", &cftor53.DelegationPipelineProps{
+			Config: config,
+		})
+		return nil
+	}
+
+	// With StackSet settings, the delegation stack is rolled out to member accounts instead
+	if config.StackSet != nil {
+		cftor53.NewDelegationStackSet(app, "Cftor53StackSet", &cftor53.DelegationStackSetProps{
+			Config: config,
+		})
+		return nil
+	}
+
+	// With several domains, each domain and subdomain gets stacks of its own
+	if len(config.Domains) > 0 {
+		cftor53.NewDelegatedDomains(app, "Cftor53", &cftor53.DelegatedDomainsProps{
+			Config: config,
+		})
+		return nil
+	}
+
+	// The secrets stack keeps its original name so existing deployments are updated in place.
+	// The stacks of a stage are all named after the stage and the subdomain.
+	secretsStackID := "CfCloudflareSecretsStack"
+	if config.Stage != "" {
+		secretsStackID = ""
+	}
+	cftor53.NewDelegatedSubdomain(app, "Cftor53", &cftor53.DelegatedSubdomainProps{
+		Config:         config,
+		SecretsStackID: secretsStackID,
+	})
+	return nil
+}
+
+// applyContextOverrides sets the configuration fields found in the context of the app under
+// their config.json names. Values given with -c are strings, so the values of fields that
+// aren't strings are parsed as JSON, e.g. -c ns_record_ttl=300 or -c 'regions={"main":"eu-west-1"}'.
+func applyContextOverrides(app awscdk.App, config *cftor53.ConfigFile) error {
+	overrides, err := configValues(func(key string) interface{} {
+		return app.Node().TryGetContext(jsii.String(key))
+	}, "context value")
+	if err != nil || len(overrides) == 0 {
+		return err
+	}
+
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return fmt.Errorf("failed to marshal context overrides: %v", err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("failed to apply context overrides: %v", err)
+	}
+	return nil
+}
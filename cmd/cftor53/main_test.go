@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/ferrix/cftor53"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPlanNSChanges(t *testing.T) {
+	existing := []nsRecord{
+		{ID: "1", NameServer: "ns-1.awsdns-01.org."},
+		{ID: "2", NameServer: "old.ns.example.net"},
+	}
+	changes := planNSChanges(existing, []string{"NS-1.awsdns-01.org", "ns-2.awsdns-02.net."})
+	expected := []nsChange{
+		{Action: " ", NameServer: "ns-1.awsdns-01.org", RecordID: "1"},
+		{Action: "-", NameServer: "old.ns.example.net", RecordID: "2"},
+		{Action: "+", NameServer: "ns-2.awsdns-02.net"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	var out bytes.Buffer
+	changed := writePlan(&out, []delegationPlan{
+		{Name: "a.example.com", Location: "Cloudflare zone example.com", Changes: planNSChanges([]nsRecord{{ID: "1", NameServer: "old.ns.example.net"}}, []string{"ns-1.awsdns-01.org"})},
+		{Name: "b.example.com", Location: "Cloudflare zone example.com", NewZone: true},
+		{Name: "c.example.com", Skipped: "private hosted zone, not delegated"},
+	})
+	if !changed {
+		t.Error("Expected changes")
+	}
+	for _, line := range []string{"~ NS a.example.com", "- old.ns.example.net (1)", "+ ns-1.awsdns-01.org", "known after apply", "c.example.com: private", "Plan: 5 to add, 1 to remove."} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the plan:\n%s", line, out.String())
+		}
+	}
+
+	out.Reset()
+	if writePlan(&out, []delegationPlan{{Name: "a.example.com", Changes: planNSChanges([]nsRecord{{NameServer: "ns-1.awsdns-01.org"}}, []string{"ns-1.awsdns-01.org"})}}) {
+		t.Errorf("Expected no changes:\n%s", out.String())
+	}
+}
+
+func TestCompareNameServers(t *testing.T) {
+	expected := []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.net."}
+	if err := compareNameServers([]string{"ns-2.awsdns-02.net", "NS-1.awsdns-01.org"}, expected); err != nil {
+		t.Errorf("Expected matching name servers, got %v", err)
+	}
+	err := compareNameServers([]string{"ns-1.awsdns-01.org", "old.ns.example.net"}, expected)
+	if err == nil || err.Error() != "missing ns-2.awsdns-02.net; unexpected old.ns.example.net" {
+		t.Errorf("Expected the differences, got %v", err)
+	}
+	if err := compareNameServers(nil, expected); err == nil {
+		t.Error("Expected an error without NS records")
+	}
+}
+
+func TestAnswerNameServers(t *testing.T) {
+	name := dnsmessage.MustNewName("sub.example.com.")
+	response := &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeNS}, Body: &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns-2.awsdns-02.net.")}},
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeNS}, Body: &dnsmessage.NSResource{NS: dnsmessage.MustNewName("NS-1.awsdns-01.org.")}},
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSOA}, Body: &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns-1.awsdns-01.org."), MBox: dnsmessage.MustNewName("hostmaster.example.com.")}},
+		},
+	}
+	if got := answerNameServers(response); !reflect.DeepEqual(got, []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.net"}) {
+		t.Errorf("Unexpected name servers %v", got)
+	}
+	if !hasAnswerSOA(response, "Sub.example.com") || hasAnswerSOA(response, "example.com") {
+		t.Error("Expected the SOA record of sub.example.com only")
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	opts := initOptions{ParentDomain: "Example.com.", Subdomain: "api", MainRegion: "eu-west-1", CertificateRegion: "us-east-1", ApiToken: "token"}
+	config, err := initConfig(opts)
+	if err != nil {
+		t.Fatalf("Expected a config, got %v", err)
+	}
+	if config.ParentDomain != "example.com" || config.ApiToken != "token" || config.Regions.Main != "eu-west-1" || config.ExistingSecretOnly {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	opts.CreateSecret = true
+	opts.Namespace = "blog"
+	config, err = initConfig(opts)
+	if err != nil {
+		t.Fatalf("Expected a config, got %v", err)
+	}
+	if config.ApiToken != "" || config.SecretName != "cftor53/blog/cloudflare/api-token" || !config.ExistingSecretOnly {
+		t.Errorf("Expected the token in the secret only, got %+v", config)
+	}
+
+	config, err = initConfig(initOptions{ParentDomain: "bücher.example", Subdomain: "München", MainRegion: "eu-west-1", CertificateRegion: "us-east-1", ApiToken: "token"})
+	if err != nil || config.ParentDomain != "xn--bcher-kva.example" || config.Subdomain != "xn--mnchen-3ya" {
+		t.Errorf("Expected the names in punycode, got %+v (%v)", config, err)
+	}
+	if _, err := initConfig(initOptions{ParentDomain: "bücher.example", Subdomain: "mün chen", MainRegion: "eu-west-1", CertificateRegion: "us-east-1", ApiToken: "token"}); err == nil || !strings.HasPrefix(err.Error(), "invalid subdomain: mün chen (idna: ") {
+		t.Errorf("Expected the conversion error of the subdomain, got %v", err)
+	}
+
+	for _, invalid := range []initOptions{
+		{ParentDomain: "example.com", MainRegion: "eu-west-1", CertificateRegion: "us-east-1"},
+		{ParentDomain: "example", Subdomain: "api", MainRegion: "eu-west-1", CertificateRegion: "us-east-1"},
+		{ParentDomain: "example.com", Subdomain: "api_1", MainRegion: "eu-west-1", CertificateRegion: "us-east-1"},
+		{ParentDomain: "example.com", Subdomain: "api", MainRegion: "europe", CertificateRegion: "us-east-1"},
+		{ParentDomain: "example.com", Subdomain: "api", MainRegion: "eu-west-1", CertificateRegion: "us-east-1", CreateSecret: true},
+	} {
+		if _, err := initConfig(invalid); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+func TestDelegationStatus(t *testing.T) {
+	nameServers := []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.net."}
+	if state := delegationState([]string{"ns-2.awsdns-02.net", "ns-1.awsdns-01.org"}, nameServers); state != "in sync" {
+		t.Errorf("Expected in sync, got %s", state)
+	}
+	if state := delegationState(nil, nameServers); state != "out of sync: no NS records" {
+		t.Errorf("Expected out of sync, got %s", state)
+	}
+
+	var out bytes.Buffer
+	writeStatus(&out, "sub.example.com", []statusLine{{"Hosted zone", "Z123"}, {"Name servers", joinOrNone(nameServers)}, {"Certificate", "not deployed"}})
+	expected := "sub.example.com\n  Hosted zone   Z123\n  Name servers  ns-1.awsdns-01.org, ns-2.awsdns-02.net\n  Certificate   not deployed\n\n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestDeletionOrder(t *testing.T) {
+	stacks := []appStack{
+		{ID: "Secrets"},
+		{ID: "Main", DependsOn: []string{"Secrets", "Main.assets"}},
+		{ID: "Certificate", DependsOn: []string{"Main"}},
+		{ID: "CloudFront", DependsOn: []string{"Certificate", "Main"}},
+	}
+	var ids []string
+	for _, stack := range deletionOrder(stacks) {
+		ids = append(ids, stack.ID)
+	}
+	if expected := []string{"CloudFront", "Certificate", "Main", "Secrets"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestIsDefaultRecord(t *testing.T) {
+	record := func(name, recordType string) *route53.ResourceRecordSet {
+		return &route53.ResourceRecordSet{Name: aws.String(name), Type: aws.String(recordType)}
+	}
+	for _, tt := range []struct {
+		record   *route53.ResourceRecordSet
+		expected bool
+	}{
+		{record("sub.example.com.", "NS"), true},
+		{record("sub.example.com.", "SOA"), true},
+		{record("nested.sub.example.com.", "NS"), false},
+		{record("sub.example.com.", "TXT"), false},
+	} {
+		if got := isDefaultRecord(tt.record, "sub.example.com."); got != tt.expected {
+			t.Errorf("isDefaultRecord(%s %s) = %v, expected %v", *tt.record.Name, *tt.record.Type, got, tt.expected)
+		}
+	}
+}
+
+func TestInSubdomain(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"sub.example.com":        true,
+		"SUB.example.com.":       true,
+		"www.sub.example.com":    true,
+		"example.com":            false,
+		"othersub.example.com":   false,
+		"sub.example.com.evil.x": false,
+	} {
+		if got := inSubdomain(name, "sub.example.com"); got != expected {
+			t.Errorf("inSubdomain(%s) = %v, expected %v", name, got, expected)
+		}
+	}
+}
+
+func TestMissingRecords(t *testing.T) {
+	var records []recordBackup
+	raw := `[
+		{"id": "1", "type": "NS", "name": "sub.example.com", "content": "ns-1.awsdns-01.org", "ttl": 300, "proxied": false, "meta": {"auto_added": false}},
+		{"id": "2", "type": "SRV", "name": "_sip._tcp.sub.example.com", "content": "1 5060 sip.example.com", "priority": 10, "data": {"weight": 1, "port": 5060, "target": "sip.example.com"}, "ttl": 1, "proxied": false}
+	]`
+	if err := json.Unmarshal([]byte(raw), &records); err != nil {
+		t.Fatal(err)
+	}
+	if records[1].Priority == nil || *records[1].Priority != 10 || len(records[1].Data) == 0 {
+		t.Errorf("Expected the priority and data of the SRV record, got %+v", records[1])
+	}
+
+	existing := map[string]bool{recordKey("NS", "Sub.Example.com.", "ns-1.awsdns-01.org."): true}
+	missing := missingRecords(records, existing)
+	if len(missing) != 1 || missing[0].ID != "2" {
+		t.Errorf("Expected only the SRV record to be missing, got %+v", missing)
+	}
+}
+
+func TestRecordDrift(t *testing.T) {
+	items := []stateItem{
+		{RecordId: "1", Content: "ns-1.awsdns-01.org"},
+		{RecordId: "2", Content: "ns-2.awsdns-02.com"},
+		{RecordId: "3", Content: "ns-3.awsdns-03.net"},
+	}
+	records := []nsRecord{{ID: "1", NameServer: "NS-1.awsdns-01.org."}, {ID: "2", NameServer: "ns-9.awsdns-09.net"}, {ID: "4", NameServer: "ns-4.awsdns-04.co.uk."}}
+	expected := []string{
+		"NS record 4 (ns-4.awsdns-04.co.uk) is not recorded",
+		"record 2 changed from ns-2.awsdns-02.com to ns-9.awsdns-09.net",
+		"record 3 (ns-3.awsdns-03.net) is missing from Cloudflare",
+	}
+	if problems := recordDrift(items, records); strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected drift\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+	if problems := recordDrift(items[:1], records[:1]); len(problems) > 0 {
+		t.Errorf("Expected no drift, got %v", problems)
+	}
+}
+
+func TestApplyContextOverrides(t *testing.T) {
+	app := awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{
+			"subdomain":                      "foo",
+			"ns_record_ttl":                  "600",
+			"regions":                        `{"main": "eu-west-1"}`,
+			"@aws-cdk/core:checkSecretUsage": true,
+		},
+	})
+	config := &cftor53.ConfigFile{
+		ParentDomain: "example.com",
+		Subdomain:    "api",
+		Regions:      &cftor53.RegionConfig{Main: "eu-north-1", Certificate: "us-east-1"},
+	}
+	if err := applyContextOverrides(app, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Subdomain != "foo" || config.ParentDomain != "example.com" || config.NSRecordTTL != 600 {
+		t.Errorf("Expected the subdomain and TTL to be overridden, got %+v", config)
+	}
+	if config.Regions.Main != "eu-west-1" || config.Regions.Certificate != "us-east-1" {
+		t.Errorf("Expected the main region to be overridden, got %+v", config.Regions)
+	}
+
+	app = awscdk.NewApp(&awscdk.AppProps{Context: &map[string]interface{}{"ns_record_ttl": "ten"}})
+	if err := applyContextOverrides(app, config); err == nil {
+		t.Error("Expected an error for an invalid TTL")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	yamlConfig := `# Route53 zone for the API
+parent_domain: example.com
+subdomain: api
+regions:
+  main: eu-north-1
+  certificate: us-east-1
+ns_record_ttl: 300 # long enough for resolvers to cache
+lambda_settings:
+  timeout_seconds: 120
+`
+	config, err := parseConfig("config.yaml", []byte(yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ParentDomain != "example.com" || config.Subdomain != "api" || config.NSRecordTTL != 300 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Regions == nil || config.Regions.Main != "eu-north-1" || config.LambdaSettings == nil {
+		t.Errorf("Expected the regions and Lambda settings, got %+v", config)
+	}
+
+	data, err := marshalConfig("config.yml", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := parseConfig("config.yml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, roundTrip) {
+		t.Errorf("Expected %+v after a round trip, got %+v", config, roundTrip)
+	}
+
+	if _, err := parseConfig("config.json", []byte(yamlConfig)); err == nil {
+		t.Error("Expected an error for YAML in a JSON file")
+	}
+
+	// The log level of the Lambda is a Lambda setting
+	config, err = parseConfig("config.json", []byte(`{"parent_domain":"example.com","subdomain":"api","lambda_settings":{"log_level":"DEBUG"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LambdaSettings == nil || config.LambdaSettings.LogLevel != "DEBUG" {
+		t.Errorf("Expected the DEBUG log level, got %+v", config.LambdaSettings)
+	}
+	if _, err := parseConfig("config.json", []byte(`{"parent_domain":"example.com","subdomain":"api","lambda_settings":{"log_level":"verbose"}}`)); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
+
+func TestReadConfigIDN(t *testing.T) {
+	// The internationalized names of the README pass the schema and are checked as IDNs
+	path := filepath.Join(t.TempDir(), "config.json")
+	// Names the schema lets through are still checked as IDNs, here with a zero width joiner
+	if err := os.WriteFile(path, []byte(`{"parent_domain":"bücher.example","subdomain":"münchen","api_token":"token"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous string) { configFile = previous }(configFile)
+	configFile = path
+
+	config, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cftor53.ValidateConfig(config); err != nil {
+		t.Errorf("Expected the IDN config to be valid, got %v", err)
+	}
+	if name := cftor53.Delegations(config)[0].FullDomainName(); name != "xn--mnchen-3ya.xn--bcher-kva.example" {
+		t.Errorf("Expected the punycode name, got %s", name)
+	}
+
+	// Names the schema lets through are still checked as IDNs, here with a zero width joiner
+	if err := os.WriteFile(path, []byte(`{"parent_domain":"bücher.example","subdomain":"mün\u200dchen","api_token":"token"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cftor53.ValidateConfig(config); err == nil || !strings.Contains(err.Error(), "Invalid subdomain: mün\u200dchen") {
+		t.Errorf("Expected the invalid IDN to be rejected, got %v", err)
+	}
+}
+
+func TestEnvironmentConfig(t *testing.T) {
+	environment := map[string]string{
+		"CFTOR53_PARENT_DOMAIN":        "example.com",
+		"CFTOR53_SUBDOMAIN":            "api",
+		"CFTOR53_SECRET_NAME":          "ci/cloudflare-token",
+		"CFTOR53_EXISTING_SECRET_ONLY": "true",
+		"CFTOR53_NS_RECORD_TTL":        "600",
+		"CFTOR53_MAIN_REGION":          "eu-west-1",
+		"CFTOR53_CONFIG":               "ignored.json",
+	}
+	document, err := environmentConfig(func(name string) string { return environment[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseConfig("environment", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ParentDomain != "example.com" || config.Subdomain != "api" || config.SecretName != "ci/cloudflare-token" || !config.ExistingSecretOnly || config.NSRecordTTL != 600 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Regions == nil || config.Regions.Main != "eu-west-1" || config.Regions.Certificate != "" {
+		t.Errorf("Expected only the main region, got %+v", config.Regions)
+	}
+
+	environment["CFTOR53_NS_RECORD_TTL"] = "ten minutes"
+	if _, err := environmentConfig(func(name string) string { return environment[name] }); err == nil {
+		t.Error("Expected an error for an invalid TTL")
+	}
+}
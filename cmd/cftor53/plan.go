@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/ferrix/cftor53"
+)
+
+// Route53 assigns four name servers to every new hosted zone
+const newZoneNameServers = 4
+
+// nsRecord is an NS record of a delegation, with its Cloudflare ID if it is in Cloudflare
+type nsRecord struct {
+	ID         string
+	NameServer string
+}
+
+// nsChange is the planned change of one NS record: "+" to add it, "-" to remove it or " "
+// to keep it
+type nsChange struct {
+	Action     string
+	NameServer string
+	RecordID   string
+}
+
+// delegationPlan holds the NS changes of one delegation
+type delegationPlan struct {
+	Name string
+	// Where the NS records are, e.g. "Cloudflare zone example.com"
+	Location string
+	Changes  []nsChange
+	// The hosted zone is created by the deployment, so its name servers are not known yet
+	NewZone bool
+	// Why the delegation has no NS records, if it has none
+	Skipped string
+}
+
+// runPlan prints the NS changes a deployment of config.json would make, without changing anything
+func runPlan(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	detailedExitCode := flags.Bool("detailed-exitcode", false, "exit with 2 when there are changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	var plans []delegationPlan
+	for _, delegation := range cftor53.Delegations(config) {
+		plan, err := planDelegation(ctx, sess, delegation)
+		if err != nil {
+			return fmt.Errorf("%s: %v", delegation.FullDomainName(), err)
+		}
+		plans = append(plans, plan)
+	}
+
+	if changes := writePlan(os.Stdout, plans); changes && *detailedExitCode {
+		return errChanges
+	}
+	return nil
+}
+
+// planDelegation compares the delegation's NS records with the name servers of its hosted zone
+func planDelegation(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (delegationPlan, error) {
+	config := delegation.Config
+	name := strings.ToLower(delegation.FullDomainName())
+	plan := delegationPlan{Name: name}
+	if config.PrivateZone != nil {
+		plan.Skipped = "private hosted zone, not delegated"
+		return plan, nil
+	}
+	if config.CertificateOnly {
+		plan.Skipped = "certificate only, not delegated"
+		return plan, nil
+	}
+
+	nameServers, err := delegationNameServers(ctx, sess, delegation)
+	if err != nil {
+		return plan, err
+	}
+	plan.NewZone = nameServers == nil
+
+	location, existing, err := delegationNSRecords(ctx, sess, delegation)
+	if err != nil {
+		return plan, err
+	}
+	plan.Location = location
+	plan.Changes = planNSChanges(existing, nameServers)
+	// Append mode leaves the NS records of other name servers in place
+	if config.NSRecordMode == cftor53.NSRecordModeAppend {
+		for i := range plan.Changes {
+			if plan.Changes[i].Action == "-" {
+				plan.Changes[i].Action = " "
+			}
+		}
+	}
+	return plan, nil
+}
+
+// delegationNSRecords returns where the NS records delegating the subdomain are and the
+// records. A nested subdomain is delegated in the hosted zone of its parent instead of Cloudflare.
+func delegationNSRecords(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (string, []nsRecord, error) {
+	name := strings.ToLower(delegation.FullDomainName())
+	parentZoneID, parentZoneName, err := parentZone(ctx, sess, delegation)
+	if err != nil {
+		return "", nil, err
+	}
+	if parentZoneID != "" {
+		values, err := parentZoneNameServers(ctx, sess, parentZoneID, name)
+		return "hosted zone " + parentZoneName, nsRecordsOf(values), err
+	}
+
+	api, err := cloudflareClient(ctx, sess, delegation)
+	if err != nil {
+		return "", nil, err
+	}
+	zoneID, err := cloudflareZoneID(ctx, api, delegation.Config)
+	if err != nil {
+		return "", nil, err
+	}
+	records, err := cloudflareNSRecords(ctx, api, zoneID, name)
+	return "Cloudflare zone " + delegation.Config.ParentDomain, records, err
+}
+
+// planNSChanges returns the changes turning the existing NS records into the expected name
+// servers, ignoring trailing dots and case like the Lambda function
+func planNSChanges(existing []nsRecord, expected []string) []nsChange {
+	normalize := func(ns string) string {
+		return strings.ToLower(strings.TrimSuffix(ns, "."))
+	}
+	expectedSet := map[string]bool{}
+	for _, ns := range expected {
+		expectedSet[normalize(ns)] = true
+	}
+
+	var changes []nsChange
+	existingSet := map[string]bool{}
+	for _, record := range existing {
+		existingSet[normalize(record.NameServer)] = true
+		action := "-"
+		if expectedSet[normalize(record.NameServer)] {
+			action = " "
+		}
+		changes = append(changes, nsChange{Action: action, NameServer: normalize(record.NameServer), RecordID: record.ID})
+	}
+	for _, ns := range expected {
+		if !existingSet[normalize(ns)] {
+			existingSet[normalize(ns)] = true
+			changes = append(changes, nsChange{Action: "+", NameServer: normalize(ns)})
+		}
+	}
+	return changes
+}
+
+// writePlan writes the plans in the style of a Terraform plan and reports whether there are changes
+func writePlan(w io.Writer, plans []delegationPlan) bool {
+	added, removed := 0, 0
+	for _, plan := range plans {
+		if plan.Skipped != "" {
+			fmt.Fprintf(w, "  # %s: %s\n\n", plan.Name, plan.Skipped)
+			continue
+		}
+
+		var lines []string
+		changed := plan.NewZone
+		for _, change := range plan.Changes {
+			line := fmt.Sprintf("      %s %s", change.Action, change.NameServer)
+			if change.RecordID != "" {
+				line += " (" + change.RecordID + ")"
+			}
+			lines = append(lines, line)
+			switch change.Action {
+			case "+":
+				added++
+				changed = true
+			case "-":
+				removed++
+				changed = true
+			}
+		}
+		if plan.NewZone {
+			lines = append(lines, "      + (name servers of the new hosted zone, known after apply)")
+			added += newZoneNameServers
+		}
+
+		action := " "
+		if changed {
+			action = "~"
+		}
+		fmt.Fprintf(w, "  # %s in %s\n", plan.Name, plan.Location)
+		fmt.Fprintf(w, "  %s NS %s\n", action, plan.Name)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if added == 0 && removed == 0 {
+		fmt.Fprintln(w, "No changes. The NS records match the hosted zones.")
+		return false
+	}
+	fmt.Fprintf(w, "Plan: %d to add, %d to remove.\n", added, removed)
+	return true
+}
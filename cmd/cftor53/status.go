@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/ferrix/cftor53"
+)
+
+// statusLine is one line of a status report
+type statusLine struct {
+	Label string
+	Value string
+}
+
+// runStatus prints the deployed state of the delegations of config.json
+func runStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	for _, delegation := range cftor53.Delegations(config) {
+		lines, err := delegationStatus(ctx, sess, delegation)
+		if err != nil {
+			return fmt.Errorf("%s: %v", delegation.FullDomainName(), err)
+		}
+		writeStatus(os.Stdout, strings.ToLower(delegation.FullDomainName()), lines)
+	}
+	return nil
+}
+
+// delegationStatus reads the SSM parameters the stacks stored for the delegation and compares
+// the NS records delegating it with the name servers of its hosted zone
+func delegationStatus(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) ([]statusLine, error) {
+	config := delegation.Config
+	var lines []statusLine
+
+	if !config.CertificateOnly {
+		zoneID, err := ssmParameter(ctx, sess, delegation.MainRegion, delegation.ParameterName("hostedZoneId"))
+		if err != nil {
+			return nil, err
+		}
+		if zoneID == "" {
+			lines = append(lines, statusLine{"Hosted zone", "not deployed"})
+		} else {
+			lines = append(lines, statusLine{"Hosted zone", zoneID})
+		}
+
+		switch {
+		case config.PrivateZone != nil:
+			lines = append(lines, statusLine{"Delegation", "private hosted zone, not delegated"})
+		case zoneID == "":
+			lines = append(lines, statusLine{"Delegation", "not deployed"})
+		default:
+			nameServers, err := hostedZoneNameServers(ctx, route53Client(sess, config.AssumeRoleArn), zoneID)
+			if err != nil {
+				return nil, err
+			}
+			location, records, err := delegationNSRecords(ctx, sess, delegation)
+			if err != nil {
+				return nil, err
+			}
+			var values []string
+			for _, record := range records {
+				values = append(values, record.NameServer)
+			}
+			lines = append(lines,
+				statusLine{"Name servers", joinOrNone(nameServers)},
+				statusLine{"NS records", joinOrNone(values) + " (" + location + ")"},
+				statusLine{"Delegation", delegationState(values, nameServers)},
+			)
+		}
+	}
+
+	if delegation.CertificateEnabled() {
+		certificate, err := certificateStatus(ctx, sess, delegation.CertificateRegion, delegation.ParameterName("certificateArn"))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, statusLine{"Certificate", certificate})
+		if config.Certificate != nil && config.Certificate.Regional {
+			regional, err := certificateStatus(ctx, sess, delegation.MainRegion, delegation.ParameterName("regionalCertificateArn"))
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, statusLine{"Regional certificate", regional})
+		}
+	}
+	return lines, nil
+}
+
+// delegationState describes whether the NS records delegating the subdomain match its name servers
+func delegationState(records, nameServers []string) string {
+	if err := compareNameServers(records, nameServers); err != nil {
+		return "out of sync: " + err.Error()
+	}
+	return "in sync"
+}
+
+// certificateStatus describes the certificate stored in the SSM parameter
+func certificateStatus(ctx context.Context, sess *session.Session, region, parameterName string) (string, error) {
+	arn, err := ssmParameter(ctx, sess, region, parameterName)
+	if err != nil || arn == "" {
+		return "not deployed", err
+	}
+	output, err := acm.New(sess, &aws.Config{Region: aws.String(region)}).DescribeCertificateWithContext(ctx, &acm.DescribeCertificateInput{
+		CertificateArn: aws.String(arn),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe certificate %s: %v", arn, err)
+	}
+	status := arn + " (" + aws.StringValue(output.Certificate.Status)
+	if output.Certificate.NotAfter != nil {
+		status += ", expires " + output.Certificate.NotAfter.Format("2006-01-02")
+	}
+	return status + ")", nil
+}
+
+// ssmParameter returns the value of the SSM parameter, or "" if it doesn't exist
+func ssmParameter(ctx context.Context, sess *session.Session, region, name string) (string, error) {
+	output, err := ssm.New(sess, &aws.Config{Region: aws.String(region)}).GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get parameter %s: %v", name, err)
+	}
+	return aws.StringValue(output.Parameter.Value), nil
+}
+
+// joinOrNone returns the values without trailing dots, comma-separated, or "none"
+func joinOrNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	clean := make([]string, 0, len(values))
+	for _, value := range values {
+		clean = append(clean, strings.TrimSuffix(value, "."))
+	}
+	return strings.Join(clean, ", ")
+}
+
+// writeStatus writes the status report of a delegation with aligned values
+func writeStatus(w io.Writer, name string, lines []statusLine) {
+	fmt.Fprintln(w, name)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, line := range lines {
+		fmt.Fprintf(tw, "  %s\t%s\n", line.Label, line.Value)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
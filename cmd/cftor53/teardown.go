@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/jsii-runtime-go"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/ferrix/cftor53"
+)
+
+// appStack is a stack of the app of config.json
+type appStack struct {
+	ID     string
+	Name   string
+	Region string
+	// IDs of the stacks it depends on
+	DependsOn []string
+}
+
+// runTeardown removes the delegations of config.json: the NS records delegating the subdomains
+// first, so that they never point at deleted hosted zones, then the stacks, dependents first
+func runTeardown(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("teardown", flag.ContinueOnError)
+	emptyZone := flags.Bool("empty-zone", false, "delete the records CloudFormation doesn't manage when they keep a hosted zone from being deleted")
+	autoApprove := flags.Bool("auto-approve", false, "skip the confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if config.Pipeline != nil || config.StackSet != nil {
+		return fmt.Errorf("the stacks of pipeline and stack_set deployments are deleted through the pipeline or StackSet")
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	stacks, err := appStacks(config, aws.StringValue(sess.Config.Region))
+	if err != nil {
+		return err
+	}
+	deployed, err := deployedStacks(ctx, sess, deletionOrder(stacks))
+	if err != nil {
+		return err
+	}
+	delegations := cftor53.Delegations(config)
+
+	fmt.Println("cftor53 will remove the NS records delegating")
+	for _, delegation := range delegations {
+		if delegation.Config.PrivateZone == nil && !delegation.Config.CertificateOnly {
+			fmt.Printf("  - %s\n", strings.ToLower(delegation.FullDomainName()))
+		}
+	}
+	fmt.Println("and then delete the stacks")
+	for _, stack := range deployed {
+		fmt.Printf("  - %s (%s)\n", stack.Name, stack.Region)
+	}
+	if !*autoApprove {
+		if !isTerminal(os.Stdin) {
+			return fmt.Errorf("confirm on a terminal or with -auto-approve")
+		}
+		if ask(bufio.NewReader(os.Stdin), "\nThe subdomains stop resolving. Only 'yes' will be accepted to confirm", "") != "yes" {
+			return fmt.Errorf("teardown cancelled")
+		}
+	}
+
+	for _, delegation := range delegations {
+		if delegation.Config.PrivateZone != nil || delegation.Config.CertificateOnly {
+			continue
+		}
+		removed, location, err := removeDelegation(ctx, sess, delegation)
+		if err != nil {
+			return fmt.Errorf("%s: %v", delegation.FullDomainName(), err)
+		}
+		fmt.Printf("Removed %d NS records of %s from %s\n", removed, strings.ToLower(delegation.FullDomainName()), location)
+	}
+
+	for _, stack := range deployed {
+		fmt.Printf("Deleting %s in %s...\n", stack.Name, stack.Region)
+		if err := deleteStack(ctx, sess, stack, *emptyZone); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Teardown complete.")
+	return nil
+}
+
+// appStacks synthesizes the app of the configuration, without bundling the Lambda function,
+// and returns its stacks
+func appStacks(config *cftor53.ConfigFile, defaultRegion string) (stacks []appStack, err error) {
+	defer jsii.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid %s: %v", configPath(), r)
+		}
+	}()
+
+	outdir, err := os.MkdirTemp("", "cftor53-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outdir)
+	if err := os.Setenv("CDK_OUTDIR", outdir); err != nil {
+		return nil, err
+	}
+
+	app := newApp(map[string]interface{}{"aws:cdk:bundling-stacks": []string{}})
+	if err := addStacks(app, config); err != nil {
+		return nil, err
+	}
+	assembly := app.Synth(nil)
+	for _, artifact := range *assembly.Stacks() {
+		stack := appStack{ID: *artifact.Id(), Name: *artifact.StackName(), Region: *artifact.Environment().Region}
+		if strings.HasPrefix(stack.Region, "unknown-") {
+			stack.Region = defaultRegion
+		}
+		for _, dependency := range *artifact.Dependencies() {
+			stack.DependsOn = append(stack.DependsOn, *dependency.Id())
+		}
+		stacks = append(stacks, stack)
+	}
+	return stacks, nil
+}
+
+// deletionOrder returns the stacks in an order deleting each before the stacks it depends on
+func deletionOrder(stacks []appStack) []appStack {
+	dependents := map[string]int{}
+	for _, stack := range stacks {
+		for _, id := range stack.DependsOn {
+			dependents[id]++
+		}
+	}
+
+	var order []appStack
+	deleted := map[string]bool{}
+	for len(order) < len(stacks) {
+		progress := false
+		for _, stack := range stacks {
+			if deleted[stack.ID] || dependents[stack.ID] > 0 {
+				continue
+			}
+			deleted[stack.ID] = true
+			order = append(order, stack)
+			for _, id := range stack.DependsOn {
+				dependents[id]--
+			}
+			progress = true
+		}
+		// CDK rejects dependency cycles, so this only guards against looping forever
+		if !progress {
+			for _, stack := range stacks {
+				if !deleted[stack.ID] {
+					order = append(order, stack)
+				}
+			}
+			break
+		}
+	}
+	return order
+}
+
+// deployedStacks returns the stacks that are deployed, failing on termination protection
+func deployedStacks(ctx context.Context, sess *session.Session, stacks []appStack) ([]appStack, error) {
+	var deployed, protected []appStack
+	for _, stack := range stacks {
+		output, err := cloudformation.New(sess, &aws.Config{Region: aws.String(stack.Region)}).DescribeStacksWithContext(ctx, &cloudformation.DescribeStacksInput{
+			StackName: aws.String(stack.Name),
+		})
+		if aerr, ok := err.(awserr.Error); ok && strings.Contains(aerr.Message(), "does not exist") {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe stack %s: %v", stack.Name, err)
+		}
+		if len(output.Stacks) > 0 && aws.BoolValue(output.Stacks[0].EnableTerminationProtection) {
+			protected = append(protected, stack)
+		}
+		deployed = append(deployed, stack)
+	}
+	if len(protected) > 0 {
+		var names []string
+		for _, stack := range protected {
+			names = append(names, stack.Name)
+		}
+		return nil, fmt.Errorf("termination protection is enabled for %s, disable it in termination_protection and deploy first", strings.Join(names, ", "))
+	}
+	return deployed, nil
+}
+
+// removeDelegation deletes the NS records delegating the subdomain and returns how many
+// there were and where
+func removeDelegation(ctx context.Context, sess *session.Session, delegation cftor53.Delegation) (int, string, error) {
+	name := strings.ToLower(delegation.FullDomainName())
+	parentZoneID, parentZoneName, err := parentZone(ctx, sess, delegation)
+	if err != nil {
+		return 0, "", err
+	}
+	if parentZoneID != "" {
+		record, err := parentZoneNSRecordSet(ctx, sess, parentZoneID, name)
+		if err != nil || record == nil {
+			return 0, "hosted zone " + parentZoneName, err
+		}
+		_, err = route53Client(sess, "").ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+			HostedZoneId: aws.String(parentZoneID),
+			ChangeBatch: &route53.ChangeBatch{
+				Changes: []*route53.Change{{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: record}},
+			},
+		})
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to delete the NS records in %s: %v", parentZoneName, err)
+		}
+		return len(record.ResourceRecords), "hosted zone " + parentZoneName, nil
+	}
+
+	api, err := cloudflareClient(ctx, sess, delegation)
+	if err != nil {
+		return 0, "", err
+	}
+	zoneID, err := cloudflareZoneID(ctx, api, delegation.Config)
+	if err != nil {
+		return 0, "", err
+	}
+	records, err := cloudflareNSRecords(ctx, api, zoneID, name)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, record := range records {
+		if _, err := api.DNS.Records.Delete(ctx, record.ID, dns.RecordDeleteParams{ZoneID: cloudflare.F(zoneID)}); err != nil {
+			return 0, "", fmt.Errorf("failed to delete NS record %s: %v", record.ID, err)
+		}
+	}
+	return len(records), "Cloudflare zone " + delegation.Config.ParentDomain, nil
+}
+
+// deleteStack deletes the stack and waits for it. When records CloudFormation doesn't manage
+// keep a hosted zone of the stack from being deleted, emptyZone deletes them and retries.
+func deleteStack(ctx context.Context, sess *session.Session, stack appStack, emptyZone bool) error {
+	client := cloudformation.New(sess, &aws.Config{Region: aws.String(stack.Region)})
+	for attempt := 0; ; attempt++ {
+		if _, err := client.DeleteStackWithContext(ctx, &cloudformation.DeleteStackInput{StackName: aws.String(stack.Name)}); err != nil {
+			return fmt.Errorf("failed to delete stack %s: %v", stack.Name, err)
+		}
+		err := client.WaitUntilStackDeleteCompleteWithContext(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stack.Name)})
+		if err == nil {
+			return nil
+		}
+		if !emptyZone || attempt > 0 {
+			return fmt.Errorf("failed to delete stack %s, see its events: %v", stack.Name, err)
+		}
+
+		resources, err := client.DescribeStackResourcesWithContext(ctx, &cloudformation.DescribeStackResourcesInput{StackName: aws.String(stack.Name)})
+		if err != nil {
+			return fmt.Errorf("failed to describe the resources of stack %s: %v", stack.Name, err)
+		}
+		for _, resource := range resources.StackResources {
+			if aws.StringValue(resource.ResourceType) == "AWS::Route53::HostedZone" && aws.StringValue(resource.ResourceStatus) == cloudformation.ResourceStatusDeleteFailed {
+				deleted, err := emptyHostedZone(ctx, route53Client(sess, ""), aws.StringValue(resource.PhysicalResourceId))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Deleted %d records from hosted zone %s\n", deleted, aws.StringValue(resource.PhysicalResourceId))
+			}
+		}
+	}
+}
+
+// emptyHostedZone deletes the records of the hosted zone except the NS and SOA records of
+// its apex, which Route53 deletes with the zone, and returns how many it deleted
+func emptyHostedZone(ctx context.Context, client *route53.Route53, zoneID string) (int, error) {
+	zone, err := client.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get hosted zone %s: %v", zoneID, err)
+	}
+	apex := aws.StringValue(zone.HostedZone.Name)
+
+	var changes []*route53.Change
+	err = client.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{HostedZoneId: aws.String(zoneID)},
+		func(page *route53.ListResourceRecordSetsOutput, _ bool) bool {
+			for _, record := range page.ResourceRecordSets {
+				if !isDefaultRecord(record, apex) {
+					changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: record})
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list records of hosted zone %s: %v", zoneID, err)
+	}
+
+	// Route53 accepts up to 1000 changes per batch
+	for start := 0; start < len(changes); start += 500 {
+		end := start + 500
+		if end > len(changes) {
+			end = len(changes)
+		}
+		_, err := client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+			HostedZoneId: aws.String(zoneID),
+			ChangeBatch:  &route53.ChangeBatch{Changes: changes[start:end]},
+		})
+		if err != nil {
+			return start, fmt.Errorf("failed to delete records of hosted zone %s: %v", zoneID, err)
+		}
+	}
+	return len(changes), nil
+}
+
+// isDefaultRecord reports whether the record is the NS or SOA record of the zone apex
+func isDefaultRecord(record *route53.ResourceRecordSet, apex string) bool {
+	recordType := aws.StringValue(record.Type)
+	return (recordType == route53.RRTypeNs || recordType == route53.RRTypeSoa) && strings.EqualFold(aws.StringValue(record.Name), apex)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ferrix/cftor53"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Public resolvers asked by default: Cloudflare, Google and Quad9
+const defaultResolvers = "1.1.1.1,8.8.8.8,9.9.9.9"
+
+// check is the outcome of one check of a delegation
+type check struct {
+	Description string
+	Err         error
+}
+
+// runVerify checks that the delegations of config.json resolve to their hosted zones, and
+// fails when any check does
+func runVerify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	resolvers := flags.String("resolvers", defaultResolvers, "comma-separated public resolvers to ask")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+
+	failed, total := 0, 0
+	for _, delegation := range cftor53.Delegations(config) {
+		name := strings.ToLower(delegation.FullDomainName())
+		if delegation.Config.PrivateZone != nil || delegation.Config.CertificateOnly {
+			fmt.Printf("%s: not delegated, skipped\n\n", name)
+			continue
+		}
+
+		var checks []check
+		expected, err := delegationNameServers(ctx, sess, delegation)
+		if err == nil && expected == nil {
+			err = fmt.Errorf("no hosted zone found, it is created by the first deployment")
+		}
+		if err != nil {
+			checks = []check{{Description: "hosted zone", Err: err}}
+		} else {
+			checks = verifyDelegation(ctx, name, expected, strings.Split(*resolvers, ","))
+		}
+		failed += writeChecks(os.Stdout, name, checks)
+		total += len(checks)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, total)
+	}
+	fmt.Printf("All %d checks passed.\n", total)
+	return nil
+}
+
+// verifyDelegation asks the resolvers for the NS records of the name and the hosted zone's
+// name servers for its SOA record
+func verifyDelegation(ctx context.Context, name string, expected, resolvers []string) []check {
+	var checks []check
+	for _, resolver := range resolvers {
+		resolver = strings.TrimSpace(resolver)
+		c := check{Description: "NS records from " + resolver}
+		response, err := queryDNS(ctx, resolver, name, dnsmessage.TypeNS, true)
+		if err != nil {
+			c.Err = err
+		} else {
+			c.Err = compareNameServers(answerNameServers(response), expected)
+		}
+		checks = append(checks, c)
+	}
+
+	for _, nameServer := range expected {
+		nameServer = strings.TrimSuffix(nameServer, ".")
+		c := check{Description: "SOA record from " + nameServer}
+		response, err := queryDNS(ctx, nameServer, name, dnsmessage.TypeSOA, false)
+		switch {
+		case err != nil:
+			c.Err = err
+		case !response.Authoritative || !hasAnswerSOA(response, name):
+			c.Err = fmt.Errorf("%s is not authoritative for %s", nameServer, name)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// compareNameServers returns an error listing the differences between the resolved and
+// the expected name servers, ignoring trailing dots, case and order
+func compareNameServers(resolved, expected []string) error {
+	if len(resolved) == 0 {
+		return fmt.Errorf("no NS records")
+	}
+	changes := planNSChanges(nsRecordsOf(resolved), expected)
+	var missing, extra []string
+	for _, change := range changes {
+		switch change.Action {
+		case "+":
+			missing = append(missing, change.NameServer)
+		case "-":
+			extra = append(extra, change.NameServer)
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		problems = append(problems, "missing "+strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		problems = append(problems, "unexpected "+strings.Join(extra, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// nsRecordsOf returns NS records for the name servers
+func nsRecordsOf(nameServers []string) []nsRecord {
+	records := make([]nsRecord, 0, len(nameServers))
+	for _, ns := range nameServers {
+		records = append(records, nsRecord{NameServer: ns})
+	}
+	return records
+}
+
+// writeChecks writes the outcome of the delegation's checks and returns the number that failed
+func writeChecks(w io.Writer, name string, checks []check) int {
+	failed := 0
+	fmt.Fprintf(w, "%s\n", name)
+	for _, c := range checks {
+		if c.Err != nil {
+			failed++
+			fmt.Fprintf(w, "  FAIL %s: %v\n", c.Description, c.Err)
+		} else {
+			fmt.Fprintf(w, "  ok   %s\n", c.Description)
+		}
+	}
+	fmt.Fprintln(w)
+	return failed
+}
@@ -0,0 +1,179 @@
+package cftor53
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// DashboardConfig adds a CloudWatch dashboard with the health of every delegation of the app
+type DashboardConfig struct {
+	Enabled bool `json:"enabled"`
+	// Name of the dashboard, by default cftor53 followed by the namespace, the stage and,
+	// without domains, the delegated name
+	Name string `json:"name,omitempty"`
+	// CloudWatch Synthetics canaries in the dashboard's region checking the subdomains
+	Canaries []string `json:"canaries,omitempty"`
+}
+
+// DashboardStackProps configures the stack holding the dashboard of the delegations
+type DashboardStackProps struct {
+	awscdk.StackProps
+
+	// Delegations shown on the dashboard
+	Delegations []Delegation
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+// dashboardNamePattern matches the dashboard names CloudWatch allows
+var dashboardNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+
+// canaryNamePattern matches the canary names CloudWatch Synthetics allows
+var canaryNamePattern = regexp.MustCompile(`^[0-9a-z_-]{1,255}$`)
+
+// dashboardPeriod is the period of the graphs of the Lambda metrics
+var dashboardPeriod = awscdk.Duration_Hours(jsii.Number(1))
+
+// NewDashboardStack creates a stack with a CloudWatch dashboard graphing, for each delegation,
+// the failures of its custom resources, the NS records added and deleted, the drift found
+// by plans and the collisions found by checks, along with the configured canaries and the
+// days to expiry of the certificates in each certificate region
+func NewDashboardStack(scope constructs.Construct, id string, props *DashboardStackProps) awscdk.Stack {
+	if props == nil {
+		props = &DashboardStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	provided := props.Config != nil && props.Config.Dashboard != nil && len(props.Delegations) > 0
+	if err := validateProps(props.Config, provided, "Config with dashboard settings and Delegations"); err != nil {
+		panic(err)
+	}
+	settings := props.Config.Dashboard
+	name := settings.Name
+	if name == "" {
+		name = defaultDashboardName(props.Config, props.Delegations)
+	}
+
+	var names []string
+	var failures, records, drift []awscloudwatch.IMetric
+	for _, delegation := range props.Delegations {
+		label := strings.ToLower(delegation.FullDomainName())
+		names = append(names, "`"+label+"`")
+		failures = append(failures,
+			delegationMetric(delegation, "CustomResourceFailures", label+" failures", "Sum"),
+			delegationMetric(delegation, "NSRecordErrors", label+" NS record errors", "Sum"))
+		records = append(records,
+			delegationMetric(delegation, "NSRecordsAdded", label+" added", "Sum"),
+			delegationMetric(delegation, "NSRecordsDeleted", label+" deleted", "Sum"))
+		drift = append(drift,
+			delegationMetric(delegation, "NSRecordDrift", label+" drift", "Maximum"),
+			delegationMetric(delegation, "CollidingRecords", label+" colliding records", "Maximum"))
+	}
+
+	dashboard := awscloudwatch.NewDashboard(stack, jsii.String("DelegationHealthDashboard"), &awscloudwatch.DashboardProps{
+		DashboardName:   jsii.String(name),
+		DefaultInterval: awscdk.Duration_Days(jsii.Number(7)),
+	})
+	dashboard.AddWidgets(awscloudwatch.NewTextWidget(&awscloudwatch.TextWidgetProps{
+		Markdown: jsii.String("# Cloudflare delegations\n" + strings.Join(names, ", ") + "\n\nDrift is the number of NS record changes found by the last `plan` of the delegation."),
+		Width:    jsii.Number(24),
+		Height:   jsii.Number(2),
+	}))
+	dashboard.AddWidgets(
+		dashboardGraph("Custom resource failures", failures),
+		dashboardGraph("NS records added and deleted", records),
+	)
+
+	// Plans and checks report zero when they find nothing, so gaps mean nothing was checked
+	row := []awscloudwatch.IWidget{dashboardGraph("NS record drift and collisions", drift)}
+	if len(settings.Canaries) > 0 {
+		var canaries []awscloudwatch.IMetric
+		for _, canary := range settings.Canaries {
+			canaries = append(canaries, awscloudwatch.NewMetric(&awscloudwatch.MetricProps{
+				Namespace:     jsii.String("CloudWatchSynthetics"),
+				MetricName:    jsii.String("SuccessPercent"),
+				DimensionsMap: &map[string]*string{"CanaryName": jsii.String(canary)},
+				Statistic:     jsii.String("Average"),
+				Period:        dashboardPeriod,
+				Label:         jsii.String(canary),
+			}))
+		}
+		row = append(row, dashboardGraph("Canary success (%)", canaries))
+	}
+	dashboard.AddWidgets(row...)
+
+	// ACM's metric only has the certificate ARN as dimension, so the certificates of each
+	// region the delegations use are found with a search
+	var regions []string
+	seen := map[string]bool{}
+	for _, delegation := range props.Delegations {
+		if !delegation.CertificateEnabled() || delegation.Config.PrivateZone != nil || seen[delegation.CertificateRegion] {
+			continue
+		}
+		seen[delegation.CertificateRegion] = true
+		regions = append(regions, delegation.CertificateRegion)
+	}
+	sort.Strings(regions)
+	if len(regions) > 0 {
+		var expiry []awscloudwatch.IMetric
+		for _, region := range regions {
+			expiry = append(expiry, awscloudwatch.NewMathExpression(&awscloudwatch.MathExpressionProps{
+				Expression:   jsii.String(`SEARCH('{AWS/CertificateManager,CertificateArn} MetricName="DaysToExpiry"', 'Minimum', 86400)`),
+				UsingMetrics: &map[string]awscloudwatch.IMetric{},
+				SearchRegion: jsii.String(region),
+				Period:       awscdk.Duration_Days(jsii.Number(1)),
+			}))
+		}
+		dashboard.AddWidgets(dashboardGraph("Certificate days to expiry", expiry))
+	}
+	return stack
+}
+
+// defaultDashboardName returns the dashboard name of the delegations
+func defaultDashboardName(config *ConfigFile, delegations []Delegation) string {
+	parts := []string{"cftor53"}
+	for _, part := range []string{config.Namespace, config.Stage} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(config.Domains) == 0 {
+		parts = append(parts, strings.ReplaceAll(strings.ToLower(delegations[0].FullDomainName()), ".", "-"))
+	}
+	return strings.Join(parts, "-")
+}
+
+// delegationMetric returns a metric the Lambda function publishes for the delegation
+func delegationMetric(delegation Delegation, metricName, label, statistic string) awscloudwatch.IMetric {
+	powertools := defaultLambdaSettings(delegation.Config.LambdaSettings, "lambda").Powertools
+	return awscloudwatch.NewMetric(&awscloudwatch.MetricProps{
+		Namespace:  jsii.String(powertools.MetricsNamespace),
+		MetricName: jsii.String(metricName),
+		DimensionsMap: &map[string]*string{
+			"service":    jsii.String(powertools.ServiceName),
+			"delegation": jsii.String(strings.ToLower(delegation.FullDomainName())),
+		},
+		Region:    jsii.String(delegation.MainRegion),
+		Statistic: jsii.String(statistic),
+		Period:    dashboardPeriod,
+		Label:     jsii.String(label),
+	})
+}
+
+// dashboardGraph returns a graph of the metrics in half of the dashboard's width
+func dashboardGraph(title string, metrics []awscloudwatch.IMetric) awscloudwatch.IWidget {
+	return awscloudwatch.NewGraphWidget(&awscloudwatch.GraphWidgetProps{
+		Title:  jsii.String(title),
+		Left:   &metrics,
+		Width:  jsii.Number(12),
+		Height: jsii.Number(6),
+	})
+}
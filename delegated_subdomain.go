@@ -0,0 +1,599 @@
+package cftor53
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+var hostedZoneIDPattern = regexp.MustCompile(`^[A-Z0-9]{1,32}$`)
+
+// DelegatedSubdomainProps configures a delegated subdomain
+type DelegatedSubdomainProps struct {
+	// Configuration settings, as read from config.json
+	Config *ConfigFile
+
+	// Directory of the Lambda module (default: "lambda", relative to the working directory)
+	LambdaSourceDir string
+
+	// ID of the secrets stack (default: id + "SecretsStack")
+	SecretsStackID string
+
+	// Token secret of another delegation to share, e.g. of the same domain, instead of a secrets stack
+	CloudflareApiTokenSecret awssecretsmanager.ISecret
+}
+
+// DelegatedSubdomain holds the stacks delegating a Cloudflare subdomain to Route53
+type DelegatedSubdomain struct {
+	// Stack holding the token secret, nil when an existing secret or parameter is used
+	SecretsStack awscdk.Stack
+
+	// Token secret of the secrets stack or the one passed in, nil otherwise
+	CloudflareApiTokenSecret awssecretsmanager.ISecret
+
+	// Stack with the hosted zone and the delegation custom resources
+	Stack awscdk.Stack
+
+	// Stack with the ACM certificate, nil for a private hosted zone or with certificate.enabled false
+	CertificateStack awscdk.Stack
+
+	// Stack with the certificate in the main region when Config.Certificate.Regional is set, nil otherwise
+	RegionalCertificateStack awscdk.Stack
+
+	// Stack with the CloudFront distribution when Config.CloudFront is enabled, nil otherwise
+	CloudFrontStack awscdk.Stack
+
+	// Stack with the website bucket and distribution when Config.Website is enabled, nil otherwise
+	WebsiteStack awscdk.Stack
+
+	// Stack with the API Gateway custom domain when Config.ApiGateway is enabled, nil otherwise
+	ApiGatewayDomainStack awscdk.Stack
+
+	// Stack with the SES domain identity when Config.Ses is enabled, nil otherwise
+	SesIdentityStack awscdk.Stack
+
+	// Stack with the hosted zone in the account of Config.AssumeRoleArn, nil otherwise
+	ZoneStack awscdk.Stack
+
+	// Stack with the dashboard when Config.Dashboard is enabled, nil otherwise. With
+	// Config.Domains the first subdomain holds the dashboard of all of them.
+	DashboardStack awscdk.Stack
+
+	// Stack with the query log group in us-east-1 when Config.QueryLogging is enabled, nil otherwise
+	QueryLoggingStack awscdk.Stack
+
+	// Stack with the reusable delegation set when Config.DelegationSet.Create is set, nil otherwise
+	DelegationSetStack awscdk.Stack
+
+	// ID of the Route53 hosted zone for the subdomain
+	HostedZoneId *string
+}
+
+// NewDelegatedSubdomain adds the stacks delegating the configured Cloudflare subdomain to
+// Route53 to scope, which must be an app or a stage. The stacks are named id + "Stack" and
+// id + "CertificateStack", prefixed with Config.Namespace if set. With Config.Stage, id is
+// followed by the stage and the subdomain, e.g. Cftor53-prod-app-Stack. Missing settings are
+// defaulted, and an invalid configuration panics with the error of ValidateConfig.
+func NewDelegatedSubdomain(scope constructs.Construct, id string, props *DelegatedSubdomainProps) *DelegatedSubdomain {
+	if props == nil {
+		props = &DelegatedSubdomainProps{}
+	}
+	if err := validateProps(props.Config, true, "Config"); err != nil {
+		panic(err)
+	}
+	config := *props.Config
+	config.ParentDomain = asciiDomainName(config.ParentDomain)
+	config.Subdomain = asciiDomainName(config.Subdomain)
+
+	// Get the Lambda source directory (default: "lambda")
+	lambdaSourceDir := "lambda"
+	if props.LambdaSourceDir != "" {
+		lambdaSourceDir = props.LambdaSourceDir
+	}
+
+	// Name the stacks of a stage after the stage and the subdomain
+	if config.Stage != "" {
+		id = stageStackID(id, &config)
+	}
+
+	// Get the secrets stack ID (default: id + "SecretsStack")
+	secretsStackID := id + "SecretsStack"
+	if props.SecretsStackID != "" {
+		secretsStackID = props.SecretsStackID
+	}
+
+	// Prefix the stack IDs with the namespace
+	id = stackID(config.Namespace, id)
+	secretsStackID = stackID(config.Namespace, secretsStackID)
+
+	// Set default regions if not provided
+	mainRegion, certRegion := configRegions(&config)
+
+	// Domain configuration from config.json
+	parentDomain := jsii.String(config.ParentDomain)
+	subdomain := jsii.String(config.Subdomain)
+
+	// Get secret name (default: "cftor53/cloudflare/api-token") and SSM
+	// parameter prefix (default: "/cftor53"), within the namespace if any
+	secretName, ssmParamPrefix := resourceNames(&config)
+
+	// Get Lambda settings with defaults
+	lambdaSettings := defaultLambdaSettings(config.LambdaSettings, lambdaSourceDir)
+
+	// Get token source (default: Secrets Manager)
+	tokenSource := TokenSourceSecretsManager
+	if config.TokenSource != "" {
+		tokenSource = config.TokenSource
+	}
+
+	// Get the delegation workflow orchestration (default: chain of custom resources)
+	orchestration := OrchestrationCustomResources
+	if config.Orchestration != "" {
+		orchestration = config.Orchestration
+	}
+
+	// Get termination protection (default: none)
+	protection := &TerminationProtectionConfig{}
+	if config.TerminationProtection != nil {
+		protection = config.TerminationProtection
+	}
+
+	// Without a delegation the stacks are deployed to the certificate region, where the
+	// Lambda requests the certificate
+	if config.CertificateOnly {
+		mainRegion = certRegion
+
+		// ACM usually takes a few minutes to validate, which the Lambda waits for
+		if config.LambdaSettings == nil || config.LambdaSettings.TimeoutSeconds == 0 {
+			lambdaSettings.TimeoutSeconds = 900
+		}
+	}
+
+	// The SSM SecureString parameter is created outside of CDK, since CloudFormation
+	// cannot create SecureString parameters, so the secrets stack is only needed for Secrets Manager
+	// An existing secret referenced by ARN or by name is imported by the main stack instead
+	delegation := &DelegatedSubdomain{}
+	cloudflareSecret := props.CloudflareApiTokenSecret
+	if cloudflareSecret == nil && tokenSource == TokenSourceSecretsManager && config.SecretArn == "" && !config.ExistingSecretOnly && config.PrivateZone == nil {
+		// Create a secret in Secrets Manager for the Cloudflare API token (in the main region)
+		secretsStack := awscdk.NewStack(scope, jsii.String(secretsStackID), &awscdk.StackProps{
+			Env: &awscdk.Environment{
+				Region: jsii.String(mainRegion),
+			},
+			CrossRegionReferences: jsii.Bool(true),
+			Synthesizer:           stackSynthesizer(config.CloudFormation),
+			TerminationProtection: jsii.Bool(protection.Secrets),
+		})
+
+		// Other accounts can only read the secret when it is encrypted with a key of its own
+		readers := secretReaderPrincipals(config.SecretReaders)
+		var encryptionKey awskms.IKey
+		if len(readers) > 0 {
+			encryptionKey = newSecretReadersKey(secretsStack, readers)
+		}
+
+		// Create a secret for the Cloudflare API token
+		cloudflareSecret = awssecretsmanager.NewSecret(secretsStack, jsii.String("CloudflareApiToken"), &awssecretsmanager.SecretProps{
+			Description: jsii.String("Cloudflare API Token for DNS management"),
+			SecretName:  jsii.String(secretName),
+			SecretObjectValue: &map[string]awscdk.SecretValue{
+				"api_token": awscdk.SecretValue_UnsafePlainText(jsii.String(config.ApiToken)),
+			},
+			ReplicaRegions: secretReplicaRegions(mainRegion, config.SecretReplicas),
+			EncryptionKey:  encryptionKey,
+		})
+		if config.RemovalPolicy != nil {
+			applyRemovalPolicy(cloudflareSecret, config.RemovalPolicy.Secret)
+		}
+		if len(readers) > 0 {
+			grantSecretReaders(cloudflareSecret, readers)
+		}
+		addTokenRotation(secretsStack, cloudflareSecret, config.Rotation, lambdaSettings)
+		delegation.SecretsStack = secretsStack
+	}
+
+	delegation.CloudflareApiTokenSecret = cloudflareSecret
+
+	// An existing hosted zone is delegated instead of creating one
+	hostedZoneID := strings.TrimPrefix(config.HostedZoneID, "/hostedzone/")
+
+	// CloudFormation cannot put a hosted zone in a reusable delegation set, so the zone is
+	// created by the state machine
+	var delegationSet *DelegationSetConfig
+	if config.DelegationSet != nil {
+		delegationSet = &DelegationSetConfig{ID: config.DelegationSet.ID}
+		if config.DelegationSet.Create {
+			var delegationSetId *string
+			delegation.DelegationSetStack, delegationSetId = NewDelegationSetStack(scope, id+"DelegationSetStack", &DelegationSetStackProps{
+				StackProps: awscdk.StackProps{
+					Env: &awscdk.Environment{
+						Region: jsii.String(mainRegion),
+					},
+					Synthesizer:           stackSynthesizer(config.CloudFormation),
+					TerminationProtection: jsii.Bool(protection.Zone),
+				},
+			})
+			delegationSet.ID = *delegationSetId
+		}
+	}
+
+	// With a role in another account, the hosted zone and certificate are deployed there
+	var zoneAccount *string
+	if config.AssumeRoleArn != "" {
+		zoneAccount = jsii.String(roleAccount(config.AssumeRoleArn))
+	}
+
+	// Records of a zone file are created along with those of the configuration
+	records, _ := configRecords(&config)
+
+	// Route53 writes query logs to a log group in us-east-1, in the zone's account
+	var queryLogging *QueryLoggingConfig
+	var queryLoggingStack awscdk.Stack
+	if config.QueryLogging != nil && config.QueryLogging.Enabled {
+		queryLogging = config.QueryLogging
+		queryLoggingStack = NewQueryLoggingStack(scope, id+"QueryLoggingStack", &QueryLoggingStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Account: zoneAccount,
+					Region:  jsii.String(queryLoggingRegion),
+				},
+				Synthesizer: stackSynthesizer(config.CloudFormation),
+			},
+			ZoneName: jsii.String(config.Subdomain + "." + config.ParentDomain),
+			Config:   &ConfigFile{QueryLogging: queryLogging},
+		})
+		delegation.QueryLoggingStack = queryLoggingStack
+	}
+	if config.AssumeRoleArn != "" && hostedZoneID == "" {
+		delegation.ZoneStack, delegation.HostedZoneId = NewHostedZoneStack(scope, id+"ZoneStack", &HostedZoneStackProps{
+			StackProps: awscdk.StackProps{
+				CrossRegionReferences: jsii.Bool(true),
+				Env: &awscdk.Environment{
+					Account: zoneAccount,
+					Region:  jsii.String(mainRegion),
+				},
+				Synthesizer:           stackSynthesizer(config.CloudFormation),
+				TerminationProtection: jsii.Bool(protection.Zone),
+			},
+			ParentDomain: parentDomain,
+			Subdomain:    subdomain,
+			Config: &ConfigFile{
+				SsmParamPrefix:    ssmParamPrefix,
+				RemovalPolicy:     config.RemovalPolicy,
+				QueryLogging:      queryLogging,
+				Records:           records,
+				Exports:           config.Exports,
+				HostedZoneComment: config.HostedZoneComment,
+				HostedZoneTags:    config.HostedZoneTags,
+			},
+		})
+	}
+
+	// Create the main stack with Route53 hosted zone and get the hosted zone ID
+	var hostedZoneId *string
+	delegation.Stack, hostedZoneId = NewCftor53Stack(scope, id+"Stack", &Cftor53StackProps{
+		StackProps: awscdk.StackProps{
+			CrossRegionReferences: jsii.Bool(true),
+			Env: &awscdk.Environment{
+				Region: jsii.String(mainRegion),
+			},
+			Synthesizer:           stackSynthesizer(config.CloudFormation),
+			TerminationProtection: jsii.Bool(protection.Zone),
+		},
+		ParentDomain:             parentDomain,
+		Subdomain:                subdomain,
+		CloudflareApiTokenSecret: cloudflareSecret,
+		Config: &ConfigFile{
+			SsmParamPrefix:       ssmParamPrefix,
+			AccountID:            config.AccountID,
+			ZoneID:               config.ZoneID,
+			TokenSource:          tokenSource,
+			TokenParameterName:   config.TokenParameterName,
+			SecretName:           secretName,
+			SecretArn:            config.SecretArn,
+			ExistingSecretOnly:   config.ExistingSecretOnly,
+			SecretVersion:        config.SecretVersion,
+			Rotation:             config.Rotation,
+			Namespace:            config.Namespace,
+			RemovalPolicy:        config.RemovalPolicy,
+			LambdaSettings:       lambdaSettings,
+			Orchestration:        orchestration,
+			NSRecordTTL:          config.NSRecordTTL,
+			NSRecordMode:         config.NSRecordMode,
+			AcceptProxiedRecords: config.AcceptProxiedRecords,
+			Exports:              config.Exports,
+			Certificate:          config.Certificate,
+			CertificateOnly:      config.CertificateOnly,
+			AssumeRoleArn:        config.AssumeRoleArn,
+			HostedZoneID:         hostedZoneID,
+			DelegationSet:        delegationSet,
+			PrivateZone:          config.PrivateZone,
+			QueryLogging:         queryLogging,
+			Records:              records,
+			Lock:                 config.Lock,
+			State:                config.State,
+			ResponseSpill:        config.ResponseSpill,
+			Propagation:          config.Propagation,
+			CloudflareRetry:      config.CloudflareRetry,
+			HostedZoneComment:    config.HostedZoneComment,
+			HostedZoneTags:       config.HostedZoneTags,
+		},
+	})
+	if delegation.ZoneStack != nil {
+		// The Lambda reads the name servers of the deployed zone
+		delegation.Stack.AddDependency(delegation.ZoneStack, jsii.String("the hosted zone must exist before delegating it"))
+	} else {
+		delegation.HostedZoneId = hostedZoneId
+	}
+	if queryLoggingStack != nil {
+		zoneStack := delegation.Stack
+		if delegation.ZoneStack != nil {
+			zoneStack = delegation.ZoneStack
+		}
+		zoneStack.AddDependency(queryLoggingStack, jsii.String("Route53 checks the query log group when creating the hosted zone"))
+	}
+
+	// SES verifies the identity through public DNS, in the region mail is sent from
+	if config.Ses != nil && config.Ses.Enabled {
+		sesRegion := mainRegion
+		if config.Ses.Region != "" {
+			sesRegion = config.Ses.Region
+		}
+		delegation.SesIdentityStack = NewSesIdentityStack(scope, id+"SesIdentityStack", &SesIdentityStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Account: zoneAccount,
+					Region:  jsii.String(sesRegion),
+				},
+				CrossRegionReferences: jsii.Bool(true),
+				Synthesizer:           stackSynthesizer(config.CloudFormation),
+			},
+			ParentDomain: parentDomain,
+			Subdomain:    subdomain,
+			HostedZoneId: delegation.HostedZoneId,
+			Config: &ConfigFile{
+				SsmParamPrefix: ssmParamPrefix,
+				Ses:            config.Ses,
+			},
+		})
+	}
+
+	// ACM validates certificates through public DNS only, so a private zone gets none
+	cloudFront := config.CloudFront != nil && config.CloudFront.Enabled
+	website := config.Website != nil && config.Website.Enabled
+	apiGateway := config.ApiGateway != nil && config.ApiGateway.Enabled
+	if config.PrivateZone == nil && !config.CertificateOnly && certificateEnabled(config.Certificate) {
+		// Create the certificate stack in us-east-1 with direct reference to the hosted zone ID
+		var certificateArn, regionalCertificateArn *string
+		delegation.CertificateStack, certificateArn = NewCertificateStack(scope, id+"CertificateStack", &CertificateStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Account: zoneAccount,
+					Region:  jsii.String(certRegion),
+				},
+				CrossRegionReferences: jsii.Bool(true),
+				Synthesizer:           stackSynthesizer(config.CloudFormation),
+				TerminationProtection: jsii.Bool(protection.Certificate),
+			},
+			ParentDomain: parentDomain,
+			Subdomain:    subdomain,
+			HostedZoneId: delegation.HostedZoneId,
+			Config: &ConfigFile{
+				ParentDomain:   config.ParentDomain,
+				Subdomain:      config.Subdomain,
+				SsmParamPrefix: ssmParamPrefix,
+				Regions:        config.Regions,
+				Certificate:    config.Certificate,
+				Exports:        config.Exports,
+			},
+		})
+
+		// Regional endpoints such as ALBs and API Gateway need a certificate in their own region
+		if config.Certificate != nil && config.Certificate.Regional {
+			delegation.RegionalCertificateStack, regionalCertificateArn = NewCertificateStack(scope, id+"RegionalCertificateStack", &CertificateStackProps{
+				StackProps: awscdk.StackProps{
+					Env: &awscdk.Environment{
+						Account: zoneAccount,
+						Region:  jsii.String(mainRegion),
+					},
+					CrossRegionReferences: jsii.Bool(true),
+					Synthesizer:           stackSynthesizer(config.CloudFormation),
+					TerminationProtection: jsii.Bool(protection.Certificate),
+				},
+				ParentDomain: parentDomain,
+				Subdomain:    subdomain,
+				HostedZoneId: delegation.HostedZoneId,
+				Regional:     true,
+				Config: &ConfigFile{
+					ParentDomain:   config.ParentDomain,
+					Subdomain:      config.Subdomain,
+					SsmParamPrefix: ssmParamPrefix,
+					Regions:        config.Regions,
+					Certificate:    config.Certificate,
+					Exports:        config.Exports,
+				},
+			})
+		}
+
+		// The distributions use the certificate from the same region
+		cloudFrontProps := &CloudFrontStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Account: zoneAccount,
+					Region:  jsii.String(certRegion),
+				},
+				CrossRegionReferences: jsii.Bool(true),
+				Synthesizer:           stackSynthesizer(config.CloudFormation),
+			},
+			ParentDomain:   parentDomain,
+			Subdomain:      subdomain,
+			HostedZoneId:   delegation.HostedZoneId,
+			CertificateArn: certificateArn,
+			Config: &ConfigFile{
+				SsmParamPrefix: ssmParamPrefix,
+				Regions:        config.Regions,
+				CloudFront:     config.CloudFront,
+				Website:        config.Website,
+			},
+		}
+		if cloudFront {
+			delegation.CloudFrontStack = NewCloudFrontStack(scope, id+"CloudFrontStack", cloudFrontProps)
+		}
+		if website {
+			delegation.WebsiteStack = NewWebsiteStack(scope, id+"WebsiteStack", cloudFrontProps)
+		}
+
+		// The custom domain is created in the main region, where the REST API is
+		if apiGateway {
+			apiCertificateArn := certificateArn
+			if apiGatewayEndpointType(config.ApiGateway) == ApiGatewayEndpointRegional && mainRegion != certRegion {
+				apiCertificateArn = regionalCertificateArn
+			}
+			delegation.ApiGatewayDomainStack = NewApiGatewayDomainStack(scope, id+"ApiGatewayDomainStack", &ApiGatewayDomainStackProps{
+				StackProps: awscdk.StackProps{
+					Env: &awscdk.Environment{
+						Account: zoneAccount,
+						Region:  jsii.String(mainRegion),
+					},
+					CrossRegionReferences: jsii.Bool(true),
+					Synthesizer:           stackSynthesizer(config.CloudFormation),
+				},
+				ParentDomain:   parentDomain,
+				Subdomain:      subdomain,
+				HostedZoneId:   delegation.HostedZoneId,
+				CertificateArn: apiCertificateArn,
+				Config: &ConfigFile{
+					SsmParamPrefix: ssmParamPrefix,
+					Regions:        config.Regions,
+					Certificate:    config.Certificate,
+					ApiGateway:     config.ApiGateway,
+				},
+			})
+		}
+	}
+
+	if config.Dashboard != nil && config.Dashboard.Enabled {
+		delegation.DashboardStack = NewDashboardStack(scope, id+"DashboardStack", &DashboardStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Region: jsii.String(mainRegion),
+				},
+				Synthesizer: stackSynthesizer(config.CloudFormation),
+			},
+			Delegations: Delegations(&config),
+			Config:      &config,
+		})
+	}
+
+	for _, stack := range delegation.stacks() {
+		applyPermissionsBoundary(stack, config.PermissionsBoundaryArn)
+		applyTags(stack, config.Tags)
+	}
+
+	return delegation
+}
+
+// certificateEnabled reports whether a certificate is issued for the subdomain
+func certificateEnabled(certificate *CertificateConfig) bool {
+	return certificate == nil || certificate.Enabled == nil || *certificate.Enabled
+}
+
+// configRegions returns the main and certificate regions of the configuration
+func configRegions(config *ConfigFile) (mainRegion, certRegion string) {
+	mainRegion = "eu-north-1" // Default main region
+	certRegion = "us-east-1"  // Default cert region (needed for CloudFront)
+	if config.Regions != nil {
+		if config.Regions.Main != "" {
+			mainRegion = config.Regions.Main
+		}
+		if config.Regions.Certificate != "" {
+			certRegion = config.Regions.Certificate
+		}
+	}
+	return mainRegion, certRegion
+}
+
+// stacks returns the stacks of the delegation that were created
+func (d *DelegatedSubdomain) stacks() []awscdk.Stack {
+	var stacks []awscdk.Stack
+	for _, stack := range []awscdk.Stack{d.SecretsStack, d.DelegationSetStack, d.QueryLoggingStack, d.ZoneStack, d.Stack, d.CertificateStack, d.RegionalCertificateStack, d.CloudFrontStack, d.WebsiteStack, d.ApiGatewayDomainStack, d.SesIdentityStack, d.DashboardStack} {
+		if stack != nil {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+// constructLambdaSettings applies the defaults to the Lambda settings of a constructor, which
+// may be given settings NewDelegatedSubdomain hasn't defaulted, and keeps their source directory
+func constructLambdaSettings(settings *LambdaSettingsConfig) *LambdaSettingsConfig {
+	sourceDir := "lambda"
+	if settings != nil && settings.SourceDir != "" {
+		sourceDir = settings.SourceDir
+	}
+	return defaultLambdaSettings(settings, sourceDir)
+}
+
+// defaultLambdaSettings returns the Lambda settings with defaults applied
+func defaultLambdaSettings(settings *LambdaSettingsConfig, sourceDir string) *LambdaSettingsConfig {
+	lambdaTimeout := float64(120)      // Default timeout: 120 seconds
+	lambdaMemory := float64(256)       // Default memory: 256 MB
+	lambdaArchitecture := "x86_64"     // Default architecture: x86_64
+	lambdaRuntime := "provided.al2"    // Default runtime: Amazon Linux 2
+	var secretCacheTTL *int            // Default: Lambda's built-in cache TTL
+	var vpcConfig *VpcConfig           // Default: no VPC
+	var codeSigning *CodeSigningConfig // Default: no code signing
+	powertools := &PowertoolsConfig{ServiceName: "cftor53", MetricsNamespace: "cftor53"}
+	logLevel := "INFO"          // Default: no debug output
+	reservedConcurrency := 0    // Default: unreserved
+	provisionedConcurrency := 0 // Default: on-demand only
+	if settings != nil {
+		secretCacheTTL = settings.SecretCacheTTLSeconds
+		vpcConfig = settings.Vpc
+		codeSigning = settings.CodeSigning
+		if settings.Powertools != nil {
+			powertools.Tracing = settings.Powertools.Tracing
+			if settings.Powertools.ServiceName != "" {
+				powertools.ServiceName = settings.Powertools.ServiceName
+			}
+			if settings.Powertools.MetricsNamespace != "" {
+				powertools.MetricsNamespace = settings.Powertools.MetricsNamespace
+			}
+		}
+		if settings.Architecture != "" {
+			lambdaArchitecture = settings.Architecture
+		}
+		if settings.Runtime != "" {
+			lambdaRuntime = settings.Runtime
+		}
+		if settings.TimeoutSeconds > 0 {
+			lambdaTimeout = float64(settings.TimeoutSeconds)
+		}
+		if settings.MemorySizeMB > 0 {
+			lambdaMemory = float64(settings.MemorySizeMB)
+		}
+		reservedConcurrency = settings.ReservedConcurrency
+		provisionedConcurrency = settings.ProvisionedConcurrency
+		logLevel = lambdaLogLevel(settings.LogLevel)
+	}
+
+	return &LambdaSettingsConfig{
+		TimeoutSeconds:         int(lambdaTimeout),
+		MemorySizeMB:           int(lambdaMemory),
+		SecretCacheTTLSeconds:  secretCacheTTL,
+		Architecture:           lambdaArchitecture,
+		Runtime:                lambdaRuntime,
+		Vpc:                    vpcConfig,
+		ReservedConcurrency:    reservedConcurrency,
+		ProvisionedConcurrency: provisionedConcurrency,
+		CodeSigning:            codeSigning,
+		Powertools:             powertools,
+		LogLevel:               logLevel,
+		SourceDir:              sourceDir,
+	}
+}
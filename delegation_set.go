@@ -0,0 +1,67 @@
+package cftor53
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/customresources"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// DelegationSetConfig shares the name servers of a Route53 reusable delegation set
+// between the hosted zones of all delegated subdomains
+type DelegationSetConfig struct {
+	// ID of an existing reusable delegation set
+	ID string `json:"id,omitempty"`
+	// Create a reusable delegation set in a stack of its own
+	Create bool `json:"create,omitempty"`
+}
+
+// DelegationSetStackProps configures a stack holding a reusable delegation set
+type DelegationSetStackProps struct {
+	awscdk.StackProps
+}
+
+// NewDelegationSetStack creates a stack with a reusable delegation set and returns the
+// set's ID. CloudFormation has no delegation set resource, so the set is created through
+// the Route53 API and retained when the stack is deleted, keeping its name servers stable.
+func NewDelegationSetStack(scope constructs.Construct, id string, props *DelegationSetStackProps) (awscdk.Stack, *string) {
+	if props == nil {
+		props = &DelegationSetStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	delegationSet := customresources.NewAwsCustomResource(stack, jsii.String("ReusableDelegationSet"), &customresources.AwsCustomResourceProps{
+		OnCreate: &customresources.AwsSdkCall{
+			Service: jsii.String("Route53"),
+			Action:  jsii.String("createReusableDelegationSet"),
+			Parameters: map[string]interface{}{
+				// The stack ID ends in a UUID unique to each creation of the stack
+				"CallerReference": awscdk.Fn_Select(jsii.Number(2), awscdk.Fn_Split(jsii.String("/"), awscdk.Aws_STACK_ID(), nil)),
+			},
+			PhysicalResourceId: customresources.PhysicalResourceId_FromResponse(jsii.String("DelegationSet.Id")),
+		},
+		Policy: customresources.AwsCustomResourcePolicy_FromSdkCalls(&customresources.SdkCallsPolicyOptions{
+			Resources: customresources.AwsCustomResourcePolicy_ANY_RESOURCE(),
+		}),
+		RemovalPolicy:       awscdk.RemovalPolicy_RETAIN,
+		InstallLatestAwsSdk: jsii.Bool(false),
+	})
+
+	// The API returns the ID as /delegationset/<id>
+	delegationSetId := awscdk.Fn_Select(jsii.Number(2), awscdk.Fn_Split(jsii.String("/"), delegationSet.GetResponseField(jsii.String("DelegationSet.Id")), nil))
+	awscdk.NewCfnOutput(stack, jsii.String("DelegationSetId"), &awscdk.CfnOutputProps{
+		Value:       delegationSetId,
+		Description: jsii.String("ID of the reusable delegation set, for the delegation_set.id of other deployments"),
+	})
+
+	var nameServers []*string
+	for _, index := range []string{"0", "1", "2", "3"} {
+		nameServers = append(nameServers, delegationSet.GetResponseField(jsii.String("DelegationSet.NameServers."+index)))
+	}
+	awscdk.NewCfnOutput(stack, jsii.String("NameServers"), &awscdk.CfnOutputProps{
+		Value:       awscdk.Fn_Join(jsii.String(", "), &nameServers),
+		Description: jsii.String("Name servers shared by the hosted zones in the delegation set"),
+	})
+
+	return stack, delegationSetId
+}
@@ -0,0 +1,68 @@
+package cftor53
+
+import (
+	"strings"
+)
+
+// Delegation is a subdomain delegation of a configuration, with the settings of
+// NewDelegatedSubdomain resolved for tools that look it up in Cloudflare and Route53
+type Delegation struct {
+	// Configuration of the delegation, with the settings of its domain and subdomain applied
+	Config ConfigFile
+
+	MainRegion        string
+	CertificateRegion string
+
+	// Name of the token secret, unless Config.SecretArn is set, and the SSM parameter prefix
+	SecretName     string
+	SsmParamPrefix string
+}
+
+// FullDomainName returns the delegated name, e.g. sub.example.com
+func (d Delegation) FullDomainName() string {
+	return d.Config.Subdomain + "." + d.Config.ParentDomain
+}
+
+// ParameterName returns the name of an SSM parameter the stacks store for the delegation,
+// e.g. hostedZoneId or certificateArn
+func (d Delegation) ParameterName(name string) string {
+	return d.SsmParamPrefix + "/" + d.Config.Subdomain + "/" + strings.ReplaceAll(d.Config.ParentDomain, ".", "-") + "/" + name
+}
+
+// CertificateEnabled reports whether the stacks issue or publish a certificate for the delegation
+func (d Delegation) CertificateEnabled() bool {
+	return certificateEnabled(d.Config.Certificate)
+}
+
+// Delegations returns the delegations of the configuration, one for each subdomain of
+// Config.Domains or the one of ParentDomain and Subdomain. The configuration is not validated.
+func Delegations(config *ConfigFile) []Delegation {
+	var configs []ConfigFile
+	if len(config.Domains) == 0 {
+		single := *config
+		single.ParentDomain = asciiDomainName(single.ParentDomain)
+		single.Subdomain = asciiDomainName(single.Subdomain)
+		configs = append(configs, single)
+	}
+	for _, domain := range config.Domains {
+		domainConfig := domainDelegationConfig(*config, domain, domainsParentDomain(domain))
+		domainConfig.Domains = nil
+		for _, subdomain := range domain.Subdomains {
+			subdomainConfig := subdomainDelegationConfig(domainConfig, subdomain)
+			subdomainConfig.Subdomain = domainsSubdomain(subdomain)
+			configs = append(configs, subdomainConfig)
+		}
+	}
+
+	delegations := make([]Delegation, 0, len(configs))
+	for _, delegationConfig := range configs {
+		delegation := Delegation{Config: delegationConfig}
+		delegation.MainRegion, delegation.CertificateRegion = configRegions(&delegationConfig)
+		if delegationConfig.CertificateOnly {
+			delegation.MainRegion = delegation.CertificateRegion
+		}
+		delegation.SecretName, delegation.SsmParamPrefix = resourceNames(&delegationConfig)
+		delegations = append(delegations, delegation)
+	}
+	return delegations
+}
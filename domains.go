@@ -0,0 +1,213 @@
+package cftor53
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// DomainConfig is a Cloudflare domain with the subdomains delegated from it. The token,
+// secret and Cloudflare account settings override the top-level ones for the domain.
+type DomainConfig struct {
+	ParentDomain string            `json:"parent_domain"`
+	Subdomains   []SubdomainConfig `json:"subdomains"`
+	ApiToken     string            `json:"api_token,omitempty"`
+	SecretName   string            `json:"secret_name,omitempty"`
+	SecretArn    string            `json:"secret_arn,omitempty"`
+	AccountID    string            `json:"account_id,omitempty"`
+	ZoneID       string            `json:"zone_id,omitempty"`
+}
+
+// SubdomainConfig is a subdomain delegated from the Cloudflare domain. The settings given
+// override the top-level ones field by field.
+type SubdomainConfig struct {
+	Name           string                `json:"name"`
+	Regions        *RegionConfig         `json:"regions,omitempty"`
+	LambdaSettings *LambdaSettingsConfig `json:"lambda_settings,omitempty"`
+	NSRecordTTL    int                   `json:"ns_record_ttl,omitempty"`
+	Certificate    *CertificateConfig    `json:"certificate,omitempty"`
+	CloudFront     *CloudFrontConfig     `json:"cloudfront,omitempty"`
+	Website        *WebsiteConfig        `json:"website,omitempty"`
+	ApiGateway     *ApiGatewayConfig     `json:"api_gateway,omitempty"`
+	Ses            *SesConfig            `json:"ses,omitempty"`
+}
+
+// DelegatedDomainsProps configures the delegations of several Cloudflare domains
+type DelegatedDomainsProps struct {
+	// Configuration settings with domains, as read from config.json
+	Config *ConfigFile
+
+	// Directory of the Lambda module (default: "lambda", relative to the working directory)
+	LambdaSourceDir string
+}
+
+// NewDelegatedDomains adds the stacks delegating the subdomains of every domain in
+// Config.Domains to scope. Each domain gets a secrets stack named id + domain +
+// "SecretsStack" shared by its subdomains, and each subdomain the stacks of
+// NewDelegatedSubdomain, named after id and the subdomain's full name.
+func NewDelegatedDomains(scope constructs.Construct, id string, props *DelegatedDomainsProps) []*DelegatedSubdomain {
+	if props == nil {
+		props = &DelegatedDomainsProps{}
+	}
+	if err := validateProps(props.Config, props.Config != nil && len(props.Config.Domains) > 0, "Config with domains"); err != nil {
+		panic(err)
+	}
+	config := *props.Config
+	config.Domains = nil
+
+	var delegations []*DelegatedSubdomain
+	for _, domain := range props.Config.Domains {
+		parentDomain := domainsParentDomain(domain)
+		domainConfig := domainDelegationConfig(config, domain, parentDomain)
+
+		// The secret is created in the main region of the first subdomain and replicated
+		// to those of the others
+		for _, subdomain := range domain.Subdomains {
+			mainRegion, _ := configRegions(&ConfigFile{Regions: mergeSettings(config.Regions, subdomain.Regions)})
+			domainConfig.SecretReplicas = append(append([]string{}, domainConfig.SecretReplicas...), mainRegion)
+		}
+		secretsStackID := id + domainStackID(parentDomain) + "SecretsStack"
+		if config.Stage != "" {
+			secretsStackID = stageStackID(id, &ConfigFile{Stage: config.Stage, Subdomain: parentDomain}) + "SecretsStack"
+		}
+
+		// The first subdomain creates the domain's secret, the others share it
+		var first *DelegatedSubdomain
+		for _, subdomain := range domain.Subdomains {
+			name := domainsSubdomain(subdomain)
+			subdomainConfig := subdomainDelegationConfig(domainConfig, subdomain)
+			subdomainConfig.Subdomain = name
+			// The subdomains share the dashboard of the domains
+			subdomainConfig.Dashboard = nil
+			delegationProps := &DelegatedSubdomainProps{
+				Config:          &subdomainConfig,
+				LambdaSourceDir: props.LambdaSourceDir,
+				SecretsStackID:  secretsStackID,
+			}
+			if first != nil {
+				delegationProps.CloudflareApiTokenSecret = first.CloudflareApiTokenSecret
+			}
+			// The stacks of a stage are named after the subdomain alone
+			subdomainID := id + domainStackID(name+"."+parentDomain)
+			if config.Stage != "" {
+				subdomainID = id
+			}
+			delegation := NewDelegatedSubdomain(scope, subdomainID, delegationProps)
+			if first == nil {
+				first = delegation
+			}
+			delegations = append(delegations, delegation)
+		}
+	}
+
+	if config.Dashboard != nil && config.Dashboard.Enabled {
+		dashboardID := id + "DashboardStack"
+		if config.Stage != "" {
+			dashboardID = id + "-" + config.Stage + "-DashboardStack"
+		}
+		all := Delegations(props.Config)
+		stack := NewDashboardStack(scope, stackID(config.Namespace, dashboardID), &DashboardStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Region: jsii.String(all[0].MainRegion),
+				},
+				Synthesizer: stackSynthesizer(config.CloudFormation),
+			},
+			Delegations: all,
+			Config:      props.Config,
+		})
+		applyPermissionsBoundary(stack, config.PermissionsBoundaryArn)
+		applyTags(stack, config.Tags)
+		delegations[0].DashboardStack = stack
+	}
+	return delegations
+}
+
+// domainsParentDomain returns the parent domain of a domain of Config.Domains in lower case
+// punycode
+func domainsParentDomain(domain DomainConfig) string {
+	return asciiDomainName(strings.ToLower(strings.TrimSuffix(domain.ParentDomain, ".")))
+}
+
+// domainsSubdomain returns the name of a subdomain of Config.Domains in lower case punycode
+func domainsSubdomain(subdomain SubdomainConfig) string {
+	return asciiDomainName(strings.ToLower(strings.Trim(subdomain.Name, ".")))
+}
+
+// domainDelegationConfig returns the configuration of the domain's delegations, with the
+// domain's settings overriding the top-level ones
+func domainDelegationConfig(config ConfigFile, domain DomainConfig, parentDomain string) ConfigFile {
+	config.ParentDomain = parentDomain
+	if domain.ApiToken != "" {
+		config.ApiToken = domain.ApiToken
+	}
+	if domain.SecretArn != "" {
+		config.SecretArn = domain.SecretArn
+	}
+	if domain.AccountID != "" {
+		config.AccountID = domain.AccountID
+	}
+	if domain.ZoneID != "" {
+		config.ZoneID = domain.ZoneID
+	}
+
+	// Each domain has a token secret of its own, by default named after the domain
+	secretName, _ := resourceNames(&ConfigFile{Namespace: config.Namespace, Stage: config.Stage})
+	config.SecretName = strings.TrimSuffix(secretName, "cloudflare/api-token") + parentDomain + "/cloudflare/api-token"
+	if domain.SecretName != "" {
+		config.SecretName = domain.SecretName
+	}
+	return config
+}
+
+// subdomainDelegationConfig returns the configuration of the subdomain's delegation, with
+// the subdomain's settings overriding those of the domain
+func subdomainDelegationConfig(config ConfigFile, subdomain SubdomainConfig) ConfigFile {
+	config.Regions = mergeSettings(config.Regions, subdomain.Regions)
+	config.LambdaSettings = mergeSettings(config.LambdaSettings, subdomain.LambdaSettings)
+	config.Certificate = mergeSettings(config.Certificate, subdomain.Certificate)
+	config.CloudFront = mergeSettings(config.CloudFront, subdomain.CloudFront)
+	config.Website = mergeSettings(config.Website, subdomain.Website)
+	config.ApiGateway = mergeSettings(config.ApiGateway, subdomain.ApiGateway)
+	config.Ses = mergeSettings(config.Ses, subdomain.Ses)
+	if subdomain.NSRecordTTL != 0 {
+		config.NSRecordTTL = subdomain.NSRecordTTL
+	}
+	return config
+}
+
+// mergeSettings returns a copy of base with the fields set in override replacing its own,
+// merging nested settings the same way. Neither is modified.
+func mergeSettings[T any](base, override *T) *T {
+	if override == nil {
+		return base
+	}
+	merged := new(T)
+	for _, settings := range []*T{base, override} {
+		if settings == nil {
+			continue
+		}
+		data, err := json.Marshal(settings)
+		if err != nil {
+			panic("Failed to merge settings: " + err.Error())
+		}
+		if err := json.Unmarshal(data, merged); err != nil {
+			panic("Failed to merge settings: " + err.Error())
+		}
+	}
+	return merged
+}
+
+// domainStackID returns the part of a stack ID for a domain name, e.g. SubExampleCom
+func domainStackID(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if label != "" {
+			labels[i] = strings.ToUpper(label[:1]) + label[1:]
+		}
+	}
+	return strings.Join(labels, "")
+}
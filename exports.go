@@ -0,0 +1,79 @@
+package cftor53
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Outputs that can be exported, keyed as in ExportsConfig.Names
+const (
+	ExportHostedZoneID           = "hosted_zone_id"
+	ExportHostedZoneArn          = "hosted_zone_arn"
+	ExportZoneName               = "zone_name"
+	ExportNameServers            = "name_servers"
+	ExportCertificateArn         = "certificate_arn"
+	ExportRegionalCertificateArn = "regional_certificate_arn"
+)
+
+var exportSuffixes = map[string]string{
+	ExportHostedZoneID:           "HostedZoneId",
+	ExportHostedZoneArn:          "HostedZoneArn",
+	ExportZoneName:               "ZoneName",
+	ExportNameServers:            "NameServers",
+	ExportCertificateArn:         "CertificateArn",
+	ExportRegionalCertificateArn: "RegionalCertificateArn",
+}
+
+// CloudFormation export names may only contain letters, digits, colons and hyphens
+var exportNamePattern = regexp.MustCompile(`^[A-Za-z0-9:-]{1,255}$`)
+
+// ExportsConfig exports the outputs of the stacks for Fn::ImportValue in other stacks
+type ExportsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Prefix of the export names, by default "cftor53-" and the subdomain's full name with hyphens
+	Prefix string `json:"prefix,omitempty"`
+	// Export names replacing the prefixed ones, keyed by hosted_zone_id, hosted_zone_arn,
+	// zone_name, name_servers, certificate_arn or regional_certificate_arn
+	Names map[string]string `json:"names,omitempty"`
+}
+
+// exportsProblems returns the problems of unknown outputs and invalid export names
+func exportsProblems(exports *ExportsConfig) []string {
+	if exports == nil {
+		return nil
+	}
+	var problems []string
+	if exports.Prefix != "" && !exportNamePattern.MatchString(exports.Prefix) {
+		problems = append(problems, "Invalid exports.prefix: "+exports.Prefix)
+	}
+	for _, key := range tagKeys(exports.Names) {
+		if _, ok := exportSuffixes[key]; !ok {
+			problems = append(problems, "Invalid exports.names key: "+key)
+		} else if name := exports.Names[key]; !exportNamePattern.MatchString(name) {
+			problems = append(problems, "Invalid exports.names."+key+": "+name)
+		}
+	}
+	return problems
+}
+
+// exportName returns the export name of an output of the subdomain, or nil when exports
+// are not enabled
+func exportName(exports *ExportsConfig, key, fullDomainName string) *string {
+	if exports == nil || !exports.Enabled {
+		return nil
+	}
+	if name, ok := exports.Names[key]; ok {
+		return jsii.String(name)
+	}
+	prefix := exports.Prefix
+	if prefix == "" {
+		if *awscdk.Token_IsUnresolved(jsii.String(fullDomainName)) {
+			panic("exports requires exports.prefix when the subdomain is a parameter")
+		}
+		prefix = "cftor53-" + strings.ReplaceAll(strings.ToLower(fullDomainName), ".", "-")
+	}
+	return jsii.String(prefix + "-" + exportSuffixes[key])
+}
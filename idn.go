@@ -0,0 +1,50 @@
+package cftor53
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// ASCIIDomainName returns an internationalized domain name in punycode, the form Cloudflare,
+// Route53 and CloudFormation know it by, e.g. xn--mnchen-3ya.example.com for
+// münchen.example.com. ASCII names are returned unchanged, and invalid names with an error.
+func ASCIIDomainName(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return name, err
+	}
+	if strings.HasSuffix(name, ".") {
+		ascii += "."
+	}
+	return ascii, nil
+}
+
+// asciiDomainName returns the punycode of a name, or the name itself when it isn't a valid
+// internationalized domain name, which idnProblem reports
+func asciiDomainName(name string) string {
+	ascii, _ := ASCIIDomainName(name)
+	return ascii
+}
+
+// idnProblem returns the problem of a field with a name that can't be converted to punycode,
+// or "" if it can
+func idnProblem(field, name string) string {
+	if _, err := ASCIIDomainName(name); err != nil {
+		return "Invalid " + field + ": " + name + " (" + err.Error() + ")"
+	}
+	return ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+)
+
+// Certificate-only mode: instead of delegating the subdomain, the Lambda requests an ACM
+// certificate for it and creates the DNS validation CNAMEs directly in Cloudflare.
+
+// certificatePollInterval is how often the certificate status is checked
+const certificatePollInterval = 10 * time.Second
+
+// certificateProperties are the properties that, when changed, require a new certificate
+var certificateProperties = []string{"Domain", "Subdomain", "SubjectAlternativeNames", "KeyAlgorithm", "TransparencyLogging"}
+
+// handleCertificate requests, keeps or deletes the certificate of the subdomain. The
+// certificate ARN is the physical resource ID, so CloudFormation deletes the old
+// certificate after a replacement.
+func (h *handler) handleCertificate(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	if !props.hasTokenSource() || props.Domain == "" || props.Subdomain == "" {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to create AWS session: %v", err), nil)
+	}
+	client := acm.New(sess)
+
+	switch event.RequestType {
+	case "Delete":
+		return h.deleteCertificate(ctx, event, client)
+	case "Update":
+		if strings.HasPrefix(event.PhysicalResourceId, "arn:") && !certificateReplacementNeeded(event) {
+			return h.sendResponse(event, "SUCCESS", "Certificate unchanged", &ResponseData{Domain: props.Domain, Subdomain: props.Subdomain, CertificateArn: event.PhysicalResourceId})
+		}
+	}
+	return h.requestCertificate(ctx, event, client)
+}
+
+// certificateReplacementNeeded reports whether properties of the certificate changed
+func certificateReplacementNeeded(event CloudFormationEvent) bool {
+	current := map[string]interface{}{
+		"Domain":                  event.ResourceProperties.Domain,
+		"Subdomain":               event.ResourceProperties.Subdomain,
+		"SubjectAlternativeNames": event.ResourceProperties.SubjectAlternativeNames,
+		"KeyAlgorithm":            event.ResourceProperties.KeyAlgorithm,
+		"TransparencyLogging":     event.ResourceProperties.TransparencyLogging,
+	}
+	for _, name := range certificateProperties {
+		if propertyString(current[name]) != propertyString(event.OldResourceProperties[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyString formats a property for comparison, treating a missing one as empty
+func propertyString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(v, ",")
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// requestCertificate requests the certificate, creates its validation records in Cloudflare
+// and waits for ACM to issue it
+func (h *handler) requestCertificate(ctx context.Context, event CloudFormationEvent, client *acm.ACM) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	logger.Info("Requesting certificate validated in Cloudflare", "name", fullDomainName)
+
+	api, zoneID, err := h.connectCloudflare(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
+	}
+
+	input := &acm.RequestCertificateInput{
+		DomainName:       aws.String(fullDomainName),
+		ValidationMethod: aws.String(acm.ValidationMethodDns),
+		// Retried requests of the same event get the same certificate
+		IdempotencyToken: aws.String(idempotencyToken(event.RequestId)),
+	}
+	if len(props.SubjectAlternativeNames) > 0 {
+		input.SubjectAlternativeNames = aws.StringSlice(append([]string{fullDomainName}, props.SubjectAlternativeNames...))
+	}
+	if props.KeyAlgorithm != "" {
+		input.KeyAlgorithm = aws.String(props.KeyAlgorithm)
+	}
+	if props.TransparencyLogging != "" {
+		input.Options = &acm.CertificateOptions{CertificateTransparencyLoggingPreference: aws.String(props.TransparencyLogging)}
+	}
+	output, err := client.RequestCertificateWithContext(ctx, input)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to request certificate: %v", err), nil)
+	}
+	certificateArn := aws.StringValue(output.CertificateArn)
+	event.PhysicalResourceId = certificateArn
+	logger.Info("Requested certificate", "certificate_arn", certificateArn)
+
+	// ACM adds the validation records to the certificate shortly after the request
+	var records []*acm.ResourceRecord
+	for {
+		records, err = validationRecords(ctx, client, certificateArn)
+		if err != nil {
+			return h.sendResponse(event, "FAILED", err.Error(), nil)
+		}
+		if records != nil {
+			break
+		}
+		if err := waitForCertificate(ctx); err != nil {
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Validation records of %s did not appear in time", certificateArn), nil)
+		}
+	}
+
+	errs := forEachParallel(ctx, len(records), func(i int) error {
+		return upsertValidationRecord(ctx, api, zoneID, records[i])
+	})
+	if err := aggregateErrors(errs); err != nil {
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
+	}
+	metrics.Add("ValidationRecordsCreated", float64(len(records)))
+
+	for {
+		certificate, err := client.DescribeCertificateWithContext(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+		if err != nil {
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to describe certificate %s: %v", certificateArn, err), nil)
+		}
+		switch aws.StringValue(certificate.Certificate.Status) {
+		case acm.CertificateStatusIssued:
+			return h.sendResponse(event, "SUCCESS", "Certificate issued", &ResponseData{Domain: props.Domain, Subdomain: props.Subdomain, CertificateArn: certificateArn})
+		case acm.CertificateStatusPendingValidation:
+		default:
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Certificate %s is %s: %s", certificateArn, aws.StringValue(certificate.Certificate.Status), aws.StringValue(certificate.Certificate.FailureReason)), nil)
+		}
+		if err := waitForCertificate(ctx); err != nil {
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Certificate %s was not issued before the Lambda timeout, raise lambda_settings.timeout_seconds", certificateArn), nil)
+		}
+	}
+}
+
+// idempotencyToken returns an ACM idempotency token, at most 32 alphanumeric characters
+func idempotencyToken(requestID string) string {
+	token := strings.ReplaceAll(requestID, "-", "")
+	if len(token) > 32 {
+		token = token[:32]
+	}
+	return token
+}
+
+// waitForCertificate waits for the next poll, failing when the Lambda is about to time out
+func waitForCertificate(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < certificatePollInterval+10*time.Second {
+		return fmt.Errorf("deadline exceeded")
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(certificatePollInterval):
+		return nil
+	}
+}
+
+// validationRecords returns the distinct DNS validation records of the certificate, or nil
+// while ACM has not added all of them yet
+func validationRecords(ctx context.Context, client *acm.ACM, certificateArn string) ([]*acm.ResourceRecord, error) {
+	certificate, err := client.DescribeCertificateWithContext(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe certificate %s: %w", certificateArn, err)
+	}
+
+	records := []*acm.ResourceRecord{}
+	seen := map[string]bool{}
+	for _, option := range certificate.Certificate.DomainValidationOptions {
+		if option.ResourceRecord == nil {
+			return nil, nil
+		}
+		// A wildcard name shares the validation record of its base name
+		name := aws.StringValue(option.ResourceRecord.Name)
+		if !seen[name] {
+			seen[name] = true
+			records = append(records, option.ResourceRecord)
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records, nil
+}
+
+// upsertValidationRecord creates the validation CNAME in Cloudflare unless it exists
+func upsertValidationRecord(ctx context.Context, api cloudflareAPI, zoneID string, record *acm.ResourceRecord) error {
+	name := strings.TrimSuffix(aws.StringValue(record.Name), ".")
+	value := strings.TrimSuffix(aws.StringValue(record.Value), ".")
+
+	existing, err := api.ListDNSRecords(ctx, zoneID, name)
+	if err != nil {
+		return fmt.Errorf("failed to check DNS records: %v", err)
+	}
+	for _, current := range existing {
+		if current.Type == dns.RecordTypeCNAME && strings.EqualFold(strings.TrimSuffix(recordContent(current), "."), value) {
+			logger.Info("Validation record exists", "name", name)
+			return nil
+		}
+	}
+
+	_, err = api.NewDNSRecord(ctx, dns.RecordNewParams{
+		ZoneID: cloudflare.F(zoneID),
+		Record: dns.CNAMERecordParam{
+			Type:    cloudflare.F(dns.CNAMERecordTypeCNAME),
+			Name:    cloudflare.F(name),
+			Content: cloudflare.F[interface{}](value),
+			Proxied: cloudflare.F(false),
+			TTL:     cloudflare.F(dns.TTL(300)),
+			Comment: cloudflare.F("ACM validation managed by cftor53"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create validation record %s: %v", name, err)
+	}
+	logger.Info("Created validation record", "name", name)
+	return nil
+}
+
+// deleteCertificate removes the validation records from Cloudflare and deletes the certificate
+func (h *handler) deleteCertificate(ctx context.Context, event CloudFormationEvent, client *acm.ACM) error {
+	certificateArn := event.PhysicalResourceId
+	if !strings.HasPrefix(certificateArn, "arn:") {
+		// The certificate was never requested
+		return h.sendResponse(event, "SUCCESS", "Resource deleted", nil)
+	}
+
+	records, err := validationRecords(ctx, client, certificateArn)
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == acm.ErrCodeResourceNotFoundException {
+			return h.sendResponse(event, "SUCCESS", "Certificate already deleted", nil)
+		}
+		logger.Warn("Could not read the validation records", "certificate_arn", certificateArn, "error", err)
+	}
+	if len(records) > 0 {
+		api, zoneID, err := h.connectCloudflare(ctx, event.ResourceProperties)
+		if err != nil {
+			return h.sendResponse(event, "FAILED", err.Error(), nil)
+		}
+		errs := forEachParallel(ctx, len(records), func(i int) error {
+			return deleteValidationRecord(ctx, api, zoneID, records[i])
+		})
+		if err := aggregateErrors(errs); err != nil {
+			return h.sendResponse(event, "FAILED", err.Error(), nil)
+		}
+	}
+
+	_, err = client.DeleteCertificateWithContext(ctx, &acm.DeleteCertificateInput{CertificateArn: aws.String(certificateArn)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == acm.ErrCodeResourceNotFoundException {
+			return h.sendResponse(event, "SUCCESS", "Certificate already deleted", nil)
+		}
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to delete certificate %s, it may still be in use: %v", certificateArn, err), nil)
+	}
+	return h.sendResponse(event, "SUCCESS", "Certificate deleted", nil)
+}
+
+// deleteValidationRecord removes the validation CNAME from Cloudflare if it exists
+func deleteValidationRecord(ctx context.Context, api cloudflareAPI, zoneID string, record *acm.ResourceRecord) error {
+	name := strings.TrimSuffix(aws.StringValue(record.Name), ".")
+	value := strings.TrimSuffix(aws.StringValue(record.Value), ".")
+
+	existing, err := api.ListDNSRecords(ctx, zoneID, name)
+	if err != nil {
+		return fmt.Errorf("failed to check DNS records: %v", err)
+	}
+	for _, current := range existing {
+		if current.Type != dns.RecordTypeCNAME || !strings.EqualFold(strings.TrimSuffix(recordContent(current), "."), value) {
+			continue
+		}
+		if err := api.DeleteDNSRecord(ctx, zoneID, current.ID); err != nil {
+			return fmt.Errorf("failed to delete validation record %s: %v", name, err)
+		}
+		logger.Info("Deleted validation record", "name", name)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// With the ProviderFramework property, the CDK Provider framework serves the update resource
+// and responds to CloudFormation itself. Its onEvent call updates the NS records as usual and
+// returns the physical ID and Data, and its isComplete calls, which carry that Data, poll the
+// authoritative name servers of the parent zone until each of them refers the subdomain to
+// the hosted zone's name servers.
+
+// dnsTimeout bounds each query of an authoritative name server, including its retry
+const dnsTimeout = 5 * time.Second
+
+// providerEventResult is the result of the onEvent call of the Provider framework, whose
+// fields the framework adds to the event of each isComplete call
+type providerEventResult struct {
+	PhysicalResourceId   string        `json:"PhysicalResourceId"`
+	Data                 *ResponseData `json:"Data,omitempty"`
+	PropagationStartedAt string        `json:"PropagationStartedAt,omitempty"`
+}
+
+// isCompleteResult is the result of the isComplete call of the Provider framework, whose
+// Data is added to the Data of onEvent
+type isCompleteResult struct {
+	IsComplete bool          `json:"IsComplete"`
+	Data       *ResponseData `json:"Data,omitempty"`
+}
+
+// parentDNS looks up and queries the authoritative name servers of the parent zone
+type parentDNS interface {
+	// LookupNS returns the name servers of the zone, none when the name is not a zone
+	LookupNS(ctx context.Context, zone string) ([]string, error)
+	// DelegationNS asks the server, without recursion, for the NS records of the name and
+	// returns the name servers of its answer or referral
+	DelegationNS(ctx context.Context, server, name string) ([]string, error)
+}
+
+// HandleEvent handles the custom resource events and direct invocations, and the onEvent
+// and isComplete calls of the Provider framework, which are told apart by the Data of onEvent
+func (h *handler) HandleEvent(ctx context.Context, event CloudFormationEvent) (interface{}, error) {
+	if event.ResourceProperties.ProviderFramework != "true" {
+		return h.HandleRequest(ctx, event)
+	}
+	if event.Data != nil {
+		return h.HandleIsComplete(ctx, event)
+	}
+	return h.HandleProviderEvent(ctx, event)
+}
+
+// HandleProviderEvent handles the onEvent call of the Provider framework, returning the
+// outcome instead of sending it to the ResponseURL, which the framework keeps to itself
+func (h *handler) HandleProviderEvent(ctx context.Context, event CloudFormationEvent) (*providerEventResult, error) {
+	var physicalResourceID string
+	event.ResponseURL = ""
+	event.result = &ResponseData{}
+	event.resultPhysicalID = &physicalResourceID
+	if err := h.handleRequest(ctx, event); err != nil {
+		return nil, err
+	}
+	return &providerEventResult{
+		PhysicalResourceId:   physicalResourceID,
+		Data:                 event.result,
+		PropagationStartedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// HandleIsComplete reports whether every authoritative name server of the parent zone already
+// refers the subdomain to the hosted zone's name servers, with the progress in Data. Servers
+// that can't be reached count as pending, until the PropagationTimeoutSeconds since onEvent
+// run out and the update fails.
+func (h *handler) HandleIsComplete(ctx context.Context, event CloudFormationEvent) (*isCompleteResult, error) {
+	props, err := asciiDomainNames(event.ResourceProperties)
+	if err != nil || event.RequestType == "Delete" || props.Action != "update" {
+		return &isCompleteResult{IsComplete: true}, nil
+	}
+
+	name := delegationName(props)
+	zone, servers, err := h.parentZoneServers(ctx, props)
+	if err != nil {
+		logger.Warn("Failed to look up the parent zone", "name", name, "error", err)
+		if propagationTimedOut(event) {
+			return nil, fmt.Errorf("failed to look up the parent zone of %s after %ds: %v", name, int(propagationTimeout(props).Seconds()), err)
+		}
+		return &isCompleteResult{IsComplete: false}, nil
+	}
+
+	var serving, pending []string
+	for _, server := range servers {
+		referred, err := h.parentDNS.DelegationNS(ctx, server, name)
+		if err != nil {
+			logger.Warn("Failed to query the parent zone's name server", "server", server, "error", err)
+			pending = append(pending, server)
+			continue
+		}
+		if missing, extra := delegationDifference(props, referred); len(missing) > 0 || len(extra) > 0 {
+			logger.Debug("Parent zone's name server refers to other name servers", "server", server, "name_servers", referred)
+			pending = append(pending, server)
+			continue
+		}
+		serving = append(serving, server)
+	}
+	logger.Info("Checked the delegation at the parent zone", "name", name, "zone", zone, "serving", len(serving), "pending", len(pending))
+	if len(pending) > 0 && propagationTimedOut(event) {
+		return nil, fmt.Errorf("delegation of %s is not served by %s after %ds", name, strings.Join(pending, ","), int(propagationTimeout(props).Seconds()))
+	}
+	return &isCompleteResult{
+		IsComplete: len(pending) == 0,
+		Data: &ResponseData{
+			ParentServersServing: strings.Join(serving, ","),
+			ParentServersPending: strings.Join(pending, ","),
+		},
+	}, nil
+}
+
+// propagationTimedOut reports whether the next isComplete call would come after the
+// PropagationTimeoutSeconds since onEvent started the polling
+func propagationTimedOut(event CloudFormationEvent) bool {
+	started, err := time.Parse(time.RFC3339, event.PropagationStartedAt)
+	if err != nil {
+		return false
+	}
+	props := event.ResourceProperties
+	return time.Since(started)+pollInterval(props) > propagationTimeout(props)
+}
+
+// parentZoneServers returns the closest zone above the subdomain, up to the domain, and its
+// name servers, so that a nested subdomain is checked at its parent hosted zone
+func (h *handler) parentZoneServers(ctx context.Context, props CloudflareDNSProperties) (string, []string, error) {
+	domain := strings.ToLower(strings.Trim(props.Domain, "."))
+	labels := strings.Split(strings.ToLower(strings.Trim(props.Subdomain, ".")), ".")
+	for i := 1; i <= len(labels); i++ {
+		zone := strings.Join(append(labels[i:], domain), ".")
+		servers, err := h.parentDNS.LookupNS(ctx, zone)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(servers) > 0 {
+			return zone, servers, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no name servers found for %s", domain)
+}
+
+// udpDNS implements parentDNS with the resolver of the Lambda environment and plain DNS
+// queries of the authoritative name servers
+type udpDNS struct{}
+
+func (udpDNS) LookupNS(ctx context.Context, zone string) ([]string, error) {
+	records, err := net.DefaultResolver.LookupNS(ctx, zone)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, record := range records {
+		servers = append(servers, normalizeNameServer(record.Host))
+	}
+	sort.Strings(servers)
+	return servers, nil
+}
+
+func (udpDNS) DelegationNS(ctx context.Context, server, name string) ([]string, error) {
+	response, err := queryAuthoritative(ctx, server, name)
+	if err != nil {
+		return nil, err
+	}
+	return referralNameServers(response, name), nil
+}
+
+// queryAuthoritative asks the server over UDP for the NS records of the name, without recursion
+func queryAuthoritative(ctx context.Context, server, name string) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %s: %v", name, err)
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", server, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+
+	// UDP queries get lost, so the query is sent again once halfway through the timeout
+	buf := make([]byte, 4096)
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, fmt.Errorf("failed to query %s: %v", server, err)
+		}
+		readDeadline := deadline
+		if attempt == 0 {
+			readDeadline = time.Now().Add(dnsTimeout / 2)
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, err
+		}
+
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no answer from %s: %v", server, err)
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil {
+			return nil, fmt.Errorf("invalid answer from %s: %v", server, err)
+		}
+		if response.ID != id {
+			return nil, fmt.Errorf("mismatched answer from %s", server)
+		}
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("%s answered %s", server, strings.TrimPrefix(response.RCode.String(), "RCode"))
+		}
+		return &response, nil
+	}
+}
+
+// referralNameServers returns the name servers of the name's NS records in the answer or, for
+// a referral to the child zone, the authority section of a response, sorted
+func referralNameServers(response *dnsmessage.Message, name string) []string {
+	var nameServers []string
+	for _, section := range [][]dnsmessage.Resource{response.Answers, response.Authorities} {
+		for _, resource := range section {
+			ns, ok := resource.Body.(*dnsmessage.NSResource)
+			if ok && normalizeNameServer(resource.Header.Name.String()) == normalizeNameServer(name) {
+				nameServers = append(nameServers, normalizeNameServer(ns.NS.String()))
+			}
+		}
+	}
+	sort.Strings(nameServers)
+	return nameServers
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+)
+
+// ResponseData is the Data the custom resources return to CloudFormation, retrievable with
+// Fn::GetAtt under the JSON names. Every value is a string, so that any of them can be used
+// where CloudFormation expects one, lists are comma-separated and empty values are left out.
+type ResponseData struct {
+	// Cloudflare domain and the delegated subdomain
+	Domain    string `json:"Domain,omitempty"`
+	Subdomain string `json:"Subdomain,omitempty"`
+	// Cloudflare zone ID of the domain
+	ZoneID string `json:"ZoneID,omitempty"`
+	// Route53 hosted zone holding the NS records of a nested subdomain instead of Cloudflare
+	ParentHostedZoneID string `json:"ParentHostedZoneId,omitempty"`
+	// Route53 hosted zone of the subdomain, when the Lambda knows it
+	HostedZoneID string `json:"HostedZoneId,omitempty"`
+	// Name servers of the hosted zone without trailing dots
+	NameServers string `json:"NameServers,omitempty"`
+	// Numbers of NS records added and deleted by the update
+	RecordsAdded   string `json:"RecordsAdded,omitempty"`
+	RecordsDeleted string `json:"RecordsDeleted,omitempty"`
+	// Cloudflare IDs of the subdomain's NS records after the update, or of those a plan removes
+	RecordIds string `json:"RecordIds,omitempty"`
+	// Name servers a plan adds and removes
+	NameServersToAdd    string `json:"NameServersToAdd,omitempty"`
+	NameServersToRemove string `json:"NameServersToRemove,omitempty"`
+	// Certificate requested with the certificate action
+	CertificateArn string `json:"CertificateArn,omitempty"`
+	// Errors that did not fail the update, separated by semicolons
+	Warnings string `json:"Warnings,omitempty"`
+	// Records that failed the check by colliding with the delegation, separated by semicolons
+	CollidingRecords string `json:"CollidingRecords,omitempty"`
+	// Proxied records at or below the subdomain found by the check, separated by semicolons
+	ProxiedRecords string `json:"ProxiedRecords,omitempty"`
+	// Name servers of the parent zone already serving the delegation and those that are not yet,
+	// checked by isComplete with the Provider framework
+	ParentServersServing string `json:"ParentServersServing,omitempty"`
+	ParentServersPending string `json:"ParentServersPending,omitempty"`
+	// Values shortened to fit the CloudFormation response limit, and the S3 location of the
+	// full Data when the SpillBucket property is set
+	DataTruncated string `json:"DataTruncated,omitempty"`
+	DataLocation  string `json:"DataLocation,omitempty"`
+}
+
+// joinNameServers returns the name servers without trailing dots, comma-separated
+func joinNameServers(nameServers []string) string {
+	var clean []string
+	for _, ns := range nameServers {
+		clean = append(clean, strings.TrimSuffix(ns, "."))
+	}
+	return strings.Join(clean, ",")
+}
+
+// describeRecordDetails returns the type, name, content, ID and proxied flag of each
+// record, for the operator to act on them without looking them up in Cloudflare
+func describeRecordDetails(records []dns.Record) string {
+	var described []string
+	for _, record := range records {
+		described = append(described, fmt.Sprintf("%s %s %q (ID %s, proxied %t)", record.Type, record.Name, recordContent(record), record.ID, record.Proxied))
+	}
+	return strings.Join(described, "; ")
+}
+
+// keptRecordIds returns the IDs of the existing records that are not removed
+func keptRecordIds(existing, removed []dns.Record) []string {
+	removedIds := map[string]bool{}
+	for _, record := range removed {
+		removedIds[record.ID] = true
+	}
+	var ids []string
+	for _, record := range existing {
+		if !removedIds[record.ID] {
+			ids = append(ids, record.ID)
+		}
+	}
+	return ids
+}
+
+// managedRecords returns the NS records a delegation has after an update: the existing ones
+// that were kept or failed to be deleted, and the created ones
+func managedRecords(existing, removed, undeleted, created []dns.Record) []dns.Record {
+	gone := map[string]bool{}
+	for _, record := range removed {
+		gone[record.ID] = true
+	}
+	for _, record := range undeleted {
+		gone[record.ID] = false
+	}
+	var records []dns.Record
+	for _, record := range existing {
+		if !gone[record.ID] {
+			records = append(records, record)
+		}
+	}
+	return append(records, created...)
+}
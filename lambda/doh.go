@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The propagation of a delegation is verified through the JSON API of DNS-over-HTTPS
+// resolvers rather than plain DNS, since functions in locked-down VPCs often may only
+// reach the internet over HTTPS, without UDP or TCP egress on port 53.
+
+// dohTimeout bounds each query of a resolver
+const dohTimeout = 5 * time.Second
+
+// Defaults of the PropagationTimeoutSeconds and PollIntervalSeconds properties
+const (
+	defaultPropagationTimeout = 30 * time.Minute
+	defaultPollInterval       = 10 * time.Second
+)
+
+// propagationWaitReserve is the time left to the invocation for its response after waiting
+const propagationWaitReserve = 15 * time.Second
+
+// Numbers of the record types in DNS answers
+const (
+	dnsTypeNS  = 2
+	dnsTypeSOA = 6
+)
+
+// DNS response codes of the answers
+const (
+	dnsNoError  = 0
+	dnsNXDomain = 3
+)
+
+// dohAnswer is the part of a DNS-over-HTTPS JSON answer the verification reads
+type dohAnswer struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Name string `json:"name"`
+		Type int    `json:"type"`
+		TTL  int    `json:"TTL"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// queryDoH queries a DNS-over-HTTPS resolver for the records of the type, e.g. NS, of the name
+func (h *handler) queryDoH(ctx context.Context, endpoint, name, recordType string) (*dohAnswer, error) {
+	ctx, cancel := context.WithTimeout(ctx, dohTimeout)
+	defer cancel()
+
+	query := url.Values{"name": {name}, "type": {recordType}}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver %s: %v", endpoint, err)
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := h.doh.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query %s: %s", endpoint, resp.Status)
+	}
+
+	var answer dohAnswer
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid answer from %s: %v", endpoint, err)
+	}
+	return &answer, nil
+}
+
+// lookupNameServers queries a DNS-over-HTTPS resolver for the NS records of the name and
+// returns the name servers it answers with, none for NXDOMAIN
+func (h *handler) lookupNameServers(ctx context.Context, endpoint, name string) ([]string, error) {
+	answer, err := h.queryDoH(ctx, endpoint, name, "NS")
+	if err != nil {
+		return nil, err
+	}
+	switch answer.Status {
+	case dnsNoError:
+	case dnsNXDomain:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s answered with DNS error %d", endpoint, answer.Status)
+	}
+
+	var nameServers []string
+	for _, record := range answer.Answer {
+		if record.Type == dnsTypeNS && normalizeNameServer(record.Name) == normalizeNameServer(name) {
+			nameServers = append(nameServers, normalizeNameServer(record.Data))
+		}
+	}
+	sort.Strings(nameServers)
+	return nameServers, nil
+}
+
+// verifyPropagation checks that the resolvers of DoHEndpoints answer with exactly the name
+// servers of the delegation for the name, or with at least them in append mode. Resolvers
+// that can't be reached are skipped, as long as one answers.
+func (h *handler) verifyPropagation(ctx context.Context, props CloudflareDNSProperties, name string) error {
+	endpoints := props.DoHEndpoints
+	var unreachable, problems []string
+	for _, endpoint := range endpoints {
+		resolved, err := h.lookupNameServers(ctx, endpoint, name)
+		if err != nil {
+			logger.Warn("Failed to query resolver", "resolver", endpoint, "error", err)
+			unreachable = append(unreachable, err.Error())
+			continue
+		}
+		logger.Debug("Resolved name servers", "resolver", endpoint, "name", name, "name_servers", resolved)
+		if len(resolved) == 0 {
+			problems = append(problems, fmt.Sprintf("%s has no NS records for %s yet", endpoint, name))
+			continue
+		}
+		if missing, extra := delegationDifference(props, resolved); len(missing) > 0 || len(extra) > 0 {
+			problems = append(problems, fmt.Sprintf("%s resolves %s to %s: missing %v, unexpected %v", endpoint, name, strings.Join(resolved, ","), missing, extra))
+		}
+	}
+	if len(unreachable) == len(endpoints) {
+		return fmt.Errorf("no DNS-over-HTTPS resolver could be reached: %s", strings.Join(unreachable, "; "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("delegation of %s has not propagated: %s", name, strings.Join(problems, "; "))
+	}
+	logger.Info("Verified the delegation resolves", "name", name, "resolvers", len(endpoints)-len(unreachable))
+	return nil
+}
+
+// propagationTimeout returns how long to wait for the delegation to be served
+func propagationTimeout(props CloudflareDNSProperties) time.Duration {
+	return secondsProperty("PropagationTimeoutSeconds", props.PropagationTimeoutSeconds, defaultPropagationTimeout)
+}
+
+// pollInterval returns the time between checks while waiting for the delegation
+func pollInterval(props CloudflareDNSProperties) time.Duration {
+	return secondsProperty("PollIntervalSeconds", props.PollIntervalSeconds, defaultPollInterval)
+}
+
+// secondsProperty returns the duration of a property in seconds, or the default when it is
+// not set or invalid
+func secondsProperty(name, value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		logger.Warn("Invalid "+name+" value, using default", "value", value)
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waitDeadline returns when waiting that starts now must stop: after the timeout, or before
+// the invocation times out
+func waitDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if invocation, ok := ctx.Deadline(); ok && invocation.Add(-propagationWaitReserve).Before(deadline) {
+		deadline = invocation.Add(-propagationWaitReserve)
+	}
+	return deadline
+}
+
+// pollUntil calls check every interval until it succeeds, or until the next call would come
+// after the deadline, and returns the error of the last call
+func pollUntil(ctx context.Context, deadline time.Time, interval time.Duration, check func() error) error {
+	for {
+		err := check()
+		if err == nil || time.Now().Add(interval).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
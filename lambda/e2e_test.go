@@ -0,0 +1,206 @@
+//go:build e2e
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// The end-to-end tests run the handler created by newHandler, as in the Lambda, with Secrets
+// Manager and SSM on LocalStack and the mock Cloudflare API. Start LocalStack first:
+//
+//	docker run --rm -d -p 4566:4566 localstack/localstack
+//	go test -tags e2e -run E2E ./...
+//
+// LOCALSTACK_ENDPOINT overrides the default endpoint http://localhost:4566.
+
+// defaultLocalStackEndpoint is the edge port of a local LocalStack container
+const defaultLocalStackEndpoint = "http://localhost:4566"
+
+// setupLocalStack points the AWS clients of the handler at LocalStack and returns a session
+// for preparing the test resources
+func setupLocalStack(t *testing.T) *session.Session {
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultLocalStackEndpoint
+	}
+	resp, err := http.Get(endpoint + "/_localstack/health")
+	if err != nil {
+		t.Fatalf("LocalStack is not reachable at %s: %v", endpoint, err)
+	}
+	resp.Body.Close()
+
+	t.Setenv("AWS_ENDPOINT_URL", endpoint)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("POWERTOOLS_TRACE_DISABLED", "true")
+	t.Setenv("SECRET_CACHE_TTL_SECONDS", "0")
+
+	sess, err := awsSession()
+	if err != nil {
+		t.Fatalf("Failed to create AWS session: %v", err)
+	}
+	return sess
+}
+
+// responseRecorder stands in for the pre-signed S3 URL CloudFormation waits on
+type responseRecorder struct {
+	*httptest.Server
+	mu   sync.Mutex
+	sent []CloudFormationResponse
+}
+
+func newResponseRecorder(t *testing.T) *responseRecorder {
+	r := &responseRecorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var response CloudFormationResponse
+		if req.Method != http.MethodPut || json.NewDecoder(req.Body).Decode(&response) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.sent = append(r.sent, response)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// last returns the last response sent
+func (r *responseRecorder) last(t *testing.T) CloudFormationResponse {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) == 0 {
+		t.Fatalf("Expected a response to be sent")
+	}
+	return r.sent[len(r.sent)-1]
+}
+
+// e2eEvent returns an event of the custom resources responding to the recorder
+func e2eEvent(recorder *responseRecorder, requestType, action, secretID string) CloudFormationEvent {
+	event := testEvent(requestType, action)
+	event.ResponseURL = recorder.URL + "/response"
+	event.StackId = "arn:aws:cloudformation:us-east-1:000000000000:stack/Cftor53Stack/e2e"
+	event.RequestId = fmt.Sprintf("%s-%s", requestType, action)
+	event.ResourceProperties.SecretID = secretID
+	return event
+}
+
+func TestE2ESecretsManager(t *testing.T) {
+	sess := setupLocalStack(t)
+	mock := newMockCloudflare(t)
+	recorder := newResponseRecorder(t)
+
+	secrets := secretsmanager.New(sess)
+	name := fmt.Sprintf("cftor53/e2e/%d", time.Now().UnixNano())
+	secret, err := secrets.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		SecretString: aws.String(`{"api_token":"token"}`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the secret: %v", err)
+	}
+	t.Cleanup(func() {
+		secrets.DeleteSecret(&secretsmanager.DeleteSecretInput{SecretId: secret.ARN, ForceDeleteWithoutRecovery: aws.Bool(true)})
+	})
+
+	h, err := newHandler()
+	if err != nil {
+		t.Fatalf("Failed to create the handler: %v", err)
+	}
+	handle := withPowertools(h.HandleRequest)
+	ctx := context.Background()
+
+	// The events of a stack creation, update and deletion
+	steps := []struct {
+		requestType string
+		action      string
+		nameServers []string
+		expected    []string
+	}{
+		{requestType: "Create", action: "check"},
+		{requestType: "Create", action: "update", expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"}},
+		{requestType: "Create", action: "verify"},
+		{requestType: "Update", action: "update", nameServers: []string{"ns-1.awsdns-01.org.", "ns-3.awsdns-03.net."}, expected: []string{"ns-1.awsdns-01.org", "ns-3.awsdns-03.net"}},
+		{requestType: "Delete", action: "update", expected: []string{"ns-1.awsdns-01.org", "ns-3.awsdns-03.net"}},
+	}
+	for _, step := range steps {
+		event := e2eEvent(recorder, step.requestType, step.action, aws.StringValue(secret.ARN))
+		if step.nameServers != nil {
+			event.ResourceProperties.NameServers = step.nameServers
+		}
+		if _, err := handle(ctx, event); err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", step.requestType, step.action, err)
+		}
+		response := recorder.last(t)
+		if response.Status != "SUCCESS" || response.RequestId != event.RequestId {
+			t.Fatalf("%s %s: expected success, got %+v", step.requestType, step.action, response)
+		}
+		if step.expected != nil {
+			if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != strings.Join(step.expected, ",") {
+				t.Errorf("%s %s: expected NS records %v, got %v", step.requestType, step.action, step.expected, got)
+			}
+		}
+	}
+
+	// A missing secret fails the custom resource instead of the invocation
+	event := e2eEvent(recorder, "Create", "update", name+"-missing")
+	if _, err := handle(ctx, event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := recorder.last(t); response.Status != "FAILED" || !strings.Contains(response.Reason, "failed to get secret") {
+		t.Errorf("Expected the missing secret to fail, got %+v", response)
+	}
+}
+
+func TestE2ESSMParameter(t *testing.T) {
+	sess := setupLocalStack(t)
+	mock := newMockCloudflare(t)
+	recorder := newResponseRecorder(t)
+
+	parameters := ssm.New(sess)
+	name := fmt.Sprintf("/cftor53/e2e/%d", time.Now().UnixNano())
+	if _, err := parameters.PutParameter(&ssm.PutParameterInput{
+		Name:  aws.String(name),
+		Type:  aws.String(ssm.ParameterTypeSecureString),
+		Value: aws.String(`{"api_token":"token"}`),
+	}); err != nil {
+		t.Fatalf("Failed to create the parameter: %v", err)
+	}
+	t.Cleanup(func() {
+		parameters.DeleteParameter(&ssm.DeleteParameterInput{Name: aws.String(name)})
+	})
+
+	h, err := newHandler()
+	if err != nil {
+		t.Fatalf("Failed to create the handler: %v", err)
+	}
+	event := e2eEvent(recorder, "Create", "update", "")
+	event.ResourceProperties.TokenSource = tokenSourceSSM
+	event.ResourceProperties.TokenParameterName = name
+	if _, err := withPowertools(h.HandleRequest)(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := recorder.last(t); response.Status != "SUCCESS" || response.Data.RecordsAdded != "2" {
+		t.Errorf("Expected the NS records to be added, got %+v", response)
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); len(got) != 2 {
+		t.Errorf("Expected two NS records, got %v", got)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+	"github.com/cloudflare/cloudflare-go/v2/user"
+	"github.com/cloudflare/cloudflare-go/v2/zones"
+)
+
+// handler handles the custom resource events with the clients it is given, which tests
+// replace with fakes
+type handler struct {
+	// Clients reading the Cloudflare credentials from Secrets Manager and SSM Parameter Store
+	secretsManager secretsmanageriface.SecretsManagerAPI
+	ssm            ssmiface.SSMAPI
+
+	// Tells a replaced delegation from a deleted stack
+	stacks cloudformationiface.CloudFormationAPI
+
+	// Holds the locks serializing the updates of a subdomain and the state of its records
+	tables dynamodbiface.DynamoDBAPI
+
+	// Stores the full Data of responses too large for CloudFormation
+	objects s3iface.S3API
+
+	// Queries the DNS-over-HTTPS resolvers verifying the propagation of a delegation
+	doh *http.Client
+
+	// Queries the parent zone's name servers for isComplete
+	parentDNS parentDNS
+
+	// Creates the Cloudflare client for the credentials
+	newCloudflare func(secret *CloudflareSecret, retry retryPolicy) cloudflareAPI
+
+	// Sends the responses of the custom resources to CloudFormation
+	responses responseSender
+}
+
+// newHandler returns a handler with the AWS, Cloudflare and HTTP clients of the Lambda
+func newHandler() (*handler, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	return &handler{
+		secretsManager: secretsmanager.New(sess),
+		ssm:            ssm.New(sess),
+		stacks:         cloudformation.New(sess),
+		tables:         dynamodb.New(sess),
+		objects:        s3.New(sess),
+		doh:            dohHTTPClient(),
+		parentDNS:      udpDNS{},
+		newCloudflare:  newCloudflareClient,
+		responses:      httpResponseSender{client: &http.Client{}},
+	}, nil
+}
+
+// cloudflareAPI is the part of the Cloudflare API the handler uses
+type cloudflareAPI interface {
+	VerifyToken(ctx context.Context) (*user.TokenVerifyResponse, error)
+	ListZones(ctx context.Context, params zones.ZoneListParams) ([]zones.Zone, error)
+	GetZone(ctx context.Context, zoneID string) (*zones.Zone, error)
+	GetZoneHold(ctx context.Context, zoneID string) (*zones.ZoneHold, error)
+	// ListDNSRecords returns all DNS records with the given name, following pagination
+	ListDNSRecords(ctx context.Context, zoneID, name string) ([]dns.Record, error)
+	// ListProxiedDNSRecords returns all proxied DNS records of the zone, following pagination
+	ListProxiedDNSRecords(ctx context.Context, zoneID string) ([]dns.Record, error)
+	NewDNSRecord(ctx context.Context, params dns.RecordNewParams) (*dns.Record, error)
+	// BatchDNSRecords deletes and creates records in a single transaction
+	BatchDNSRecords(ctx context.Context, zoneID string, batch dnsRecordBatch) (*dnsRecordBatchResult, error)
+	DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error
+}
+
+// dnsRecordBatch is a request of the batch DNS records endpoint, which Cloudflare applies in
+// one transaction, the deletes before the posts
+type dnsRecordBatch struct {
+	Deletes []dnsRecordBatchDelete `json:"deletes,omitempty"`
+	Posts   []dnsRecordBatchPost   `json:"posts,omitempty"`
+}
+
+// dnsRecordBatchDelete is a record deleted by a batch
+type dnsRecordBatchDelete struct {
+	ID string `json:"id"`
+}
+
+// dnsRecordBatchPost is a record created by a batch
+type dnsRecordBatchPost struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+}
+
+// dnsRecordBatchResult holds the records a batch deleted and created
+type dnsRecordBatchResult struct {
+	Deletes []dns.Record `json:"deletes"`
+	Posts   []dns.Record `json:"posts"`
+}
+
+// cloudflareClient implements cloudflareAPI with the Cloudflare Go SDK
+type cloudflareClient struct {
+	client *cloudflare.Client
+}
+
+// newCloudflareClient returns a client authenticated with the API token of the secret, or
+// with its Global API key and email. CLOUDFLARE_API_BASE_URL points the client at another
+// server than the Cloudflare API, such as the mock server of the tests.
+func newCloudflareClient(secret *CloudflareSecret, retry retryPolicy) cloudflareAPI {
+	// The retries of the SDK can't be tuned, so the middleware retries instead
+	opts := []option.RequestOption{cloudflareHTTPClient(), option.WithMaxRetries(0), option.WithMiddleware(retry.middleware)}
+	if baseURL := os.Getenv("CLOUDFLARE_API_BASE_URL"); baseURL != "" {
+		opts = append(opts, option.WithBaseURL(baseURL))
+	}
+	if secret.ApiToken != "" {
+		opts = append(opts, option.WithAPIToken(secret.ApiToken))
+	} else {
+		opts = append(opts, option.WithAPIKey(secret.ApiKey), option.WithAPIEmail(secret.Email))
+	}
+	return cloudflareClient{client: cloudflare.NewClient(opts...)}
+}
+
+func (c cloudflareClient) VerifyToken(ctx context.Context) (*user.TokenVerifyResponse, error) {
+	return c.client.User.Tokens.Verify(ctx)
+}
+
+func (c cloudflareClient) ListZones(ctx context.Context, params zones.ZoneListParams) ([]zones.Zone, error) {
+	page, err := c.client.Zones.List(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return page.Result, nil
+}
+
+func (c cloudflareClient) GetZone(ctx context.Context, zoneID string) (*zones.Zone, error) {
+	return c.client.Zones.Get(ctx, zones.ZoneGetParams{ZoneID: cloudflare.F(zoneID)})
+}
+
+func (c cloudflareClient) GetZoneHold(ctx context.Context, zoneID string) (*zones.ZoneHold, error) {
+	return c.client.Zones.Holds.Get(ctx, zones.HoldGetParams{ZoneID: cloudflare.F(zoneID)})
+}
+
+func (c cloudflareClient) ListDNSRecords(ctx context.Context, zoneID, name string) ([]dns.Record, error) {
+	iter := c.client.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
+		ZoneID: cloudflare.F(zoneID),
+		Name:   cloudflare.F(name),
+	})
+
+	var records []dns.Record
+	for iter.Next() {
+		records = append(records, iter.Current())
+	}
+	return records, iter.Err()
+}
+
+func (c cloudflareClient) ListProxiedDNSRecords(ctx context.Context, zoneID string) ([]dns.Record, error) {
+	iter := c.client.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
+		ZoneID:  cloudflare.F(zoneID),
+		Proxied: cloudflare.F(true),
+	})
+
+	var records []dns.Record
+	for iter.Next() {
+		records = append(records, iter.Current())
+	}
+	return records, iter.Err()
+}
+
+func (c cloudflareClient) NewDNSRecord(ctx context.Context, params dns.RecordNewParams) (*dns.Record, error) {
+	return c.client.DNS.Records.New(ctx, params)
+}
+
+// BatchDNSRecords posts the batch to the endpoint directly, which the SDK doesn't cover
+func (c cloudflareClient) BatchDNSRecords(ctx context.Context, zoneID string, batch dnsRecordBatch) (*dnsRecordBatchResult, error) {
+	var envelope struct {
+		Result dnsRecordBatchResult `json:"result"`
+	}
+	if err := c.client.Post(ctx, "zones/"+zoneID+"/dns_records/batch", batch, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope.Result, nil
+}
+
+func (c cloudflareClient) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	_, err := c.client.DNS.Records.Delete(ctx, recordID, dns.RecordDeleteParams{ZoneID: cloudflare.F(zoneID)})
+	return err
+}
+
+// responseSender delivers the response of a custom resource to its pre-signed S3 URL
+type responseSender interface {
+	Send(responseURL string, response *CloudFormationResponse) error
+}
+
+// httpResponseSender PUTs the responses with an HTTP client
+type httpResponseSender struct {
+	client *http.Client
+}
+
+func (s httpResponseSender) Send(responseURL string, response *CloudFormationResponse) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	req, err := http.NewRequest("PUT", responseURL, bytes.NewBuffer(responseJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("error sending response. Status: %s", resp.Status)
+	}
+
+	return nil
+}
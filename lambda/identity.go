@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+)
+
+// A delegation custom resource is identified by the name it delegates. Renaming it on Update
+// returns a new physical ID, so CloudFormation creates the new delegation and then deletes
+// the old one, whose Delete carries the old properties and removes the old NS records.
+
+// delegationPhysicalID returns the physical ID of a delegation custom resource. The ID of a
+// delegation whose name is unchanged is kept, including the IDs of earlier versions.
+func delegationPhysicalID(event CloudFormationEvent) string {
+	if event.PhysicalResourceId != "" && (event.RequestType == "Delete" || (event.RequestType == "Update" && !delegationRenamed(event))) {
+		return event.PhysicalResourceId
+	}
+	return event.LogicalResourceId + "-" + delegationName(event.ResourceProperties)
+}
+
+// delegationName returns the delegated name in lowercase, without trailing dots
+func delegationName(props CloudflareDNSProperties) string {
+	return strings.ToLower(strings.Trim(props.Subdomain, ".") + "." + strings.Trim(props.Domain, "."))
+}
+
+// delegationRenamed reports whether an Update changes the domain or subdomain
+func delegationRenamed(event CloudFormationEvent) bool {
+	if event.OldResourceProperties == nil {
+		return false
+	}
+	old, err := asciiDomainNames(CloudflareDNSProperties{
+		Domain:    propertyString(event.OldResourceProperties["Domain"]),
+		Subdomain: propertyString(event.OldResourceProperties["Subdomain"]),
+	})
+	if err != nil {
+		return true
+	}
+	props := event.ResourceProperties
+	return !strings.EqualFold(strings.Trim(old.Domain, "."), strings.Trim(props.Domain, ".")) ||
+		!strings.EqualFold(strings.Trim(old.Subdomain, "."), strings.Trim(props.Subdomain, "."))
+}
+
+// stackDeleting reports whether the stack of the custom resource is being deleted, rather
+// than updated or rolled back
+func (h *handler) stackDeleting(ctx context.Context, stackID string) (bool, error) {
+	if h.stacks == nil || stackID == "" {
+		return true, nil
+	}
+	output, err := h.stacks.DescribeStacksWithContext(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stackID)})
+	if err != nil {
+		return true, err
+	}
+	for _, stack := range output.Stacks {
+		if aws.StringValue(stack.StackStatus) != cloudformation.StackStatusDeleteInProgress {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// handleDNSDelete removes the NS records of a delegation that CloudFormation deletes after
+// replacing it with one of another name, or when rolling back its creation. Deleting the
+// stack leaves the records in place, and so does any failure, so the Delete always succeeds.
+func (h *handler) handleDNSDelete(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+
+	deleting, err := h.stackDeleting(ctx, event.StackId)
+	if err != nil {
+		logger.Warn("Could not read the stack status, leaving the NS records", "name", fullDomainName, "error", err)
+	}
+	if deleting {
+		return h.sendResponse(event, "SUCCESS", "Resource deleted", nil)
+	}
+	logger.Info("Removing the NS records of the replaced delegation", "name", fullDomainName)
+
+	nameServers, err := resolveNameServers(ctx, props)
+	if err != nil || len(nameServers) == 0 || !props.hasTokenSource() || props.Domain == "" || props.Subdomain == "" {
+		logger.Warn("Could not determine the NS records of the replaced delegation, leaving them", "name", fullDomainName, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+
+	if props.LockTable != "" {
+		release, err := h.acquireLock(ctx, event)
+		if err != nil {
+			logger.Warn("Failed to acquire the lock, leaving the NS records", "name", fullDomainName, "error", err)
+			return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+		}
+		defer release()
+	}
+
+	parent, client, err := nestedParentZone(ctx, props)
+	if err != nil {
+		logger.Warn("Failed to look up the parent hosted zone, leaving the NS records", "name", fullDomainName, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+	if parent != nil {
+		return h.handleNestedDelete(ctx, event, client, parent)
+	}
+
+	api, zoneID, err := h.connectCloudflare(ctx, props)
+	if err != nil {
+		logger.Warn("Failed to connect to Cloudflare, leaving the NS records", "name", fullDomainName, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+	records, err := api.ListDNSRecords(ctx, zoneID, fullDomainName)
+	if err != nil {
+		logger.Warn("Failed to list the NS records, leaving them", "name", fullDomainName, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+	logger.Debug("Listed DNS records", "name", fullDomainName, "records", describeRecords(records))
+
+	// Only the records pointing at the delegation's name servers are removed, or the recorded
+	// records when the state table has any
+	delegated := map[string]bool{}
+	for _, ns := range nameServers {
+		delegated[normalizeNameServer(ns)] = true
+	}
+	var recorded map[string]bool
+	if props.StateTable != "" {
+		items, err := h.loadRecordState(ctx, props.StateTable, delegationName(props))
+		if err != nil {
+			logger.Warn("Failed to read the recorded records, deleting by name server", "name", fullDomainName, "error", err)
+		}
+		for _, item := range items {
+			if recorded == nil {
+				recorded = map[string]bool{}
+			}
+			recorded[item.RecordId] = true
+		}
+	}
+	var managed []dns.Record
+	for _, record := range records {
+		if record.Type != dns.RecordTypeNS {
+			continue
+		}
+		if recorded != nil && !recorded[record.ID] || recorded == nil && !delegated[normalizeNameServer(recordContent(record))] {
+			continue
+		}
+		managed = append(managed, record)
+	}
+	errs := forEachParallel(ctx, len(managed), func(i int) error {
+		if err := api.DeleteDNSRecord(ctx, zoneID, managed[i].ID); err != nil {
+			return fmt.Errorf("error deleting NS record %s: %v", recordContent(managed[i]), err)
+		}
+		logger.Info("Deleted NS record", "content", recordContent(managed[i]))
+		return nil
+	})
+	var remaining []dns.Record
+	for i, err := range errs {
+		if err != nil {
+			remaining = append(remaining, managed[i])
+		}
+	}
+	if err := aggregateErrors(errs); err != nil {
+		logger.Warn("Failed to delete NS records", "failed", len(remaining), "error", err)
+	}
+	deletedCount := len(managed) - len(remaining)
+	metrics.Add("NSRecordsDeleted", float64(deletedCount))
+
+	// The records that could not be deleted stay recorded
+	if props.StateTable != "" {
+		if err := h.syncRecordState(ctx, event, zoneID, remaining); err != nil {
+			logger.Warn("Failed to update the recorded records", "name", fullDomainName, "error", err)
+		}
+	}
+	return h.sendResponse(event, "SUCCESS", fmt.Sprintf("Deleted %d NS records of %s", deletedCount, fullDomainName), nil)
+}
+
+// handleNestedDelete removes the NS record set of a replaced nested delegation from the
+// parent zone
+func (h *handler) handleNestedDelete(ctx context.Context, event CloudFormationEvent, client route53iface.Route53API, parent *parentZone) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+
+	records, err := parentZoneRecords(ctx, client, parent, fullDomainName)
+	if err != nil {
+		logger.Warn("Failed to list the NS records in the parent hosted zone, leaving them", "name", fullDomainName, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+	var changes []*route53.Change
+	for _, record := range records {
+		if aws.StringValue(record.Type) == route53.RRTypeNs {
+			changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: record})
+		}
+	}
+	if len(changes) == 0 {
+		return h.sendResponse(event, "SUCCESS", "Resource deleted", nil)
+	}
+	_, err = client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(parent.ID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("Removal of the delegation of " + fullDomainName + " by cftor53"),
+			Changes: changes,
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to delete the NS records in the parent hosted zone", "name", fullDomainName, "parent_zone", parent.Name, "error", err)
+		return h.sendResponse(event, "SUCCESS", "Resource deleted, NS records left in place", nil)
+	}
+	return h.sendResponse(event, "SUCCESS", "NS records deleted from parent hosted zone "+parent.Name, nil)
+}
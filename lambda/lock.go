@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Overlapping invocations for the same subdomain, e.g. from two stacks or from a rollback
+// and a retry, take turns on a lock item in the DynamoDB table of the LockTable property,
+// keyed by the delegated name. A lock expires with the invocation holding it, so a Lambda
+// that timed out doesn't block the next one.
+
+// lockRetryInterval is the time between attempts to take a held lock
+const lockRetryInterval = 2 * time.Second
+
+// defaultLockLease is how long a lock is held without a deadline of the invocation
+const defaultLockLease = 15 * time.Minute
+
+// lockWorkReserve is the time left to the invocation for its work after waiting for the lock
+const lockWorkReserve = time.Minute
+
+// lockHolder is the lock item in the table
+type lockHolder struct {
+	owner     string
+	stackID   string
+	expiresAt time.Time
+}
+
+// acquireLock takes the lock of the delegation, waiting while another invocation holds it,
+// and returns the function releasing it
+func (h *handler) acquireLock(ctx context.Context, event CloudFormationEvent) (func(), error) {
+	props := event.ResourceProperties
+	key := delegationName(props)
+	owner := event.RequestId
+	if owner == "" {
+		owner = fmt.Sprintf("%s-%d", event.LogicalResourceId, time.Now().UnixNano())
+	}
+
+	expiresAt := time.Now().Add(defaultLockLease)
+	waitUntil := time.Now().Add(defaultLockLease - lockWorkReserve)
+	if deadline, ok := ctx.Deadline(); ok {
+		expiresAt = deadline
+		waitUntil = deadline.Add(-lockWorkReserve)
+	}
+
+	for {
+		now := time.Now()
+		_, err := h.tables.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(props.LockTable),
+			Item: map[string]*dynamodb.AttributeValue{
+				"LockId":    {S: aws.String(key)},
+				"Owner":     {S: aws.String(owner)},
+				"StackId":   {S: aws.String(event.StackId)},
+				"ExpiresAt": {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+			},
+			ConditionExpression:       aws.String("attribute_not_exists(LockId) OR ExpiresAt < :now OR #owner = :owner"),
+			ExpressionAttributeNames:  map[string]*string{"#owner": aws.String("Owner")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))}, ":owner": {S: aws.String(owner)}},
+		})
+		if err == nil {
+			logger.Info("Acquired the lock", "name", key, "table", props.LockTable)
+			return func() { h.releaseLock(props.LockTable, key, owner) }, nil
+		}
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, fmt.Errorf("failed to acquire the lock of %s: %v", key, err)
+		}
+
+		holder := h.lockHolder(ctx, props.LockTable, key)
+		if now.Add(lockRetryInterval).After(waitUntil) {
+			return nil, fmt.Errorf("timed out waiting for the lock of %s, held by %s of stack %s until %s", key, holder.owner, holder.stackID, holder.expiresAt.UTC().Format(time.RFC3339))
+		}
+		logger.Info("Waiting for the lock", "name", key, "owner", holder.owner, "stack_id", holder.stackID)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to acquire the lock of %s: %v", key, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// lockHolder reads the current holder of a lock for the log and the failure reason
+func (h *handler) lockHolder(ctx context.Context, table, key string) lockHolder {
+	output, err := h.tables.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(table),
+		Key:            map[string]*dynamodb.AttributeValue{"LockId": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	holder := lockHolder{owner: "unknown", stackID: "unknown"}
+	if err != nil || output.Item == nil {
+		return holder
+	}
+	if owner := output.Item["Owner"]; owner != nil {
+		holder.owner = aws.StringValue(owner.S)
+	}
+	if stackID := output.Item["StackId"]; stackID != nil {
+		holder.stackID = aws.StringValue(stackID.S)
+	}
+	if expiresAt := output.Item["ExpiresAt"]; expiresAt != nil {
+		seconds, _ := strconv.ParseInt(aws.StringValue(expiresAt.N), 10, 64)
+		holder.expiresAt = time.Unix(seconds, 0)
+	}
+	return holder
+}
+
+// releaseLock deletes the lock item unless another invocation took the lock over after it
+// expired. A lock that can't be released expires on its own.
+func (h *handler) releaseLock(table, key, owner string) {
+	_, err := h.tables.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(table),
+		Key:                       map[string]*dynamodb.AttributeValue{"LockId": {S: aws.String(key)}},
+		ConditionExpression:       aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]*string{"#owner": aws.String("Owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(owner)}},
+	})
+	if err != nil {
+		logger.Warn("Failed to release the lock", "name", key, "table", table, "error", err)
+		return
+	}
+	logger.Info("Released the lock", "name", key, "table", table)
+}
@@ -1,24 +1,35 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
-	"github.com/cloudflare/cloudflare-go"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/cloudflare/cloudflare-go/v2/user"
+	"github.com/cloudflare/cloudflare-go/v2/zones"
+	"golang.org/x/net/idna"
 )
 
 // CloudflareSecret represents the structure of the secret stored in AWS Secrets Manager
 type CloudflareSecret struct {
 	ApiToken string `json:"api_token"`
+
+	// Legacy Global API key authentication, used when no API token is present
+	ApiKey string `json:"api_key,omitempty"`
+	Email  string `json:"email,omitempty"`
 }
 
 // CloudFormationEvent represents an event sent by CloudFormation when a custom resource is provisioned
@@ -32,6 +43,15 @@ type CloudFormationEvent struct {
 	ResourceProperties    CloudflareDNSProperties `json:"ResourceProperties"`
 	PhysicalResourceId    string                  `json:"PhysicalResourceId,omitempty"`
 	OldResourceProperties map[string]interface{}  `json:"OldResourceProperties,omitempty"`
+
+	// Data of onEvent and the time its polling started, which the Provider framework passes to isComplete
+	Data                 *ResponseData `json:"Data,omitempty"`
+	PropagationStartedAt string        `json:"PropagationStartedAt,omitempty"`
+
+	// Data of the response to a direct invocation, returned by HandleRequest
+	result *ResponseData
+	// Physical ID of the response to a direct invocation, returned by HandleProviderEvent
+	resultPhysicalID *string
 }
 
 // CloudflareDNSEvent defines the input event structure for the Lambda function
@@ -42,11 +62,57 @@ type CloudflareDNSEvent struct {
 
 // CloudflareDNSProperties defines the properties passed to the Lambda function
 type CloudflareDNSProperties struct {
-	SecretID    string   `json:"SecretId"`
-	Domain      string   `json:"Domain"`
-	Subdomain   string   `json:"Subdomain"`
-	NameServers []string `json:"NameServers,omitempty"`
-	Action      string   `json:"Action"` // "check" or "update"
+	TokenSource        string         `json:"TokenSource,omitempty"` // "secretsmanager" (default) or "ssm"
+	TokenParameterName string         `json:"TokenParameterName,omitempty"`
+	SecretID           string         `json:"SecretId"`
+	SecretVersionStage string         `json:"SecretVersionStage,omitempty"`
+	SecretVersionID    string         `json:"SecretVersionId,omitempty"`
+	AccountID          string         `json:"AccountId,omitempty"` // Cloudflare account to look the zone up in
+	ZoneID             string         `json:"ZoneId,omitempty"`    // Cloudflare zone ID, bypasses the name lookup
+	Domain             string         `json:"Domain"`
+	Subdomain          string         `json:"Subdomain"`
+	NameServers        nameServerList `json:"NameServers,omitempty"`
+	AssumeRoleArn      string         `json:"AssumeRoleArn,omitempty"`     // Role to read the hosted zone in another account
+	HostedZoneID       string         `json:"HostedZoneId,omitempty"`      // Existing hosted zone to read the name servers of
+	NSRecordTTL        string         `json:"NSRecordTTL,omitempty"`       // TTL of the created NS records in seconds
+	Mode               string         `json:"Mode,omitempty"`              // "append" to leave the NS records of other name servers in place
+	LockTable          string         `json:"LockTable,omitempty"`         // DynamoDB table serializing the updates of the subdomain
+	StateTable         string         `json:"StateTable,omitempty"`        // DynamoDB table recording the managed records
+	StatusParameter    string         `json:"StatusParameter,omitempty"`   // SSM parameter with the outcome of the last update
+	SpillBucket        string         `json:"SpillBucket,omitempty"`       // S3 bucket for the full Data of oversized responses
+	DoHEndpoints       []string       `json:"DoHEndpoints,omitempty"`      // DNS-over-HTTPS resolvers verifying the delegation resolves
+	ProviderFramework  string         `json:"ProviderFramework,omitempty"` // "true" when the CDK Provider framework serves the resource
+	// How long the verify, wait and isComplete logic waits for the delegation to be served, and
+	// how often it checks, in seconds
+	PropagationTimeoutSeconds string `json:"PropagationTimeoutSeconds,omitempty"`
+	PollIntervalSeconds       string `json:"PollIntervalSeconds,omitempty"`
+	// "true" to pass the check despite proxied records at or below the subdomain
+	AcceptProxiedRecords string `json:"AcceptProxiedRecords,omitempty"`
+	// Retries of the Cloudflare API calls that were rate limited or failed on the server, and
+	// the delays between them in milliseconds
+	MaxRetries  string `json:"MaxRetries,omitempty"`
+	BaseDelayMs string `json:"BaseDelayMs,omitempty"`
+	MaxDelayMs  string `json:"MaxDelayMs,omitempty"`
+
+	// Certificate settings of the "certificate" action
+	SubjectAlternativeNames []string `json:"SubjectAlternativeNames,omitempty"`
+	KeyAlgorithm            string   `json:"KeyAlgorithm,omitempty"`
+	TransparencyLogging     string   `json:"TransparencyLogging,omitempty"` // "ENABLED" or "DISABLED"
+	Action                  string   `json:"Action"`                        // "check", "plan", "update", "verify", "wait", "workflow", "respond" or "certificate"
+
+	// Step Functions workflow settings
+	StateMachineArn string               `json:"StateMachineArn,omitempty"`
+	Event           *CloudFormationEvent `json:"Event,omitempty"` // Event the workflow responds to
+	Status          string               `json:"Status,omitempty"`
+	Reason          string               `json:"Reason,omitempty"`
+}
+
+// hasTokenSource reports whether the properties identify where to read the API token from
+func (p CloudflareDNSProperties) hasTokenSource() bool {
+	if p.TokenSource == tokenSourceSSM {
+		return p.TokenParameterName != ""
+	}
+	return p.SecretID != ""
 }
 
 // CloudflareDNSResult represents the result of the Lambda function execution
@@ -57,13 +123,13 @@ type CloudflareDNSResult struct {
 
 // CloudFormationResponse represents the response to send back to CloudFormation
 type CloudFormationResponse struct {
-	Status             string                 `json:"Status"`
-	Reason             string                 `json:"Reason,omitempty"`
-	PhysicalResourceId string                 `json:"PhysicalResourceId"`
-	StackId            string                 `json:"StackId"`
-	RequestId          string                 `json:"RequestId"`
-	LogicalResourceId  string                 `json:"LogicalResourceId"`
-	Data               map[string]interface{} `json:"Data,omitempty"`
+	Status             string        `json:"Status"`
+	Reason             string        `json:"Reason,omitempty"`
+	PhysicalResourceId string        `json:"PhysicalResourceId"`
+	StackId            string        `json:"StackId"`
+	RequestId          string        `json:"RequestId"`
+	LogicalResourceId  string        `json:"LogicalResourceId"`
+	Data               *ResponseData `json:"Data,omitempty"`
 }
 
 // ResponseBody represents the body of the Lambda function response
@@ -76,38 +142,242 @@ type ResponseBody struct {
 	Route53NameServers []string `json:"route53NameServers"`
 }
 
-// getSecret retrieves a secret from AWS Secrets Manager
-func getSecret(secretID string) (*CloudflareSecret, error) {
-	sess, err := session.NewSession()
+// asciiDomainNames returns the properties with the domain and subdomain in punycode, e.g.
+// xn--mnchen-3ya for münchen. ASCII names are left as they are.
+func asciiDomainNames(props CloudflareDNSProperties) (CloudflareDNSProperties, error) {
+	for _, name := range []*string{&props.Domain, &props.Subdomain} {
+		if isASCII(*name) {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(*name, "."))
+		if err != nil {
+			return props, fmt.Errorf("invalid domain name %s: %v", *name, err)
+		}
+		*name = ascii
+	}
+	return props, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// nameServerList decodes the NameServers property, which CloudFormation delivers as a list, or
+// as a string when it comes from a resolved token such as Fn::Join or a string attribute
+type nameServerList []string
+
+// UnmarshalJSON accepts a list, a comma-separated string or null, and splits the list entries
+// that are joined as well
+func (l *nameServerList) UnmarshalJSON(data []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		values = []interface{}{value}
+	}
+
+	var nameServers nameServerList
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			for _, ns := range strings.Split(value, ",") {
+				if ns = strings.TrimSpace(ns); ns != "" {
+					nameServers = append(nameServers, ns)
+				}
+			}
+		default:
+			return fmt.Errorf("NameServers must be a list or a comma-separated string of host names, got %s", data)
+		}
+	}
+	*l = nameServers
+	return nil
+}
+
+// tokenSourceSSM selects an SSM SecureString parameter instead of Secrets Manager
+const tokenSourceSSM = "ssm"
+
+// modeAppend only adds the missing name servers, for delegations that intentionally keep
+// other name servers in their NS records, e.g. during a migration
+const modeAppend = "append"
+
+// defaultSecretCacheTTL is used when SECRET_CACHE_TTL_SECONDS is not set
+const defaultSecretCacheTTL = 5 * time.Minute
+
+// secretCacheEntry holds a cached secret and when it was fetched
+type secretCacheEntry struct {
+	secret    *CloudflareSecret
+	fetchedAt time.Time
+}
+
+// secretCache keeps secrets across invocations of a warm Lambda container so that
+// the custom resources of one deployment don't each call GetSecretValue
+var (
+	secretCache   = map[string]secretCacheEntry{}
+	secretCacheMu sync.Mutex
+)
+
+// secretCacheTTL returns how long secrets are cached, zero disables caching
+func secretCacheTTL() time.Duration {
+	value := os.Getenv("SECRET_CACHE_TTL_SECONDS")
+	if value == "" {
+		return defaultSecretCacheTTL
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		logger.Warn("Invalid SECRET_CACHE_TTL_SECONDS value, using default", "value", value)
+		return defaultSecretCacheTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getSecret returns the Cloudflare secret, served from the in-process cache when fresh
+func (h *handler) getSecret(ctx context.Context, props CloudflareDNSProperties) (*CloudflareSecret, error) {
+	ttl := secretCacheTTL()
+	key := props.TokenSource + "|" + props.TokenParameterName + "|" + props.SecretID + "|" + props.SecretVersionStage + "|" + props.SecretVersionID
+
+	if ttl > 0 {
+		secretCacheMu.Lock()
+		entry, ok := secretCache[key]
+		secretCacheMu.Unlock()
+		if ok && time.Since(entry.fetchedAt) < ttl {
+			logger.Info("Using cached Cloudflare API token")
+			return entry.secret, nil
+		}
+	}
+
+	var secret *CloudflareSecret
+	var err error
+	if props.TokenSource == tokenSourceSSM {
+		secret, err = h.fetchParameter(ctx, props.TokenParameterName)
+	} else {
+		secret, err = h.fetchSecret(ctx, props)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+		return nil, err
+	}
+	secrets.Add(secret.ApiToken, secret.ApiKey)
+
+	if ttl > 0 {
+		secretCacheMu.Lock()
+		secretCache[key] = secretCacheEntry{secret: secret, fetchedAt: time.Now()}
+		secretCacheMu.Unlock()
 	}
 
-	svc := secretsmanager.New(sess)
+	return secret, nil
+}
+
+// fetchSecret retrieves a secret from AWS Secrets Manager, optionally pinned to
+// a version stage or version ID
+func (h *handler) fetchSecret(ctx context.Context, props CloudflareDNSProperties) (*CloudflareSecret, error) {
 	input := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretID),
+		SecretId: aws.String(props.SecretID),
+	}
+	if props.SecretVersionStage != "" {
+		input.VersionStage = aws.String(props.SecretVersionStage)
+	}
+	if props.SecretVersionID != "" {
+		input.VersionId = aws.String(props.SecretVersionID)
 	}
 
-	result, err := svc.GetSecretValue(input)
+	result, err := h.secretsManager.GetSecretValueWithContext(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get secret value: %v", err)
 	}
 
-	var secret CloudflareSecret
-	if err := json.Unmarshal([]byte(*result.SecretString), &secret); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal secret: %v", err)
+	// Secrets may be stored either as a string or as binary
+	var raw []byte
+	if result.SecretString != nil {
+		raw = []byte(*result.SecretString)
+	} else if result.SecretBinary != nil {
+		raw = result.SecretBinary
+	} else {
+		return nil, fmt.Errorf("secret %s has no value", props.SecretID)
+	}
+	secrets.Add(string(raw))
+
+	return parseSecret(raw)
+}
+
+// fetchParameter retrieves the API token from an SSM SecureString parameter
+func (h *handler) fetchParameter(ctx context.Context, name string) (*CloudflareSecret, error) {
+	result, err := h.ssm.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parameter value: %v", err)
+	}
+
+	if result.Parameter == nil || result.Parameter.Value == nil {
+		return nil, fmt.Errorf("parameter %s has no value", name)
 	}
+	secrets.Add(*result.Parameter.Value)
 
-	return &secret, nil
+	return parseSecret([]byte(*result.Parameter.Value))
+}
+
+// parseSecret parses a secret value that is either a JSON object with an
+// api_token key (or api_key and email) or the raw Cloudflare API token itself
+func parseSecret(raw []byte) (*CloudflareSecret, error) {
+	value := strings.TrimSpace(string(raw))
+	if value == "" {
+		return nil, fmt.Errorf("secret value is empty")
+	}
+
+	// A JSON object is expected to hold the token under api_token, or the Global API key under api_key and email
+	if strings.HasPrefix(value, "{") {
+		var secret CloudflareSecret
+		if err := json.Unmarshal([]byte(value), &secret); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal secret: %v", err)
+		}
+		return &secret, nil
+	}
+
+	// Otherwise the whole value is the token
+	return &CloudflareSecret{ApiToken: value}, nil
 }
 
 // sendResponse sends a response back to CloudFormation
-func sendResponse(event CloudFormationEvent, status string, reason string, data map[string]interface{}) error {
+func (h *handler) sendResponse(event CloudFormationEvent, status string, reason string, data *ResponseData) error {
+	if status == "FAILED" {
+		logger.Error("Custom resource failed", "reason", reason)
+		metrics.Add("CustomResourceFailures", 1)
+	}
+
+	// The status parameter tells the outcome of the last NS record update, not of plans or deletes
+	props := event.ResourceProperties
+	if props.StatusParameter != "" && props.Action == "update" && event.RequestType != "Delete" {
+		h.writeDelegationStatus(event, status, reason, data)
+	}
+
 	physicalResourceId := event.PhysicalResourceId
 	if physicalResourceId == "" {
 		physicalResourceId = fmt.Sprintf("%s-cloudflare-dns", event.LogicalResourceId)
 	}
 
+	// Steps of the Step Functions workflow and the Provider framework invoke the function
+	// directly, and fail with an error
+	if event.ResponseURL == "" {
+		if status == "FAILED" {
+			return fmt.Errorf("%s", reason)
+		}
+		if event.result != nil && data != nil {
+			*event.result = *data
+		}
+		if event.resultPhysicalID != nil {
+			*event.resultPhysicalID = physicalResourceId
+		}
+		return nil
+	}
+
 	responseBody := &CloudFormationResponse{
 		Status:             status,
 		Reason:             reason,
@@ -117,41 +387,55 @@ func sendResponse(event CloudFormationEvent, status string, reason string, data
 		LogicalResourceId:  event.LogicalResourceId,
 		Data:               data,
 	}
+	h.fitResponse(event, responseBody)
 
-	responseJSON, err := json.Marshal(responseBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal response: %v", err)
-	}
+	return h.responses.Send(event.ResponseURL, responseBody)
+}
 
-	req, err := http.NewRequest("PUT", event.ResponseURL, bytes.NewBuffer(responseJSON))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+// HandleRequest is the main Lambda handler function. Direct invocations without a ResponseURL,
+// such as the steps of the Step Functions workflow, get the Data of the response as the result.
+func (h *handler) HandleRequest(ctx context.Context, event CloudFormationEvent) (*ResponseData, error) {
+	event.result = &ResponseData{}
+	if err := h.handleRequest(ctx, event); err != nil {
+		return nil, err
 	}
+	return event.result, nil
+}
 
-	req.Header.Set("Content-Type", "")
+// handleRequest dispatches the event to the handler of its action
+func (h *handler) handleRequest(ctx context.Context, event CloudFormationEvent) error {
+	// Log the request type
+	logger.Info("Received request", "request_type", event.RequestType, "action", event.ResourceProperties.Action)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send response: %v", err)
+	// Cloudflare and Route53 know internationalized names by their punycode
+	props, err := asciiDomainNames(event.ResourceProperties)
+	if err != nil && event.RequestType != "Delete" {
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("error sending response. Status: %s", resp.Status)
+	event.ResourceProperties = props
+	if props.Domain != "" && props.Subdomain != "" {
+		metrics.SetDelegation(delegationName(props))
 	}
 
-	return nil
-}
+	// The workflow handles every request type itself
+	switch event.ResourceProperties.Action {
+	case "workflow":
+		return h.handleWorkflowStart(ctx, event)
+	case "respond":
+		return h.handleWorkflowResponse(ctx, event)
+	case "certificate":
+		return h.handleCertificate(ctx, event)
+	}
 
-// HandleRequest is the main Lambda handler function
-func HandleRequest(ctx context.Context, event CloudFormationEvent) error {
-	// Log the request type
-	log.Println("Received request type:", event.RequestType)
+	// The delegation is identified by its name, so that renaming it replaces the resource
+	event.PhysicalResourceId = delegationPhysicalID(event)
 
-	// For Delete operation, simply return a success response
+	// Deleting the stack leaves the NS records, but a replaced delegation removes its own
 	if event.RequestType == "Delete" {
-		return sendResponse(event, "SUCCESS", "Resource deleted", nil)
+		if event.ResourceProperties.Action == "update" {
+			return h.handleDNSDelete(ctx, event)
+		}
+		return h.sendResponse(event, "SUCCESS", "Resource deleted", nil)
 	}
 
 	// For Create and Update operations, proceed based on the action type
@@ -159,264 +443,596 @@ func HandleRequest(ctx context.Context, event CloudFormationEvent) error {
 		switch event.ResourceProperties.Action {
 		case "check":
 			// Only check for collisions, don't update records
-			return handleDNSCheck(ctx, event)
-		case "update":
-			// Update NS records
-			return handleDNSUpdate(ctx, event)
+			return h.handleDNSCheck(ctx, event)
+		case "update", "plan":
+			// Update NS records, or only return the changes for a plan
+			return h.handleDNSUpdate(ctx, event)
+		case "verify":
+			// Verify NS records match the hosted zone
+			return h.handleDNSVerify(ctx, event)
+		case "wait":
+			// Wait for the resolvers to stop caching the new subdomain as missing
+			return h.handleNegativeCacheWait(ctx, event)
 		default:
-			return sendResponse(event, "FAILED", fmt.Sprintf("Invalid action: %s", event.ResourceProperties.Action), nil)
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Invalid action: %s", event.ResourceProperties.Action), nil)
 		}
 	}
 
-	return sendResponse(event, "FAILED", fmt.Sprintf("Invalid request type: %s", event.RequestType), nil)
+	return h.sendResponse(event, "FAILED", fmt.Sprintf("Invalid request type: %s", event.RequestType), nil)
 }
 
-// handleDNSCheck checks for colliding DNS records in Cloudflare but doesn't make any changes
-func handleDNSCheck(ctx context.Context, event CloudFormationEvent) error {
-	props := event.ResourceProperties
-	log.Println("Starting Cloudflare DNS collision check")
+// connectCloudflare initializes the Cloudflare API client and resolves the zone ID for the domain,
+// verifying up front that the token is active and allowed to edit DNS records in the zone.
+// Returned errors are suitable as the FAILED reason sent to CloudFormation.
+func (h *handler) connectCloudflare(ctx context.Context, props CloudflareDNSProperties) (cloudflareAPI, string, error) {
+	// Get Cloudflare credentials from the configured token source
+	secret, err := h.getSecret(ctx, props)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get secret: %v", err)
+	}
 
-	// Validate required parameters
-	if props.SecretID == "" || props.Domain == "" || props.Subdomain == "" {
-		return sendResponse(event, "FAILED", "Missing required parameters", nil)
+	// Initialize Cloudflare API client
+	var api cloudflareAPI
+	if secret.ApiToken != "" {
+		api = h.newCloudflare(secret, cloudflareRetryPolicy(props))
+
+		// Verify the token before attempting any zone operations
+		verified, err := api.VerifyToken(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to verify Cloudflare API token: %v", err)
+		}
+		if verified.Status != user.TokenVerifyResponseStatusActive {
+			return nil, "", fmt.Errorf("token is %s, not active", verified.Status)
+		}
+	} else if secret.ApiKey != "" && secret.Email != "" {
+		// The Global API key can't be verified like a token, so problems surface from the zone lookup
+		api = h.newCloudflare(secret, cloudflareRetryPolicy(props))
+	} else {
+		return nil, "", fmt.Errorf("no API token or API key and email found in secret")
 	}
 
-	// Get Cloudflare API token from Secrets Manager
-	secret, err := getSecret(props.SecretID)
+	// Get the zone ID for the domain
+	zoneID, err := resolveZoneID(ctx, api, props)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to get secret: %v", err), nil)
+		return nil, "", fmt.Errorf("failed to get zone ID for %s: %v", props.Domain, err)
 	}
+	logger.Info("Found zone", "zone_id", zoneID, "domain", props.Domain)
 
-	if secret.ApiToken == "" {
-		return sendResponse(event, "FAILED", "API token not found in secret", nil)
+	// Check the token can edit DNS records in the zone
+	zone, err := api.GetZone(ctx, zoneID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get zone details for %s: %v", props.Domain, err)
+	}
+	if !strings.EqualFold(zone.Name, props.Domain) {
+		return nil, "", fmt.Errorf("zone %s is %s, not %s", zoneID, zone.Name, props.Domain)
+	}
+	if !hasDNSEditPermission(zonePermissions(zone)) {
+		return nil, "", fmt.Errorf("token lacks DNS:Edit on %s", props.Domain)
 	}
 
-	// Initialize Cloudflare API client
-	api, err := cloudflare.NewWithAPIToken(secret.ApiToken)
-	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to initialize Cloudflare API client: %v", err), nil)
+	return api, zoneID, nil
+}
+
+// resolveZoneID returns the configured zone ID, or looks the zone up by name,
+// restricted to the configured account if any
+func resolveZoneID(ctx context.Context, api cloudflareAPI, props CloudflareDNSProperties) (string, error) {
+	if props.ZoneID != "" {
+		return props.ZoneID, nil
 	}
 
-	// Get the zone ID for the domain
-	zoneID, err := api.ZoneIDByName(props.Domain)
+	params := zones.ZoneListParams{Name: cloudflare.F(props.Domain)}
+	if props.AccountID != "" {
+		params.Account = cloudflare.F(zones.ZoneListParamsAccount{ID: cloudflare.F(props.AccountID)})
+	}
+
+	result, err := api.ListZones(ctx, params)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to get zone ID for %s: %v", props.Domain, err), nil)
+		return "", err
+	}
+	switch len(result) {
+	case 0:
+		if props.AccountID != "" {
+			return "", fmt.Errorf("zone could not be found in account %s", props.AccountID)
+		}
+		return "", fmt.Errorf("zone could not be found")
+	case 1:
+		return result[0].ID, nil
+	default:
+		if props.AccountID != "" {
+			return "", fmt.Errorf("ambiguous zone name in account %s", props.AccountID)
+		}
+		return "", fmt.Errorf("ambiguous zone name; an account ID might help")
 	}
-	log.Println("Found zone ID:", zoneID, "for domain", props.Domain)
+}
 
-	// Create a ResourceContainer for the zone
-	rc := cloudflare.ZoneIdentifier(zoneID)
+// zonePermissions returns the permissions the credentials have on the zone. The
+// typed zone object doesn't expose them, so they are read from the raw response.
+func zonePermissions(zone *zones.Zone) []string {
+	var raw struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.Unmarshal([]byte(zone.JSON.RawJSON()), &raw); err != nil {
+		return nil
+	}
+	return raw.Permissions
+}
 
-	// Get existing DNS records for the subdomain
-	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
-	listParams := cloudflare.ListDNSRecordsParams{
-		Name: fullDomainName,
+// recordContent returns the content of a DNS record as a string
+func recordContent(record dns.Record) string {
+	if content, ok := record.Content.(string); ok {
+		return content
 	}
+	return fmt.Sprint(record.Content)
+}
 
-	records, _, err := api.ListDNSRecords(ctx, rc, listParams)
-	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+// describeRecords returns the type, content and ID of each record for debug logs
+func describeRecords(records []dns.Record) []string {
+	described := make([]string, 0, len(records))
+	for _, record := range records {
+		described = append(described, fmt.Sprintf("%s %s (%s)", record.Type, recordContent(record), record.ID))
 	}
+	return described
+}
 
-	// Check for colliding records (non-NS records)
-	var collidingRecords []cloudflare.DNSRecord
+// proxiedRecordsUnder returns the proxied records of the zone at the name or below it
+func proxiedRecordsUnder(ctx context.Context, api cloudflareAPI, zoneID, name string) ([]dns.Record, error) {
+	records, err := api.ListProxiedDNSRecords(ctx, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var under []dns.Record
 	for _, record := range records {
-		if record.Type != "NS" {
-			collidingRecords = append(collidingRecords, record)
+		if recordName := strings.ToLower(record.Name); recordName == name || strings.HasSuffix(recordName, "."+name) {
+			under = append(under, record)
 		}
 	}
+	return under, nil
+}
 
-	if len(collidingRecords) > 0 {
-		var recordTypes []string
-		for _, record := range collidingRecords {
-			recordTypes = append(recordTypes, record.Type)
-		}
-		return sendResponse(event, "FAILED", fmt.Sprintf("Found colliding DNS records for %s: %v. Please remove these records first", fullDomainName, recordTypes), nil)
+// collisionGuidance advises on the colliding record types that need more care than removing
+// them: a DS record makes validating resolvers expect a signed child zone, and CAA records stop
+// restricting the certificate authorities once the hosted zone answers for the name
+func collisionGuidance(recordTypes []string) string {
+	var guidance []string
+	if containsString(recordTypes, "DS") {
+		guidance = append(guidance, "The DS record tells validating resolvers that the subdomain is signed with DNSSEC, which the hosted zone isn't, so remove it, or the subdomain fails to resolve for them")
+	}
+	if containsString(recordTypes, "CAA") {
+		guidance = append(guidance, "The CAA records no longer apply once the hosted zone answers for the subdomain, so add them to its records before removing them, or any certificate authority may issue for it")
 	}
+	return strings.Join(guidance, ". ")
+}
 
-	// Create response data
-	data := map[string]interface{}{
-		"Domain":    props.Domain,
-		"Subdomain": props.Subdomain,
-		"ZoneID":    zoneID,
-		"Message":   "No colliding DNS records found",
+// hasDNSEditPermission reports whether the zone permissions allow editing DNS records.
+// Cloudflare omits the permission list for some token types, in which case the
+// permission is assumed and any problem surfaces from the DNS API itself.
+func hasDNSEditPermission(permissions []string) bool {
+	if len(permissions) == 0 {
+		return true
 	}
+	for _, permission := range permissions {
+		if permission == "#dns_records:edit" {
+			return true
+		}
+	}
+	return false
+}
 
-	return sendResponse(event, "SUCCESS", "DNS collision check completed successfully", data)
+// zoneHoldActive reports whether a zone hold is in effect at the given time.
+// A hold with a hold_after time in the past has been released.
+func zoneHoldActive(hold zones.ZoneHold, now time.Time) bool {
+	if !hold.Hold {
+		return false
+	}
+	if hold.HoldAfter == "" {
+		return true
+	}
+	holdAfter, err := time.Parse(time.RFC3339, hold.HoldAfter)
+	if err != nil {
+		return true
+	}
+	return holdAfter.After(now)
 }
 
-// handleDNSUpdate updates NS records in Cloudflare for the subdomain
-func handleDNSUpdate(ctx context.Context, event CloudFormationEvent) error {
+// handleDNSCheck checks for colliding DNS records in Cloudflare but doesn't make any changes
+func (h *handler) handleDNSCheck(ctx context.Context, event CloudFormationEvent) error {
 	props := event.ResourceProperties
-	log.Println("Starting Cloudflare NS record update")
+	logger.Info("Starting Cloudflare DNS collision check", "domain", props.Domain, "subdomain", props.Subdomain)
 
 	// Validate required parameters
-	if props.SecretID == "" || props.Domain == "" || props.Subdomain == "" || len(props.NameServers) == 0 {
-		return sendResponse(event, "FAILED", "Missing required parameters", nil)
+	if !props.hasTokenSource() || props.Domain == "" || props.Subdomain == "" {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
 	}
 
-	// Get Cloudflare API token from Secrets Manager
-	secret, err := getSecret(props.SecretID)
+	// A nested subdomain is delegated in the hosted zone of its parent subdomain
+	parent, client, err := nestedParentZone(ctx, props)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to get secret: %v", err), nil)
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to look up the parent hosted zone: %v", err), nil)
 	}
-
-	if secret.ApiToken == "" {
-		return sendResponse(event, "FAILED", "API token not found in secret", nil)
+	if parent != nil {
+		return h.handleNestedCheck(ctx, event, client, parent)
 	}
 
-	// Initialize Cloudflare API client
-	api, err := cloudflare.NewWithAPIToken(secret.ApiToken)
+	// Connect to Cloudflare and look up the zone for the domain
+	api, zoneID, err := h.connectCloudflare(ctx, props)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to initialize Cloudflare API client: %v", err), nil)
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
 	}
 
-	// Get the zone ID for the domain
-	zoneID, err := api.ZoneIDByName(props.Domain)
+	// A zone hold may restrict changes to the zone, so fail early rather than mid-update
+	hold, err := api.GetZoneHold(ctx, zoneID)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to get zone ID for %s: %v", props.Domain, err), nil)
+		logger.Warn("Could not check zone hold status", "domain", props.Domain, "error", err)
+	} else if zoneHoldActive(*hold, time.Now()) {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Zone %s has a zone hold enabled. Release the hold in the Cloudflare dashboard (Overview > Zone Hold) before delegating %s.%s", props.Domain, props.Subdomain, props.Domain), nil)
 	}
-	log.Println("Found zone ID:", zoneID, "for domain", props.Domain)
-
-	// Create a ResourceContainer for the zone
-	rc := cloudflare.ZoneIdentifier(zoneID)
 
 	// Get existing DNS records for the subdomain
 	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
-	listParams := cloudflare.ListDNSRecordsParams{
-		Name: fullDomainName,
+	records, err := api.ListDNSRecords(ctx, zoneID, fullDomainName)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
 	}
+	logger.Debug("Listed DNS records", "name", fullDomainName, "records", describeRecords(records))
 
-	records, _, err := api.ListDNSRecords(ctx, rc, listParams)
+	// Proxied records stop being proxied once Cloudflare no longer answers for their names
+	proxied, err := proxiedRecordsUnder(ctx, api, zoneID, fullDomainName)
 	if err != nil {
-		return sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+		logger.Warn("Could not check for proxied records", "name", fullDomainName, "error", err)
 	}
+	proxiedRecords := describeRecordDetails(proxied)
 
-	// Get existing NS records
-	var existingNSRecords []cloudflare.DNSRecord
+	// Check for colliding records (non-NS records)
+	var collidingRecords []dns.Record
 	for _, record := range records {
-		if record.Type == "NS" {
-			existingNSRecords = append(existingNSRecords, record)
+		if record.Type != dns.RecordTypeNS {
+			collidingRecords = append(collidingRecords, record)
+		}
+	}
+
+	metrics.Add("CollidingRecords", float64(len(collidingRecords)))
+	if len(collidingRecords) > 0 {
+		var recordTypes []string
+		for _, record := range collidingRecords {
+			recordTypes = append(recordTypes, string(record.Type))
+		}
+		colliding := describeRecordDetails(collidingRecords)
+		logger.Warn("Found colliding DNS records", "name", fullDomainName, "records", colliding)
+		reason := fmt.Sprintf("Found colliding DNS records for %s: %v. Please remove these records first", fullDomainName, recordTypes)
+		if guidance := collisionGuidance(recordTypes); guidance != "" {
+			reason += ". " + guidance
 		}
+		return h.sendResponse(event, "FAILED", reason, &ResponseData{
+			Domain:           props.Domain,
+			Subdomain:        props.Subdomain,
+			ZoneID:           zoneID,
+			CollidingRecords: colliding,
+			ProxiedRecords:   proxiedRecords,
+		})
 	}
-	log.Println("Found", len(existingNSRecords), "existing NS records for", fullDomainName)
 
-	// Extract existing nameservers (removing trailing dots)
-	var existingNameservers []string
-	for _, record := range existingNSRecords {
-		existingNameservers = append(existingNameservers, strings.TrimSuffix(record.Content, "."))
+	data := &ResponseData{
+		Domain:         props.Domain,
+		Subdomain:      props.Subdomain,
+		ZoneID:         zoneID,
+		ProxiedRecords: proxiedRecords,
+	}
+	if len(proxied) > 0 {
+		logger.Warn("Found proxied DNS records under the subdomain", "name", fullDomainName, "records", proxiedRecords)
+		reason := fmt.Sprintf("Found %d proxied DNS records under %s, which lose Cloudflare's proxy, WAF and caching once the subdomain is delegated", len(proxied), fullDomainName)
+		if props.AcceptProxiedRecords != "true" {
+			return h.sendResponse(event, "FAILED", reason+". Remove them, or accept the change with accept_proxied_records", data)
+		}
+		data.Warnings = reason
 	}
 
-	// Remove trailing dots from Route53 nameservers
-	var route53NameServersClean []string
-	for _, ns := range props.NameServers {
-		route53NameServersClean = append(route53NameServersClean, strings.TrimSuffix(ns, "."))
+	return h.sendResponse(event, "SUCCESS", "DNS collision check completed successfully", data)
+}
+
+// defaultNSRecordTTL is used when the NSRecordTTL property is not set
+const defaultNSRecordTTL = 3600
+
+// nsRecordTTL returns the TTL in seconds of the NS records created for the subdomain
+func nsRecordTTL(props CloudflareDNSProperties) int64 {
+	if props.NSRecordTTL == "" {
+		return defaultNSRecordTTL
 	}
+	ttl, err := strconv.ParseInt(props.NSRecordTTL, 10, 64)
+	if err != nil || ttl <= 0 {
+		logger.Warn("Invalid NSRecordTTL value, using default", "value", props.NSRecordTTL)
+		return defaultNSRecordTTL
+	}
+	return ttl
+}
+
+// nsDiff holds the changes that make the NS records of a subdomain match its name servers
+type nsDiff struct {
+	// Name servers of the hosted zone, normalized and without duplicates
+	desired []string
+	// Existing NS records, and those of them to delete
+	existing []dns.Record
+	remove   []dns.Record
+	// Name servers without a record, to create
+	add []string
+}
+
+// normalizeNameServer returns a name server in lower case without the trailing dot
+func normalizeNameServer(ns string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(ns), "."))
+}
+
+// maxHostNameLength is the longest host name DNS allows, without the trailing dot
+const maxHostNameLength = 253
 
-	// Identify nameservers to add and remove
-	var nsToAdd []string
-	var nsRecordsToRemove []cloudflare.DNSRecord
+// validateNameServers returns an error listing the name servers that aren't plausible fully
+// qualified host names, so that no broken NS records are created
+func validateNameServers(nameServers []string) error {
+	var invalid []string
+	for _, ns := range nameServers {
+		if problem := nameServerProblem(ns); problem != "" {
+			invalid = append(invalid, fmt.Sprintf("%q (%s)", ns, problem))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid name servers: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
 
-	for _, ns := range route53NameServersClean {
-		found := false
-		for _, existingNS := range existingNameservers {
-			if ns == existingNS {
-				found = true
-				break
+// nameServerProblem returns why a name server isn't a fully qualified host name, or "" if it is
+func nameServerProblem(ns string) string {
+	name := strings.TrimSuffix(ns, ".")
+	switch {
+	case strings.TrimSpace(ns) == "":
+		return "empty"
+	case strings.ContainsAny(ns, " \t\r\n"):
+		return "contains whitespace"
+	case net.ParseIP(name) != nil:
+		return "an IP address, not a host name"
+	case len(name) > maxHostNameLength:
+		return fmt.Sprintf("longer than %d characters", maxHostNameLength)
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "not fully qualified"
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return "labels must have 1 to 63 characters"
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "labels must not start or end with a hyphen"
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Sprintf("invalid character %q", c)
 			}
 		}
-		if !found {
-			nsToAdd = append(nsToAdd, ns)
+	}
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "numeric top-level domain"
+	}
+	return ""
+}
+
+// computeNSDiff compares the NS records among records with the desired name servers,
+// ignoring trailing dots and case. A name server with several records keeps the first one.
+func computeNSDiff(records []dns.Record, desired []string) nsDiff {
+	var diff nsDiff
+	wanted := map[string]bool{}
+	for _, ns := range desired {
+		ns = normalizeNameServer(ns)
+		if ns == "" || wanted[ns] {
+			continue
 		}
+		wanted[ns] = true
+		diff.desired = append(diff.desired, ns)
 	}
 
-	for _, record := range existingNSRecords {
-		found := false
-		cleanContent := strings.TrimSuffix(record.Content, ".")
-		for _, ns := range route53NameServersClean {
-			if cleanContent == ns {
-				found = true
-				break
-			}
+	present := map[string]bool{}
+	for _, record := range records {
+		if record.Type != dns.RecordTypeNS {
+			continue
 		}
-		if !found {
-			nsRecordsToRemove = append(nsRecordsToRemove, record)
+		diff.existing = append(diff.existing, record)
+		ns := normalizeNameServer(recordContent(record))
+		if !wanted[ns] || present[ns] {
+			diff.remove = append(diff.remove, record)
+			continue
 		}
+		present[ns] = true
 	}
 
-	// Delete incorrect NS records
-	deletedCount := 0
-	deleteErrors := []string{}
-	for _, record := range nsRecordsToRemove {
-		err := api.DeleteDNSRecord(ctx, rc, record.ID)
+	for _, ns := range diff.desired {
+		if !present[ns] {
+			diff.add = append(diff.add, ns)
+		}
+	}
+	return diff
+}
+
+// resolveNameServers returns the name servers to delegate to. Those of an existing hosted
+// zone, or of one in another account, are read from Route53.
+func resolveNameServers(ctx context.Context, props CloudflareDNSProperties) ([]string, error) {
+	if props.HostedZoneID != "" {
+		return lookupZoneNameServers(ctx, props.AssumeRoleArn, props.HostedZoneID)
+	}
+	if props.AssumeRoleArn != "" && props.Domain != "" && props.Subdomain != "" {
+		return lookupNameServers(ctx, props.AssumeRoleArn, fmt.Sprintf("%s.%s", props.Subdomain, props.Domain))
+	}
+	return props.NameServers, nil
+}
+
+// handleDNSUpdate updates NS records in Cloudflare for the subdomain
+func (h *handler) handleDNSUpdate(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	logger.Info("Starting Cloudflare NS record update", "domain", props.Domain, "subdomain", props.Subdomain)
+
+	nameServers, err := resolveNameServers(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to look up the hosted zone: %v", err), nil)
+	}
+	props.NameServers = nameServers
+
+	// Validate required parameters
+	if !props.hasTokenSource() || props.Domain == "" || props.Subdomain == "" || len(props.NameServers) == 0 {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
+	}
+
+	if err := validateNameServers(props.NameServers); err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Refusing to create NS records: %v", err), nil)
+	}
+
+	if props.LockTable != "" && props.Action == "update" {
+		release, err := h.acquireLock(ctx, event)
 		if err != nil {
-			errMsg := fmt.Sprintf("Error deleting NS record %s: %v", record.Content, err)
-			log.Println(errMsg)
-			deleteErrors = append(deleteErrors, errMsg)
-			continue
+			return h.sendResponse(event, "FAILED", err.Error(), nil)
+		}
+		defer release()
+	}
+
+	parent, client, err := nestedParentZone(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to look up the parent hosted zone: %v", err), nil)
+	}
+	if parent != nil {
+		return h.handleNestedUpdate(ctx, event, client, parent, props.NameServers)
+	}
+
+	// Connect to Cloudflare and look up the zone for the domain
+	api, zoneID, err := h.connectCloudflare(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
+	}
+
+	// Get existing DNS records for the subdomain
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	records, err := api.ListDNSRecords(ctx, zoneID, fullDomainName)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+	}
+	logger.Debug("Listed DNS records", "name", fullDomainName, "records", describeRecords(records))
+
+	// Compare the existing NS records with the name servers of the hosted zone
+	diff := computeNSDiff(records, props.NameServers)
+	logger.Info("Found existing NS records", "count", len(diff.existing), "name", fullDomainName)
+	nsToAdd, nsRecordsToRemove := diff.add, diff.remove
+
+	// Append mode keeps the records it would remove, which aren't the delegation's own
+	existing := diff.existing
+	if props.Mode == modeAppend {
+		if len(nsRecordsToRemove) > 0 {
+			logger.Info("Leaving the NS records of other name servers in place", "count", len(nsRecordsToRemove), "name", fullDomainName)
 		}
-		log.Println("Deleted NS record", record.Content)
-		deletedCount++
+		existing = managedRecords(diff.existing, nsRecordsToRemove, nil, nil)
+		nsRecordsToRemove = nil
 	}
 
-	// Add missing NS records
-	addedCount := 0
-	addErrors := []string{}
-	for _, ns := range nsToAdd {
-		createParams := cloudflare.CreateDNSRecordParams{
-			Type:    "NS",
-			Name:    fullDomainName,
-			Content: ns,
-			TTL:     3600,
+	// A plan returns the changes without making them
+	if props.Action == "plan" {
+		var nsToRemove, recordIdsToRemove []string
+		for _, record := range nsRecordsToRemove {
+			nsToRemove = append(nsToRemove, normalizeNameServer(recordContent(record)))
+			recordIdsToRemove = append(recordIdsToRemove, record.ID)
 		}
+		logger.Info("Planned NS record changes", "add", len(nsToAdd), "remove", len(nsRecordsToRemove))
+		metrics.Add("NSRecordDrift", float64(len(nsToAdd)+len(nsRecordsToRemove)))
+		return h.sendResponse(event, "SUCCESS", "NS record changes planned", &ResponseData{
+			Domain:              props.Domain,
+			Subdomain:           props.Subdomain,
+			ZoneID:              zoneID,
+			NameServers:         strings.Join(diff.desired, ","),
+			NameServersToAdd:    strings.Join(nsToAdd, ","),
+			NameServersToRemove: strings.Join(nsToRemove, ","),
+			RecordIds:           strings.Join(recordIdsToRemove, ","),
+		})
+	}
 
-		_, err := api.CreateDNSRecord(ctx, rc, createParams)
+	// Replace the incorrect NS records with the missing ones in one batch, which Cloudflare
+	// applies in a single transaction, so that either every change is made or none
+	deletedCount, addedCount := 0, 0
+	recordIds := keptRecordIds(existing, nsRecordsToRemove)
+	var batchErrors []string
+	var undeleted, created []dns.Record
+	if len(nsRecordsToRemove) > 0 || len(nsToAdd) > 0 {
+		var batch dnsRecordBatch
+		for _, record := range nsRecordsToRemove {
+			batch.Deletes = append(batch.Deletes, dnsRecordBatchDelete{ID: record.ID})
+		}
+		for _, ns := range nsToAdd {
+			batch.Posts = append(batch.Posts, dnsRecordBatchPost{Type: "NS", Name: fullDomainName, Content: ns, TTL: nsRecordTTL(props)})
+		}
+		result, err := api.BatchDNSRecords(ctx, zoneID, batch)
 		if err != nil {
-			errMsg := fmt.Sprintf("Error creating NS record for %s: %v", ns, err)
-			log.Println(errMsg)
-			addErrors = append(addErrors, errMsg)
-			continue
+			logger.Error("Error changing NS records", "delete", len(batch.Deletes), "add", len(batch.Posts), "error", err)
+			batchErrors = append(batchErrors, fmt.Sprintf("Error changing NS records: %v", err))
+			undeleted = nsRecordsToRemove
+			recordIds = keptRecordIds(existing, nil)
+		} else {
+			for _, record := range nsRecordsToRemove {
+				logger.Info("Deleted NS record", "content", recordContent(record))
+			}
+			for _, record := range result.Posts {
+				logger.Info("Created NS record", "content", recordContent(record))
+				recordIds = append(recordIds, record.ID)
+			}
+			created = result.Posts
+			deletedCount, addedCount = len(nsRecordsToRemove), len(result.Posts)
+		}
+	}
+
+	// The state table records the NS records the delegation now has in Cloudflare
+	var stateErrors []string
+	if props.StateTable != "" {
+		if err := h.syncRecordState(ctx, event, zoneID, managedRecords(existing, nsRecordsToRemove, undeleted, created)); err != nil {
+			logger.Error("Error recording the NS records", "error", err)
+			stateErrors = append(stateErrors, err.Error())
 		}
-		log.Println("Created NS record for", ns)
-		addedCount++
 	}
 
-	// Create response data
-	data := map[string]interface{}{
-		"Domain":             props.Domain,
-		"Subdomain":          props.Subdomain,
-		"ZoneID":             zoneID,
-		"NSRecordsDeleted":   deletedCount,
-		"NSRecordsAdded":     addedCount,
-		"Route53NameServers": route53NameServersClean,
+	metrics.Add("NSRecordsDeleted", float64(deletedCount))
+	metrics.Add("NSRecordsAdded", float64(addedCount))
+	metrics.Add("NSRecordErrors", float64(len(batchErrors)))
+
+	data := &ResponseData{
+		Domain:         props.Domain,
+		Subdomain:      props.Subdomain,
+		ZoneID:         zoneID,
+		NameServers:    strings.Join(diff.desired, ","),
+		RecordsAdded:   strconv.Itoa(addedCount),
+		RecordsDeleted: strconv.Itoa(deletedCount),
+		RecordIds:      strings.Join(recordIds, ","),
 	}
 
 	// Add error information if there were any errors
-	if len(deleteErrors) > 0 || len(addErrors) > 0 {
-		data["Warnings"] = map[string]interface{}{
-			"DeleteErrors": deleteErrors,
-			"AddErrors":    addErrors,
-		}
+	if len(batchErrors) > 0 || len(stateErrors) > 0 {
+		data.Warnings = strings.Join(append(batchErrors, stateErrors...), "; ")
 
 		// Log warnings prominently
-		log.Println("WARNING: There were", len(deleteErrors), "delete errors and", len(addErrors), "add errors during NS record update")
+		logger.Warn("NS record update had errors", "batch_errors", len(batchErrors), "state_errors", len(stateErrors))
 	}
 
 	// If no records were successfully added when they needed to be, consider that a failure
 	if len(nsToAdd) > 0 && addedCount == 0 {
-		return sendResponse(event, "FAILED",
+		return h.sendResponse(event, "FAILED",
 			fmt.Sprintf("Failed to add any of the %d required NS records. See CloudWatch logs for details.", len(nsToAdd)),
 			data)
 	}
 
 	// If no records were successfully deleted when they needed to be, add a warning but don't fail
 	if len(nsRecordsToRemove) > 0 && deletedCount == 0 {
-		log.Println("WARNING: Failed to delete any of the outdated NS records")
+		logger.Warn("Failed to delete any of the outdated NS records")
 	}
 
-	return sendResponse(event, "SUCCESS", "NS records updated successfully", data)
+	return h.sendResponse(event, "SUCCESS", "NS records updated successfully", data)
 }
 
 func main() {
-	lambda.Start(HandleRequest)
+	h, err := newHandler()
+	if err != nil {
+		logger.Error("Failed to initialize the handler", "error", err)
+		os.Exit(1)
+	}
+	lambda.Start(withPowertools(h.HandleEvent))
 }
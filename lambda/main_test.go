@@ -0,0 +1,2412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/cloudflare/cloudflare-go/v2/user"
+	"github.com/cloudflare/cloudflare-go/v2/zones"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+		wantErr  bool
+	}{
+		{name: "json object", raw: `{"api_token":"json-token"}`, expected: "json-token"},
+		{name: "plain string", raw: "plain-token", expected: "plain-token"},
+		{name: "plain string with whitespace", raw: "  plain-token\n", expected: "plain-token"},
+		{name: "global api key", raw: `{"api_key":"key","email":"ops@example.com"}`, expected: ""},
+		{name: "empty", raw: "   ", wantErr: true},
+		{name: "invalid json", raw: `{"api_token":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := parseSecret([]byte(tt.raw))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got none", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if secret.ApiToken != tt.expected {
+				t.Errorf("Expected ApiToken %s, got %s", tt.expected, secret.ApiToken)
+			}
+		})
+	}
+}
+
+func TestHasDNSEditPermission(t *testing.T) {
+	if !hasDNSEditPermission([]string{"#zone:read", "#dns_records:edit"}) {
+		t.Errorf("Expected DNS edit permission to be found")
+	}
+	if hasDNSEditPermission([]string{"#zone:read", "#dns_records:read"}) {
+		t.Errorf("Expected missing DNS edit permission to be detected")
+	}
+	if !hasDNSEditPermission(nil) {
+		t.Errorf("Expected unknown permissions to be allowed")
+	}
+}
+
+func TestCollisionGuidance(t *testing.T) {
+	if guidance := collisionGuidance([]string{"A", "TXT"}); guidance != "" {
+		t.Errorf("Expected no guidance for plain records, got %q", guidance)
+	}
+	guidance := collisionGuidance([]string{"CAA", "DS"})
+	if !strings.Contains(guidance, "DS record tells validating resolvers") || !strings.Contains(guidance, "CAA records no longer apply") {
+		t.Errorf("Expected DS and CAA guidance, got %q", guidance)
+	}
+}
+
+func TestForEachParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, most := 0, 0
+	errs := forEachParallel(context.Background(), 10, func(i int) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if i%4 == 1 {
+			return fmt.Errorf("record %d failed", i)
+		}
+		return nil
+	})
+	if most > recordWorkers {
+		t.Errorf("Expected at most %d operations at once, got %d", recordWorkers, most)
+	}
+	if errs[1] == nil || errs[0] != nil || errs[9] == nil {
+		t.Errorf("Expected the errors by index, got %v", errs)
+	}
+	if err := aggregateErrors(errs); err == nil || err.Error() != "3 of 10 operations failed: record 1 failed; record 5 failed; record 9 failed" {
+		t.Errorf("Expected the aggregated errors, got %v", err)
+	}
+	if err := aggregateErrors(errs[:2]); err == nil || err.Error() != "record 1 failed" {
+		t.Errorf("Expected the single error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if errs := forEachParallel(ctx, 3, func(int) error { return nil }); !errors.Is(errs[2], context.Canceled) {
+		t.Errorf("Expected the calls to stop with the context, got %v", errs)
+	}
+}
+
+func TestZoneHoldActive(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+	future := now.Add(time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name     string
+		hold     zones.ZoneHold
+		expected bool
+	}{
+		{name: "no hold", hold: zones.ZoneHold{}, expected: false},
+		{name: "hold enabled", hold: zones.ZoneHold{Hold: true}, expected: true},
+		{name: "hold released", hold: zones.ZoneHold{Hold: true, HoldAfter: past}, expected: false},
+		{name: "hold pending release", hold: zones.ZoneHold{Hold: true, HoldAfter: future}, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := zoneHoldActive(tt.hold, now); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMetricsFlush(t *testing.T) {
+	var out bytes.Buffer
+	recorder := &metricsRecorder{out: &out, namespace: "cftor53", service: "cftor53", values: map[string]float64{}}
+	recorder.Add("NSRecordsAdded", 2)
+	recorder.Add("NSRecordsAdded", 1)
+	recorder.Flush()
+
+	var entry struct {
+		AWS struct {
+			CloudWatchMetrics []struct {
+				Namespace string
+				Metrics   []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		Service        string  `json:"service"`
+		NSRecordsAdded float64 `json:"NSRecordsAdded"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Metrics output is not JSON: %v", err)
+	}
+	if entry.NSRecordsAdded != 3 || entry.Service != "cftor53" {
+		t.Errorf("Unexpected metrics entry: %s", out.String())
+	}
+	if len(entry.AWS.CloudWatchMetrics) != 1 || entry.AWS.CloudWatchMetrics[0].Namespace != "cftor53" || len(entry.AWS.CloudWatchMetrics[0].Metrics) != 1 {
+		t.Errorf("Unexpected metric definitions: %s", out.String())
+	}
+
+	// Nothing is written once the metrics are flushed
+	out.Reset()
+	recorder.Flush()
+	if out.Len() != 0 {
+		t.Errorf("Expected no output after flush, got %s", out.String())
+	}
+
+	// The delegated name is a second dimension until the metrics are flushed
+	recorder.SetDelegation("api.example.com")
+	recorder.Add("NSRecordDrift", 0)
+	recorder.Flush()
+	if !strings.Contains(out.String(), `"delegation":"api.example.com"`) || !strings.Contains(out.String(), `"Dimensions":[["service"],["service","delegation"]]`) || !strings.Contains(out.String(), `"NSRecordDrift":0`) {
+		t.Errorf("Expected the metrics of the delegation, got %s", out.String())
+	}
+	if recorder.delegation != "" {
+		t.Errorf("Expected the delegation to be reset, got %s", recorder.delegation)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := &structuredLogger{out: &out, service: "cftor53"}
+	l.Warn("Could not check zone hold status", "domain", "example.com", "error", errors.New("timeout"))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Log output is not JSON: %v", err)
+	}
+	if entry["level"] != "WARN" || entry["domain"] != "example.com" || entry["error"] != "timeout" || entry["service"] != "cftor53" {
+		t.Errorf("Unexpected log entry: %s", out.String())
+	}
+
+	// Entries below LOG_LEVEL are left out
+	t.Setenv("LOG_LEVEL", "warn")
+	out.Reset()
+	l = &structuredLogger{out: &out, service: "cftor53", level: logLevel()}
+	l.Debug("Listed DNS records", "records", []string{"NS ns-1.awsdns-01.org (record-1)"})
+	l.Info("Found zone")
+	if out.Len() != 0 {
+		t.Errorf("Expected no entries below WARN, got %s", out.String())
+	}
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	l = &structuredLogger{out: &out, service: "cftor53", level: logLevel()}
+	l.Debug("Listed DNS records", "records", []string{"NS ns-1.awsdns-01.org (record-1)"})
+	if !strings.Contains(out.String(), `"level":"DEBUG"`) || !strings.Contains(out.String(), "record-1") {
+		t.Errorf("Expected the debug entry, got %s", out.String())
+	}
+	t.Setenv("LOG_LEVEL", "verbose")
+	if level := logLevel(); level != logLevels["INFO"] {
+		t.Errorf("Expected INFO for an unknown level, got %d", level)
+	}
+}
+
+func TestRedactedLogs(t *testing.T) {
+	// The token of the secret read by the handler is redacted wherever it appears
+	h, _, _ := newTestHandler(t)
+	h.secretsManager = &fakeSecretsManager{value: `{"api_token":"cf-redaction-token-123"}`}
+	if _, err := h.getSecret(context.Background(), testEvent("Create", "check").ResourceProperties); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	l := &structuredLogger{out: &out, service: "cftor53"}
+	responseURL := "https://cloudformation-custom-resource-response-eunorth1.s3.eu-north-1.amazonaws.com/arn%3Aaws%3Acloudformation/response?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIAEXAMPLE&X-Amz-Signature=abcdef"
+	l.Error("Token cf-redaction-token-123 was rejected",
+		"api_token", "another-token-value",
+		"ResponseURL", responseURL,
+		"error", fmt.Errorf(`Put %q: dial tcp: i/o timeout`, responseURL),
+		"name", "api.example.com")
+	for _, leaked := range []string{"cf-redaction-token-123", "another-token-value", "X-Amz-Signature", "AKIAEXAMPLE", `{"api_token"`} {
+		if strings.Contains(out.String(), leaked) {
+			t.Errorf("Expected %s to be redacted, got %s", leaked, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), `"name":"api.example.com"`) || !strings.Contains(out.String(), "response?[REDACTED]") {
+		t.Errorf("Expected the other values and the URL without its query, got %s", out.String())
+	}
+
+	// Errors reported to the Lambda runtime are redacted too
+	if err := redactError(errors.New("verify failed for cf-redaction-token-123")); err.Error() != "verify failed for [REDACTED]" {
+		t.Errorf("Expected a redacted error, got %v", err)
+	}
+	if err := redactError(nil); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestNameServerDifference(t *testing.T) {
+	missing, extra := nameServerDifference(
+		[]string{"ns-1.awsdns-00.com.", "NS-2.awsdns-00.net", "ns-old.example.org"},
+		[]string{"ns-1.awsdns-00.com", "ns-2.awsdns-00.net.", "ns-3.awsdns-00.org"},
+	)
+	if len(missing) != 1 || missing[0] != "ns-3.awsdns-00.org" {
+		t.Errorf("Unexpected missing name servers: %v", missing)
+	}
+	if len(extra) != 1 || extra[0] != "ns-old.example.org" {
+		t.Errorf("Unexpected extra name servers: %v", extra)
+	}
+
+	missing, extra = nameServerDifference([]string{"ns-1.awsdns-00.com."}, []string{"ns-1.awsdns-00.com"})
+	if len(missing) != 0 || len(extra) != 0 {
+		t.Errorf("Expected no difference, got missing %v extra %v", missing, extra)
+	}
+}
+
+func TestComputeNSDiff(t *testing.T) {
+	ns := func(id, content string) dns.Record {
+		return dns.Record{ID: id, Type: dns.RecordTypeNS, Name: "api.example.com", Content: content}
+	}
+	tests := []struct {
+		name     string
+		records  []dns.Record
+		desired  []string
+		expected []string
+		add      []string
+		remove   []string
+	}{
+		{
+			name:     "no records",
+			desired:  []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.com."},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			add:      []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+		},
+		{
+			name:     "in sync",
+			records:  []dns.Record{ns("1", "ns-1.awsdns-01.org"), ns("2", "ns-2.awsdns-02.com")},
+			desired:  []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+		},
+		{
+			name:     "trailing dots",
+			records:  []dns.Record{ns("1", "ns-1.awsdns-01.org."), ns("2", "ns-2.awsdns-02.com")},
+			desired:  []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com."},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+		},
+		{
+			name:     "casing",
+			records:  []dns.Record{ns("1", "NS-1.AWSDNS-01.ORG"), ns("2", "ns-2.awsdns-02.com")},
+			desired:  []string{"ns-1.awsdns-01.org", "Ns-2.Awsdns-02.Com."},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+		},
+		{
+			name:     "replaced name server",
+			records:  []dns.Record{ns("1", "ns-1.awsdns-01.org"), ns("old", "ns-9.awsdns-09.net")},
+			desired:  []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			add:      []string{"ns-2.awsdns-02.com"},
+			remove:   []string{"old"},
+		},
+		{
+			name:     "duplicate desired name servers",
+			desired:  []string{"ns-1.awsdns-01.org.", "NS-1.awsdns-01.org", "ns-1.awsdns-01.org"},
+			expected: []string{"ns-1.awsdns-01.org"},
+			add:      []string{"ns-1.awsdns-01.org"},
+		},
+		{
+			name:     "duplicate records keep the first",
+			records:  []dns.Record{ns("1", "ns-1.awsdns-01.org"), ns("dup", "NS-1.awsdns-01.org."), ns("2", "ns-2.awsdns-02.com")},
+			desired:  []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			remove:   []string{"dup"},
+		},
+		{
+			name: "other record types are ignored",
+			records: []dns.Record{
+				{ID: "a", Type: dns.RecordTypeA, Name: "api.example.com", Content: "192.0.2.1"},
+				{ID: "txt", Type: dns.RecordTypeTXT, Name: "api.example.com", Content: "ns-1.awsdns-01.org"},
+			},
+			desired:  []string{"ns-1.awsdns-01.org"},
+			expected: []string{"ns-1.awsdns-01.org"},
+			add:      []string{"ns-1.awsdns-01.org"},
+		},
+		{
+			name:    "empty desired name servers",
+			records: []dns.Record{ns("1", "ns-1.awsdns-01.org")},
+			desired: []string{"", " . "},
+			remove:  []string{"1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := computeNSDiff(tt.records, tt.desired)
+			var remove []string
+			for _, record := range diff.remove {
+				remove = append(remove, record.ID)
+			}
+			if strings.Join(diff.desired, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected desired %v, got %v", tt.expected, diff.desired)
+			}
+			if strings.Join(diff.add, ",") != strings.Join(tt.add, ",") {
+				t.Errorf("Expected to add %v, got %v", tt.add, diff.add)
+			}
+			if strings.Join(remove, ",") != strings.Join(tt.remove, ",") {
+				t.Errorf("Expected to remove %v, got %v", tt.remove, remove)
+			}
+		})
+	}
+}
+
+func TestNameServerList(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected []string
+		err      bool
+	}{
+		{name: "list", raw: `["ns-1.awsdns-01.org.", "ns-2.awsdns-02.com."]`, expected: []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.com."}},
+		{name: "comma-joined string", raw: `"ns-1.awsdns-01.org,ns-2.awsdns-02.com"`, expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"}},
+		{name: "joined with spaces", raw: `"ns-1.awsdns-01.org, ns-2.awsdns-02.com, "`, expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"}},
+		{name: "joined list entry", raw: `["ns-1.awsdns-01.org,ns-2.awsdns-02.com", " ns-3.awsdns-03.net "]`, expected: []string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com", "ns-3.awsdns-03.net"}},
+		{name: "single name server", raw: `"ns-1.awsdns-01.org"`, expected: []string{"ns-1.awsdns-01.org"}},
+		{name: "empty string", raw: `""`},
+		{name: "empty list", raw: `[]`},
+		{name: "null", raw: `null`},
+		{name: "number", raw: `42`, err: true},
+		{name: "object", raw: `{"ns": "ns-1.awsdns-01.org"}`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var props CloudflareDNSProperties
+			err := json.Unmarshal([]byte(`{"Domain":"example.com","NameServers":`+tt.raw+`}`), &props)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", props.NameServers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if strings.Join(props.NameServers, "|") != strings.Join(tt.expected, "|") || props.Domain != "example.com" {
+				t.Errorf("Expected %v, got %v", tt.expected, props.NameServers)
+			}
+		})
+	}
+}
+
+func TestValidateNameServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		ns      string
+		problem string
+	}{
+		{name: "route53", ns: "ns-1.awsdns-01.org."},
+		{name: "without trailing dot", ns: "ns-2.awsdns-02.com"},
+		{name: "upper case", ns: "NS-3.AWSDNS-03.NET"},
+		{name: "punycode", ns: "ns1.xn--mnchen-3ya.de"},
+		{name: "empty", ns: "", problem: "empty"},
+		{name: "blank", ns: "  ", problem: "empty"},
+		{name: "whitespace", ns: "ns-1.awsdns-01 .org", problem: "contains whitespace"},
+		{name: "IPv4", ns: "192.0.2.1", problem: "an IP address, not a host name"},
+		{name: "IPv6", ns: "2001:db8::1", problem: "an IP address, not a host name"},
+		{name: "single label", ns: "localhost", problem: "not fully qualified"},
+		{name: "empty label", ns: "ns-1..awsdns-01.org", problem: "labels must have 1 to 63 characters"},
+		{name: "long label", ns: strings.Repeat("a", 64) + ".example.com", problem: "labels must have 1 to 63 characters"},
+		{name: "long name", ns: strings.Repeat("a.", 127) + "com", problem: "longer than 253 characters"},
+		{name: "hyphen", ns: "-ns.example.com", problem: "labels must not start or end with a hyphen"},
+		{name: "invalid character", ns: "ns_1.example.com", problem: `invalid character '_'`},
+		{name: "URL", ns: "https://ns-1.awsdns-01.org", problem: `invalid character ':'`},
+		{name: "numeric top-level domain", ns: "ns.192", problem: "numeric top-level domain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nameServerProblem(tt.ns); got != tt.problem {
+				t.Errorf("Expected %q, got %q", tt.problem, got)
+			}
+		})
+	}
+
+	err := validateNameServers([]string{"ns-1.awsdns-01.org.", "192.0.2.1", ""})
+	if err == nil || err.Error() != `invalid name servers: "192.0.2.1" (an IP address, not a host name), "" (empty)` {
+		t.Errorf("Expected the invalid name servers to be listed, got %v", err)
+	}
+}
+
+func TestASCIIDomainNames(t *testing.T) {
+	props, err := asciiDomainNames(CloudflareDNSProperties{Domain: "bücher.example", Subdomain: "München"})
+	if err != nil || props.Domain != "xn--bcher-kva.example" || props.Subdomain != "xn--mnchen-3ya" {
+		t.Errorf("Expected the names in punycode, got %+v (%v)", props, err)
+	}
+	props, err = asciiDomainNames(CloudflareDNSProperties{Domain: "Example.com", Subdomain: "xn--mnchen-3ya"})
+	if err != nil || props.Domain != "Example.com" || props.Subdomain != "xn--mnchen-3ya" {
+		t.Errorf("Expected ASCII names to be left alone, got %+v (%v)", props, err)
+	}
+	if _, err := asciiDomainNames(CloudflareDNSProperties{Domain: "example.com", Subdomain: "mün chen"}); err == nil {
+		t.Errorf("Expected an error for an invalid name")
+	}
+
+	// The zone and the records are looked up by their punycode
+	h, api, responses := newTestHandler(t)
+	api.zone = zones.Zone{ID: "zone-1", Name: "xn--bcher-kva.example"}
+	event := testEvent("Create", "update")
+	event.ResourceProperties.Domain = "bücher.example"
+	event.ResourceProperties.Subdomain = "münchen"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || response.Data.Domain != "xn--bcher-kva.example" || response.Data.Subdomain != "xn--mnchen-3ya" {
+		t.Errorf("Expected the delegation of the punycode names, got %+v", response)
+	}
+}
+
+func TestWorkflowFailureReason(t *testing.T) {
+	tests := map[string]string{
+		`{"Error":"errorString","Cause":"{\"errorMessage\":\"Found colliding DNS records\",\"errorType\":\"errorString\"}"}`: "Found colliding DNS records",
+		`{"Error":"Route53.HostedZoneNotEmptyException","Cause":"The hosted zone contains resource record sets"}`:            "The hosted zone contains resource record sets",
+		`{"Error":"States.Timeout"}`: "Delegation workflow failed: States.Timeout",
+		"":                           "Delegation workflow failed",
+	}
+	for cause, expected := range tests {
+		if got := workflowFailureReason(cause); got != expected {
+			t.Errorf("workflowFailureReason(%q) = %q, want %q", cause, got, expected)
+		}
+	}
+}
+
+func TestSendResponseDirectInvocation(t *testing.T) {
+	h := &handler{}
+	event := CloudFormationEvent{RequestType: "Create"}
+	if err := h.sendResponse(event, "SUCCESS", "ok", nil); err != nil {
+		t.Errorf("Expected no error for a successful step, got %v", err)
+	}
+	if err := h.sendResponse(event, "FAILED", "colliding records", nil); err == nil || err.Error() != "colliding records" {
+		t.Errorf("Expected the failure reason as error, got %v", err)
+	}
+	event.result = &ResponseData{}
+	if err := h.sendResponse(event, "SUCCESS", "planned", &ResponseData{NameServersToAdd: "ns-1.awsdns-01.org"}); err != nil {
+		t.Errorf("Expected no error for a plan, got %v", err)
+	}
+	if event.result.NameServersToAdd != "ns-1.awsdns-01.org" {
+		t.Errorf("Expected the data as result, got %+v", event.result)
+	}
+}
+
+func TestFindPublicHostedZone(t *testing.T) {
+	zones := []*route53.HostedZone{
+		{Id: aws.String("/hostedzone/PRIVATE"), Name: aws.String("api.example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)}},
+		{Id: aws.String("/hostedzone/PUBLIC"), Name: aws.String("api.example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(false)}},
+		{Id: aws.String("/hostedzone/OTHER"), Name: aws.String("app.example.com.")},
+	}
+	if id := findPublicHostedZone(zones, "API.example.com"); id != "/hostedzone/PUBLIC" {
+		t.Errorf("Expected the public zone, got %q", id)
+	}
+	if id := findPublicHostedZone(zones, "www.example.com"); id != "" {
+		t.Errorf("Expected no zone, got %q", id)
+	}
+}
+
+// fakeRoute53 answers ListHostedZonesByName from a fixed list of zones
+type fakeRoute53 struct {
+	route53iface.Route53API
+	zones   []*route53.HostedZone
+	queried []string
+}
+
+func (f *fakeRoute53) ListHostedZonesByNameWithContext(_ aws.Context, input *route53.ListHostedZonesByNameInput, _ ...request.Option) (*route53.ListHostedZonesByNameOutput, error) {
+	f.queried = append(f.queried, aws.StringValue(input.DNSName))
+	return &route53.ListHostedZonesByNameOutput{HostedZones: f.zones}, nil
+}
+
+func TestParentZoneCandidates(t *testing.T) {
+	candidates := parentZoneCandidates("example.com", "a.b.c")
+	expected := []string{"b.c.example.com", "c.example.com"}
+	if len(candidates) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, candidates)
+	}
+	for i := range expected {
+		if candidates[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, candidates)
+		}
+	}
+	if candidates := parentZoneCandidates("example.com", "sub"); len(candidates) != 0 {
+		t.Errorf("Expected no candidates for a direct subdomain, got %v", candidates)
+	}
+}
+
+func TestFindParentZone(t *testing.T) {
+	client := &fakeRoute53{zones: []*route53.HostedZone{
+		{Id: aws.String("/hostedzone/PRIVATE"), Name: aws.String("b.c.example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)}},
+		{Id: aws.String("/hostedzone/PARENT"), Name: aws.String("c.example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(false)}},
+	}}
+	parent, err := findParentZone(context.Background(), client, "example.com", "a.b.c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parent == nil || parent.ID != "/hostedzone/PARENT" || parent.Name != "c.example.com" {
+		t.Errorf("Expected the public c.example.com zone, got %+v", parent)
+	}
+	if len(client.queried) != 2 {
+		t.Errorf("Expected the nearest parent to be queried first, got %v", client.queried)
+	}
+
+	client = &fakeRoute53{}
+	if parent, err := findParentZone(context.Background(), client, "example.com", "a.b"); err != nil || parent != nil {
+		t.Errorf("Expected no parent zone, got %+v, %v", parent, err)
+	}
+}
+
+func TestNSRecordTTL(t *testing.T) {
+	tests := map[string]int64{"": 3600, "300": 300, "0": 3600, "soon": 3600}
+	for value, expected := range tests {
+		if ttl := nsRecordTTL(CloudflareDNSProperties{NSRecordTTL: value}); ttl != expected {
+			t.Errorf("nsRecordTTL(%q) = %d, expected %d", value, ttl, expected)
+		}
+	}
+}
+
+func TestPropagationTiming(t *testing.T) {
+	tests := map[string]time.Duration{"": 30 * time.Minute, "600": 10 * time.Minute, "-5": 30 * time.Minute, "later": 30 * time.Minute}
+	for value, expected := range tests {
+		if timeout := propagationTimeout(CloudflareDNSProperties{PropagationTimeoutSeconds: value}); timeout != expected {
+			t.Errorf("propagationTimeout(%q) = %s, expected %s", value, timeout, expected)
+		}
+	}
+	if interval := pollInterval(CloudflareDNSProperties{PollIntervalSeconds: "30"}); interval != 30*time.Second {
+		t.Errorf("pollInterval(\"30\") = %s, expected 30s", interval)
+	}
+}
+
+func TestIdempotencyToken(t *testing.T) {
+	if token := idempotencyToken("d8a1b7a0-3c55-4a1e-9f3e-0c8c5f2b6a7d"); token != "d8a1b7a03c554a1e9f3e0c8c5f2b6a7d" {
+		t.Errorf("Unexpected token %s", token)
+	}
+}
+
+func TestCertificateReplacementNeeded(t *testing.T) {
+	event := CloudFormationEvent{
+		ResourceProperties: CloudflareDNSProperties{Domain: "example.com", Subdomain: "api", SubjectAlternativeNames: []string{"*.api.example.com"}},
+		OldResourceProperties: map[string]interface{}{
+			"Domain":                  "example.com",
+			"Subdomain":               "api",
+			"SubjectAlternativeNames": []interface{}{"*.api.example.com"},
+			"ServiceToken":            "arn:aws:lambda:us-east-1:111111111111:function:old",
+		},
+	}
+	if certificateReplacementNeeded(event) {
+		t.Errorf("Expected no replacement when only other properties change")
+	}
+	event.ResourceProperties.KeyAlgorithm = "EC_prime256v1"
+	if !certificateReplacementNeeded(event) {
+		t.Errorf("Expected a replacement for a new key algorithm")
+	}
+}
+
+func TestResponseData(t *testing.T) {
+	encoded, err := json.Marshal(&CloudFormationResponse{Data: &ResponseData{
+		ZoneID:       "zone",
+		NameServers:  joinNameServers([]string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.com"}),
+		RecordsAdded: "2",
+	}})
+	if err != nil {
+		t.Fatalf("Failed to marshal the response: %v", err)
+	}
+	var response struct {
+		Data map[string]interface{} `json:"Data"`
+	}
+	if err := json.Unmarshal(encoded, &response); err != nil {
+		t.Fatalf("Failed to unmarshal the response: %v", err)
+	}
+	expected := map[string]interface{}{"ZoneID": "zone", "NameServers": "ns-1.awsdns-01.org,ns-2.awsdns-02.com", "RecordsAdded": "2"}
+	if len(response.Data) != len(expected) {
+		t.Errorf("Expected only the set values, got %v", response.Data)
+	}
+	for key, value := range expected {
+		if response.Data[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, response.Data[key])
+		}
+	}
+}
+
+func TestKeptRecordIds(t *testing.T) {
+	existing := []dns.Record{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	ids := keptRecordIds(existing, []dns.Record{{ID: "b"}})
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("Expected [a c], got %v", ids)
+	}
+}
+
+// fakeSecretsManager returns a fixed secret value
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	value string
+	calls int
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(_ aws.Context, input *secretsmanager.GetSecretValueInput, _ ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+	if f.value == "" {
+		return nil, errors.New("ResourceNotFoundException: " + aws.StringValue(input.SecretId))
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(f.value)}, nil
+}
+
+// fakeSSM returns a fixed parameter value and records the written ones
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	value  string
+	put    map[string]string
+	putErr error
+}
+
+func (f *fakeSSM) GetParameterWithContext(_ aws.Context, input *ssm.GetParameterInput, _ ...request.Option) (*ssm.GetParameterOutput, error) {
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(f.value)}}, nil
+}
+
+func (f *fakeSSM) PutParameter(input *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	if f.put == nil {
+		f.put = map[string]string{}
+	}
+	f.put[aws.StringValue(input.Name)] = aws.StringValue(input.Value)
+	return &ssm.PutParameterOutput{Version: aws.Int64(int64(len(f.put)))}, nil
+}
+
+// fakeObjects records the objects put into S3
+type fakeObjects struct {
+	s3iface.S3API
+	objects map[string]string
+	err     error
+}
+
+func (f *fakeObjects) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(input.Body); err != nil {
+		return nil, err
+	}
+	if f.objects == nil {
+		f.objects = map[string]string{}
+	}
+	f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = body.String()
+	return &s3.PutObjectOutput{}, nil
+}
+
+// fakeStacks describes every stack with the same status
+type fakeStacks struct {
+	cloudformationiface.CloudFormationAPI
+	status string
+}
+
+func (f *fakeStacks) DescribeStacksWithContext(_ aws.Context, input *cloudformation.DescribeStacksInput, _ ...request.Option) (*cloudformation.DescribeStacksOutput, error) {
+	if f.status == "" {
+		return nil, errors.New("ValidationError: Stack with id " + aws.StringValue(input.StackName) + " does not exist")
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{{StackId: input.StackName, StackStatus: aws.String(f.status)}}}, nil
+}
+
+// fakeLocks is a lock table evaluating the conditions of the lock items
+type fakeLocks struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	puts  int
+}
+
+func (f *fakeLocks) PutItemWithContext(_ aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.puts++
+	key := aws.StringValue(input.Item["LockId"].S)
+	if held, ok := f.items[key]; ok {
+		expiresAt, _ := strconv.ParseInt(aws.StringValue(held["ExpiresAt"].N), 10, 64)
+		now, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":now"].N), 10, 64)
+		if aws.StringValue(held["Owner"].S) != aws.StringValue(input.Item["Owner"].S) && expiresAt >= now {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		}
+	}
+	if f.items == nil {
+		f.items = map[string]map[string]*dynamodb.AttributeValue{}
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeLocks) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[aws.StringValue(input.Key["LockId"].S)]}, nil
+}
+
+func (f *fakeLocks) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	key := aws.StringValue(input.Key["LockId"].S)
+	if held, ok := f.items[key]; !ok || aws.StringValue(held["Owner"].S) != aws.StringValue(input.ExpressionAttributeValues[":owner"].S) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// holdLock adds the lock item of another invocation expiring at expiresAt
+func (f *fakeLocks) holdLock(key string, expiresAt time.Time) {
+	f.items = map[string]map[string]*dynamodb.AttributeValue{key: {
+		"LockId":    {S: aws.String(key)},
+		"Owner":     {S: aws.String("other-request")},
+		"StackId":   {S: aws.String("other-stack")},
+		"ExpiresAt": {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+	}}
+}
+
+// fakeStateTable is a state table keeping the items by record ID
+type fakeStateTable struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]recordState
+}
+
+func (f *fakeStateTable) QueryPagesWithContext(_ aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, _ ...request.Option) error {
+	var items []map[string]*dynamodb.AttributeValue
+	for _, item := range f.items {
+		if item.Name == aws.StringValue(input.ExpressionAttributeValues[":name"].S) {
+			attributes, _ := dynamodbattribute.MarshalMap(item)
+			items = append(items, attributes)
+		}
+	}
+	fn(&dynamodb.QueryOutput{Items: items}, true)
+	return nil
+}
+
+func (f *fakeStateTable) PutItemWithContext(_ aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	var item recordState
+	if err := dynamodbattribute.UnmarshalMap(input.Item, &item); err != nil {
+		return nil, err
+	}
+	if f.items == nil {
+		f.items = map[string]recordState{}
+	}
+	f.items[item.RecordId] = item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeStateTable) DeleteItemWithContext(_ aws.Context, input *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	delete(f.items, aws.StringValue(input.Key["RecordId"].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// recordIDs returns the recorded record IDs in order
+func (f *fakeStateTable) recordIDs() string {
+	var ids []string
+	for id := range f.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// fakeCloudflare is a Cloudflare account with one zone, recording the changes made to it
+type fakeCloudflare struct {
+	mu          sync.Mutex
+	tokenStatus user.TokenVerifyResponseStatus
+	zone        zones.Zone
+	hold        zones.ZoneHold
+	records     []dns.Record
+	created     []string
+	deleted     []string
+	createErr   error
+	// Number of record batches applied
+	batches int
+}
+
+func (f *fakeCloudflare) VerifyToken(context.Context) (*user.TokenVerifyResponse, error) {
+	return &user.TokenVerifyResponse{Status: f.tokenStatus}, nil
+}
+
+func (f *fakeCloudflare) ListZones(_ context.Context, params zones.ZoneListParams) ([]zones.Zone, error) {
+	if params.Name.Value != f.zone.Name {
+		return nil, nil
+	}
+	return []zones.Zone{f.zone}, nil
+}
+
+func (f *fakeCloudflare) GetZone(_ context.Context, zoneID string) (*zones.Zone, error) {
+	if zoneID != f.zone.ID {
+		return nil, errors.New("zone not found")
+	}
+	return &f.zone, nil
+}
+
+func (f *fakeCloudflare) GetZoneHold(context.Context, string) (*zones.ZoneHold, error) {
+	return &f.hold, nil
+}
+
+func (f *fakeCloudflare) ListDNSRecords(_ context.Context, _, name string) ([]dns.Record, error) {
+	var records []dns.Record
+	for _, record := range f.records {
+		if record.Name == name {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (f *fakeCloudflare) ListProxiedDNSRecords(context.Context, string) ([]dns.Record, error) {
+	var records []dns.Record
+	for _, record := range f.records {
+		if record.Proxied {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (f *fakeCloudflare) NewDNSRecord(_ context.Context, params dns.RecordNewParams) (*dns.Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	record := params.Record.(dns.NSRecordParam)
+	f.created = append(f.created, record.Content.Value)
+	return &dns.Record{ID: "new-" + record.Content.Value, Type: dns.RecordTypeNS, Name: record.Name.Value, Content: record.Content.Value}, nil
+}
+
+func (f *fakeCloudflare) BatchDNSRecords(_ context.Context, _ string, batch dnsRecordBatch) (*dnsRecordBatchResult, error) {
+	f.batches++
+	if f.createErr != nil && len(batch.Posts) > 0 {
+		return nil, f.createErr
+	}
+	var result dnsRecordBatchResult
+	for _, record := range batch.Deletes {
+		f.deleted = append(f.deleted, record.ID)
+		result.Deletes = append(result.Deletes, dns.Record{ID: record.ID})
+	}
+	for _, record := range batch.Posts {
+		f.created = append(f.created, record.Content)
+		result.Posts = append(result.Posts, dns.Record{ID: "new-" + record.Content, Type: dns.RecordTypeNS, Name: record.Name, Content: record.Content})
+	}
+	return &result, nil
+}
+
+func (f *fakeCloudflare) DeleteDNSRecord(_ context.Context, _, recordID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, recordID)
+	return nil
+}
+
+// fakeResponses keeps the responses instead of sending them to CloudFormation
+type fakeResponses struct {
+	sent []*CloudFormationResponse
+}
+
+func (f *fakeResponses) Send(_ string, response *CloudFormationResponse) error {
+	f.sent = append(f.sent, response)
+	return nil
+}
+
+// newTestHandler returns a handler with fakes for a Cloudflare zone example.com and the
+// token secret, without caching the secret across tests
+func newTestHandler(t *testing.T) (*handler, *fakeCloudflare, *fakeResponses) {
+	t.Setenv("SECRET_CACHE_TTL_SECONDS", "0")
+	api := &fakeCloudflare{
+		tokenStatus: user.TokenVerifyResponseStatusActive,
+		zone:        zones.Zone{ID: "zone-1", Name: "example.com"},
+	}
+	responses := &fakeResponses{}
+	h := &handler{
+		secretsManager: &fakeSecretsManager{value: `{"api_token":"token"}`},
+		ssm:            &fakeSSM{value: "ssm-token"},
+		stacks:         &fakeStacks{status: cloudformation.StackStatusDeleteInProgress},
+		newCloudflare:  func(*CloudflareSecret, retryPolicy) cloudflareAPI { return api },
+		responses:      responses,
+	}
+	return h, api, responses
+}
+
+// testEvent returns an event of the custom resources for api.example.com
+func testEvent(requestType, action string) CloudFormationEvent {
+	return CloudFormationEvent{
+		RequestType:       requestType,
+		ResponseURL:       "https://cloudformation-custom-resource-response.s3.amazonaws.com/response",
+		LogicalResourceId: "CloudflareDNSUpdater",
+		ResourceProperties: CloudflareDNSProperties{
+			Action:      action,
+			SecretID:    "cftor53/cloudflare/api-token",
+			Domain:      "example.com",
+			Subdomain:   "api",
+			NameServers: []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.com."},
+		},
+	}
+}
+
+// nsRecord returns an NS record of api.example.com
+func nsRecord(id, content string) dns.Record {
+	return dns.Record{ID: id, Type: dns.RecordTypeNS, Name: "api.example.com", Content: content}
+}
+
+// onlyResponse returns the single response the handler sent
+func onlyResponse(t *testing.T, responses *fakeResponses) *CloudFormationResponse {
+	t.Helper()
+	if len(responses.sent) != 1 {
+		t.Fatalf("Expected one response, got %d", len(responses.sent))
+	}
+	return responses.sent[0]
+}
+
+func TestHandleCheck(t *testing.T) {
+	h, _, responses := newTestHandler(t)
+	if err := h.handleRequest(context.Background(), testEvent("Create", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if response.Status != "SUCCESS" || response.Data.ZoneID != "zone-1" {
+		t.Errorf("Expected a successful check of zone-1, got %+v", response)
+	}
+	if response.PhysicalResourceId != "CloudflareDNSUpdater-api.example.com" {
+		t.Errorf("Expected the physical resource ID of the delegated name, got %s", response.PhysicalResourceId)
+	}
+
+	// Proxied records below the subdomain fail the check unless the change is accepted
+	for _, accept := range []string{"", "true"} {
+		h, api, responses := newTestHandler(t)
+		api.records = []dns.Record{{ID: "www", Type: dns.RecordTypeA, Name: "www.api.example.com", Content: "192.0.2.1", Proxied: true}}
+		event := testEvent("Create", "check")
+		event.ResourceProperties.AcceptProxiedRecords = accept
+		if err := h.handleRequest(context.Background(), event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		response := onlyResponse(t, responses)
+		if expected := map[string]string{"": "FAILED", "true": "SUCCESS"}[accept]; response.Status != expected || !strings.Contains(response.Reason+response.Data.Warnings, "1 proxied DNS records under api.example.com") {
+			t.Errorf("Expected %s with the proxied record, got %+v", expected, response)
+		}
+		if !strings.Contains(response.Data.ProxiedRecords, "www.api.example.com") {
+			t.Errorf("Expected the proxied record in Data, got %+v", response.Data)
+		}
+	}
+
+	// Records other than NS records would be shadowed by the delegation
+	h, api, responses := newTestHandler(t)
+	api.records = []dns.Record{
+		{ID: "a", Type: dns.RecordTypeA, Name: "api.example.com", Content: "192.0.2.1", Proxied: true},
+		{ID: "t", Type: dns.RecordTypeTXT, Name: "api.example.com", Content: "v=spf1 -all"},
+	}
+	if err := h.handleRequest(context.Background(), testEvent("Update", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response = onlyResponse(t, responses)
+	if response.Status != "FAILED" || !strings.Contains(response.Reason, "colliding DNS records") {
+		t.Errorf("Expected the colliding records to fail the check, got %+v", response)
+	}
+	if expected := `A api.example.com "192.0.2.1" (ID a, proxied true); TXT api.example.com "v=spf1 -all" (ID t, proxied false)`; response.Data == nil || response.Data.CollidingRecords != expected {
+		t.Errorf("Expected the colliding records in Data, got %+v", response.Data)
+	}
+
+	h, api, responses = newTestHandler(t)
+	api.hold = zones.ZoneHold{Hold: true}
+	if err := h.handleRequest(context.Background(), testEvent("Create", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "zone hold") {
+		t.Errorf("Expected the zone hold to fail the check, got %+v", response)
+	}
+}
+
+func TestHandleCreate(t *testing.T) {
+	h, api, responses := newTestHandler(t)
+	if err := h.handleRequest(context.Background(), testEvent("Create", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if response.Status != "SUCCESS" || response.Data.RecordsAdded != "2" || response.Data.RecordsDeleted != "0" {
+		t.Errorf("Expected two NS records to be added, got %+v", response)
+	}
+	if strings.Join(api.created, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Expected the name servers without trailing dots, got %v", api.created)
+	}
+	if response.Data.RecordIds != "new-ns-1.awsdns-01.org,new-ns-2.awsdns-02.com" {
+		t.Errorf("Expected the IDs of the created records, got %s", response.Data.RecordIds)
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	h, api, responses := newTestHandler(t)
+	api.records = []dns.Record{nsRecord("keep", "ns-1.awsdns-01.org"), nsRecord("stale", "ns-9.awsdns-09.net")}
+	event := testEvent("Update", "update")
+	event.PhysicalResourceId = "existing-id"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if response.Status != "SUCCESS" || response.PhysicalResourceId != "existing-id" {
+		t.Errorf("Expected a successful update of existing-id, got %+v", response)
+	}
+	if strings.Join(api.created, ",") != "ns-2.awsdns-02.com" || strings.Join(api.deleted, ",") != "stale" {
+		t.Errorf("Expected ns-2 to be added and the stale record deleted, got %v and %v", api.created, api.deleted)
+	}
+	if api.batches != 1 {
+		t.Errorf("Expected the changes in one batch, got %d", api.batches)
+	}
+	if response.Data.RecordIds != "keep,new-ns-2.awsdns-02.com" {
+		t.Errorf("Expected the kept and created record IDs, got %s", response.Data.RecordIds)
+	}
+
+	// A plan reports the same changes without making them
+	h, api, responses = newTestHandler(t)
+	api.records = []dns.Record{nsRecord("keep", "ns-1.awsdns-01.org"), nsRecord("stale", "ns-9.awsdns-09.net")}
+	if err := h.handleRequest(context.Background(), testEvent("Update", "plan")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response = onlyResponse(t, responses)
+	if response.Data.NameServersToAdd != "ns-2.awsdns-02.com" || response.Data.NameServersToRemove != "ns-9.awsdns-09.net" {
+		t.Errorf("Expected the planned changes, got %+v", response.Data)
+	}
+	if len(api.created) > 0 || len(api.deleted) > 0 {
+		t.Errorf("Expected a plan to make no changes, got %v and %v", api.created, api.deleted)
+	}
+
+	// Append mode only adds the missing name servers and plans no removals
+	for _, action := range []string{"update", "plan"} {
+		h, api, responses = newTestHandler(t)
+		api.records = []dns.Record{nsRecord("keep", "ns-1.awsdns-01.org"), nsRecord("other", "ns-9.awsdns-09.net")}
+		event = testEvent("Update", action)
+		event.ResourceProperties.Mode = "append"
+		if err := h.handleRequest(context.Background(), event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		response = onlyResponse(t, responses)
+		if response.Status != "SUCCESS" || len(api.deleted) > 0 || response.Data.NameServersToRemove != "" {
+			t.Errorf("Expected %s to leave the other NS record, got %+v and %v deleted", action, response, api.deleted)
+		}
+		if action == "update" && response.Data.RecordIds != "keep,new-ns-2.awsdns-02.com" {
+			t.Errorf("Expected the delegation's record IDs only, got %s", response.Data.RecordIds)
+		}
+	}
+
+	// Verification in append mode accepts the other name servers
+	h, api, responses = newTestHandler(t)
+	api.records = []dns.Record{nsRecord("1", "ns-1.awsdns-01.org"), nsRecord("2", "ns-2.awsdns-02.com"), nsRecord("other", "ns-9.awsdns-09.net")}
+	event = testEvent("Update", "verify")
+	event.ResourceProperties.Mode = "append"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected the other name server to be accepted, got %+v", response)
+	}
+
+	// Invalid name servers fail the update before Cloudflare is called
+	h, api, responses = newTestHandler(t)
+	event = testEvent("Update", "update")
+	event.ResourceProperties.NameServers = []string{"ns-1.awsdns-01.org", "192.0.2.53"}
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, `"192.0.2.53" (an IP address, not a host name)`) {
+		t.Errorf("Expected the IP address to be rejected, got %+v", response)
+	}
+	if len(api.created) > 0 || h.secretsManager.(*fakeSecretsManager).calls > 0 {
+		t.Errorf("Expected no Cloudflare calls, got %v created", api.created)
+	}
+
+	// Failing to create every missing record fails the update
+	h, api, responses = newTestHandler(t)
+	api.createErr = errors.New("rate limited")
+	if err := h.handleRequest(context.Background(), testEvent("Update", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Data.Warnings, "rate limited") {
+		t.Errorf("Expected the update to fail with the errors as warnings, got %+v", response)
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	h, api, responses := newTestHandler(t)
+	api.records = []dns.Record{nsRecord("keep", "ns-1.awsdns-01.org")}
+	if err := h.handleRequest(context.Background(), testEvent("Delete", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected a successful delete, got %+v", response)
+	}
+	if len(api.deleted) > 0 || h.secretsManager.(*fakeSecretsManager).calls > 0 {
+		t.Errorf("Expected a delete to leave Cloudflare alone, got %v deleted", api.deleted)
+	}
+}
+
+func TestHandleReplacedDelete(t *testing.T) {
+	// The delegation replaced by a renamed one removes its own NS records only
+	h, api, responses := newTestHandler(t)
+	h.stacks = &fakeStacks{status: cloudformation.StackStatusUpdateCompleteCleanupInProgress}
+	api.records = []dns.Record{nsRecord("old-1", "ns-1.awsdns-01.org."), nsRecord("old-2", "NS-2.awsdns-02.com"), nsRecord("other", "ns-9.awsdns-09.net")}
+	event := testEvent("Delete", "update")
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+	event.PhysicalResourceId = "CloudflareDNSUpdater-api.example.com"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if response.Status != "SUCCESS" || response.PhysicalResourceId != event.PhysicalResourceId {
+		t.Errorf("Expected a successful delete of %s, got %+v", event.PhysicalResourceId, response)
+	}
+	if strings.Join(api.deleted, ",") != "old-1,old-2" {
+		t.Errorf("Expected the NS records of the delegation to be deleted, got %v", api.deleted)
+	}
+
+	// Failures leave the records and still succeed, so the stack update can complete
+	h, api, responses = newTestHandler(t)
+	h.stacks = &fakeStacks{status: cloudformation.StackStatusUpdateCompleteCleanupInProgress}
+	h.secretsManager = &fakeSecretsManager{}
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || len(api.deleted) > 0 {
+		t.Errorf("Expected the records to be left in place, got %+v", response)
+	}
+
+	// A stack that can't be described is treated as deleted
+	h, api, responses = newTestHandler(t)
+	h.stacks = &fakeStacks{}
+	api.records = []dns.Record{nsRecord("old-1", "ns-1.awsdns-01.org")}
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || len(api.deleted) > 0 {
+		t.Errorf("Expected the records to be left in place, got %+v", response)
+	}
+}
+
+func TestHandleLockedUpdate(t *testing.T) {
+	// A free lock is taken for the update and released after it
+	h, api, responses := newTestHandler(t)
+	locks := &fakeLocks{}
+	h.tables = locks
+	event := testEvent("Create", "update")
+	event.RequestId = "request-1"
+	event.ResourceProperties.LockTable = "locks"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || len(api.created) != 2 {
+		t.Errorf("Expected the NS records to be added, got %+v", response)
+	}
+	if locks.puts != 1 || len(locks.items) != 0 {
+		t.Errorf("Expected the lock to be taken once and released, got %d puts and %v", locks.puts, locks.items)
+	}
+
+	// A lock held by another invocation fails the update when the wait runs out
+	h, api, responses = newTestHandler(t)
+	locks = &fakeLocks{}
+	locks.holdLock("api.example.com", time.Now().Add(time.Hour))
+	h.tables = locks
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.handleRequest(ctx, event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if response.Status != "FAILED" || !strings.Contains(response.Reason, "held by other-request of stack other-stack") {
+		t.Errorf("Expected the held lock to fail the update, got %+v", response)
+	}
+	if len(api.created) > 0 || aws.StringValue(locks.items["api.example.com"]["Owner"].S) != "other-request" {
+		t.Errorf("Expected the update to leave the records and the lock alone, got %v created", api.created)
+	}
+
+	// An expired lock is taken over
+	h, api, responses = newTestHandler(t)
+	locks = &fakeLocks{}
+	locks.holdLock("api.example.com", time.Now().Add(-time.Minute))
+	h.tables = locks
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || len(api.created) != 2 || len(locks.items) != 0 {
+		t.Errorf("Expected the expired lock to be taken over, got %+v", response)
+	}
+}
+
+func TestHandleRecordState(t *testing.T) {
+	// The kept and created NS records are recorded, and the removed ones forgotten
+	h, api, responses := newTestHandler(t)
+	state := &fakeStateTable{items: map[string]recordState{
+		"keep":  {Name: "api.example.com", RecordId: "keep", Content: "ns-1.awsdns-01.org", CreatedAt: "2024-01-01T00:00:00Z"},
+		"stale": {Name: "api.example.com", RecordId: "stale", Content: "ns-9.awsdns-09.net"},
+		"other": {Name: "www.example.com", RecordId: "other", Content: "ns-9.awsdns-09.net"},
+	}}
+	h.tables = state
+	api.records = []dns.Record{nsRecord("keep", "ns-1.awsdns-01.org"), nsRecord("stale", "ns-9.awsdns-09.net")}
+	event := testEvent("Update", "update")
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+	event.ResourceProperties.StateTable = "state"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || response.Data.Warnings != "" {
+		t.Errorf("Expected a successful update, got %+v", response)
+	}
+	if ids := state.recordIDs(); ids != "keep,new-ns-2.awsdns-02.com,other" {
+		t.Errorf("Expected the kept and created records to be recorded, got %s", ids)
+	}
+	kept, created := state.items["keep"], state.items["new-ns-2.awsdns-02.com"]
+	if kept.CreatedAt != "2024-01-01T00:00:00Z" || kept.UpdatedAt == "" || kept.StackId != event.StackId {
+		t.Errorf("Expected the kept record to keep its creation time, got %+v", kept)
+	}
+	if created.Content != "ns-2.awsdns-02.com" || created.Type != "NS" || created.ZoneId != "zone-1" || created.LogicalResourceId != "CloudflareDNSUpdater" {
+		t.Errorf("Expected the created record to be recorded, got %+v", created)
+	}
+
+	// The replaced delegation deletes the recorded records, whatever their content
+	h, api, responses = newTestHandler(t)
+	h.stacks = &fakeStacks{status: cloudformation.StackStatusUpdateCompleteCleanupInProgress}
+	state = &fakeStateTable{items: map[string]recordState{
+		"old-1": {Name: "api.example.com", RecordId: "old-1", Content: "ns-7.awsdns-07.net"},
+	}}
+	h.tables = state
+	api.records = []dns.Record{nsRecord("old-1", "ns-7.awsdns-07.net"), nsRecord("unrecorded", "ns-1.awsdns-01.org")}
+	event = testEvent("Delete", "update")
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+	event.PhysicalResourceId = "CloudflareDNSUpdater-api.example.com"
+	event.ResourceProperties.StateTable = "state"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected a successful delete, got %+v", response)
+	}
+	if strings.Join(api.deleted, ",") != "old-1" || len(state.items) != 0 {
+		t.Errorf("Expected only the recorded record to be deleted and forgotten, got %v deleted and %v", api.deleted, state.items)
+	}
+}
+
+func TestHandleDelegationStatus(t *testing.T) {
+	const parameter = "/cftor53/api/example-com/delegationStatus"
+	readStatus := func(t *testing.T, parameters *fakeSSM) delegationStatus {
+		t.Helper()
+		var status delegationStatus
+		if err := json.Unmarshal([]byte(parameters.put[parameter]), &status); err != nil {
+			t.Fatalf("Expected the delegation status to be written, got %v: %v", parameters.put, err)
+		}
+		return status
+	}
+
+	// A successful update writes the name servers and the zone
+	h, _, responses := newTestHandler(t)
+	parameters := &fakeSSM{}
+	h.ssm = parameters
+	event := testEvent("Create", "update")
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+	event.ResourceProperties.StatusParameter = parameter
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	onlyResponse(t, responses)
+	status := readStatus(t, parameters)
+	if status.Action != "create" || status.Status != "SUCCESS" || status.ZoneID != "zone-1" || status.StackID != event.StackId || status.Timestamp == "" {
+		t.Errorf("Expected a successful create status, got %+v", status)
+	}
+	if strings.Join(status.NameServers, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Expected the delegated name servers, got %v", status.NameServers)
+	}
+
+	// A failed update writes the reason and the desired name servers
+	h, api, responses := newTestHandler(t)
+	parameters = &fakeSSM{}
+	h.ssm = parameters
+	api.createErr = errors.New("rate limited")
+	event = testEvent("Update", "update")
+	event.ResourceProperties.StatusParameter = parameter
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" {
+		t.Fatalf("Expected a failed update, got %+v", response)
+	}
+	status = readStatus(t, parameters)
+	if status.Action != "update" || status.Status != "FAILED" || !strings.Contains(status.Reason, "Failed to add") || len(status.NameServers) != 2 {
+		t.Errorf("Expected a failed update status, got %+v", status)
+	}
+
+	// Deletes and plans leave the status alone, and a failed write doesn't fail the update
+	for _, event := range []CloudFormationEvent{testEvent("Delete", "update"), testEvent("Update", "plan")} {
+		h, _, responses = newTestHandler(t)
+		parameters = &fakeSSM{}
+		h.ssm = parameters
+		event.PhysicalResourceId = "CloudflareDNSUpdater-api.example.com"
+		event.ResourceProperties.StatusParameter = parameter
+		if err := h.handleRequest(context.Background(), event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		onlyResponse(t, responses)
+		if len(parameters.put) != 0 {
+			t.Errorf("Expected no delegation status for a %s with action %s, got %v", event.RequestType, event.ResourceProperties.Action, parameters.put)
+		}
+	}
+	h, _, responses = newTestHandler(t)
+	h.ssm = &fakeSSM{putErr: errors.New("AccessDeniedException")}
+	event = testEvent("Update", "update")
+	event.ResourceProperties.StatusParameter = parameter
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected the update to succeed without the status, got %+v", response)
+	}
+}
+
+func TestSendOversizedResponse(t *testing.T) {
+	var warnings, recordIDs []string
+	for i := 0; i < 100; i++ {
+		warnings = append(warnings, fmt.Sprintf("failed to delete NS record record-%d: rate limited", i))
+		recordIDs = append(recordIDs, fmt.Sprintf("record-%d", i))
+	}
+	data := &ResponseData{
+		Domain:         "example.com",
+		Subdomain:      "api",
+		ZoneID:         "zone-1",
+		NameServers:    "ns-1.awsdns-01.org,ns-2.awsdns-02.com",
+		RecordsAdded:   "2",
+		RecordsDeleted: "0",
+		RecordIds:      strings.Join(recordIDs, ","),
+		Warnings:       strings.Join(warnings, "; "),
+	}
+	event := testEvent("Update", "update")
+	event.RequestId = "request-1"
+	event.StackId = "arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id"
+
+	// The full Data is stored in S3 and the warnings are shortened, keeping the essential values
+	h, _, responses := newTestHandler(t)
+	objects := &fakeObjects{}
+	h.objects = objects
+	event.ResourceProperties.SpillBucket = "spill"
+	if err := h.sendResponse(event, "SUCCESS", "NS records updated", data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response := onlyResponse(t, responses)
+	if size := responseSize(response); size > responseSizeLimit {
+		t.Errorf("Expected the response to fit the limit, got %d bytes", size)
+	}
+	if response.Data.Domain != "example.com" || response.Data.ZoneID != "zone-1" || response.Data.RecordsAdded != "2" || response.Data.NameServers != data.NameServers {
+		t.Errorf("Expected the essential values to be kept, got %+v", response.Data)
+	}
+	if response.Data.DataTruncated != "Warnings" || response.Data.Warnings == "" || !strings.HasPrefix(data.Warnings, response.Data.Warnings) || response.Data.RecordIds != data.RecordIds {
+		t.Errorf("Expected only the warnings to be shortened, got %+v", response.Data)
+	}
+	const key = "spill/cftor53/Cftor53Stack/CloudflareDNSUpdater/request-1.json"
+	if response.Data.DataLocation != "s3://"+key {
+		t.Errorf("Expected the location of the full Data, got %s", response.Data.DataLocation)
+	}
+	var stored ResponseData
+	if err := json.Unmarshal([]byte(objects.objects[key]), &stored); err != nil || stored.Warnings != data.Warnings {
+		t.Errorf("Expected the full Data in S3, got %v: %v", objects.objects, err)
+	}
+	if data.DataTruncated != "" || len(data.Warnings) < responseSizeLimit {
+		t.Errorf("Expected the Data of the caller to be left alone, got %+v", data)
+	}
+
+	// When the bucket can't be written the Data is only shortened, after an overlong reason
+	h, _, responses = newTestHandler(t)
+	h.objects = &fakeObjects{err: errors.New("AccessDenied")}
+	if err := h.sendResponse(event, "FAILED", strings.Repeat("Cloudflare error page ", 300), data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	response = onlyResponse(t, responses)
+	if size := responseSize(response); size > responseSizeLimit {
+		t.Errorf("Expected the response to fit the limit, got %d bytes", size)
+	}
+	if response.Data.DataLocation != "" || response.Data.DataTruncated != "Warnings" || response.Data.NameServers == "" || response.Data.Subdomain != "api" {
+		t.Errorf("Expected only the warnings to be shortened, got %+v", response.Data)
+	}
+	if len(response.Reason) > maxReasonSize || !strings.HasSuffix(response.Reason, "... (truncated)") {
+		t.Errorf("Expected the reason to be cut, got %s", response.Reason)
+	}
+
+	// Responses within the limit are sent as they are
+	h, _, responses = newTestHandler(t)
+	small := &ResponseData{Domain: "example.com", Subdomain: "api", Warnings: "one; two"}
+	if err := h.sendResponse(event, "SUCCESS", "NS records updated", small); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Data != small || response.Data.DataTruncated != "" {
+		t.Errorf("Expected the response unchanged, got %+v", response.Data)
+	}
+}
+
+func TestDelegationPhysicalID(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestType string
+		physicalID  string
+		old         map[string]interface{}
+		subdomain   string
+		expected    string
+	}{
+		{name: "create", requestType: "Create", expected: "CloudflareDNSUpdater-api.example.com"},
+		{name: "create ignores a given id", requestType: "Create", physicalID: "other", expected: "CloudflareDNSUpdater-api.example.com"},
+		{name: "unchanged update keeps the id", requestType: "Update", physicalID: "CloudflareDNSUpdater-cloudflare-dns", old: map[string]interface{}{"Domain": "example.com", "Subdomain": "api"}, expected: "CloudflareDNSUpdater-cloudflare-dns"},
+		{name: "case change keeps the id", requestType: "Update", physicalID: "CloudflareDNSUpdater-api.example.com", old: map[string]interface{}{"Domain": "Example.com", "Subdomain": "API"}, expected: "CloudflareDNSUpdater-api.example.com"},
+		{name: "renamed subdomain", requestType: "Update", physicalID: "CloudflareDNSUpdater-cloudflare-dns", old: map[string]interface{}{"Domain": "example.com", "Subdomain": "www"}, expected: "CloudflareDNSUpdater-api.example.com"},
+		{name: "renamed domain", requestType: "Update", physicalID: "CloudflareDNSUpdater-api.example.org", old: map[string]interface{}{"Domain": "example.org", "Subdomain": "api"}, expected: "CloudflareDNSUpdater-api.example.com"},
+		{name: "unicode old name", requestType: "Update", physicalID: "CloudflareDNSUpdater-xn--mnchen-3ya.example.com", old: map[string]interface{}{"Domain": "example.com", "Subdomain": "münchen"}, subdomain: "xn--mnchen-3ya", expected: "CloudflareDNSUpdater-xn--mnchen-3ya.example.com"},
+		{name: "delete keeps the id", requestType: "Delete", physicalID: "CloudflareDNSUpdater-www.example.com", expected: "CloudflareDNSUpdater-www.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := testEvent(tt.requestType, "update")
+			event.PhysicalResourceId = tt.physicalID
+			event.OldResourceProperties = tt.old
+			if tt.subdomain != "" {
+				event.ResourceProperties.Subdomain = tt.subdomain
+			}
+			if got := delegationPhysicalID(event); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandleVerify(t *testing.T) {
+	h, api, responses := newTestHandler(t)
+	api.records = []dns.Record{nsRecord("1", "ns-1.awsdns-01.org"), nsRecord("2", "NS-2.awsdns-02.com.")}
+	if err := h.handleRequest(context.Background(), testEvent("Create", "verify")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected the NS records to be verified, got %+v", response)
+	}
+
+	h, api, responses = newTestHandler(t)
+	api.records = []dns.Record{nsRecord("1", "ns-1.awsdns-01.org")}
+	if err := h.handleRequest(context.Background(), testEvent("Create", "verify")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "ns-2.awsdns-02.com") {
+		t.Errorf("Expected the missing name server to fail the verification, got %+v", response)
+	}
+}
+
+func TestHandleVerifyPropagation(t *testing.T) {
+	// dohServer answers NS queries for api.example.com with the name servers
+	dohServer := func(status int, nameServers ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != "application/dns-json" || r.URL.Query().Get("name") != "api.example.com" || r.URL.Query().Get("type") != "NS" {
+				http.Error(w, "unexpected query", http.StatusBadRequest)
+				return
+			}
+			answer := map[string]interface{}{"Status": status}
+			var records []map[string]interface{}
+			for _, ns := range nameServers {
+				records = append(records, map[string]interface{}{"name": "api.example.com.", "type": 2, "TTL": 300, "data": ns + "."})
+			}
+			answer["Answer"] = records
+			json.NewEncoder(w).Encode(answer)
+		}))
+	}
+	propagated := dohServer(0, "ns-2.awsdns-02.com", "ns-1.awsdns-01.org")
+	defer propagated.Close()
+	stale := dohServer(0, "old.ns.example.net")
+	defer stale.Close()
+	cached := dohServer(3)
+	defer cached.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		status    string
+		reason    string
+	}{
+		{"propagated", []string{propagated.URL}, "SUCCESS", "resolving"},
+		{"unreachable resolver skipped", []string{unreachable.URL, propagated.URL}, "SUCCESS", "resolving"},
+		{"stale name servers", []string{propagated.URL, stale.URL}, "FAILED", "unexpected [old.ns.example.net]"},
+		{"negative answer", []string{cached.URL}, "FAILED", "has no NS records for api.example.com yet"},
+		{"no resolver reachable", []string{unreachable.URL}, "FAILED", "no DNS-over-HTTPS resolver could be reached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, api, responses := newTestHandler(t)
+			h.doh = &http.Client{}
+			api.records = []dns.Record{nsRecord("1", "ns-1.awsdns-01.org"), nsRecord("2", "ns-2.awsdns-02.com")}
+			event := testEvent("Create", "verify")
+			event.ResourceProperties.DoHEndpoints = tt.endpoints
+			event.ResourceProperties.PropagationTimeoutSeconds = "1"
+			if err := h.handleRequest(context.Background(), event); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if response := onlyResponse(t, responses); response.Status != tt.status || !strings.Contains(response.Reason, tt.reason) {
+				t.Errorf("Expected %s with %q, got %+v", tt.status, tt.reason, response)
+			}
+		})
+	}
+}
+
+func TestHandleNegativeCacheWait(t *testing.T) {
+	// dohServer answers with the SOA record of example.com and the NS records of api.example.com
+	dohServer := func(minimum int, nameServers ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var records []map[string]interface{}
+			switch query := r.URL.Query(); {
+			case query.Get("name") == "example.com" && query.Get("type") == "SOA":
+				records = append(records, map[string]interface{}{"name": "example.com.", "type": 6, "TTL": 3600, "data": fmt.Sprintf("ns1.cloudflare.com. dns.cloudflare.com. 2345 10000 2400 604800 %d", minimum)})
+			case query.Get("name") == "api.example.com" && query.Get("type") == "NS":
+				if len(nameServers) == 0 {
+					json.NewEncoder(w).Encode(map[string]interface{}{"Status": 3})
+					return
+				}
+				for _, ns := range nameServers {
+					records = append(records, map[string]interface{}{"name": "api.example.com.", "type": 2, "TTL": 300, "data": ns})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Status": 0, "Answer": records})
+		}))
+	}
+	resolving := dohServer(1800, "ns-1.awsdns-01.org.", "ns-2.awsdns-02.com.")
+	defer resolving.Close()
+	shortTTL := dohServer(5)
+	defer shortTTL.Close()
+	longTTL := dohServer(1800)
+	defer longTTL.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name           string
+		requestType    string
+		endpoint       string
+		timeout        time.Duration
+		timeoutSeconds string
+		status         string
+		reason         string
+	}{
+		{"resolving", "Create", resolving.URL, time.Minute, "", "SUCCESS", "Delegation resolves"},
+		{"short negative ttl", "Create", shortTTL.URL, time.Minute, "", "SUCCESS", "Waited out the negative TTL of 5s"},
+		{"lambda timeout", "Create", longTTL.URL, 20 * time.Second, "", "SUCCESS", "before the negative TTL of example.com expires"},
+		{"propagation timeout", "Create", longTTL.URL, time.Minute, "1", "SUCCESS", "Stopped waiting at the timeout"},
+		{"update", "Update", longTTL.URL, time.Minute, "", "SUCCESS", "No negative cache to wait for"},
+		{"unreachable", "Create", unreachable.URL, time.Minute, "", "FAILED", "Failed to read the negative TTL of example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, responses := newTestHandler(t)
+			h.doh = &http.Client{}
+			event := testEvent(tt.requestType, "wait")
+			event.ResourceProperties.DoHEndpoints = []string{tt.endpoint}
+			event.ResourceProperties.PropagationTimeoutSeconds = tt.timeoutSeconds
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if err := h.handleRequest(ctx, event); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if response := onlyResponse(t, responses); response.Status != tt.status || !strings.Contains(response.Reason, tt.reason) {
+				t.Errorf("Expected %s with %q, got %+v", tt.status, tt.reason, response)
+			}
+		})
+	}
+}
+
+// fakeParentDNS answers for the parent zones and the referrals of their name servers
+type fakeParentDNS struct {
+	zones     map[string][]string
+	referrals map[string][]string
+}
+
+func (f *fakeParentDNS) LookupNS(ctx context.Context, zone string) ([]string, error) {
+	return f.zones[zone], nil
+}
+
+func (f *fakeParentDNS) DelegationNS(ctx context.Context, server, name string) ([]string, error) {
+	referral, ok := f.referrals[server+" "+name]
+	if !ok {
+		return nil, fmt.Errorf("no answer from %s", server)
+	}
+	return referral, nil
+}
+
+func TestHandleProviderFramework(t *testing.T) {
+	// onEvent returns the outcome to the framework instead of sending it
+	h, _, responses := newTestHandler(t)
+	event := testEvent("Create", "update")
+	event.ResourceProperties.ProviderFramework = "true"
+	event.ResponseURL = "..."
+	result, err := h.HandleEvent(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	onEvent, ok := result.(*providerEventResult)
+	if !ok || onEvent.PhysicalResourceId != "CloudflareDNSUpdater-api.example.com" || onEvent.Data.RecordsAdded != "2" || onEvent.PropagationStartedAt == "" {
+		t.Errorf("Expected the physical ID and Data of the update, got %+v", result)
+	}
+	if len(responses.sent) != 0 {
+		t.Errorf("Expected the framework to respond, got %d responses", len(responses.sent))
+	}
+
+	// isComplete is called with the Data of onEvent until the parent zone serves the delegation
+	tests := []struct {
+		name      string
+		subdomain string
+		referrals map[string][]string
+		complete  bool
+		serving   string
+		pending   string
+	}{
+		{
+			name:      "served",
+			subdomain: "api",
+			referrals: map[string][]string{
+				"ada.ns.cloudflare.com api.example.com": {"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+				"bob.ns.cloudflare.com api.example.com": {"ns-2.awsdns-02.com", "ns-1.awsdns-01.org"},
+			},
+			complete: true,
+			serving:  "ada.ns.cloudflare.com,bob.ns.cloudflare.com",
+		},
+		{
+			name:      "stale and unreachable servers",
+			subdomain: "api",
+			referrals: map[string][]string{
+				"ada.ns.cloudflare.com api.example.com": {"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+			},
+			serving: "ada.ns.cloudflare.com",
+			pending: "bob.ns.cloudflare.com",
+		},
+		{
+			name:      "nested subdomain at its parent hosted zone",
+			subdomain: "a.api",
+			referrals: map[string][]string{
+				"ns-1.awsdns-01.org a.api.example.com": {"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+				"ns-2.awsdns-02.com a.api.example.com": {"old.ns.example.net"},
+			},
+			serving: "ns-1.awsdns-01.org",
+			pending: "ns-2.awsdns-02.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newTestHandler(t)
+			h.parentDNS = &fakeParentDNS{
+				zones: map[string][]string{
+					"example.com":     {"ada.ns.cloudflare.com", "bob.ns.cloudflare.com"},
+					"api.example.com": {"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"},
+				},
+				referrals: tt.referrals,
+			}
+			event := testEvent("Create", "update")
+			event.ResourceProperties.ProviderFramework = "true"
+			event.ResourceProperties.Subdomain = tt.subdomain
+			event.Data = &ResponseData{}
+			result, err := h.HandleEvent(context.Background(), event)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			isComplete, ok := result.(*isCompleteResult)
+			if !ok || isComplete.IsComplete != tt.complete || isComplete.Data.ParentServersServing != tt.serving || isComplete.Data.ParentServersPending != tt.pending {
+				t.Errorf("Expected complete %v with %q serving and %q pending, got %+v", tt.complete, tt.serving, tt.pending, result)
+			}
+		})
+	}
+
+	// The update fails once the parent zone hasn't served the delegation for the timeout
+	h.parentDNS = &fakeParentDNS{zones: map[string][]string{"example.com": {"ada.ns.cloudflare.com"}}}
+	event = testEvent("Create", "update")
+	event.ResourceProperties.ProviderFramework = "true"
+	event.ResourceProperties.PropagationTimeoutSeconds = "60"
+	event.ResourceProperties.PollIntervalSeconds = "30"
+	event.Data = &ResponseData{}
+	event.PropagationStartedAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if _, err := h.HandleEvent(context.Background(), event); err == nil || !strings.Contains(err.Error(), "is not served by ada.ns.cloudflare.com after 60s") {
+		t.Errorf("Expected the propagation to time out, got %v", err)
+	}
+	event.PropagationStartedAt = time.Now().UTC().Format(time.RFC3339)
+	if result, err := h.HandleEvent(context.Background(), event); err != nil || result.(*isCompleteResult).IsComplete {
+		t.Errorf("Expected the propagation to be pending, got %+v, %v", result, err)
+	}
+
+	// Deletes complete with onEvent
+	event = testEvent("Delete", "update")
+	event.ResourceProperties.ProviderFramework = "true"
+	event.Data = &ResponseData{}
+	if result, err := h.HandleEvent(context.Background(), event); err != nil || !result.(*isCompleteResult).IsComplete {
+		t.Errorf("Expected a delete to be complete, got %+v, %v", result, err)
+	}
+}
+
+func TestReferralNameServers(t *testing.T) {
+	name := dnsmessage.MustNewName("api.example.com.")
+	ns := func(owner dnsmessage.Name, server string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: owner, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(server)},
+		}
+	}
+	response := &dnsmessage.Message{
+		Authorities: []dnsmessage.Resource{
+			ns(name, "NS-2.awsdns-02.com."),
+			ns(name, "ns-1.awsdns-01.org."),
+			ns(dnsmessage.MustNewName("example.com."), "ada.ns.cloudflare.com."),
+		},
+	}
+	if got := referralNameServers(response, "api.example.com"); strings.Join(got, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Unexpected name servers of the referral: %v", got)
+	}
+}
+
+func TestHandleCredentials(t *testing.T) {
+	// An inactive token fails before any zone operation
+	h, api, responses := newTestHandler(t)
+	api.tokenStatus = user.TokenVerifyResponseStatusDisabled
+	if err := h.handleRequest(context.Background(), testEvent("Create", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || response.Reason != "token is disabled, not active" {
+		t.Errorf("Expected the disabled token to fail, got %+v", response)
+	}
+
+	h, _, responses = newTestHandler(t)
+	h.secretsManager = &fakeSecretsManager{}
+	if err := h.handleRequest(context.Background(), testEvent("Create", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "failed to get secret") {
+		t.Errorf("Expected the missing secret to fail, got %+v", response)
+	}
+
+	// The token is read from SSM with token_source ssm
+	h, _, responses = newTestHandler(t)
+	var token string
+	h.newCloudflare = func(secret *CloudflareSecret, _ retryPolicy) cloudflareAPI {
+		token = secret.ApiToken
+		return &fakeCloudflare{tokenStatus: user.TokenVerifyResponseStatusActive, zone: zones.Zone{ID: "zone-1", Name: "example.com"}}
+	}
+	event := testEvent("Create", "check")
+	event.ResourceProperties.TokenSource = tokenSourceSSM
+	event.ResourceProperties.TokenParameterName = "/cftor53/cloudflare/api-token"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || token != "ssm-token" {
+		t.Errorf("Expected the SSM token to be used, got %q and %+v", token, response)
+	}
+
+	// A zone ID of another zone is rejected
+	h, _, responses = newTestHandler(t)
+	event = testEvent("Create", "check")
+	event.ResourceProperties.ZoneID = "zone-2"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "failed to get zone details") {
+		t.Errorf("Expected the unknown zone to fail, got %+v", response)
+	}
+}
+
+func TestHandleInvalidRequest(t *testing.T) {
+	h, _, responses := newTestHandler(t)
+	event := testEvent("Create", "teleport")
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || response.Reason != "Invalid action: teleport" {
+		t.Errorf("Expected the invalid action to fail, got %+v", response)
+	}
+
+	h, _, responses = newTestHandler(t)
+	event = testEvent("Create", "update")
+	event.ResourceProperties.NameServers = nil
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || response.Reason != "Missing required parameters" {
+		t.Errorf("Expected the missing name servers to fail, got %+v", response)
+	}
+}
+
+func TestHTTPResponseSender(t *testing.T) {
+	var received CloudFormationResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	sender := httpResponseSender{client: server.Client()}
+	if err := sender.Send(server.URL, &CloudFormationResponse{Status: "SUCCESS", PhysicalResourceId: "id"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if received.Status != "SUCCESS" || received.PhysicalResourceId != "id" {
+		t.Errorf("Expected the response to be received, got %+v", received)
+	}
+	if err := sender.Send(server.URL+"/missing\x7f", &CloudFormationResponse{}); err == nil {
+		t.Errorf("Expected an error for an invalid URL")
+	}
+}
+
+// mockCloudflare is an httptest server implementing the zone and DNS record endpoints of the
+// Cloudflare API v4 that the Lambda uses, on a single account
+type mockCloudflare struct {
+	*httptest.Server
+	t *testing.T
+
+	mu sync.Mutex
+	// Credentials accepted by the server, and the status of the token
+	token       string
+	tokenStatus string
+	apiKey      string
+	email       string
+	zones       []mockZone
+	records     map[string][]mockRecord
+	nextID      int
+	// Records returned per page of the DNS record list
+	perPage int
+	// Method and path of every request, such as "POST zones/zone-1/dns_records"
+	requests []string
+	// Number of the next requests rate limited
+	rateLimited int
+}
+
+// mockZone is a zone of the mock server, with the permissions of the credentials on it
+type mockZone struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Status      string   `json:"status"`
+	Permissions []string `json:"permissions,omitempty"`
+	hold        bool
+}
+
+// mockRecord is a DNS record of the mock server
+type mockRecord struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// newMockCloudflare starts a mock Cloudflare API with the zone example.com and points the
+// Cloudflare client of the Lambda at it
+func newMockCloudflare(t *testing.T) *mockCloudflare {
+	m := &mockCloudflare{
+		t:           t,
+		token:       "token",
+		tokenStatus: "active",
+		apiKey:      "global-key",
+		email:       "admin@example.com",
+		zones:       []mockZone{{ID: "zone-1", Name: "example.com", Status: "active", Permissions: []string{"#zone:read", "#dns_records:read", "#dns_records:edit"}}},
+		records:     map[string][]mockRecord{},
+		perPage:     100,
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	t.Setenv("CLOUDFLARE_API_BASE_URL", m.URL+"/client/v4/")
+	return m
+}
+
+// addRecord adds a record to the zone without going through the API
+func (m *mockCloudflare) addRecord(zoneID, recordType, name, content string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	id := fmt.Sprintf("record-%d", m.nextID)
+	m.records[zoneID] = append(m.records[zoneID], mockRecord{ID: id, Type: recordType, Name: name, Content: content, TTL: 1})
+	return id
+}
+
+// contents returns the sorted contents of the records of a type and name in the zone
+func (m *mockCloudflare) contents(zoneID, recordType, name string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var contents []string
+	for _, record := range m.records[zoneID] {
+		if record.Type == recordType && record.Name == name {
+			contents = append(contents, record.Content)
+		}
+	}
+	sort.Strings(contents)
+	return contents
+}
+
+// writes returns the requests that changed records
+func (m *mockCloudflare) writes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var writes []string
+	for _, request := range m.requests {
+		if !strings.HasPrefix(request, http.MethodGet) {
+			writes = append(writes, request)
+		}
+	}
+	return writes
+}
+
+func (m *mockCloudflare) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/client/v4/")
+	m.requests = append(m.requests, r.Method+" "+path)
+	if m.rateLimited > 0 {
+		m.rateLimited--
+		m.fail(w, http.StatusTooManyRequests, 10000, "Rate limited")
+		return
+	}
+	if !m.authenticated(r) {
+		m.fail(w, http.StatusForbidden, 9109, "Invalid access token")
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "user/tokens/verify":
+		m.succeed(w, map[string]string{"id": "token-id", "status": m.tokenStatus}, nil)
+	case r.Method == http.MethodGet && path == "zones":
+		var result []mockZone
+		for _, zone := range m.zones {
+			if name := r.URL.Query().Get("name"); name == "" || name == zone.Name {
+				result = append(result, zone)
+			}
+		}
+		m.succeed(w, result, map[string]int{"page": 1, "per_page": 20, "count": len(result), "total_count": len(result)})
+	case len(parts) >= 2 && parts[0] == "zones":
+		zone := m.zone(parts[1])
+		if zone == nil {
+			m.fail(w, http.StatusNotFound, 1001, "Invalid zone identifier")
+			return
+		}
+		m.serveZone(w, r, zone, parts[2:])
+	default:
+		m.fail(w, http.StatusNotFound, 7003, "No route for the URI")
+	}
+}
+
+// serveZone serves the endpoints below zones/{zone_id}
+func (m *mockCloudflare) serveZone(w http.ResponseWriter, r *http.Request, zone *mockZone, parts []string) {
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 0:
+		m.succeed(w, zone, nil)
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "hold":
+		m.succeed(w, map[string]interface{}{"hold": zone.hold, "hold_after": "", "include_subdomains": "false"}, nil)
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "dns_records":
+		var matching []mockRecord
+		for _, record := range m.records[zone.ID] {
+			if name := r.URL.Query().Get("name"); name != "" && name != record.Name {
+				continue
+			}
+			if proxied := r.URL.Query().Get("proxied"); proxied != "" && proxied != strconv.FormatBool(record.Proxied) {
+				continue
+			}
+			matching = append(matching, record)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		start, end := (page-1)*m.perPage, page*m.perPage
+		if start > len(matching) {
+			start = len(matching)
+		}
+		if end > len(matching) {
+			end = len(matching)
+		}
+		m.succeed(w, append([]mockRecord{}, matching[start:end]...), map[string]int{"page": page, "per_page": m.perPage, "count": end - start, "total_count": len(matching)})
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "dns_records":
+		var record mockRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			m.fail(w, http.StatusBadRequest, 9000, "DNS name, type and content are required")
+			return
+		}
+		if code, message := recordConflict(m.records[zone.ID], record); code != 0 {
+			m.fail(w, http.StatusBadRequest, code, message)
+			return
+		}
+		m.nextID++
+		record.ID = fmt.Sprintf("record-%d", m.nextID)
+		m.records[zone.ID] = append(m.records[zone.ID], record)
+		m.succeed(w, record, nil)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[0] == "dns_records" && parts[1] == "batch":
+		// A batch applies its deletes, then its posts, and changes nothing if any of them fails
+		var batch struct {
+			Deletes []mockRecord `json:"deletes"`
+			Posts   []mockRecord `json:"posts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			m.fail(w, http.StatusBadRequest, 9000, "Invalid batch")
+			return
+		}
+		records := append([]mockRecord{}, m.records[zone.ID]...)
+		var deleted []mockRecord
+		for _, record := range batch.Deletes {
+			found := false
+			for i, existing := range records {
+				if existing.ID == record.ID {
+					deleted = append(deleted, existing)
+					records = append(records[:i:i], records[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				m.fail(w, http.StatusNotFound, 81044, "Record does not exist.")
+				return
+			}
+		}
+		nextID := m.nextID
+		var posted []mockRecord
+		for _, record := range batch.Posts {
+			if code, message := recordConflict(records, record); code != 0 {
+				m.fail(w, http.StatusBadRequest, code, message)
+				return
+			}
+			nextID++
+			record.ID = fmt.Sprintf("record-%d", nextID)
+			records = append(records, record)
+			posted = append(posted, record)
+		}
+		m.nextID = nextID
+		m.records[zone.ID] = records
+		m.succeed(w, map[string][]mockRecord{"deletes": deleted, "posts": posted}, nil)
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "dns_records":
+		records := m.records[zone.ID]
+		for i, record := range records {
+			if record.ID == parts[1] {
+				m.records[zone.ID] = append(records[:i:i], records[i+1:]...)
+				m.succeed(w, map[string]string{"id": record.ID}, nil)
+				return
+			}
+		}
+		m.fail(w, http.StatusNotFound, 81044, "Record does not exist.")
+	default:
+		m.fail(w, http.StatusNotFound, 7003, "No route for the URI")
+	}
+}
+
+// recordConflict returns the error code and message of Cloudflare for a record that can't be
+// added next to the records, or 0 if it can
+func recordConflict(records []mockRecord, record mockRecord) (int, string) {
+	if record.Type == "" || record.Name == "" || record.Content == "" {
+		return 9000, "DNS name, type and content are required"
+	}
+	for _, existing := range records {
+		if existing.Type == record.Type && existing.Name == record.Name && existing.Content == record.Content {
+			return 81058, "An identical record already exists."
+		}
+		if existing.Name == record.Name && (existing.Type == "CNAME") != (record.Type == "CNAME") {
+			return 81053, "An A, AAAA, or CNAME record with that host already exists."
+		}
+	}
+	return 0, ""
+}
+
+// authenticated reports whether the request has the API token, or the Global API key and email
+func (m *mockCloudflare) authenticated(r *http.Request) bool {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		return token == m.token
+	}
+	return r.Header.Get("X-Auth-Key") == m.apiKey && r.Header.Get("X-Auth-Email") == m.email
+}
+
+func (m *mockCloudflare) zone(id string) *mockZone {
+	for i := range m.zones {
+		if m.zones[i].ID == id {
+			return &m.zones[i]
+		}
+	}
+	return nil
+}
+
+// succeed writes a result in the Cloudflare response envelope
+func (m *mockCloudflare) succeed(w http.ResponseWriter, result interface{}, resultInfo interface{}) {
+	response := map[string]interface{}{"success": true, "errors": []interface{}{}, "messages": []interface{}{}, "result": result}
+	if resultInfo != nil {
+		response["result_info"] = resultInfo
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		m.t.Errorf("Failed to write the mock Cloudflare response: %v", err)
+	}
+}
+
+// fail writes an error in the Cloudflare response envelope
+func (m *mockCloudflare) fail(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	response := map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": code, "message": message}}, "messages": []interface{}{}, "result": nil}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		m.t.Errorf("Failed to write the mock Cloudflare response: %v", err)
+	}
+}
+
+// newIntegrationHandler returns a handler using the real Cloudflare client against the mock
+// server, with the API token secret
+func newIntegrationHandler(t *testing.T, secret string) (*handler, *fakeResponses) {
+	t.Setenv("SECRET_CACHE_TTL_SECONDS", "0")
+	responses := &fakeResponses{}
+	return &handler{
+		secretsManager: &fakeSecretsManager{value: secret},
+		newCloudflare:  newCloudflareClient,
+		responses:      responses,
+	}, responses
+}
+
+func TestCloudflareIntegrationLifecycle(t *testing.T) {
+	mock := newMockCloudflare(t)
+	h, responses := newIntegrationHandler(t, `{"api_token":"token"}`)
+	ctx := context.Background()
+
+	// Create runs the check, then the update, as the two custom resources do
+	for _, action := range []string{"check", "update", "verify"} {
+		if err := h.handleRequest(ctx, testEvent("Create", action)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i, response := range responses.sent {
+		if response.Status != "SUCCESS" {
+			t.Fatalf("Expected response %d to succeed, got %+v", i, response)
+		}
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Expected the NS records of the hosted zone, got %v", got)
+	}
+
+	// An update with the same name servers changes nothing
+	responses.sent = nil
+	writes := len(mock.writes())
+	if err := h.handleRequest(ctx, testEvent("Update", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || response.Data.RecordsAdded != "0" || response.Data.RecordsDeleted != "0" {
+		t.Errorf("Expected an update without changes, got %+v", response)
+	}
+	if len(mock.writes()) != writes {
+		t.Errorf("Expected no writes, got %v", mock.writes()[writes:])
+	}
+
+	// A replaced name server swaps a single record
+	responses.sent = nil
+	event := testEvent("Update", "update")
+	event.ResourceProperties.NameServers = []string{"ns-1.awsdns-01.org.", "ns-3.awsdns-03.net."}
+	if err := h.handleRequest(ctx, event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || response.Data.RecordsAdded != "1" || response.Data.RecordsDeleted != "1" {
+		t.Errorf("Expected one record to be replaced, got %+v", response)
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != "ns-1.awsdns-01.org,ns-3.awsdns-03.net" {
+		t.Errorf("Expected the new NS records, got %v", got)
+	}
+
+	// Deleting the stack leaves the delegation in Cloudflare
+	responses.sent = nil
+	writes = len(mock.writes())
+	if err := h.handleRequest(ctx, testEvent("Delete", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || len(mock.writes()) != writes {
+		t.Errorf("Expected a delete without writes, got %+v and %v", response, mock.writes()[writes:])
+	}
+}
+
+func TestCloudflareIntegrationCheck(t *testing.T) {
+	mock := newMockCloudflare(t)
+	mock.addRecord("zone-1", "CNAME", "api.example.com", "example.pages.dev")
+	mock.addRecord("zone-1", "A", "www.example.com", "192.0.2.1")
+	h, responses := newIntegrationHandler(t, `{"api_token":"token"}`)
+	if err := h.handleRequest(context.Background(), testEvent("Create", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "[CNAME]") {
+		t.Errorf("Expected the CNAME record to collide, got %+v", response)
+	}
+
+	// Proxied records below the subdomain are found among the proxied records of the zone
+	mock = newMockCloudflare(t)
+	mock.addRecord("zone-1", "A", "www.api.example.com", "192.0.2.1")
+	mock.addRecord("zone-1", "A", "www.example.com", "192.0.2.2")
+	for i := range mock.records["zone-1"] {
+		mock.records["zone-1"][i].Proxied = true
+	}
+	mock.addRecord("zone-1", "A", "internal.api.example.com", "192.0.2.3")
+	h, responses = newIntegrationHandler(t, `{"api_token":"token"}`)
+	if err := h.handleRequest(context.Background(), testEvent("Create", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || response.Data.ProxiedRecords != `A www.api.example.com "192.0.2.1" (ID record-1, proxied true)` {
+		t.Errorf("Expected the proxied record below the subdomain to fail the check, got %+v", response)
+	}
+
+	mock = newMockCloudflare(t)
+	mock.zones[0].hold = true
+	h, responses = newIntegrationHandler(t, `{"api_token":"token"}`)
+	if err := h.handleRequest(context.Background(), testEvent("Create", "check")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "zone hold") {
+		t.Errorf("Expected the zone hold to fail the check, got %+v", response)
+	}
+	if len(mock.writes()) > 0 {
+		t.Errorf("Expected a check to make no changes, got %v", mock.writes())
+	}
+}
+
+func TestCloudflareIntegrationPagination(t *testing.T) {
+	mock := newMockCloudflare(t)
+	mock.perPage = 2
+	for i := 1; i <= 5; i++ {
+		mock.addRecord("zone-1", "NS", "api.example.com", fmt.Sprintf("ns-old-%d.example.net", i))
+	}
+	h, responses := newIntegrationHandler(t, `{"api_token":"token"}`)
+	if err := h.handleRequest(context.Background(), testEvent("Update", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" || response.Data.RecordsDeleted != "5" || response.Data.RecordsAdded != "2" {
+		t.Errorf("Expected the records of every page to be replaced, got %+v", response)
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Expected only the NS records of the hosted zone, got %v", got)
+	}
+	if got := mock.writes(); strings.Join(got, ",") != "POST zones/zone-1/dns_records/batch" {
+		t.Errorf("Expected the changes in a single batch, got %v", got)
+	}
+}
+
+func TestCloudflareIntegrationFailedBatch(t *testing.T) {
+	mock := newMockCloudflare(t)
+	mock.addRecord("zone-1", "NS", "api.example.com", "ns-old.example.net")
+	// The CNAME record makes the new NS records fail, after the delete of the outdated one
+	mock.addRecord("zone-1", "CNAME", "api.example.com", "example.net")
+	h, responses := newIntegrationHandler(t, `{"api_token":"token"}`)
+	if err := h.handleRequest(context.Background(), testEvent("Update", "update")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || response.Data.RecordsDeleted != "0" || !strings.Contains(response.Data.Warnings, "81053") {
+		t.Errorf("Expected the batch to fail, got %+v", response)
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != "ns-old.example.net" {
+		t.Errorf("Expected the failed batch to change nothing, got %v", got)
+	}
+}
+
+func TestCloudflareIntegrationRetries(t *testing.T) {
+	mock := newMockCloudflare(t)
+	h, responses := newIntegrationHandler(t, `{"api_token":"token"}`)
+	event := testEvent("Create", "update")
+	event.ResourceProperties.MaxRetries = "3"
+	event.ResourceProperties.BaseDelayMs = "1"
+	event.ResourceProperties.MaxDelayMs = "5"
+
+	// Rate limited calls are retried up to MaxRetries times
+	mock.rateLimited = 3
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "SUCCESS" {
+		t.Errorf("Expected the retries to succeed, got %+v", response)
+	}
+	if got := mock.contents("zone-1", "NS", "api.example.com"); strings.Join(got, ",") != "ns-1.awsdns-01.org,ns-2.awsdns-02.com" {
+		t.Errorf("Expected the NS records of the hosted zone, got %v", got)
+	}
+
+	// Without retries the first rate limited call fails
+	responses.sent = nil
+	mock.rateLimited = 1
+	event.ResourceProperties.MaxRetries = "0"
+	if err := h.handleRequest(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response := onlyResponse(t, responses); response.Status != "FAILED" || !strings.Contains(response.Reason, "429") {
+		t.Errorf("Expected the rate limited call to fail, got %+v", response)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	if policy := cloudflareRetryPolicy(CloudflareDNSProperties{}); policy != (retryPolicy{maxRetries: 2, baseDelay: 500 * time.Millisecond, maxDelay: 8 * time.Second}) {
+		t.Errorf("Expected the defaults, got %+v", policy)
+	}
+	policy := cloudflareRetryPolicy(CloudflareDNSProperties{MaxRetries: "-1", BaseDelayMs: "200", MaxDelayMs: "100"})
+	if policy != (retryPolicy{maxRetries: 2, baseDelay: 200 * time.Millisecond, maxDelay: 200 * time.Millisecond}) {
+		t.Errorf("Expected invalid values to use the defaults, got %+v", policy)
+	}
+
+	policy = retryPolicy{maxRetries: 5, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	for retry, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if delay := policy.delay(retry, nil); delay > expected || delay < expected*3/4 {
+			t.Errorf("Expected retry %d to wait about %s, got %s", retry, expected, delay)
+		}
+	}
+	res := &http.Response{Header: http.Header{"Retry-After": {"30"}}}
+	if delay := policy.delay(0, res); delay != time.Second {
+		t.Errorf("Expected Retry-After to be capped at the maximum delay, got %s", delay)
+	}
+}
+
+func TestCloudflareIntegrationCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		setup  func(*mockCloudflare)
+		reason string
+	}{
+		{name: "invalid token", secret: `{"api_token":"wrong"}`, reason: "failed to verify Cloudflare API token"},
+		{name: "expired token", secret: `{"api_token":"token"}`, setup: func(m *mockCloudflare) { m.tokenStatus = "expired" }, reason: "token is expired, not active"},
+		{name: "read-only token", secret: `{"api_token":"token"}`, setup: func(m *mockCloudflare) { m.zones[0].Permissions = []string{"#dns_records:read"} }, reason: "token lacks DNS:Edit on example.com"},
+		{name: "unknown zone", secret: `{"api_token":"token"}`, setup: func(m *mockCloudflare) { m.zones[0].Name = "example.org" }, reason: "zone could not be found"},
+		{name: "wrong global API key", secret: `{"api_key":"wrong","email":"admin@example.com"}`, reason: "failed to get zone ID"},
+		{name: "global API key", secret: `{"api_key":"global-key","email":"admin@example.com"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockCloudflare(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			h, responses := newIntegrationHandler(t, tt.secret)
+			if err := h.handleRequest(context.Background(), testEvent("Create", "update")); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			response := onlyResponse(t, responses)
+			if tt.reason == "" {
+				if response.Status != "SUCCESS" {
+					t.Errorf("Expected success, got %+v", response)
+				}
+				return
+			}
+			if response.Status != "FAILED" || !strings.Contains(response.Reason, tt.reason) {
+				t.Errorf("Expected a failure with %q, got %+v", tt.reason, response)
+			}
+			if len(mock.writes()) > 0 {
+				t.Errorf("Expected no changes, got %v", mock.writes())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolvers that looked the subdomain up before its delegation cache the NXDOMAIN answer
+// for the negative TTL of the parent zone's SOA record, the lower of its TTL and MINIMUM
+// field (RFC 2308), and ACM's validation of a certificate of the subdomain stalls until it
+// expires. The "wait" action holds the deployment of the certificate stacks for that long,
+// or until the resolvers serve the delegation.
+
+// handleNegativeCacheWait waits for the resolvers to stop caching the subdomain as missing
+func (h *handler) handleNegativeCacheWait(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	if props.Domain == "" || props.Subdomain == "" || len(props.NameServers) == 0 || len(props.DoHEndpoints) == 0 {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
+	}
+	// Only a name that didn't exist until the delegation was created can be cached as missing
+	if event.RequestType != "Create" {
+		return h.sendResponse(event, "SUCCESS", "No negative cache to wait for", nil)
+	}
+
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	ttl, err := h.negativeCacheTTL(ctx, props.DoHEndpoints, props.Domain)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to read the negative TTL of %s: %v", props.Domain, err), nil)
+	}
+	expiresAt := time.Now().Add(ttl)
+	waitUntil := waitDeadline(ctx, propagationTimeout(props))
+	if expiresAt.Before(waitUntil) {
+		waitUntil = expiresAt
+	}
+	interval := pollInterval(props)
+	logger.Info("Waiting for the negative cache to expire", "name", fullDomainName, "negative_ttl", int(ttl.Seconds()))
+
+	err = pollUntil(ctx, waitUntil, interval, func() error {
+		return h.verifyPropagation(ctx, props, fullDomainName)
+	})
+	if err == nil {
+		return h.sendResponse(event, "SUCCESS", "Delegation resolves", nil)
+	}
+	if ctx.Err() != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Stopped waiting for the negative cache of %s: %v", fullDomainName, ctx.Err()), nil)
+	}
+
+	// Validation is only slower while caches still hold the NXDOMAIN, so the deployment goes on
+	if remaining := time.Until(expiresAt); remaining > interval {
+		logger.Warn("Stopped waiting for the negative cache at the timeout", "name", fullDomainName, "remaining_seconds", int(remaining.Seconds()))
+		return h.sendResponse(event, "SUCCESS", fmt.Sprintf("Stopped waiting at the timeout, %ds before the negative TTL of %s expires", int(remaining.Seconds()), props.Domain), nil)
+	}
+	return h.sendResponse(event, "SUCCESS", fmt.Sprintf("Waited out the negative TTL of %ds", int(ttl.Seconds())), nil)
+}
+
+// negativeCacheTTL returns how long resolvers cache a missing name of the zone, from the SOA
+// record of the first resolver that answers
+func (h *handler) negativeCacheTTL(ctx context.Context, endpoints []string, zone string) (time.Duration, error) {
+	var problems []string
+	for _, endpoint := range endpoints {
+		answer, err := h.queryDoH(ctx, endpoint, zone, "SOA")
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, record := range answer.Answer {
+			if record.Type != dnsTypeSOA {
+				continue
+			}
+			// The SOA data is: mname rname serial refresh retry expire minimum
+			fields := strings.Fields(record.Data)
+			if len(fields) != 7 {
+				return 0, fmt.Errorf("invalid SOA record from %s: %s", endpoint, record.Data)
+			}
+			minimum, err := strconv.Atoi(fields[6])
+			if err != nil {
+				return 0, fmt.Errorf("invalid SOA record from %s: %s", endpoint, record.Data)
+			}
+			if record.TTL < minimum {
+				minimum = record.TTL
+			}
+			return time.Duration(minimum) * time.Second, nil
+		}
+		problems = append(problems, fmt.Sprintf("%s has no SOA record for %s", endpoint, zone))
+	}
+	return 0, fmt.Errorf("%s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// Nested delegation: a subdomain of a subdomain that is already delegated to a Route53
+// hosted zone, e.g. a.b.example.com with b.example.com delegated by an earlier deployment.
+// Resolvers never ask Cloudflare about names below b.example.com, so the NS records are
+// written to the Route53 zone of the nearest delegated parent instead.
+
+// parentZone is the Route53 hosted zone a nested subdomain is delegated in
+type parentZone struct {
+	ID   string
+	Name string
+}
+
+// parentZoneCandidates returns the names of the possible parent zones of the subdomain
+// below domain, nearest first
+func parentZoneCandidates(domain, subdomain string) []string {
+	labels := strings.Split(strings.Trim(subdomain, "."), ".")
+	var candidates []string
+	for i := 1; i < len(labels); i++ {
+		candidates = append(candidates, strings.Join(labels[i:], ".")+"."+strings.Trim(domain, "."))
+	}
+	return candidates
+}
+
+// findParentZone returns the nearest public hosted zone of the account the subdomain is
+// nested in, or nil if it is a direct subdomain of the Cloudflare domain
+func findParentZone(ctx context.Context, client route53iface.Route53API, domain, subdomain string) (*parentZone, error) {
+	for _, name := range parentZoneCandidates(domain, subdomain) {
+		zones, err := client.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{
+			DNSName:  aws.String(name),
+			MaxItems: aws.String("10"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list hosted zones for %s: %v", name, err)
+		}
+		if zoneID := findPublicHostedZone(zones.HostedZones, name); zoneID != "" {
+			return &parentZone{ID: zoneID, Name: name}, nil
+		}
+	}
+	return nil, nil
+}
+
+// nestedParentZone looks up the parent zone of a nested subdomain, without Route53 calls
+// for direct subdomains of the Cloudflare domain
+func nestedParentZone(ctx context.Context, props CloudflareDNSProperties) (*parentZone, route53iface.Route53API, error) {
+	if !strings.Contains(strings.Trim(props.Subdomain, "."), ".") {
+		return nil, nil, nil
+	}
+	client, err := route53Client("")
+	if err != nil {
+		return nil, nil, err
+	}
+	parent, err := findParentZone(ctx, client, props.Domain, props.Subdomain)
+	return parent, client, err
+}
+
+// parentZoneRecords returns the record sets named name in the parent zone
+func parentZoneRecords(ctx context.Context, client route53iface.Route53API, parent *parentZone, name string) ([]*route53.ResourceRecordSet, error) {
+	output, err := client.ListResourceRecordSetsWithContext(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(parent.ID),
+		StartRecordName: aws.String(name),
+		MaxItems:        aws.String("20"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records of %s: %v", parent.Name, err)
+	}
+
+	var records []*route53.ResourceRecordSet
+	for _, record := range output.ResourceRecordSets {
+		if strings.EqualFold(strings.TrimSuffix(aws.StringValue(record.Name), "."), strings.TrimSuffix(name, ".")) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// handleNestedCheck checks the parent zone for records colliding with the delegation
+func (h *handler) handleNestedCheck(ctx context.Context, event CloudFormationEvent, client route53iface.Route53API, parent *parentZone) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	logger.Info("Checking the parent hosted zone for colliding records", "name", fullDomainName, "parent_zone", parent.Name)
+
+	records, err := parentZoneRecords(ctx, client, parent, fullDomainName)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+	}
+
+	var recordTypes []string
+	for _, record := range records {
+		if aws.StringValue(record.Type) != route53.RRTypeNs {
+			recordTypes = append(recordTypes, aws.StringValue(record.Type))
+		}
+	}
+	metrics.Add("CollidingRecords", float64(len(recordTypes)))
+	if len(recordTypes) > 0 {
+		reason := fmt.Sprintf("Found colliding DNS records for %s in hosted zone %s: %v. Please remove these records first", fullDomainName, parent.Name, recordTypes)
+		if guidance := collisionGuidance(recordTypes); guidance != "" {
+			reason += ". " + guidance
+		}
+		return h.sendResponse(event, "FAILED", reason, nil)
+	}
+
+	data := &ResponseData{
+		Domain:             props.Domain,
+		Subdomain:          props.Subdomain,
+		ParentHostedZoneID: strings.TrimPrefix(parent.ID, "/hostedzone/"),
+	}
+	return h.sendResponse(event, "SUCCESS", "DNS collision check completed successfully", data)
+}
+
+// handleNestedUpdate writes the NS records of the subdomain to the parent zone
+func (h *handler) handleNestedUpdate(ctx context.Context, event CloudFormationEvent, client route53iface.Route53API, parent *parentZone, nameServers []string) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	logger.Info("Updating NS records in the parent hosted zone", "name", fullDomainName, "parent_zone", parent.Name)
+
+	// A plan compares the NS records in the parent zone instead of replacing them
+	if props.Action == "plan" {
+		records, err := parentZoneRecords(ctx, client, parent, fullDomainName)
+		if err != nil {
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+		}
+		var existing []string
+		for _, record := range records {
+			if aws.StringValue(record.Type) == route53.RRTypeNs {
+				for _, value := range record.ResourceRecords {
+					existing = append(existing, aws.StringValue(value.Value))
+				}
+			}
+		}
+		toAdd, toRemove := nameServerDifference(existing, nameServers)
+		if props.Mode == modeAppend {
+			toRemove = nil
+		}
+		return h.sendResponse(event, "SUCCESS", "NS record changes planned", &ResponseData{
+			Domain:              props.Domain,
+			Subdomain:           props.Subdomain,
+			ParentHostedZoneID:  strings.TrimPrefix(parent.ID, "/hostedzone/"),
+			NameServers:         joinNameServers(nameServers),
+			NameServersToAdd:    strings.Join(toAdd, ","),
+			NameServersToRemove: strings.Join(toRemove, ","),
+		})
+	}
+
+	// The record set is replaced as a whole, so append mode adds the other name servers to it
+	values := append([]string{}, nameServers...)
+	if props.Mode == modeAppend {
+		records, err := parentZoneRecords(ctx, client, parent, fullDomainName)
+		if err != nil {
+			return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+		}
+		for _, record := range records {
+			if aws.StringValue(record.Type) != route53.RRTypeNs {
+				continue
+			}
+			for _, value := range record.ResourceRecords {
+				if missing, _ := nameServerDifference(values, []string{aws.StringValue(value.Value)}); len(missing) > 0 {
+					values = append(values, aws.StringValue(value.Value))
+				}
+			}
+		}
+	}
+
+	var resourceRecords []*route53.ResourceRecord
+	for _, ns := range values {
+		resourceRecords = append(resourceRecords, &route53.ResourceRecord{Value: aws.String(strings.TrimSuffix(ns, ".") + ".")})
+	}
+	_, err := client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(parent.ID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("Delegation of " + fullDomainName + " by cftor53"),
+			Changes: []*route53.Change{{
+				Action: aws.String(route53.ChangeActionUpsert),
+				ResourceRecordSet: &route53.ResourceRecordSet{
+					Name:            aws.String(fullDomainName),
+					Type:            aws.String(route53.RRTypeNs),
+					TTL:             aws.Int64(nsRecordTTL(props)),
+					ResourceRecords: resourceRecords,
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to update NS records in hosted zone %s: %v", parent.Name, err), nil)
+	}
+
+	data := &ResponseData{
+		Domain:             props.Domain,
+		Subdomain:          props.Subdomain,
+		ParentHostedZoneID: strings.TrimPrefix(parent.ID, "/hostedzone/"),
+		NameServers:        joinNameServers(nameServers),
+	}
+	return h.sendResponse(event, "SUCCESS", "NS records updated in parent hosted zone "+parent.Name, data)
+}
+
+// handleNestedVerify checks that the NS records in the parent zone match the name servers
+func (h *handler) handleNestedVerify(ctx context.Context, event CloudFormationEvent, client route53iface.Route53API, parent *parentZone) error {
+	props := event.ResourceProperties
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+
+	records, err := parentZoneRecords(ctx, client, parent, fullDomainName)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+	}
+	var existing []string
+	for _, record := range records {
+		if aws.StringValue(record.Type) == route53.RRTypeNs {
+			for _, value := range record.ResourceRecords {
+				existing = append(existing, aws.StringValue(value.Value))
+			}
+		}
+	}
+	if missing, extra := delegationDifference(props, existing); len(missing) > 0 || len(extra) > 0 {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("NS records for %s in hosted zone %s do not match the hosted zone: missing %v, unexpected %v", fullDomainName, parent.Name, missing, extra), nil)
+	}
+	return h.sendResponse(event, "SUCCESS", "NS records verified", nil)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Deleting or creating many records one call at a time can use up the invocation, so the
+// calls run on a few workers at once, few enough to stay below the rate limit of the
+// Cloudflare API.
+
+// recordWorkers is the number of record operations run at once
+const recordWorkers = 4
+
+// forEachParallel calls op for every index below n on up to recordWorkers goroutines and
+// returns the errors of the calls by index, nil for the calls that succeeded. Once the context
+// is done, the remaining calls fail with its error.
+func forEachParallel(ctx context.Context, n int, op func(i int) error) []error {
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < recordWorkers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = op(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// aggregateErrors returns one error describing the failed operations, or nil if none failed
+func aggregateErrors(errs []error) error {
+	var failed error
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			failed = err
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) <= 1 {
+		return failed
+	}
+	return fmt.Errorf("%d of %d operations failed: %s", len(messages), len(errs), strings.Join(messages, "; "))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+)
+
+// Operational tooling modelled on Powertools for AWS Lambda, which has no Go release:
+// structured JSON logs, CloudWatch embedded metric format (EMF) metrics and X-Ray
+// tracing, configured through the same POWERTOOLS_* environment variables.
+
+const defaultServiceName = "cftor53"
+
+// serviceName returns the service name used in logs and as the metrics dimension
+func serviceName() string {
+	if name := os.Getenv("POWERTOOLS_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return defaultServiceName
+}
+
+// tracingEnabled reports whether AWS and Cloudflare calls are traced with X-Ray
+func tracingEnabled() bool {
+	return os.Getenv("POWERTOOLS_TRACE_DISABLED") != "true"
+}
+
+// logLevels orders the levels of the log entries
+var logLevels = map[string]int{"DEBUG": 0, "INFO": 1, "WARN": 2, "ERROR": 3}
+
+// logLevel returns the lowest level logged, INFO unless LOG_LEVEL sets another one
+func logLevel() int {
+	if level, ok := logLevels[strings.ToUpper(os.Getenv("LOG_LEVEL"))]; ok {
+		return level
+	}
+	return logLevels["INFO"]
+}
+
+// structuredLogger writes one JSON object per log entry
+type structuredLogger struct {
+	mu        sync.Mutex
+	out       io.Writer
+	service   string
+	level     int
+	requestID string
+	coldStart bool
+}
+
+var logger = &structuredLogger{out: os.Stdout, service: serviceName(), level: logLevel()}
+
+// Debug logs diagnostics, such as full record listings, with optional key/value pairs
+func (l *structuredLogger) Debug(message string, keyvals ...interface{}) {
+	l.write("DEBUG", message, keyvals)
+}
+
+// Info logs a message with optional key/value pairs
+func (l *structuredLogger) Info(message string, keyvals ...interface{}) {
+	l.write("INFO", message, keyvals)
+}
+
+// Warn logs a warning with optional key/value pairs
+func (l *structuredLogger) Warn(message string, keyvals ...interface{}) {
+	l.write("WARN", message, keyvals)
+}
+
+// Error logs an error with optional key/value pairs
+func (l *structuredLogger) Error(message string, keyvals ...interface{}) {
+	l.write("ERROR", message, keyvals)
+}
+
+func (l *structuredLogger) write(level, message string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if logLevels[level] < l.level {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"level":     level,
+		"message":   message,
+		"service":   l.service,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if l.requestID != "" {
+		entry["function_request_id"] = l.requestID
+		entry["cold_start"] = l.coldStart
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		entry[key] = redactLogValue(key, logValue(keyvals[i+1]))
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"ERROR","message":"failed to marshal log entry: %v"}`, err))
+	}
+	line = []byte(secrets.Redact(string(line)))
+	l.out.Write(append(line, '\n'))
+}
+
+// logValue converts errors to strings, which encoding/json would otherwise render as {}
+func logValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+// metricsRecorder collects counters during an invocation and writes them as a single EMF entry
+type metricsRecorder struct {
+	mu        sync.Mutex
+	out       io.Writer
+	namespace string
+	service   string
+	// Delegated name of the invocation, a second dimension of the metrics
+	delegation string
+	values     map[string]float64
+}
+
+var metrics = &metricsRecorder{out: os.Stdout, namespace: metricsNamespace(), service: serviceName(), values: map[string]float64{}}
+
+// metricsNamespace returns the CloudWatch namespace for the handler metrics
+func metricsNamespace() string {
+	if namespace := os.Getenv("POWERTOOLS_METRICS_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return defaultServiceName
+}
+
+// Add increments a count metric
+func (m *metricsRecorder) Add(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[name] += value
+}
+
+// SetDelegation adds the delegated name as a dimension of the metrics until they are flushed,
+// so the delegations served by one function can be told apart
+func (m *metricsRecorder) SetDelegation(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delegation = name
+}
+
+// Flush writes the collected metrics in embedded metric format and resets them
+func (m *metricsRecorder) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.values) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, 0, len(names))
+	entry := map[string]interface{}{"service": m.service}
+	dimensions := [][]string{{"service"}}
+	if m.delegation != "" {
+		entry["delegation"] = m.delegation
+		dimensions = append(dimensions, []string{"service", "delegation"})
+	}
+	for _, name := range names {
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": "Count"})
+		entry[name] = m.values[name]
+	}
+	entry["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  m.namespace,
+			"Dimensions": dimensions,
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Failed to marshal metrics", "error", err)
+		return
+	}
+	m.out.Write(append(line, '\n'))
+	m.values = map[string]float64{}
+	m.delegation = ""
+}
+
+var coldStart = true
+
+// withPowertools wraps the handler with request-scoped logging, metrics flushing and tracing
+func withPowertools[T any](handler func(context.Context, CloudFormationEvent) (T, error)) func(context.Context, CloudFormationEvent) (T, error) {
+	return func(ctx context.Context, event CloudFormationEvent) (data T, err error) {
+		logger.mu.Lock()
+		logger.requestID = ""
+		if lc, ok := lambdacontext.FromContext(ctx); ok {
+			logger.requestID = lc.AwsRequestID
+		}
+		logger.coldStart = coldStart
+		logger.mu.Unlock()
+
+		if coldStart {
+			metrics.Add("ColdStart", 1)
+			coldStart = false
+		}
+		defer metrics.Flush()
+
+		if tracingEnabled() {
+			var segment *xray.Segment
+			ctx, segment = xray.BeginSubsegment(ctx, "## handler")
+			segment.AddAnnotation("RequestType", event.RequestType)
+			segment.AddAnnotation("Action", event.ResourceProperties.Action)
+			defer func() { segment.Close(err) }()
+		}
+
+		data, err = handler(ctx, event)
+		return data, redactError(err)
+	}
+}
+
+// awsSession creates an AWS session whose clients are traced when tracing is enabled.
+// AWS_ENDPOINT_URL sends every AWS call to another endpoint, such as LocalStack in the
+// end-to-end tests.
+func awsSession() (*session.Session, error) {
+	config := aws.NewConfig()
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	if tracingEnabled() {
+		return xray.AWSSession(sess), nil
+	}
+	return sess, nil
+}
+
+// cloudflareHTTPClient returns the HTTP client option for Cloudflare API calls, traced when tracing is enabled
+func cloudflareHTTPClient() option.RequestOption {
+	if tracingEnabled() {
+		return option.WithHTTPClient(xray.Client(&http.Client{}))
+	}
+	return option.WithHTTPClient(&http.Client{})
+}
+
+// dohHTTPClient returns the HTTP client of the DNS-over-HTTPS queries, traced when tracing is enabled
+func dohHTTPClient() *http.Client {
+	if tracingEnabled() {
+		return xray.Client(&http.Client{})
+	}
+	return &http.Client{}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Every log entry passes through the redactor before it is written, so that neither the
+// Cloudflare credentials, nor the secret payloads holding them, nor the pre-signed response
+// URLs of CloudFormation reach CloudWatch, whatever a log call or an error message contains.
+
+// redacted replaces the secrets in the logs
+const redacted = "[REDACTED]"
+
+// minSecretLength is the length below which a value isn't redacted wherever it appears,
+// since short values would blank out unrelated text
+const minSecretLength = 8
+
+// sensitiveKeys are the log keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"api_token":     true,
+	"api_key":       true,
+	"token":         true,
+	"secret":        true,
+	"secret_string": true,
+	"secret_value":  true,
+	"password":      true,
+	"authorization": true,
+	"response_url":  true,
+	"responseurl":   true,
+}
+
+// signedURLQuery matches the query of pre-signed URLs, such as the ResponseURL of the
+// CloudFormation events, which lets anyone holding it answer for the custom resource
+var signedURLQuery = regexp.MustCompile(`(https?://[^\s"?]+)\?[^\s"]*(?:Signature|X-Amz-Credential)=[^\s"]*`)
+
+// redactor remembers the secrets the handler read and removes them from text
+type redactor struct {
+	mu      sync.Mutex
+	secrets []string
+}
+
+var secrets = &redactor{}
+
+// Add remembers secret values, such as a Cloudflare API token, for redaction
+func (r *redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < minSecretLength || containsString(r.secrets, value) {
+			continue
+		}
+		r.secrets = append(r.secrets, value)
+		// A secret with characters JSON escapes appears escaped in the log entries
+		if escaped, err := json.Marshal(value); err == nil {
+			if escaped := strings.Trim(string(escaped), `"`); escaped != value {
+				r.secrets = append(r.secrets, escaped)
+			}
+		}
+	}
+}
+
+// Redact removes the remembered secrets and the queries of pre-signed URLs from text
+func (r *redactor) Redact(text string) string {
+	r.mu.Lock()
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	r.mu.Unlock()
+	return signedURLQuery.ReplaceAllString(text, "$1?"+redacted)
+}
+
+// redactLogValue hides the value of a sensitive key
+func redactLogValue(key string, value interface{}) interface{} {
+	if sensitiveKeys[strings.ToLower(key)] {
+		return redacted
+	}
+	return value
+}
+
+// redactError returns the error with its message redacted, for errors the Lambda runtime reports
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if message := secrets.Redact(err.Error()); message != err.Error() {
+		return errors.New(message)
+	}
+	return err
+}
+
+// containsString reports whether the values contain the value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
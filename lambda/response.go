@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CloudFormation rejects custom resource responses over 4KB, and the stack then waits for a
+// response until the custom resource times out. Responses with too much Data, e.g. many
+// warnings or name servers, are first stored in full in the bucket of the SpillBucket
+// property, when set, and then shortened until they fit. The essential values, the names, zone
+// IDs, counts and certificate ARN, are always kept.
+
+// responseSizeLimit is the largest response body CloudFormation accepts
+const responseSizeLimit = 4096
+
+// maxReasonSize is the size an overlong reason is cut to before the Data is shortened
+const maxReasonSize = 1024
+
+// spillTimeout bounds the time storing an oversized response in S3
+const spillTimeout = 10 * time.Second
+
+// truncatableData returns the optional values of the Data in the order they are shortened,
+// with the separators of their lists
+func truncatableData(data *ResponseData) []struct {
+	name      string
+	value     *string
+	separator string
+} {
+	return []struct {
+		name      string
+		value     *string
+		separator string
+	}{
+		{"Warnings", &data.Warnings, "; "},
+		{"CollidingRecords", &data.CollidingRecords, "; "},
+		{"ProxiedRecords", &data.ProxiedRecords, "; "},
+		{"RecordIds", &data.RecordIds, ","},
+		{"NameServersToRemove", &data.NameServersToRemove, ","},
+		{"NameServersToAdd", &data.NameServersToAdd, ","},
+		{"NameServers", &data.NameServers, ","},
+	}
+}
+
+// responseSize returns the size of the response body
+func responseSize(response *CloudFormationResponse) int {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return 0
+	}
+	return len(body)
+}
+
+// fitResponse shortens the response to the CloudFormation limit, storing its full Data in
+// the spill bucket first
+func (h *handler) fitResponse(event CloudFormationEvent, response *CloudFormationResponse) {
+	size := responseSize(response)
+	if size <= responseSizeLimit {
+		return
+	}
+
+	// A reason such as a Cloudflare error page is cut before the Data, and further if need be
+	var truncated []string
+	if len(response.Reason) > maxReasonSize {
+		response.Reason = shortenText(response.Reason, len(response.Reason)-maxReasonSize)
+		truncated = append(truncated, "Reason")
+	}
+	if response.Data != nil && responseSize(response) > responseSizeLimit {
+		data := *response.Data
+		response.Data = &data
+		if bucket := event.ResourceProperties.SpillBucket; bucket != "" {
+			if location, err := h.spillResponseData(event, bucket, &data); err != nil {
+				logger.Warn("Failed to store the full response data", "bucket", bucket, "error", err)
+			} else {
+				data.DataLocation = location
+			}
+		}
+
+		var fields []string
+		for _, field := range truncatableData(&data) {
+			if *field.value == "" || responseSize(response) <= responseSizeLimit {
+				continue
+			}
+			fields = append(fields, field.name)
+			data.DataTruncated = strings.Join(fields, ",")
+			for *field.value != "" && responseSize(response) > responseSizeLimit {
+				*field.value = shortenList(*field.value, field.separator, responseSize(response)-responseSizeLimit)
+			}
+		}
+		truncated = append(truncated, fields...)
+	}
+
+	if excess := responseSize(response) - responseSizeLimit; excess > 0 {
+		response.Reason = shortenText(response.Reason, excess)
+		if len(truncated) == 0 || truncated[0] != "Reason" {
+			truncated = append(truncated, "Reason")
+		}
+	}
+	logger.Warn("Truncated the response to the CloudFormation size limit", "size", size, "limit", responseSizeLimit, "truncated", strings.Join(truncated, ","))
+	metrics.Add("TruncatedResponses", 1)
+}
+
+// spillResponseData stores the Data in the bucket and returns its s3:// location
+func (h *handler) spillResponseData(event CloudFormationEvent, bucket string, data *ResponseData) (string, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	requestID := event.RequestId
+	if requestID == "" {
+		requestID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	key := fmt.Sprintf("cftor53/%s/%s/%s.json", stackName(event.StackId), event.LogicalResourceId, requestID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), spillTimeout)
+	defer cancel()
+	if _, err := h.objects.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(string(body)),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return "", err
+	}
+	location := "s3://" + bucket + "/" + key
+	logger.Info("Stored the full response data", "location", location, "size", len(body))
+	return location, nil
+}
+
+// stackName returns the name of the stack in a stack ID, e.g. Cftor53Stack in
+// arn:aws:cloudformation:eu-north-1:123456789012:stack/Cftor53Stack/id
+func stackName(stackID string) string {
+	parts := strings.Split(stackID, "/")
+	if len(parts) < 2 || parts[1] == "" {
+		return "unknown"
+	}
+	return parts[1]
+}
+
+// shortenList drops the last elements of the list until it is at least excess bytes shorter
+func shortenList(list, separator string, excess int) string {
+	elements := strings.Split(list, separator)
+	for len(elements) > 0 && len(list)-len(strings.Join(elements, separator)) < excess {
+		elements = elements[:len(elements)-1]
+	}
+	return strings.Join(elements, separator)
+}
+
+// shortenText cuts the text by at least excess bytes, marking the cut
+func shortenText(text string, excess int) string {
+	const marker = "... (truncated)"
+	keep := len(text) - excess - len(marker)
+	if keep <= 0 {
+		return marker
+	}
+	// Don't cut a multibyte character in half
+	for keep > 0 && !utf8.RuneStart(text[keep]) {
+		keep--
+	}
+	return text[:keep] + marker
+}
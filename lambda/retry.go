@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go/v2/option"
+)
+
+// Cloudflare API calls that were rate limited or failed on the server are retried with
+// exponential backoff, as the SDK does, but with the number of retries and the delays of the
+// MaxRetries, BaseDelayMs and MaxDelayMs properties.
+
+// Defaults of the MaxRetries, BaseDelayMs and MaxDelayMs properties, those of the SDK
+const (
+	defaultMaxRetries = 2
+	defaultBaseDelay  = 500 * time.Millisecond
+	defaultMaxDelay   = 8 * time.Second
+)
+
+// retryPolicy is how often and how long apart Cloudflare API calls are retried
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// cloudflareRetryPolicy returns the retry policy of the properties
+func cloudflareRetryPolicy(props CloudflareDNSProperties) retryPolicy {
+	policy := retryPolicy{
+		maxRetries: countProperty("MaxRetries", props.MaxRetries, defaultMaxRetries),
+		baseDelay:  millisecondsProperty("BaseDelayMs", props.BaseDelayMs, defaultBaseDelay),
+		maxDelay:   millisecondsProperty("MaxDelayMs", props.MaxDelayMs, defaultMaxDelay),
+	}
+	if policy.maxDelay < policy.baseDelay {
+		policy.maxDelay = policy.baseDelay
+	}
+	return policy
+}
+
+// countProperty returns the number of a property, or the default when it is not set or invalid
+func countProperty(name, value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		logger.Warn("Invalid "+name+" value, using default", "value", value)
+		return fallback
+	}
+	return count
+}
+
+// millisecondsProperty returns the duration of a property in milliseconds, or the default when
+// it is not set or invalid
+func millisecondsProperty(name, value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	milliseconds, err := strconv.Atoi(value)
+	if err != nil || milliseconds <= 0 {
+		logger.Warn("Invalid "+name+" value, using default", "value", value)
+		return fallback
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
+// delay returns the time to wait before a retry, counted from 0: the base delay doubled for
+// each earlier retry, less a random quarter, or the Retry-After of the response, up to the
+// maximum delay
+func (p retryPolicy) delay(retry int, res *http.Response) time.Duration {
+	if res != nil {
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			if delay := time.Duration(seconds) * time.Second; delay < p.maxDelay {
+				return delay
+			}
+			return p.maxDelay
+		}
+	}
+	delay := p.maxDelay
+	if retry < 32 && p.baseDelay<<retry < p.maxDelay {
+		delay = p.baseDelay << retry
+	}
+	if jitter := int64(delay / 4); jitter > 0 {
+		delay -= time.Duration(rand.Int63n(jitter))
+	}
+	return delay
+}
+
+// middleware retries the calls of the Cloudflare client
+func (p retryPolicy) middleware(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		res, err := next(req)
+		if retry >= p.maxRetries || !shouldRetry(req, res) {
+			return res, err
+		}
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		delay := p.delay(retry, res)
+		logger.Warn("Retrying Cloudflare API call", "method", req.Method, "path", req.URL.Path, "status", status, "retry", retry+1, "delay_ms", delay.Milliseconds())
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// shouldRetry reports whether the call may succeed when retried: it failed to connect, was rate
+// limited, timed out, conflicted or failed on the server, and its body can be sent again
+func shouldRetry(req *http.Request, res *http.Response) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if res == nil {
+		return true
+	}
+	switch res.Header.Get("x-should-retry") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return res.StatusCode == http.StatusRequestTimeout ||
+		res.StatusCode == http.StatusConflict ||
+		res.StatusCode == http.StatusTooManyRequests ||
+		res.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+	"github.com/cloudflare/cloudflare-go/v2/user"
+)
+
+// RotationEvent represents the event sent by Secrets Manager for each rotation step
+type RotationEvent struct {
+	SecretID           string `json:"SecretId"`
+	ClientRequestToken string `json:"ClientRequestToken"`
+	Step               string `json:"Step"`
+}
+
+// secretValue holds a secret value in the format it was stored in, so that the
+// rolled token is written back the same way
+type secretValue struct {
+	token  string
+	fields map[string]interface{} // nil when the secret is the raw token
+}
+
+// parseSecretValue parses a JSON object with an api_token key or a raw token
+func parseSecretValue(raw string) (*secretValue, error) {
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return nil, fmt.Errorf("secret value is empty")
+	}
+
+	if !strings.HasPrefix(value, "{") {
+		return &secretValue{token: value}, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal secret: %v", err)
+	}
+	token, _ := fields["api_token"].(string)
+	if token == "" {
+		return nil, fmt.Errorf("API token not found in secret")
+	}
+
+	return &secretValue{token: token, fields: fields}, nil
+}
+
+// withToken returns the secret string with the token replaced
+func (s *secretValue) withToken(token string) (string, error) {
+	if s.fields == nil {
+		return token, nil
+	}
+
+	fields := make(map[string]interface{}, len(s.fields))
+	for key, value := range s.fields {
+		fields[key] = value
+	}
+	fields["api_token"] = token
+
+	valueJSON, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal secret: %v", err)
+	}
+	return string(valueJSON), nil
+}
+
+// getSecretValue retrieves the secret string for a version stage, optionally pinned to a version ID
+func getSecretValue(svc *secretsmanager.SecretsManager, secretID, stage, versionID string) (*secretValue, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(secretID),
+		VersionStage: aws.String(stage),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := svc.GetSecretValue(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.SecretString == nil {
+		return nil, fmt.Errorf("secret %s has no string value", secretID)
+	}
+
+	return parseSecretValue(*result.SecretString)
+}
+
+// HandleRotation is the Secrets Manager rotation handler
+func HandleRotation(ctx context.Context, event RotationEvent) error {
+	log.Println("Received rotation step:", event.Step)
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	svc := secretsmanager.New(sess)
+
+	// Make sure the version is staged correctly before doing anything
+	metadata, err := svc.DescribeSecret(&secretsmanager.DescribeSecretInput{SecretId: aws.String(event.SecretID)})
+	if err != nil {
+		return fmt.Errorf("failed to describe secret: %v", err)
+	}
+	if metadata.RotationEnabled == nil || !*metadata.RotationEnabled {
+		return fmt.Errorf("rotation is not enabled for secret %s", event.SecretID)
+	}
+	stages, ok := metadata.VersionIdsToStages[event.ClientRequestToken]
+	if !ok {
+		return fmt.Errorf("secret version %s has no stage for rotation", event.ClientRequestToken)
+	}
+	if hasStage(stages, "AWSCURRENT") {
+		log.Println("Secret version", event.ClientRequestToken, "is already AWSCURRENT")
+		return nil
+	}
+	if !hasStage(stages, "AWSPENDING") {
+		return fmt.Errorf("secret version %s is not set as AWSPENDING for rotation", event.ClientRequestToken)
+	}
+
+	switch event.Step {
+	case "createSecret":
+		return createSecret(ctx, svc, event)
+	case "setSecret":
+		// Rolling the token in createSecret already made it active in Cloudflare
+		log.Println("Nothing to set, token was rolled in createSecret")
+		return nil
+	case "testSecret":
+		return testSecret(ctx, svc, event)
+	case "finishSecret":
+		return finishSecret(svc, event, metadata.VersionIdsToStages)
+	default:
+		return fmt.Errorf("invalid rotation step: %s", event.Step)
+	}
+}
+
+// createSecret rolls the Cloudflare API token and stores the new value as AWSPENDING
+func createSecret(ctx context.Context, svc *secretsmanager.SecretsManager, event RotationEvent) error {
+	// The pending version may already exist if a previous attempt failed after storing it
+	if _, err := getSecretValue(svc, event.SecretID, "AWSPENDING", event.ClientRequestToken); err == nil {
+		log.Println("Pending secret version already exists")
+		return nil
+	} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("failed to get pending secret value: %v", err)
+	}
+
+	current, err := getSecretValue(svc, event.SecretID, "AWSCURRENT", "")
+	if err != nil {
+		return fmt.Errorf("failed to get current secret value: %v", err)
+	}
+
+	api := cloudflare.NewClient(option.WithAPIToken(current.token))
+
+	// Look up the ID of the current token so it can roll itself
+	verified, err := api.User.Tokens.Verify(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify current Cloudflare API token: %v", err)
+	}
+
+	newToken, err := api.User.Tokens.Value.Update(ctx, verified.ID, user.TokenValueUpdateParams{Body: map[string]interface{}{}})
+	if err != nil {
+		return fmt.Errorf("failed to roll Cloudflare API token %s: %v", verified.ID, err)
+	}
+	log.Println("Rolled Cloudflare API token", verified.ID)
+
+	newValue, err := current.withToken(*newToken)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String(event.SecretID),
+		ClientRequestToken: aws.String(event.ClientRequestToken),
+		SecretString:       aws.String(newValue),
+		VersionStages:      aws.StringSlice([]string{"AWSPENDING"}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store rolled token: %v", err)
+	}
+
+	return nil
+}
+
+// testSecret verifies that the pending token is accepted by Cloudflare
+func testSecret(ctx context.Context, svc *secretsmanager.SecretsManager, event RotationEvent) error {
+	pending, err := getSecretValue(svc, event.SecretID, "AWSPENDING", event.ClientRequestToken)
+	if err != nil {
+		return fmt.Errorf("failed to get pending secret value: %v", err)
+	}
+
+	api := cloudflare.NewClient(option.WithAPIToken(pending.token))
+
+	verified, err := api.User.Tokens.Verify(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify pending Cloudflare API token: %v", err)
+	}
+	if verified.Status != user.TokenVerifyResponseStatusActive {
+		return fmt.Errorf("pending Cloudflare API token is %s", verified.Status)
+	}
+
+	return nil
+}
+
+// finishSecret moves the AWSCURRENT stage to the pending version
+func finishSecret(svc *secretsmanager.SecretsManager, event RotationEvent, versions map[string][]*string) error {
+	currentVersion := ""
+	for versionID, stages := range versions {
+		if hasStage(stages, "AWSCURRENT") {
+			currentVersion = versionID
+			break
+		}
+	}
+
+	_, err := svc.UpdateSecretVersionStage(&secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            aws.String(event.SecretID),
+		VersionStage:        aws.String("AWSCURRENT"),
+		MoveToVersionId:     aws.String(event.ClientRequestToken),
+		RemoveFromVersionId: aws.String(currentVersion),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to finish rotation: %v", err)
+	}
+
+	log.Println("Secret version", event.ClientRequestToken, "is now AWSCURRENT")
+	return nil
+}
+
+// hasStage reports whether a version has the given stage label
+func hasStage(stages []*string, stage string) bool {
+	for _, s := range stages {
+		if s != nil && *s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	lambda.Start(HandleRotation)
+}
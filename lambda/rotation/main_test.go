@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSecretValueWithToken(t *testing.T) {
+	// JSON secrets keep their other fields
+	secret, err := parseSecretValue(`{"api_token":"old-token","owner":"dns-team"}`)
+	if err != nil {
+		t.Fatalf("Failed to parse JSON secret: %v", err)
+	}
+	if secret.token != "old-token" {
+		t.Errorf("Expected token old-token, got %s", secret.token)
+	}
+
+	rolled, err := secret.withToken("new-token")
+	if err != nil {
+		t.Fatalf("Failed to replace token: %v", err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(rolled), &fields); err != nil {
+		t.Fatalf("Rolled secret is not JSON: %v", err)
+	}
+	if fields["api_token"] != "new-token" || fields["owner"] != "dns-team" {
+		t.Errorf("Unexpected rolled secret: %s", rolled)
+	}
+
+	// Plain string secrets stay plain strings
+	secret, err = parseSecretValue("old-token")
+	if err != nil {
+		t.Fatalf("Failed to parse plain secret: %v", err)
+	}
+	rolled, err = secret.withToken("new-token")
+	if err != nil {
+		t.Fatalf("Failed to replace token: %v", err)
+	}
+	if rolled != "new-token" {
+		t.Errorf("Expected new-token, got %s", rolled)
+	}
+
+	// JSON secrets without a token are rejected
+	if _, err := parseSecretValue(`{"owner":"dns-team"}`); err == nil {
+		t.Errorf("Expected error for secret without api_token")
+	}
+}
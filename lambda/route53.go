@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// lookupNameServers assumes the role in the hosted zone's account and returns the name
+// servers of the public hosted zone for name
+func lookupNameServers(ctx context.Context, roleArn, name string) ([]string, error) {
+	client, err := route53Client(roleArn)
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := client.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{
+		DNSName:  aws.String(name),
+		MaxItems: aws.String("10"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hosted zones as %s: %v", roleArn, err)
+	}
+	zoneID := findPublicHostedZone(zones.HostedZones, name)
+	if zoneID == "" {
+		return nil, fmt.Errorf("no public hosted zone for %s in the account of %s", name, roleArn)
+	}
+	return zoneNameServers(ctx, client, zoneID)
+}
+
+// lookupZoneNameServers returns the name servers of an existing hosted zone, assuming the
+// role in the zone's account if one is given
+func lookupZoneNameServers(ctx context.Context, roleArn, zoneID string) ([]string, error) {
+	client, err := route53Client(roleArn)
+	if err != nil {
+		return nil, err
+	}
+	return zoneNameServers(ctx, client, zoneID)
+}
+
+// route53Client returns a Route53 client, using the role's credentials if one is given
+func route53Client(roleArn string) (*route53.Route53, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	if roleArn == "" {
+		return route53.New(sess), nil
+	}
+	return route53.New(sess, &aws.Config{Credentials: stscreds.NewCredentials(sess, roleArn)}), nil
+}
+
+// zoneNameServers returns the name servers of the hosted zone
+func zoneNameServers(ctx context.Context, client *route53.Route53, zoneID string) ([]string, error) {
+	zone, err := client.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hosted zone %s: %v", zoneID, err)
+	}
+	if zone.DelegationSet == nil || len(zone.DelegationSet.NameServers) == 0 {
+		return nil, fmt.Errorf("hosted zone %s has no name servers", zoneID)
+	}
+	return aws.StringValueSlice(zone.DelegationSet.NameServers), nil
+}
+
+// findPublicHostedZone returns the ID of the public hosted zone named name, if any
+func findPublicHostedZone(zones []*route53.HostedZone, name string) string {
+	for _, zone := range zones {
+		if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSuffix(aws.StringValue(zone.Name), "."), strings.TrimSuffix(name, ".")) {
+			return aws.StringValue(zone.Id)
+		}
+	}
+	return ""
+}
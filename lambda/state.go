@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+)
+
+// The DynamoDB table of the StateTable property records the Cloudflare records a delegation
+// manages, one item per record keyed by the delegated name and the record ID. Deletes remove
+// the recorded records by ID, and the CLI lists the items as an inventory and reports drift.
+
+// recordState is the item of a managed Cloudflare record in the state table
+type recordState struct {
+	Name              string `dynamodbav:"Name"`
+	RecordId          string `dynamodbav:"RecordId"`
+	Type              string `dynamodbav:"Type"`
+	Content           string `dynamodbav:"Content"`
+	ZoneId            string `dynamodbav:"ZoneId"`
+	StackId           string `dynamodbav:"StackId"`
+	LogicalResourceId string `dynamodbav:"LogicalResourceId"`
+	CreatedAt         string `dynamodbav:"CreatedAt"`
+	UpdatedAt         string `dynamodbav:"UpdatedAt"`
+}
+
+// loadRecordState returns the recorded records of the delegated name
+func (h *handler) loadRecordState(ctx context.Context, table, name string) ([]recordState, error) {
+	var items []recordState
+	var unmarshalErr error
+	err := h.tables.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		KeyConditionExpression:    aws.String("#name = :name"),
+		ExpressionAttributeNames:  map[string]*string{"#name": aws.String("Name")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":name": {S: aws.String(name)}},
+		ConsistentRead:            aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, _ bool) bool {
+		var pageItems []recordState
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageItems); unmarshalErr != nil {
+			return false
+		}
+		items = append(items, pageItems...)
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state of %s: %v", name, err)
+	}
+	return items, nil
+}
+
+// syncRecordState records the records the delegation now manages in the zone, keeping the
+// creation time of records already recorded, and removes the items of the other records
+func (h *handler) syncRecordState(ctx context.Context, event CloudFormationEvent, zoneID string, records []dns.Record) error {
+	props := event.ResourceProperties
+	name := delegationName(props)
+	recorded, err := h.loadRecordState(ctx, props.StateTable, name)
+	if err != nil {
+		return err
+	}
+	createdAt := map[string]string{}
+	for _, item := range recorded {
+		createdAt[item.RecordId] = item.CreatedAt
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	current := map[string]bool{}
+	for _, record := range records {
+		current[record.ID] = true
+		item := recordState{
+			Name:              name,
+			RecordId:          record.ID,
+			Type:              string(record.Type),
+			Content:           normalizeNameServer(recordContent(record)),
+			ZoneId:            zoneID,
+			StackId:           event.StackId,
+			LogicalResourceId: event.LogicalResourceId,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+		}
+		if created, ok := createdAt[record.ID]; ok && created != "" {
+			item.CreatedAt = created
+		}
+		attributes, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			return fmt.Errorf("failed to record %s: %v", record.ID, err)
+		}
+		if _, err := h.tables.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(props.StateTable), Item: attributes}); err != nil {
+			return fmt.Errorf("failed to record %s: %v", record.ID, err)
+		}
+	}
+
+	for _, item := range recorded {
+		if current[item.RecordId] {
+			continue
+		}
+		if _, err := h.tables.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(props.StateTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"Name":     {S: aws.String(name)},
+				"RecordId": {S: aws.String(item.RecordId)},
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to remove the record of %s: %v", item.RecordId, err)
+		}
+	}
+	logger.Info("Recorded the managed records", "name", name, "table", props.StateTable, "count", len(records))
+	return nil
+}
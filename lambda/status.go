@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// delegationStatus is the value of the SSM parameter of the StatusParameter property, which
+// tells other tooling the outcome of the last NS record update without calling Cloudflare
+type delegationStatus struct {
+	Action      string   `json:"action"` // "create" or "update"
+	Status      string   `json:"status"` // "SUCCESS" or "FAILED"
+	Reason      string   `json:"reason,omitempty"`
+	Timestamp   string   `json:"timestamp"`
+	NameServers []string `json:"nameServers"`
+	ZoneID      string   `json:"zoneId,omitempty"`
+	StackID     string   `json:"stackId,omitempty"`
+}
+
+// writeDelegationStatus refreshes the delegation status parameter with the response of an
+// NS record update. A failure to write it is only logged.
+func (h *handler) writeDelegationStatus(event CloudFormationEvent, status, reason string, data *ResponseData) {
+	props := event.ResourceProperties
+	value := delegationStatus{
+		Action:    strings.ToLower(event.RequestType),
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		StackID:   event.StackId,
+	}
+	if data != nil && data.NameServers != "" {
+		value.NameServers = strings.Split(data.NameServers, ",")
+		value.ZoneID = data.ZoneID
+		if data.ParentHostedZoneID != "" {
+			value.ZoneID = data.ParentHostedZoneID
+		}
+	} else {
+		value.NameServers = computeNSDiff(nil, props.NameServers).desired
+	}
+	if value.NameServers == nil {
+		value.NameServers = []string{}
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		logger.Warn("Failed to encode the delegation status", "error", err)
+		return
+	}
+	if _, err := h.ssm.PutParameter(&ssm.PutParameterInput{
+		Name:      aws.String(props.StatusParameter),
+		Value:     aws.String(string(encoded)),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Overwrite: aws.Bool(true),
+	}); err != nil {
+		logger.Warn("Failed to write the delegation status", "parameter", props.StatusParameter, "error", err)
+		return
+	}
+	logger.Info("Wrote the delegation status", "parameter", props.StatusParameter, "status", status)
+}
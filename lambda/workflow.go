@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+)
+
+// Step Functions orchestration: a single custom resource starts the delegation state
+// machine, whose steps invoke this function directly (without a ResponseURL) and whose
+// last step reports the outcome back to CloudFormation.
+
+// WorkflowInput is the input of a delegation state machine execution
+type WorkflowInput struct {
+	Event CloudFormationEvent `json:"Event"`
+}
+
+// handleWorkflowStart starts the state machine for the custom resource event. The
+// response to CloudFormation is sent by the state machine once it finishes.
+func (h *handler) handleWorkflowStart(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	if props.StateMachineArn == "" {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
+	}
+
+	input, err := json.Marshal(WorkflowInput{Event: event})
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to marshal workflow input: %v", err), nil)
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to create AWS session: %v", err), nil)
+	}
+
+	// The request ID makes CloudFormation retries of the same request start the execution only once
+	output, err := sfn.New(sess).StartExecutionWithContext(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: aws.String(props.StateMachineArn),
+		Name:            aws.String(event.RequestId),
+		Input:           aws.String(string(input)),
+	})
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to start delegation workflow: %v", err), nil)
+	}
+
+	logger.Info("Started delegation workflow", "execution_arn", aws.StringValue(output.ExecutionArn))
+	return nil
+}
+
+// handleWorkflowResponse sends the outcome of a state machine execution to CloudFormation
+func (h *handler) handleWorkflowResponse(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	if props.Event == nil {
+		return fmt.Errorf("missing workflow event")
+	}
+
+	if props.Status != "SUCCESS" {
+		return h.sendResponse(*props.Event, "FAILED", workflowFailureReason(props.Reason), nil)
+	}
+
+	var data *ResponseData
+	if props.HostedZoneID != "" {
+		data = &ResponseData{
+			Domain:       props.Event.ResourceProperties.Domain,
+			Subdomain:    props.Event.ResourceProperties.Subdomain,
+			HostedZoneID: strings.TrimPrefix(props.HostedZoneID, "/hostedzone/"),
+			NameServers:  joinNameServers(props.NameServers),
+		}
+	}
+	return h.sendResponse(*props.Event, "SUCCESS", "Delegation workflow completed successfully", data)
+}
+
+// workflowFailureReason extracts the error message from the Step Functions error caught
+// by the state machine, whose cause is the Lambda error object for failed Lambda steps
+func workflowFailureReason(reason string) string {
+	var stepError struct {
+		Error string `json:"Error"`
+		Cause string `json:"Cause"`
+	}
+	if err := json.Unmarshal([]byte(reason), &stepError); err != nil {
+		stepError.Cause = reason
+	}
+
+	var lambdaError struct {
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal([]byte(stepError.Cause), &lambdaError); err == nil && lambdaError.ErrorMessage != "" {
+		return lambdaError.ErrorMessage
+	}
+	if stepError.Cause != "" {
+		return stepError.Cause
+	}
+	if stepError.Error != "" {
+		return "Delegation workflow failed: " + stepError.Error
+	}
+	return "Delegation workflow failed"
+}
+
+// handleDNSVerify checks that the NS records in Cloudflare match the Route53 name servers,
+// and with DoHEndpoints waits for public resolvers to answer with them
+func (h *handler) handleDNSVerify(ctx context.Context, event CloudFormationEvent) error {
+	props := event.ResourceProperties
+	logger.Info("Verifying Cloudflare NS records", "domain", props.Domain, "subdomain", props.Subdomain)
+
+	if !props.hasTokenSource() || props.Domain == "" || props.Subdomain == "" || len(props.NameServers) == 0 {
+		return h.sendResponse(event, "FAILED", "Missing required parameters", nil)
+	}
+
+	parent, client, err := nestedParentZone(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to look up the parent hosted zone: %v", err), nil)
+	}
+	if parent != nil {
+		return h.handleNestedVerify(ctx, event, client, parent)
+	}
+
+	api, zoneID, err := h.connectCloudflare(ctx, props)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", err.Error(), nil)
+	}
+
+	fullDomainName := fmt.Sprintf("%s.%s", props.Subdomain, props.Domain)
+	records, err := api.ListDNSRecords(ctx, zoneID, fullDomainName)
+	if err != nil {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("Failed to check DNS records: %v", err), nil)
+	}
+	logger.Debug("Listed DNS records", "name", fullDomainName, "records", describeRecords(records))
+
+	var existing []string
+	for _, record := range records {
+		if record.Type == dns.RecordTypeNS {
+			existing = append(existing, recordContent(record))
+		}
+	}
+	if missing, extra := delegationDifference(props, existing); len(missing) > 0 || len(extra) > 0 {
+		return h.sendResponse(event, "FAILED", fmt.Sprintf("NS records for %s do not match the hosted zone: missing %v, unexpected %v", fullDomainName, missing, extra), nil)
+	}
+
+	if len(props.DoHEndpoints) > 0 {
+		err := pollUntil(ctx, waitDeadline(ctx, propagationTimeout(props)), pollInterval(props), func() error {
+			return h.verifyPropagation(ctx, props, fullDomainName)
+		})
+		if err != nil {
+			return h.sendResponse(event, "FAILED", err.Error(), nil)
+		}
+		return h.sendResponse(event, "SUCCESS", "NS records verified and resolving", nil)
+	}
+
+	return h.sendResponse(event, "SUCCESS", "NS records verified", nil)
+}
+
+// delegationDifference returns the name servers of the delegation missing from existing, and
+// the unexpected ones, which append mode leaves in place and doesn't report
+func delegationDifference(props CloudflareDNSProperties, existing []string) (missing, extra []string) {
+	missing, extra = nameServerDifference(existing, props.NameServers)
+	if props.Mode == modeAppend {
+		extra = nil
+	}
+	return missing, extra
+}
+
+// nameServerDifference returns the expected name servers missing from existing, and the
+// existing ones that are not expected, ignoring trailing dots and case
+func nameServerDifference(existing, expected []string) (missing, extra []string) {
+	existingSet := map[string]bool{}
+	for _, ns := range existing {
+		existingSet[normalizeNameServer(ns)] = true
+	}
+	expectedSet := map[string]bool{}
+	for _, ns := range expected {
+		expectedSet[normalizeNameServer(ns)] = true
+		if !existingSet[normalizeNameServer(ns)] {
+			missing = append(missing, normalizeNameServer(ns))
+		}
+	}
+	for _, ns := range existing {
+		if !expectedSet[normalizeNameServer(ns)] {
+			extra = append(extra, normalizeNameServer(ns))
+		}
+	}
+	return missing, extra
+}
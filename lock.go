@@ -0,0 +1,53 @@
+package cftor53
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// LockConfig serializes the NS record updates of the subdomain with a lock in DynamoDB,
+// keyed by the delegated name, so overlapping invocations don't interleave their changes
+type LockConfig struct {
+	Enabled bool `json:"enabled"`
+	// Existing table in the stack's region shared by the stacks that may update the same
+	// subdomain, by default a table created by the stack
+	TableName string `json:"table_name,omitempty"`
+}
+
+// tableNamePattern matches the table names DynamoDB allows
+var tableNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,255}$`)
+
+// addLockTable returns the name of the lock table, creating it unless an existing one is
+// configured, and lets the Lambda function take and release locks in it
+func addLockTable(stack awscdk.Stack, function awslambda.IFunction, lock *LockConfig) *string {
+	var tableName, tableArn *string
+	if lock.TableName != "" {
+		tableName = jsii.String(lock.TableName)
+		tableArn = stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("dynamodb"),
+			Resource:     jsii.String("table"),
+			ResourceName: tableName,
+		})
+	} else {
+		// Locks only live as long as an invocation, so the table holds nothing worth keeping
+		table := awsdynamodb.NewTable(stack, jsii.String("CloudflareDNSLockTable"), &awsdynamodb.TableProps{
+			PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("LockId"), Type: awsdynamodb.AttributeType_STRING},
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+			TimeToLiveAttribute: jsii.String("ExpiresAt"),
+			RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+		})
+		tableName = table.TableName()
+		tableArn = table.TableArn()
+	}
+
+	function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("dynamodb:PutItem", "dynamodb:GetItem", "dynamodb:DeleteItem"),
+		Resources: jsii.Strings(*tableArn),
+	}))
+	return tableName
+}
@@ -0,0 +1,253 @@
+package cftor53
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Rules of the nag checks. The AwsSolutions rules are those of cdk-nag, so that suppressions
+// carry over, the Cftor53 rules cover what the AwsSolutions pack does not.
+const (
+	NagManagedPolicy   = "AwsSolutions-IAM4"
+	NagWildcard        = "AwsSolutions-IAM5"
+	NagSecretRotation  = "AwsSolutions-SMG4"
+	NagSecretValue     = "Cftor53-SecretValue"
+	NagLogRetention    = "Cftor53-LogRetention"
+	minNagReasonLength = 10
+)
+
+var nagRules = map[string]string{
+	NagManagedPolicy:  "The IAM role uses AWS managed policies",
+	NagWildcard:       "The IAM entity contains wildcard permissions",
+	NagSecretRotation: "The secret does not have automatic rotation scheduled",
+	NagSecretValue:    "The secret value is in plain text in the template, use existing_secret_only or token_source ssm",
+	NagLogRetention:   "The logs are kept forever, without a retention period",
+}
+
+// NagConfig audits the synthesized resources with a subset of the cdk-nag AwsSolutions rules
+type NagConfig struct {
+	// Run the checks, by default true
+	Enabled *bool `json:"enabled,omitempty"`
+	// Report findings as errors, which fail `cdk synth` and `cdk deploy`, instead of warnings
+	Errors bool `json:"errors,omitempty"`
+	// Findings that are accepted, with the reason
+	Suppressions []NagSuppressionConfig `json:"suppressions,omitempty"`
+}
+
+// NagSuppressionConfig accepts the findings of a rule, in all stacks or below a construct path
+type NagSuppressionConfig struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+	// Construct path such as Cftor53Stack/CloudflareDNSUpdater, by default every resource
+	Path string `json:"path,omitempty"`
+}
+
+// AddNagChecks adds the nag checks to every stack in scope as an aspect, unless disabled
+func AddNagChecks(scope constructs.Construct, config *NagConfig) {
+	if config == nil {
+		config = &NagConfig{}
+	}
+	if config.Enabled != nil && !*config.Enabled {
+		return
+	}
+	if err := ValidateConfig(&ConfigFile{Nag: config}); err != nil {
+		panic(err)
+	}
+	awscdk.Aspects_Of(scope).Add(&nagAspect{config: config})
+}
+
+// nagProblems returns the problems of suppressions of unknown rules and without a reason
+func nagProblems(config *NagConfig) []string {
+	var problems []string
+	for _, suppression := range config.Suppressions {
+		if _, ok := nagRules[suppression.ID]; !ok {
+			problems = append(problems, "Invalid nag.suppressions[].id: "+suppression.ID)
+		} else if len(strings.TrimSpace(suppression.Reason)) < minNagReasonLength {
+			problems = append(problems, fmt.Sprintf("nag.suppressions[].reason of %s must have at least %d characters", suppression.ID, minNagReasonLength))
+		}
+	}
+	return problems
+}
+
+// nagAspect reports the findings of the nag rules on the CloudFormation resources
+type nagAspect struct {
+	config *NagConfig
+}
+
+func (a *nagAspect) Visit(node constructs.IConstruct) {
+	switch resource := node.(type) {
+	case awsiam.CfnRole:
+		stack := awscdk.Stack_Of(resource)
+		var managed []string
+		if arns, ok := resolveProperty(stack, resource.ManagedPolicyArns()).([]interface{}); ok {
+			for _, arn := range arns {
+				if name := awsManagedPolicyName(arn); name != "" {
+					managed = append(managed, name)
+				}
+			}
+		}
+		if len(managed) > 0 {
+			a.report(resource, NagManagedPolicy, strings.Join(managed, ", "))
+		}
+		if policies, ok := resolveProperty(stack, resource.Policies()).([]interface{}); ok {
+			for _, policy := range policies {
+				if policy, ok := policy.(map[string]interface{}); ok {
+					a.reportWildcards(resource, policy["PolicyDocument"])
+				}
+			}
+		}
+	case awsiam.CfnPolicy:
+		a.reportWildcards(resource, resolveProperty(awscdk.Stack_Of(resource), resource.PolicyDocument()))
+	case awsiam.CfnManagedPolicy:
+		a.reportWildcards(resource, resolveProperty(awscdk.Stack_Of(resource), resource.PolicyDocument()))
+	case awssecretsmanager.CfnSecret:
+		stack := awscdk.Stack_Of(resource)
+		if value, ok := resolveProperty(stack, resource.SecretString()).(string); ok && !strings.HasPrefix(value, "{{resolve:") {
+			a.report(resource, NagSecretValue, "")
+		}
+		if !hasRotationSchedule(stack, fmt.Sprint(stack.Resolve(resource.Ref()))) {
+			a.report(resource, NagSecretRotation, "")
+		}
+	case awslogs.CfnLogGroup:
+		if resource.RetentionInDays() == nil {
+			a.report(resource, NagLogRetention, "")
+		}
+	case awslambda.CfnFunction:
+		// Function adds a LogRetention construct next to the resource when the retention is set
+		if resource.Node().Scope().Node().TryFindChild(jsii.String("LogRetention")) == nil {
+			a.report(resource, NagLogRetention, "the log group of the Lambda function")
+		}
+	}
+}
+
+// reportWildcards reports the actions and resources with wildcards of a policy document
+func (a *nagAspect) reportWildcards(resource awscdk.CfnResource, document interface{}) {
+	policy, _ := document.(map[string]interface{})
+	statements, _ := policy["Statement"].([]interface{})
+	seen := map[string]bool{}
+	for _, statement := range statements {
+		statement, _ := statement.(map[string]interface{})
+		if statement["Effect"] != "Allow" {
+			continue
+		}
+		for _, key := range []string{"Action", "Resource"} {
+			for _, value := range policyValues(statement[key]) {
+				if strings.Contains(value, "*") {
+					seen[key+"::"+value] = true
+				}
+			}
+		}
+	}
+	if len(seen) > 0 {
+		wildcards := make([]string, 0, len(seen))
+		for wildcard := range seen {
+			wildcards = append(wildcards, wildcard)
+		}
+		sort.Strings(wildcards)
+		a.report(resource, NagWildcard, strings.Join(wildcards, ", "))
+	}
+}
+
+// report adds the finding to the resource, unless it is suppressed
+func (a *nagAspect) report(resource awscdk.CfnResource, rule, detail string) {
+	path := *resource.Node().Path()
+	for _, suppression := range a.config.Suppressions {
+		if suppression.ID == rule && (suppression.Path == "" || path == suppression.Path || strings.HasPrefix(path, suppression.Path+"/")) {
+			return
+		}
+	}
+	message := "[" + rule + "] " + nagRules[rule]
+	if detail != "" {
+		message += ": " + detail
+	}
+	if a.config.Errors {
+		awscdk.Annotations_Of(resource).AddError(jsii.String(message))
+	} else {
+		awscdk.Annotations_Of(resource).AddWarning(jsii.String(message))
+	}
+}
+
+// hasRotationSchedule reports whether a rotation schedule of the stack rotates the secret,
+// given as its resolved reference
+func hasRotationSchedule(stack awscdk.Stack, secretRef string) bool {
+	for _, child := range *stack.Node().FindAll(constructs.ConstructOrder_PREORDER) {
+		if schedule, ok := child.(awssecretsmanager.CfnRotationSchedule); ok {
+			if fmt.Sprint(resolveProperty(stack, schedule.SecretId())) == secretRef {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveProperty resolves a property of a CloudFormation resource, which is nil when unset
+func resolveProperty(stack awscdk.Stack, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	}
+	return stack.Resolve(value)
+}
+
+// awsManagedPolicyName returns the name of an AWS managed policy ARN, or "" for other policies
+func awsManagedPolicyName(arn interface{}) string {
+	text := policyValue(arn)
+	if i := strings.Index(text, ":iam::aws:policy/"); i >= 0 {
+		return text[i+len(":iam::aws:policy/"):]
+	}
+	return ""
+}
+
+// policyValues returns the strings of an Action or Resource, which is a value or a list
+func policyValues(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		values = append(values, policyValue(item))
+	}
+	return values
+}
+
+// policyValue returns a policy value as a string, with references such as <Logical.Arn>
+// in place of the CloudFormation intrinsic functions, as cdk-nag does
+func policyValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case map[string]interface{}:
+		if ref, ok := value["Ref"].(string); ok {
+			return "<" + ref + ">"
+		}
+		if attribute, ok := value["Fn::GetAtt"].([]interface{}); ok && len(attribute) == 2 {
+			return "<" + fmt.Sprint(attribute[0]) + "." + fmt.Sprint(attribute[1]) + ">"
+		}
+		if join, ok := value["Fn::Join"].([]interface{}); ok && len(join) == 2 {
+			delimiter, _ := join[0].(string)
+			parts, _ := join[1].([]interface{})
+			joined := make([]string, 0, len(parts))
+			for _, part := range parts {
+				joined = append(joined, policyValue(part))
+			}
+			return strings.Join(joined, delimiter)
+		}
+	}
+	return fmt.Sprint(value)
+}
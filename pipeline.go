@@ -0,0 +1,157 @@
+package cftor53
+
+import (
+	"os"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/pipelines"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// PipelineConfig deploys the delegation through a self-mutating CDK pipeline
+type PipelineConfig struct {
+	// CodeStar connection to the repository host
+	ConnectionArn string `json:"connection_arn"`
+	// Repository as owner/name
+	Repository string `json:"repository"`
+	Branch     string `json:"branch,omitempty"`
+	// Account and region of the pipeline stack, by default those of the CLI
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// Stages deployed in order, e.g. dev then prod
+	Stages []PipelineStageConfig `json:"stages"`
+}
+
+// PipelineStageConfig overrides the configuration for one pipeline stage
+type PipelineStageConfig struct {
+	Name           string `json:"name"`
+	Account        string `json:"account,omitempty"`
+	ParentDomain   string `json:"parent_domain,omitempty"`
+	Subdomain      string `json:"subdomain,omitempty"`
+	SecretName     string `json:"secret_name,omitempty"`
+	SecretArn      string `json:"secret_arn,omitempty"`
+	SsmParamPrefix string `json:"ssm_param_prefix,omitempty"`
+	// Wait for a manual approval before deploying the stage
+	ManualApproval bool `json:"manual_approval,omitempty"`
+}
+
+// DelegationPipelineProps configures a delegation pipeline
+type DelegationPipelineProps struct {
+	// Configuration settings, as read from config.json in the repository
+	Config *ConfigFile
+
+	// Directory of the Lambda module (default: "lambda", relative to the repository root)
+	LambdaSourceDir string
+}
+
+// NewDelegationPipeline creates a stack with a self-mutating CDK pipeline that synthesizes
+// the app from the repository and deploys the delegation stacks through the configured
+// stages. The configuration is committed, so the API token must not be part of it.
+func NewDelegationPipeline(scope constructs.Construct, id string, props *DelegationPipelineProps) awscdk.Stack {
+	if props == nil {
+		props = &DelegationPipelineProps{}
+	}
+	if err := validateProps(props.Config, props.Config != nil && props.Config.Pipeline != nil, "Config with pipeline settings"); err != nil {
+		panic(err)
+	}
+	config := *props.Config
+	pipelineConfig := config.Pipeline
+	config.Pipeline = nil
+
+	branch := "main"
+	if pipelineConfig.Branch != "" {
+		branch = pipelineConfig.Branch
+	}
+
+	// Cross-region deployments need a concrete pipeline account and region
+	account := os.Getenv("CDK_DEFAULT_ACCOUNT")
+	if pipelineConfig.Account != "" {
+		account = pipelineConfig.Account
+	}
+	region := "eu-north-1"
+	if config.Regions != nil && config.Regions.Main != "" {
+		region = config.Regions.Main
+	}
+	if pipelineConfig.Region != "" {
+		region = pipelineConfig.Region
+	}
+
+	stack := awscdk.NewStack(scope, jsii.String(stackID(config.Namespace, id)), &awscdk.StackProps{
+		Env: &awscdk.Environment{
+			Account: jsii.String(account),
+			Region:  jsii.String(region),
+		},
+	})
+
+	// Stages in other accounts need the artifacts encrypted with a shareable key
+	crossAccount := false
+	for _, stage := range pipelineConfig.Stages {
+		if stage.Account != "" && stage.Account != account {
+			crossAccount = true
+		}
+	}
+
+	pipeline := pipelines.NewCodePipeline(stack, jsii.String("Pipeline"), &pipelines.CodePipelineProps{
+		Synth: pipelines.NewShellStep(jsii.String("Synth"), &pipelines.ShellStepProps{
+			Input: pipelines.CodePipelineSource_Connection(jsii.String(pipelineConfig.Repository), jsii.String(branch), &pipelines.ConnectionSourceOptions{
+				ConnectionArn: jsii.String(pipelineConfig.ConnectionArn),
+			}),
+			Commands: jsii.Strings(
+				"npm install -g aws-cdk",
+				"cdk synth",
+			),
+		}),
+		CrossAccountKeys: jsii.Bool(crossAccount),
+	})
+	applyPermissionsBoundary(stack, config.PermissionsBoundaryArn)
+	applyTags(stack, config.Tags)
+
+	for _, stageConfig := range pipelineConfig.Stages {
+		stageAccount := account
+		if stageConfig.Account != "" {
+			stageAccount = stageConfig.Account
+		}
+		stage := awscdk.NewStage(stack, jsii.String(stageConfig.Name), &awscdk.StageProps{
+			Env: &awscdk.Environment{
+				Account: jsii.String(stageAccount),
+			},
+		})
+		NewDelegatedSubdomain(stage, "Cftor53", &DelegatedSubdomainProps{
+			Config:          stageDelegationConfig(config, stageConfig),
+			LambdaSourceDir: props.LambdaSourceDir,
+		})
+
+		var opts *pipelines.AddStageOpts
+		if stageConfig.ManualApproval {
+			opts = &pipelines.AddStageOpts{
+				Pre: &[]pipelines.Step{
+					pipelines.NewManualApprovalStep(jsii.String("Approve"+stageConfig.Name), nil),
+				},
+			}
+		}
+		pipeline.AddStage(stage, opts)
+	}
+
+	return stack
+}
+
+// stageDelegationConfig applies the overrides of a pipeline stage to the configuration
+func stageDelegationConfig(config ConfigFile, stage PipelineStageConfig) *ConfigFile {
+	if stage.ParentDomain != "" {
+		config.ParentDomain = stage.ParentDomain
+	}
+	if stage.Subdomain != "" {
+		config.Subdomain = stage.Subdomain
+	}
+	if stage.SecretName != "" {
+		config.SecretName = stage.SecretName
+	}
+	if stage.SecretArn != "" {
+		config.SecretArn = stage.SecretArn
+	}
+	if stage.SsmParamPrefix != "" {
+		config.SsmParamPrefix = stage.SsmParamPrefix
+	}
+	return &config
+}
@@ -0,0 +1,96 @@
+package cftor53
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/customresources"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// PropagationConfig verifies that the delegation is served once the NS records are updated.
+// The step-functions orchestration asks public resolvers, with DNS-over-HTTPS so that the
+// check works from VPCs without egress on port 53, while custom resources poll the parent
+// zone's name servers with the Provider framework until they refer to the hosted zone.
+type PropagationConfig struct {
+	Enabled bool `json:"enabled"`
+	// URLs of the DNS-over-HTTPS JSON APIs queried, by default Cloudflare's and Google's
+	Resolvers []string `json:"resolvers,omitempty"`
+	// Seconds to wait for the delegation to be served before failing, by default 1800
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// Seconds between checks of the delegation, by default 10
+	PollIntervalSeconds int `json:"poll_interval_seconds,omitempty"`
+}
+
+// defaultDoHResolvers are the DNS-over-HTTPS resolvers verifying the propagation by default
+var defaultDoHResolvers = []string{"https://cloudflare-dns.com/dns-query", "https://dns.google/resolve"}
+
+// dohResolvers returns the DNS-over-HTTPS resolvers of the propagation settings, if any
+func dohResolvers(propagation *PropagationConfig) []string {
+	if propagation == nil || len(propagation.Resolvers) == 0 {
+		return defaultDoHResolvers
+	}
+	return propagation.Resolvers
+}
+
+// validDoHResolver reports whether the resolver is an HTTPS URL without a query
+func validDoHResolver(resolver string) bool {
+	u, err := url.Parse(resolver)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+// Defaults of the propagation timing, and the longest total timeout of the Provider framework
+const (
+	defaultPropagationTimeoutSeconds = 1800
+	defaultPollIntervalSeconds       = 10
+	maxPropagationTimeoutSeconds     = 7200
+)
+
+// propagationSeconds returns the timeout and poll interval in seconds, or their defaults
+func propagationSeconds(propagation *PropagationConfig) (int, int) {
+	timeout, interval := defaultPropagationTimeoutSeconds, defaultPollIntervalSeconds
+	if propagation != nil && propagation.TimeoutSeconds != 0 {
+		timeout = propagation.TimeoutSeconds
+	}
+	if propagation != nil && propagation.PollIntervalSeconds != 0 {
+		interval = propagation.PollIntervalSeconds
+	}
+	return timeout, interval
+}
+
+// propagationTimingProblem describes an invalid timeout or poll interval, if any
+func propagationTimingProblem(propagation *PropagationConfig) string {
+	timeout, interval := propagationSeconds(propagation)
+	if timeout < 1 || timeout > maxPropagationTimeoutSeconds {
+		return "Invalid propagation.timeout_seconds: " + strconv.Itoa(timeout) + " (must be 1 to " + strconv.Itoa(maxPropagationTimeoutSeconds) + ")"
+	}
+	if interval < 1 || interval > timeout {
+		return "Invalid propagation.poll_interval_seconds: " + strconv.Itoa(interval) + " (must be 1 to the timeout)"
+	}
+	return ""
+}
+
+// propagationTimingProperties returns the resource properties of the propagation timing
+func propagationTimingProperties(propagation *PropagationConfig) map[string]interface{} {
+	timeout, interval := propagationSeconds(propagation)
+	return map[string]interface{}{
+		"PropagationTimeoutSeconds": strconv.Itoa(timeout),
+		"PollIntervalSeconds":       strconv.Itoa(interval),
+	}
+}
+
+// addPropagationProvider returns the service token of a CDK Provider framework whose onEvent
+// and isComplete handler is the delegation Lambda, so that the update resource only completes
+// once the parent zone serves the delegation
+func addPropagationProvider(stack awscdk.Stack, function awslambda.IFunction, propagation *PropagationConfig) *string {
+	timeout, interval := propagationSeconds(propagation)
+	provider := customresources.NewProvider(stack, jsii.String("CloudflarePropagationProvider"), &customresources.ProviderProps{
+		OnEventHandler:    function,
+		IsCompleteHandler: function,
+		QueryInterval:     awscdk.Duration_Seconds(jsii.Number(float64(interval))),
+		TotalTimeout:      awscdk.Duration_Seconds(jsii.Number(float64(timeout))),
+	})
+	return provider.ServiceToken()
+}
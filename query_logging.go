@@ -0,0 +1,117 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Route53 only writes query logs to log groups in us-east-1
+const queryLoggingRegion = "us-east-1"
+
+// QueryLoggingConfig enables Route53 query logging for the hosted zone
+type QueryLoggingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Days to keep the query logs, by default 30
+	RetentionDays int `json:"retention_days,omitempty"`
+}
+
+// QueryLoggingStackProps configures a stack holding the query log group of a hosted zone
+type QueryLoggingStackProps struct {
+	awscdk.StackProps
+
+	// Name of the hosted zone, e.g. sub.example.com
+	ZoneName *string
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+var logRetentionDays = map[int]awslogs.RetentionDays{
+	1:    awslogs.RetentionDays_ONE_DAY,
+	3:    awslogs.RetentionDays_THREE_DAYS,
+	5:    awslogs.RetentionDays_FIVE_DAYS,
+	7:    awslogs.RetentionDays_ONE_WEEK,
+	14:   awslogs.RetentionDays_TWO_WEEKS,
+	30:   awslogs.RetentionDays_ONE_MONTH,
+	60:   awslogs.RetentionDays_TWO_MONTHS,
+	90:   awslogs.RetentionDays_THREE_MONTHS,
+	180:  awslogs.RetentionDays_SIX_MONTHS,
+	365:  awslogs.RetentionDays_ONE_YEAR,
+	731:  awslogs.RetentionDays_TWO_YEARS,
+	1827: awslogs.RetentionDays_FIVE_YEARS,
+}
+
+// NewQueryLoggingStack creates a stack in us-east-1 with the log group for the hosted zone's
+// query logs and the resource policy letting Route53 write to it. The stack deploying the
+// hosted zone must depend on it.
+func NewQueryLoggingStack(scope constructs.Construct, id string, props *QueryLoggingStackProps) awscdk.Stack {
+	if props == nil {
+		props = &QueryLoggingStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	if err := validateProps(props.Config, props.ZoneName != nil && props.Config != nil && props.Config.QueryLogging != nil, "ZoneName and Config with query_logging settings"); err != nil {
+		panic(err)
+	}
+
+	retention, ok := logRetentionDays[props.Config.QueryLogging.RetentionDays]
+	if !ok {
+		retention = logRetentionDays[30]
+	}
+
+	logGroup := awslogs.NewLogGroup(stack, jsii.String("QueryLogGroup"), &awslogs.LogGroupProps{
+		LogGroupName:  jsii.String(queryLogGroupName(*props.ZoneName)),
+		Retention:     retention,
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+	})
+
+	// Resource policies are per account and region, so the name includes the zone
+	awslogs.NewResourcePolicy(stack, jsii.String("QueryLoggingResourcePolicy"), &awslogs.ResourcePolicyProps{
+		ResourcePolicyName: jsii.String("cftor53-query-logging-" + strings.ReplaceAll(*props.ZoneName, ".", "-")),
+		PolicyStatements: &[]awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:    jsii.Strings("logs:CreateLogStream", "logs:PutLogEvents"),
+				Principals: &[]awsiam.IPrincipal{awsiam.NewServicePrincipal(jsii.String("route53.amazonaws.com"), nil)},
+				Resources:  jsii.Strings(*logGroup.LogGroupArn()),
+			}),
+		},
+	})
+
+	awscdk.NewCfnOutput(stack, jsii.String("QueryLogGroupName"), &awscdk.CfnOutputProps{
+		Value:       logGroup.LogGroupName(),
+		Description: jsii.String("CloudWatch Logs log group with the Route53 query logs"),
+	})
+
+	return stack
+}
+
+// queryLogGroupName returns the name of the query log group for the hosted zone
+func queryLogGroupName(zoneName string) string {
+	return "/aws/route53/" + zoneName
+}
+
+// queryLogGroupArn returns the ARN of the query log group of the hosted zone in the stack's
+// account, built from its name so the zone's stack needs no cross-region reference
+func queryLogGroupArn(stack awscdk.Stack, zoneName string) *string {
+	return stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("logs"),
+		Region:       jsii.String(queryLoggingRegion),
+		Resource:     jsii.String("log-group"),
+		ResourceName: jsii.String(queryLogGroupName(zoneName) + ":*"),
+		ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+	})
+}
+
+// zoneQueryLogsArn returns the query log group ARN for the hosted zone, or nil without query logging
+func zoneQueryLogsArn(stack awscdk.Stack, zoneName string, config *ConfigFile) *string {
+	if config.QueryLogging == nil || !config.QueryLogging.Enabled {
+		return nil
+	}
+	return queryLogGroupArn(stack, zoneName)
+}
@@ -0,0 +1,137 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// RecordConfig is a record created in the hosted zone along with it
+type RecordConfig struct {
+	// Name relative to the subdomain, e.g. "_dmarc", empty for the subdomain itself
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+	// Values in zone file presentation format, e.g. "10 mail.example.com" for MX
+	Values []string `json:"values"`
+	// TTL in seconds, by default 300
+	TTL int `json:"ttl,omitempty"`
+}
+
+// Types of the records that can be seeded, NS and SOA of the apex are managed by Route53
+var seedRecordTypes = map[string]awsroute53.RecordType{
+	"A":     awsroute53.RecordType_A,
+	"AAAA":  awsroute53.RecordType_AAAA,
+	"CAA":   awsroute53.RecordType_CAA,
+	"CNAME": awsroute53.RecordType_CNAME,
+	"DS":    awsroute53.RecordType_DS,
+	"MX":    awsroute53.RecordType_MX,
+	"NAPTR": awsroute53.RecordType_NAPTR,
+	"NS":    awsroute53.RecordType_NS,
+	"PTR":   awsroute53.RecordType_PTR,
+	"SPF":   awsroute53.RecordType_SPF,
+	"SRV":   awsroute53.RecordType_SRV,
+	"TXT":   awsroute53.RecordType_TXT,
+}
+
+// addSeedRecords creates the configured records in the hosted zone. When the stack updates the Cloudflare NS records, that happens after the records exist.
+func addSeedRecords(stack awscdk.Stack, hostedZoneId *string, zoneName string, records []RecordConfig) {
+	if len(records) == 0 {
+		return
+	}
+	updater := stack.Node().TryFindChild(jsii.String("CloudflareDNSUpdater"))
+
+	zone := awsroute53.HostedZone_FromHostedZoneAttributes(stack, jsii.String("SeedRecordsZone"), &awsroute53.HostedZoneAttributes{
+		HostedZoneId: hostedZoneId,
+		ZoneName:     jsii.String(zoneName),
+	})
+
+	for _, record := range records {
+		recordType := seedRecordTypes[strings.ToUpper(record.Type)]
+		name := strings.TrimSuffix(strings.ToLower(record.Name), ".")
+
+		values := record.Values
+		if recordType == awsroute53.RecordType_TXT || recordType == awsroute53.RecordType_SPF {
+			values = make([]string, 0, len(record.Values))
+			for _, value := range record.Values {
+				values = append(values, txtRecordValue(value))
+			}
+		}
+		ttl := 300
+		if record.TTL > 0 {
+			ttl = record.TTL
+		}
+
+		var recordName *string
+		if name != "" {
+			recordName = jsii.String(name + "." + zoneName)
+		}
+		recordSet := awsroute53.NewRecordSet(stack, jsii.String("SeedRecord"+string(recordType)+name), &awsroute53.RecordSetProps{
+			Zone:       zone,
+			RecordName: recordName,
+			RecordType: recordType,
+			Target:     awsroute53.RecordTarget_FromValues(*jsii.Strings(values...)...),
+			Ttl:        awscdk.Duration_Seconds(jsii.Number(float64(ttl))),
+		})
+		if updater != nil {
+			updater.Node().AddDependency(recordSet)
+		}
+	}
+}
+
+// txtRecordValue quotes a TXT value for Route53, splitting it into strings of at most 255
+// characters. Values that are already quoted are used as they are.
+func txtRecordValue(value string) string {
+	if strings.HasPrefix(value, `"`) {
+		return value
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+	var parts []string
+	for len(escaped) > 255 {
+		// Don't split an escape sequence
+		cut := 255
+		backslashes := 0
+		for i := cut - 1; i >= 0 && escaped[i] == '\\'; i-- {
+			backslashes++
+		}
+		if backslashes%2 == 1 {
+			cut--
+		}
+		parts = append(parts, `"`+escaped[:cut]+`"`)
+		escaped = escaped[cut:]
+	}
+	parts = append(parts, `"`+escaped+`"`)
+	return strings.Join(parts, " ")
+}
+
+// recordsProblems returns the problems of records of unsupported types, without values or
+// with the same type and name as another
+func recordsProblems(records []RecordConfig) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	seen := map[string]bool{}
+	for _, record := range records {
+		recordType, ok := seedRecordTypes[strings.ToUpper(record.Type)]
+		if !ok {
+			add("Invalid records[].type: " + record.Type)
+			continue
+		}
+		name := strings.TrimSuffix(strings.ToLower(record.Name), ".")
+		if recordType == awsroute53.RecordType_NS && name == "" {
+			add("records[] cannot replace the NS records of the hosted zone")
+		}
+		if len(record.Values) == 0 {
+			add("records[].values must not be empty for " + record.Type + " " + record.Name)
+		}
+		key := string(recordType) + " " + name
+		if seen[key] {
+			add("Duplicate record in records[]: " + key)
+		}
+		seen[key] = true
+	}
+	return problems
+}
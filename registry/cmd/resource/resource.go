@@ -0,0 +1,432 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/cloudflare/cloudflare-go/v2"
+	"github.com/cloudflare/cloudflare-go/v2/dns"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+	"github.com/cloudflare/cloudflare-go/v2/zones"
+)
+
+// nsRecordTTL is the TTL of the NS records created for the delegation
+const nsRecordTTL = 3600
+
+// clientOptions are added to every Cloudflare client, so tests can point them at a fake API
+var clientOptions []option.RequestOption
+
+// newClient creates a Cloudflare API client from the token in the type configuration
+func newClient(req handler.Request) (*cloudflare.Client, error) {
+	typeConfig, err := Configuration(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read type configuration: %v", err)
+	}
+	if typeConfig.CloudflareApiToken == nil || *typeConfig.CloudflareApiToken == "" {
+		return nil, fmt.Errorf("CloudflareApiToken is not set in the type configuration")
+	}
+
+	opts := append([]option.RequestOption{option.WithAPIToken(*typeConfig.CloudflareApiToken)}, clientOptions...)
+	return cloudflare.NewClient(opts...), nil
+}
+
+// failed returns a failed progress event with the given handler error code
+func failed(code string, err error) handler.ProgressEvent {
+	return handler.ProgressEvent{
+		OperationStatus:  handler.Failed,
+		HandlerErrorCode: code,
+		Message:          err.Error(),
+	}
+}
+
+// identifier returns the primary identifier of a delegation
+func identifier(zoneID, name string) string {
+	return zoneID + "/" + name
+}
+
+// parseIdentifier splits a primary identifier into the zone ID and the subdomain name
+func parseIdentifier(id *string) (string, string, error) {
+	if id == nil {
+		return "", "", fmt.Errorf("Id is not set")
+	}
+	zoneID, name, ok := strings.Cut(*id, "/")
+	if !ok || zoneID == "" || name == "" {
+		return "", "", fmt.Errorf("invalid Id %q, expected <zone ID>/<subdomain FQDN>", *id)
+	}
+	return zoneID, name, nil
+}
+
+// resolveZone returns the ID and name of the parent zone, looked up by name unless the
+// zone ID is given
+func resolveZone(ctx context.Context, api *cloudflare.Client, model *Model) (string, string, error) {
+	if model.ZoneId != nil && *model.ZoneId != "" {
+		zone, err := api.Zones.Get(ctx, zones.ZoneGetParams{ZoneID: cloudflare.F(*model.ZoneId)})
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get zone %s: %v", *model.ZoneId, err)
+		}
+		if !strings.EqualFold(zone.Name, aws.StringValue(model.ParentDomain)) {
+			return "", "", fmt.Errorf("zone %s is %s, not %s", zone.ID, zone.Name, aws.StringValue(model.ParentDomain))
+		}
+		return zone.ID, zone.Name, nil
+	}
+
+	params := zones.ZoneListParams{Name: cloudflare.F(aws.StringValue(model.ParentDomain))}
+	if model.AccountId != nil && *model.AccountId != "" {
+		params.Account = cloudflare.F(zones.ZoneListParamsAccount{ID: cloudflare.F(*model.AccountId)})
+	}
+	page, err := api.Zones.List(ctx, params)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look up zone %s: %v", aws.StringValue(model.ParentDomain), err)
+	}
+	switch len(page.Result) {
+	case 0:
+		return "", "", fmt.Errorf("zone %s could not be found", aws.StringValue(model.ParentDomain))
+	case 1:
+		return page.Result[0].ID, page.Result[0].Name, nil
+	default:
+		return "", "", fmt.Errorf("ambiguous zone name %s; an account ID might help", aws.StringValue(model.ParentDomain))
+	}
+}
+
+// listRecords returns all DNS records with the given name, following pagination
+func listRecords(ctx context.Context, api *cloudflare.Client, zoneID, name string) ([]dns.Record, error) {
+	iter := api.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
+		ZoneID: cloudflare.F(zoneID),
+		Name:   cloudflare.F(name),
+	})
+
+	var records []dns.Record
+	for iter.Next() {
+		records = append(records, iter.Current())
+	}
+	return records, iter.Err()
+}
+
+// nsRecords returns the NS records among the given records
+func nsRecords(records []dns.Record) []dns.Record {
+	var result []dns.Record
+	for _, record := range records {
+		if record.Type == dns.RecordTypeNS {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// recordContent returns the content of a DNS record without the trailing dot
+func recordContent(record dns.Record) string {
+	content, ok := record.Content.(string)
+	if !ok {
+		content = fmt.Sprint(record.Content)
+	}
+	return strings.TrimSuffix(content, ".")
+}
+
+// diffNameServers returns the name servers missing from the records and the records
+// that are no longer wanted
+func diffNameServers(records []dns.Record, nameServers []string) ([]string, []dns.Record) {
+	wanted := map[string]bool{}
+	for _, ns := range nameServers {
+		wanted[strings.ToLower(strings.TrimSuffix(ns, "."))] = true
+	}
+
+	existing := map[string]bool{}
+	var toRemove []dns.Record
+	for _, record := range records {
+		content := strings.ToLower(recordContent(record))
+		if wanted[content] && !existing[content] {
+			existing[content] = true
+			continue
+		}
+		toRemove = append(toRemove, record)
+	}
+
+	var toAdd []string
+	for _, ns := range nameServers {
+		clean := strings.ToLower(strings.TrimSuffix(ns, "."))
+		if !existing[clean] {
+			existing[clean] = true
+			toAdd = append(toAdd, clean)
+		}
+	}
+	return toAdd, toRemove
+}
+
+// applyNameServers reconciles the NS records of the subdomain with the wanted name servers
+func applyNameServers(ctx context.Context, api *cloudflare.Client, zoneID, name string, records []dns.Record, nameServers []string) error {
+	toAdd, toRemove := diffNameServers(records, nameServers)
+
+	for _, ns := range toAdd {
+		_, err := api.DNS.Records.New(ctx, dns.RecordNewParams{
+			ZoneID: cloudflare.F(zoneID),
+			Record: dns.NSRecordParam{
+				Type:    cloudflare.F(dns.NSRecordTypeNS),
+				Name:    cloudflare.F(name),
+				Content: cloudflare.F(ns),
+				TTL:     cloudflare.F(dns.TTL(nsRecordTTL)),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create NS record for %s: %v", ns, err)
+		}
+		log.Printf("Created NS record %s for %s", ns, name)
+	}
+
+	for _, record := range toRemove {
+		if _, err := api.DNS.Records.Delete(ctx, record.ID, dns.RecordDeleteParams{ZoneID: cloudflare.F(zoneID)}); err != nil {
+			return fmt.Errorf("failed to delete NS record %s: %v", recordContent(record), err)
+		}
+		log.Printf("Deleted NS record %s for %s", recordContent(record), name)
+	}
+
+	return nil
+}
+
+// readModel returns the current state of a delegation, or a NotFound event if it has no NS records
+func readModel(ctx context.Context, api *cloudflare.Client, id *string) (*Model, *handler.ProgressEvent) {
+	zoneID, name, err := parseIdentifier(id)
+	if err != nil {
+		event := failed(cloudformation.HandlerErrorCodeNotFound, err)
+		return nil, &event
+	}
+
+	zone, err := api.Zones.Get(ctx, zones.ZoneGetParams{ZoneID: cloudflare.F(zoneID)})
+	if err != nil {
+		event := failed(cloudformation.HandlerErrorCodeNotFound, fmt.Errorf("failed to get zone %s: %v", zoneID, err))
+		return nil, &event
+	}
+
+	records, err := listRecords(ctx, api, zoneID, name)
+	if err != nil {
+		event := failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list DNS records for %s: %v", name, err))
+		return nil, &event
+	}
+	records = nsRecords(records)
+	if len(records) == 0 {
+		event := failed(cloudformation.HandlerErrorCodeNotFound, fmt.Errorf("%s is not delegated", name))
+		return nil, &event
+	}
+
+	nameServers := make([]string, 0, len(records))
+	for _, record := range records {
+		nameServers = append(nameServers, recordContent(record))
+	}
+	sort.Strings(nameServers)
+
+	return &Model{
+		Id:           aws.String(identifier(zoneID, name)),
+		ParentDomain: aws.String(zone.Name),
+		Subdomain:    aws.String(strings.TrimSuffix(name, "."+zone.Name)),
+		ZoneId:       aws.String(zoneID),
+		NameServers:  nameServers,
+	}, nil
+}
+
+// Create handles the Create event from the Cloudformation service.
+func Create(req handler.Request, prevModel *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	ctx := context.Background()
+	api, err := newClient(req)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidTypeConfiguration, err), nil
+	}
+	if len(currentModel.NameServers) == 0 {
+		return failed(cloudformation.HandlerErrorCodeInvalidRequest, fmt.Errorf("NameServers must not be empty")), nil
+	}
+
+	zoneID, zoneName, err := resolveZone(ctx, api, currentModel)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidRequest, err), nil
+	}
+	name := aws.StringValue(currentModel.Subdomain) + "." + zoneName
+
+	records, err := listRecords(ctx, api, zoneID, name)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list DNS records for %s: %v", name, err)), nil
+	}
+
+	// Any existing record for the name means it is either delegated already or in use
+	for _, record := range records {
+		if record.Type == dns.RecordTypeNS {
+			return failed(cloudformation.HandlerErrorCodeAlreadyExists, fmt.Errorf("%s is already delegated", name)), nil
+		}
+	}
+	if len(records) > 0 {
+		var recordTypes []string
+		for _, record := range records {
+			recordTypes = append(recordTypes, string(record.Type))
+		}
+		return failed(cloudformation.HandlerErrorCodeResourceConflict, fmt.Errorf("found colliding DNS records for %s: %v", name, recordTypes)), nil
+	}
+
+	if err := applyNameServers(ctx, api, zoneID, name, nil, currentModel.NameServers); err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, err), nil
+	}
+
+	currentModel.Id = aws.String(identifier(zoneID, name))
+	currentModel.ZoneId = aws.String(zoneID)
+	return handler.ProgressEvent{
+		OperationStatus: handler.Success,
+		Message:         "Create complete",
+		ResourceModel:   currentModel,
+	}, nil
+}
+
+// Read handles the Read event from the Cloudformation service.
+func Read(req handler.Request, prevModel *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	ctx := context.Background()
+	api, err := newClient(req)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidTypeConfiguration, err), nil
+	}
+
+	model, event := readModel(ctx, api, currentModel.Id)
+	if event != nil {
+		return *event, nil
+	}
+
+	return handler.ProgressEvent{
+		OperationStatus: handler.Success,
+		Message:         "Read complete",
+		ResourceModel:   model,
+	}, nil
+}
+
+// Update handles the Update event from the Cloudformation service.
+func Update(req handler.Request, prevModel *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	ctx := context.Background()
+	api, err := newClient(req)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidTypeConfiguration, err), nil
+	}
+	if len(currentModel.NameServers) == 0 {
+		return failed(cloudformation.HandlerErrorCodeInvalidRequest, fmt.Errorf("NameServers must not be empty")), nil
+	}
+
+	id := currentModel.Id
+	if id == nil {
+		id = prevModel.Id
+	}
+	if _, event := readModel(ctx, api, id); event != nil {
+		return *event, nil
+	}
+	zoneID, name, _ := parseIdentifier(id)
+
+	records, err := listRecords(ctx, api, zoneID, name)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list DNS records for %s: %v", name, err)), nil
+	}
+	if err := applyNameServers(ctx, api, zoneID, name, nsRecords(records), currentModel.NameServers); err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, err), nil
+	}
+
+	currentModel.Id = id
+	currentModel.ZoneId = aws.String(zoneID)
+	return handler.ProgressEvent{
+		OperationStatus: handler.Success,
+		Message:         "Update complete",
+		ResourceModel:   currentModel,
+	}, nil
+}
+
+// Delete handles the Delete event from the Cloudformation service.
+func Delete(req handler.Request, prevModel *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	ctx := context.Background()
+	api, err := newClient(req)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidTypeConfiguration, err), nil
+	}
+
+	if _, event := readModel(ctx, api, currentModel.Id); event != nil {
+		return *event, nil
+	}
+	zoneID, name, _ := parseIdentifier(currentModel.Id)
+
+	records, err := listRecords(ctx, api, zoneID, name)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list DNS records for %s: %v", name, err)), nil
+	}
+	if err := applyNameServers(ctx, api, zoneID, name, nsRecords(records), nil); err != nil {
+		return failed(cloudformation.HandlerErrorCodeServiceInternalError, err), nil
+	}
+
+	return handler.ProgressEvent{
+		OperationStatus: handler.Success,
+		Message:         "Delete complete",
+	}, nil
+}
+
+// List handles the List event from the Cloudformation service.
+func List(req handler.Request, prevModel *Model, currentModel *Model) (handler.ProgressEvent, error) {
+	ctx := context.Background()
+	api, err := newClient(req)
+	if err != nil {
+		return failed(cloudformation.HandlerErrorCodeInvalidTypeConfiguration, err), nil
+	}
+
+	// Delegations are listed in the given zone, or in every zone the token can read
+	var zoneList []zones.Zone
+	if currentModel.ZoneId != nil || currentModel.ParentDomain != nil {
+		zoneID, zoneName, err := resolveZone(ctx, api, currentModel)
+		if err != nil {
+			return failed(cloudformation.HandlerErrorCodeInvalidRequest, err), nil
+		}
+		zoneList = append(zoneList, zones.Zone{ID: zoneID, Name: zoneName})
+	} else {
+		iter := api.Zones.ListAutoPaging(ctx, zones.ZoneListParams{})
+		for iter.Next() {
+			zoneList = append(zoneList, iter.Current())
+		}
+		if err := iter.Err(); err != nil {
+			return failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list zones: %v", err)), nil
+		}
+	}
+
+	models := []interface{}{}
+	for _, zone := range zoneList {
+		iter := api.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
+			ZoneID: cloudflare.F(zone.ID),
+			Type:   cloudflare.F(dns.RecordListParamsTypeNS),
+		})
+		delegated := map[string][]string{}
+		for iter.Next() {
+			record := iter.Current()
+			// NS records at the apex belong to the zone itself
+			if record.Type != dns.RecordTypeNS || strings.EqualFold(record.Name, zone.Name) {
+				continue
+			}
+			delegated[record.Name] = append(delegated[record.Name], recordContent(record))
+		}
+		if err := iter.Err(); err != nil {
+			return failed(cloudformation.HandlerErrorCodeServiceInternalError, fmt.Errorf("failed to list DNS records in %s: %v", zone.Name, err)), nil
+		}
+
+		names := make([]string, 0, len(delegated))
+		for name := range delegated {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			nameServers := delegated[name]
+			sort.Strings(nameServers)
+			models = append(models, &Model{
+				Id:           aws.String(identifier(zone.ID, name)),
+				ParentDomain: aws.String(zone.Name),
+				Subdomain:    aws.String(strings.TrimSuffix(name, "."+zone.Name)),
+				ZoneId:       aws.String(zone.ID),
+				NameServers:  nameServers,
+			})
+		}
+	}
+
+	return handler.ProgressEvent{
+		OperationStatus: handler.Success,
+		Message:         "List complete",
+		ResourceModels:  models,
+	}, nil
+}
@@ -0,0 +1,183 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws-cloudformation/cloudformation-cli-go-plugin/cfn/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/cloudflare/cloudflare-go/v2/option"
+)
+
+// fakeCloudflare serves the zone and DNS record endpoints used by the handlers for a single zone
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records []map[string]interface{}
+	nextID  int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	zone := map[string]interface{}{"id": "zone123", "name": "example.com"}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	var result interface{}
+	switch {
+	case r.Method == http.MethodGet && path == "zones":
+		result = []interface{}{}
+		if r.URL.Query().Get("page") == "" && (r.URL.Query().Get("name") == "" || r.URL.Query().Get("name") == "example.com") {
+			result = []interface{}{zone}
+		}
+	case r.Method == http.MethodGet && path == "zones/zone123":
+		result = zone
+	case r.Method == http.MethodGet && path == "zones/zone123/dns_records":
+		matching := []interface{}{}
+		if r.URL.Query().Get("page") == "" {
+			for _, record := range f.records {
+				name, recordType := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+				if (name == "" || record["name"] == name) && (recordType == "" || record["type"] == recordType) {
+					matching = append(matching, record)
+				}
+			}
+		}
+		result = matching
+	case r.Method == http.MethodPost && path == "zones/zone123/dns_records":
+		var record map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&record)
+		f.nextID++
+		record["id"] = fmt.Sprintf("record%d", f.nextID)
+		f.records = append(f.records, record)
+		result = record
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "zones/zone123/dns_records/"):
+		id := strings.TrimPrefix(path, "zones/zone123/dns_records/")
+		for i, record := range f.records {
+			if record["id"] == id {
+				f.records = append(f.records[:i], f.records[i+1:]...)
+				break
+			}
+		}
+		result = map[string]interface{}{"id": id}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []interface{}{map[string]interface{}{"code": 7003, "message": "Not found"}}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "errors": []interface{}{}, "messages": []interface{}{}, "result": result})
+}
+
+func newTestRequest(t *testing.T, previous, current *Model) handler.Request {
+	t.Helper()
+	previousBody, _ := json.Marshal(previous)
+	body, _ := json.Marshal(current)
+	return handler.NewRequest("test", nil, handler.RequestContext{}, nil, previousBody, body, []byte(`{"CloudflareApiToken":"test-token"}`))
+}
+
+func TestHandlerLifecycle(t *testing.T) {
+	fake := &fakeCloudflare{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	clientOptions = []option.RequestOption{option.WithBaseURL(server.URL + "/"), option.WithMaxRetries(0)}
+	defer func() { clientOptions = nil }()
+
+	model := &Model{
+		ParentDomain: aws.String("example.com"),
+		Subdomain:    aws.String("api"),
+		NameServers:  []string{"ns-1.awsdns-00.com.", "ns-2.awsdns-00.net"},
+	}
+
+	// Create
+	event, err := Create(newTestRequest(t, nil, model), &Model{}, model)
+	if err != nil || event.OperationStatus != handler.Success {
+		t.Fatalf("Create failed: %v %+v", err, event)
+	}
+	if aws.StringValue(model.Id) != "zone123/api.example.com" || len(fake.records) != 2 {
+		t.Fatalf("Unexpected state after create: id=%s records=%v", aws.StringValue(model.Id), fake.records)
+	}
+
+	// A second create for the same name fails
+	again := &Model{ParentDomain: model.ParentDomain, Subdomain: model.Subdomain, NameServers: model.NameServers}
+	event, _ = Create(newTestRequest(t, nil, again), &Model{}, again)
+	if event.HandlerErrorCode != cloudformation.HandlerErrorCodeAlreadyExists {
+		t.Errorf("Expected AlreadyExists, got %+v", event)
+	}
+
+	// Read
+	readModel := &Model{Id: model.Id}
+	event, _ = Read(newTestRequest(t, nil, readModel), &Model{}, readModel)
+	if event.OperationStatus != handler.Success {
+		t.Fatalf("Read failed: %+v", event)
+	}
+	read := event.ResourceModel.(*Model)
+	if aws.StringValue(read.Subdomain) != "api" || strings.Join(read.NameServers, ",") != "ns-1.awsdns-00.com,ns-2.awsdns-00.net" {
+		t.Errorf("Unexpected read model: %+v", read)
+	}
+
+	// Update replaces one of the name servers
+	updated := &Model{Id: model.Id, ParentDomain: model.ParentDomain, Subdomain: model.Subdomain, NameServers: []string{"ns-1.awsdns-00.com", "ns-3.awsdns-00.org"}}
+	event, _ = Update(newTestRequest(t, model, updated), model, updated)
+	if event.OperationStatus != handler.Success {
+		t.Fatalf("Update failed: %+v", event)
+	}
+	event, _ = Read(newTestRequest(t, nil, readModel), &Model{}, readModel)
+	if got := strings.Join(event.ResourceModel.(*Model).NameServers, ","); got != "ns-1.awsdns-00.com,ns-3.awsdns-00.org" {
+		t.Errorf("Unexpected name servers after update: %s", got)
+	}
+
+	// List
+	event, _ = List(newTestRequest(t, nil, &Model{}), &Model{}, &Model{})
+	if event.OperationStatus != handler.Success || len(event.ResourceModels) != 1 {
+		t.Errorf("Unexpected list result: %+v", event)
+	}
+
+	// Delete, after which the delegation is gone
+	event, _ = Delete(newTestRequest(t, nil, readModel), &Model{}, readModel)
+	if event.OperationStatus != handler.Success || len(fake.records) != 0 {
+		t.Fatalf("Delete failed: %+v records=%v", event, fake.records)
+	}
+	event, _ = Read(newTestRequest(t, nil, readModel), &Model{}, readModel)
+	if event.HandlerErrorCode != cloudformation.HandlerErrorCodeNotFound {
+		t.Errorf("Expected NotFound after delete, got %+v", event)
+	}
+	event, _ = Delete(newTestRequest(t, nil, readModel), &Model{}, readModel)
+	if event.HandlerErrorCode != cloudformation.HandlerErrorCodeNotFound {
+		t.Errorf("Expected NotFound for a second delete, got %+v", event)
+	}
+}
+
+func TestCreateCollidingRecords(t *testing.T) {
+	fake := &fakeCloudflare{records: []map[string]interface{}{{"id": "existing", "type": "A", "name": "api.example.com", "content": "192.0.2.1"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	clientOptions = []option.RequestOption{option.WithBaseURL(server.URL + "/"), option.WithMaxRetries(0)}
+	defer func() { clientOptions = nil }()
+
+	model := &Model{ParentDomain: aws.String("example.com"), Subdomain: aws.String("api"), NameServers: []string{"ns-1.awsdns-00.com"}}
+	event, _ := Create(newTestRequest(t, nil, model), &Model{}, model)
+	if event.HandlerErrorCode != cloudformation.HandlerErrorCodeResourceConflict {
+		t.Errorf("Expected ResourceConflict, got %+v", event)
+	}
+}
+
+func TestParseIdentifier(t *testing.T) {
+	zoneID, name, err := parseIdentifier(aws.String("zone123/api.example.com"))
+	if err != nil || zoneID != "zone123" || name != "api.example.com" {
+		t.Errorf("Unexpected result: %s %s %v", zoneID, name, err)
+	}
+	for _, id := range []string{"", "zone123", "/api.example.com", "zone123/"} {
+		if _, _, err := parseIdentifier(aws.String(id)); err == nil {
+			t.Errorf("Expected error for %q", id)
+		}
+	}
+	if _, _, err := parseIdentifier(nil); err == nil {
+		t.Errorf("Expected error for nil Id")
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/ferrix/cftor53/registry
+
+go 1.19
+
+require (
+	github.com/aws-cloudformation/cloudformation-cli-go-plugin v1.2.0
+	github.com/aws/aws-sdk-go v1.50.20
+	github.com/cloudflare/cloudflare-go/v2 v2.4.0
+)
+
+require (
+	github.com/aws/aws-lambda-go v1.37.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/segmentio/ksuid v1.0.4 // indirect
+	github.com/tidwall/gjson v1.14.4 // indirect
+	github.com/tidwall/match v1.1.1 // indirect
+	github.com/tidwall/pretty v1.2.1 // indirect
+	github.com/tidwall/sjson v1.2.5 // indirect
+	gopkg.in/validator.v2 v2.0.1 // indirect
+)
@@ -0,0 +1,56 @@
+package cftor53
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// ResponseSpillConfig stores the full Data of the custom resource responses that exceed the
+// 4KB CloudFormation limit in S3 before they are truncated
+type ResponseSpillConfig struct {
+	Enabled bool `json:"enabled"`
+	// Existing bucket in the stack's region, by default a bucket created by the stack
+	BucketName string `json:"bucket_name,omitempty"`
+	// Days after which the stored responses expire in the bucket created by the stack
+	ExpirationDays int `json:"expiration_days,omitempty"`
+}
+
+// bucketNamePattern matches the bucket names S3 allows
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// defaultResponseExpirationDays is how long the bucket created by the stack keeps a response
+const defaultResponseExpirationDays = 30
+
+// addResponseSpillBucket returns the name of the bucket for oversized responses, creating it
+// unless an existing one is configured, and lets the Lambda function write the responses
+func addResponseSpillBucket(stack awscdk.Stack, function awslambda.IFunction, spill *ResponseSpillConfig) *string {
+	var bucket awss3.IBucket
+	if spill.BucketName != "" {
+		bucket = awss3.Bucket_FromBucketName(stack, jsii.String("ResponseSpillBucket"), jsii.String(spill.BucketName))
+	} else {
+		days := spill.ExpirationDays
+		if days == 0 {
+			days = defaultResponseExpirationDays
+		}
+		// The bucket is retained on stack deletion, like CDK's default, and empties itself
+		bucket = awss3.NewBucket(stack, jsii.String("ResponseSpillBucket"), &awss3.BucketProps{
+			BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+			Encryption:        awss3.BucketEncryption_S3_MANAGED,
+			EnforceSSL:        jsii.Bool(true),
+			LifecycleRules: &[]*awss3.LifecycleRule{{
+				Expiration: awscdk.Duration_Days(jsii.Number(float64(days))),
+			}},
+		})
+	}
+
+	function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("s3:PutObject"),
+		Resources: jsii.Strings(*bucket.ArnForObjects(jsii.String("cftor53/*"))),
+	}))
+	return bucket.BucketName()
+}
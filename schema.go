@@ -0,0 +1,258 @@
+package cftor53
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConfigSchema is the JSON Schema of config.json, for editors and ValidateConfigDocument
+//
+//go:embed config.schema.json
+var ConfigSchema []byte
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// jsonSchema is the subset of JSON Schema draft-07 that ConfigSchema uses
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Description          string                 `json:"description"`
+	Enum                 []interface{}          `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+}
+
+var (
+	configSchemaOnce sync.Once
+	configSchema     *jsonSchema
+	configSchemaErr  error
+)
+
+// ValidateConfigDocument validates a configuration, as decoded into interface{} by
+// encoding/json, against ConfigSchema and returns a ValidationError with all the problems
+func ValidateConfigDocument(document interface{}) error {
+	configSchemaOnce.Do(func() {
+		configSchemaErr = json.Unmarshal(ConfigSchema, &configSchema)
+	})
+	if configSchemaErr != nil {
+		return fmt.Errorf("failed to parse config.schema.json: %v", configSchemaErr)
+	}
+
+	v := schemaValidator{root: configSchema}
+	v.validate(configSchema, document, "")
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// schemaValidator collects the problems of a document
+type schemaValidator struct {
+	root     *jsonSchema
+	problems []string
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "config"
+	}
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// validate checks value against schema. The path of the value is like domains[0].subdomains.
+func (v *schemaValidator) validate(schema *jsonSchema, value interface{}, path string) {
+	if schema.Ref != "" {
+		definition := v.root.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		if definition == nil {
+			v.fail(path, "unknown schema reference %s", schema.Ref)
+			return
+		}
+		v.validate(definition, value, path)
+		return
+	}
+
+	if schema.Type != "" && !hasSchemaType(value, schema.Type) {
+		v.fail(path, "must be %s, not %s", withArticle(schema.Type), jsonValue(value))
+		return
+	}
+	if len(schema.Enum) > 0 {
+		valid := make([]string, 0, len(schema.Enum))
+		found := false
+		for _, option := range schema.Enum {
+			found = found || option == value
+			valid = append(valid, jsonValue(option))
+		}
+		if !found {
+			v.fail(path, "%s is not one of %s", jsonValue(value), strings.Join(valid, ", "))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		if schema.MinLength != nil && len(value) < *schema.MinLength {
+			v.fail(path, "must not be empty")
+		}
+		if schema.MaxLength != nil && len(value) > *schema.MaxLength {
+			v.fail(path, "must be at most %d characters", *schema.MaxLength)
+		}
+		if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(value) {
+			expected := schema.Description
+			if expected == "" {
+				expected = "a match of " + schema.Pattern
+			}
+			v.fail(path, "%s is not valid, expected %s", jsonValue(value), expected)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			v.fail(path, "%s is out of range, %s", jsonValue(value), schema.bounds())
+		} else if schema.Maximum != nil && value > *schema.Maximum {
+			v.fail(path, "%s is out of range, %s", jsonValue(value), schema.bounds())
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			if *schema.MinItems == 1 {
+				v.fail(path, "must not be empty")
+			} else {
+				v.fail(path, "must have at least %d entries", *schema.MinItems)
+			}
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				v.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case map[string]interface{}:
+		v.validateObject(schema, value, path)
+	}
+}
+
+// validateObject checks the fields of an object, in sorted order for a stable report
+func (v *schemaValidator) validateObject(schema *jsonSchema, object map[string]interface{}, path string) {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			v.fail(path, "missing field %s", name)
+		}
+	}
+	if len(schema.AnyOf) > 0 && !v.matchesAny(schema.AnyOf, object, path) {
+		var options []string
+		for _, option := range schema.AnyOf {
+			options = append(options, strings.Join(option.Required, " and "))
+		}
+		v.fail(path, "requires %s", strings.Join(options, ", or "))
+	}
+
+	// additionalProperties is either false or the schema of the other fields
+	allowAdditional := string(schema.AdditionalProperties) != "false"
+	var additional *jsonSchema
+	if strings.HasPrefix(string(schema.AdditionalProperties), "{") {
+		if err := json.Unmarshal(schema.AdditionalProperties, &additional); err != nil {
+			v.fail(path, "invalid additionalProperties schema: %v", err)
+			return
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		switch property := schema.Properties[name]; {
+		case property != nil:
+			v.validate(property, object[name], fieldPath)
+		case additional != nil:
+			v.validate(additional, object[name], fieldPath)
+		case !allowAdditional:
+			v.fail(fieldPath, "unknown field")
+		}
+	}
+}
+
+// matchesAny reports whether the object is valid against one of the schemas
+func (v *schemaValidator) matchesAny(schemas []*jsonSchema, object map[string]interface{}, path string) bool {
+	for _, schema := range schemas {
+		option := schemaValidator{root: v.root}
+		option.validate(schema, object, path)
+		if len(option.problems) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bounds describes the range of numbers the schema accepts
+func (s *jsonSchema) bounds() string {
+	if s.Description != "" {
+		return s.Description
+	}
+	var bounds []string
+	if s.Minimum != nil {
+		bounds = append(bounds, fmt.Sprintf("at least %v", *s.Minimum))
+	}
+	if s.Maximum != nil {
+		bounds = append(bounds, fmt.Sprintf("at most %v", *s.Maximum))
+	}
+	return "expected " + strings.Join(bounds, " and ")
+}
+
+// hasSchemaType reports whether a decoded JSON value has the JSON Schema type
+func hasSchemaType(value interface{}, schemaType string) bool {
+	switch value := value.(type) {
+	case string:
+		return schemaType == "string"
+	case bool:
+		return schemaType == "boolean"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && value == math.Trunc(value))
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+	return schemaType == "null" && value == nil
+}
+
+// withArticle returns the JSON Schema type with its indefinite article, e.g. "an integer"
+func withArticle(schemaType string) string {
+	switch schemaType {
+	case "integer", "array", "object":
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+// jsonValue formats a decoded JSON value for a problem report
+func jsonValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
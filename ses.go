@@ -0,0 +1,106 @@
+package cftor53
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsses"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+var mailFromLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// SesConfig verifies the subdomain as an SES domain identity, with its DKIM and MAIL FROM records
+type SesConfig struct {
+	Enabled bool `json:"enabled"`
+	// Region to send mail from, by default the main region
+	Region string `json:"region,omitempty"`
+	// Label of the MAIL FROM domain below the subdomain, by default "mail"
+	MailFromSubdomain string `json:"mail_from_subdomain,omitempty"`
+}
+
+// SesIdentityStackProps configures a stack with the SES domain identity of the subdomain
+type SesIdentityStackProps struct {
+	awscdk.StackProps
+
+	// Domain hosted on Cloudflare
+	ParentDomain *string
+
+	// Subdomain hosted on Route53
+	Subdomain *string
+
+	// Hosted zone of the subdomain, for the DKIM and MAIL FROM records
+	HostedZoneId *string
+
+	// Configuration settings
+	Config *ConfigFile
+}
+
+// NewSesIdentityStack creates a stack with an SES domain identity for the subdomain using Easy
+// DKIM, and creates the DKIM CNAMEs and the MX and SPF records of the MAIL FROM domain in
+// the hosted zone. SES verifies the identity once the delegation resolves.
+func NewSesIdentityStack(scope constructs.Construct, id string, props *SesIdentityStackProps) awscdk.Stack {
+	if props == nil {
+		props = &SesIdentityStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	provided := props.ParentDomain != nil && props.Subdomain != nil && props.HostedZoneId != nil && props.Config != nil && props.Config.Ses != nil
+	if err := validateProps(props.Config, provided, "ParentDomain, Subdomain, HostedZoneId and Config.Ses"); err != nil {
+		panic(err)
+	}
+	mailFromLabel := mailFromSubdomain(props.Config.Ses)
+
+	// Full domain name for the subdomain (e.g., sub.example.com)
+	fullDomainName := *props.Subdomain + "." + *props.ParentDomain
+
+	// With a public hosted zone SES creates the records in it
+	zone := awsroute53.PublicHostedZone_FromPublicHostedZoneAttributes(stack, jsii.String("ImportedZone"), &awsroute53.PublicHostedZoneAttributes{
+		HostedZoneId: props.HostedZoneId,
+		ZoneName:     jsii.String(fullDomainName),
+	})
+	awsses.NewEmailIdentity(stack, jsii.String("EmailIdentity"), &awsses.EmailIdentityProps{
+		Identity:       awsses.Identity_PublicHostedZone(zone),
+		MailFromDomain: jsii.String(mailFromLabel + "." + fullDomainName),
+	})
+
+	// Store the identity in SSM Parameter Store for the senders' IAM policies
+	identityParamName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/sesIdentityArn"
+	identityArn := stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("ses"),
+		Resource:     jsii.String("identity"),
+		ResourceName: jsii.String(fullDomainName),
+	})
+	awsssm.NewStringParameter(stack, jsii.String("SesIdentityArnSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(identityParamName),
+		StringValue:   identityArn,
+		Description:   jsii.String("SES domain identity ARN for " + fullDomainName),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("SesIdentityArnOutput"), &awscdk.CfnOutputProps{
+		Value:       identityArn,
+		Description: jsii.String("SES domain identity ARN"),
+	})
+
+	return stack
+}
+
+// mailFromSubdomain returns the label of the MAIL FROM domain, by default "mail"
+func mailFromSubdomain(settings *SesConfig) string {
+	if settings.MailFromSubdomain == "" {
+		return "mail"
+	}
+	return strings.ToLower(settings.MailFromSubdomain)
+}
+
+// mailFromSubdomainProblem describes an invalid label of the MAIL FROM domain, if any
+func mailFromSubdomainProblem(settings *SesConfig) string {
+	if !mailFromLabelPattern.MatchString(mailFromSubdomain(settings)) {
+		return "Invalid ses.mail_from_subdomain: " + settings.MailFromSubdomain
+	}
+	return ""
+}
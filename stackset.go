@@ -0,0 +1,215 @@
+package cftor53
+
+import (
+	"os"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudformation"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3assets"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// StackSetConfig rolls the delegation stack out to member accounts with a StackSet
+type StackSetConfig struct {
+	Name string `json:"name,omitempty"`
+	// Account and region of the management stack, by default those of the CLI
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// Stack instances, each deploying to accounts or organizational units
+	Instances []StackSetInstanceConfig `json:"instances"`
+	// Percentage of accounts deployed to concurrently in each region
+	MaxConcurrentPercentage int `json:"max_concurrent_percentage,omitempty"`
+	// Percentage of accounts that may fail in each region before the operation stops
+	FailureTolerancePercentage int `json:"failure_tolerance_percentage,omitempty"`
+}
+
+// StackSetInstanceConfig targets accounts or organizational units with the delegation stack
+type StackSetInstanceConfig struct {
+	Accounts              []string `json:"accounts,omitempty"`
+	OrganizationalUnitIDs []string `json:"organizational_unit_ids,omitempty"`
+	// Regions to deploy to, by default regions.main
+	Regions []string `json:"regions,omitempty"`
+	// Subdomain delegated by these instances, by default subdomain
+	Subdomain string `json:"subdomain,omitempty"`
+}
+
+// DelegationStackSetProps configures a delegation StackSet
+type DelegationStackSetProps struct {
+	// Configuration settings, as read from config.json
+	Config *ConfigFile
+
+	// Directory of the Lambda module (default: "lambda", relative to the working directory)
+	LambdaSourceDir string
+}
+
+// NewDelegationStackSet creates a management account stack with a StackSet that deploys the
+// delegation stack to member accounts. The subdomain is a parameter of the StackSet template,
+// so each instance can delegate its own subdomain. The template's Lambda assets are read from
+// cloudformation.asset_bucket, which every member account must be able to read.
+func NewDelegationStackSet(scope constructs.Construct, id string, props *DelegationStackSetProps) awscdk.Stack {
+	if props == nil {
+		props = &DelegationStackSetProps{}
+	}
+	if err := validateProps(props.Config, props.Config != nil && props.Config.StackSet != nil, "Config with stack_set settings"); err != nil {
+		panic(err)
+	}
+	config := *props.Config
+	stackSetConfig := config.StackSet
+
+	// The template is shared with every member account, so it must not contain the token
+	tokenSource := TokenSourceSecretsManager
+	if config.TokenSource != "" {
+		tokenSource = config.TokenSource
+	}
+
+	lambdaSourceDir := "lambda"
+	if props.LambdaSourceDir != "" {
+		lambdaSourceDir = props.LambdaSourceDir
+	}
+	secretName, ssmParamPrefix := resourceNames(&config)
+	mainRegion := "eu-north-1"
+	if config.Regions != nil && config.Regions.Main != "" {
+		mainRegion = config.Regions.Main
+	}
+	account := os.Getenv("CDK_DEFAULT_ACCOUNT")
+	if stackSetConfig.Account != "" {
+		account = stackSetConfig.Account
+	}
+	region := mainRegion
+	if stackSetConfig.Region != "" {
+		region = stackSetConfig.Region
+	}
+
+	stack := awscdk.NewStack(scope, jsii.String(stackID(config.Namespace, id)), &awscdk.StackProps{
+		Env: &awscdk.Environment{
+			Account: jsii.String(account),
+			Region:  jsii.String(region),
+		},
+	})
+	applyPermissionsBoundary(stack, config.PermissionsBoundaryArn)
+	applyTags(stack, config.Tags)
+
+	// Synthesize the member account template in its own stage, with the subdomain
+	// referring to a template parameter added once the stack exists
+	stage := awscdk.NewStage(stack, jsii.String("Template"), nil)
+	memberStack, _ := NewCftor53Stack(stage, "Cftor53Stack", &Cftor53StackProps{
+		StackProps: awscdk.StackProps{
+			Synthesizer: stackSynthesizer(config.CloudFormation),
+		},
+		ParentDomain: jsii.String(config.ParentDomain),
+		Subdomain:    awscdk.Fn_Ref(jsii.String("Subdomain")),
+		Config: &ConfigFile{
+			SsmParamPrefix:       ssmParamPrefix,
+			AccountID:            config.AccountID,
+			ZoneID:               config.ZoneID,
+			TokenSource:          tokenSource,
+			TokenParameterName:   config.TokenParameterName,
+			SecretName:           secretName,
+			SecretArn:            config.SecretArn,
+			ExistingSecretOnly:   config.ExistingSecretOnly,
+			SecretVersion:        config.SecretVersion,
+			LambdaSettings:       defaultLambdaSettings(config.LambdaSettings, lambdaSourceDir),
+			Orchestration:        config.Orchestration,
+			Namespace:            config.Namespace,
+			RemovalPolicy:        config.RemovalPolicy,
+			NSRecordTTL:          config.NSRecordTTL,
+			NSRecordMode:         config.NSRecordMode,
+			AcceptProxiedRecords: config.AcceptProxiedRecords,
+			Lock:                 config.Lock,
+			State:                config.State,
+			ResponseSpill:        config.ResponseSpill,
+			Propagation:          config.Propagation,
+			CloudflareRetry:      config.CloudflareRetry,
+			HostedZoneComment:    config.HostedZoneComment,
+			HostedZoneTags:       config.HostedZoneTags,
+		},
+	})
+	awscdk.NewCfnParameter(memberStack, jsii.String("Subdomain"), &awscdk.CfnParameterProps{
+		Type:        jsii.String("String"),
+		Default:     jsii.String(config.Subdomain),
+		Description: jsii.String("Subdomain of " + config.ParentDomain + " to delegate to Route53"),
+	})
+	applyPermissionsBoundary(memberStack, config.PermissionsBoundaryArn)
+	applyTags(memberStack, config.Tags)
+	artifact := stage.Synth(nil).GetStackArtifact(memberStack.ArtifactId())
+	template := awss3assets.NewAsset(stack, jsii.String("StackSetTemplate"), &awss3assets.AssetProps{
+		Path: artifact.TemplateFullPath(),
+	})
+
+	// Organizational units are deployed to through Organizations, accounts through self-managed roles
+	serviceManaged := false
+	var instances []interface{}
+	for _, instance := range stackSetConfig.Instances {
+		if len(instance.OrganizationalUnitIDs) > 0 {
+			serviceManaged = true
+		}
+
+		regions := instance.Regions
+		if len(regions) == 0 {
+			regions = []string{mainRegion}
+		}
+		targets := &awscloudformation.CfnStackSet_DeploymentTargetsProperty{}
+		if len(instance.Accounts) > 0 {
+			targets.Accounts = jsii.Strings(instance.Accounts...)
+		}
+		if len(instance.OrganizationalUnitIDs) > 0 {
+			targets.OrganizationalUnitIds = jsii.Strings(instance.OrganizationalUnitIDs...)
+		}
+		group := &awscloudformation.CfnStackSet_StackInstancesProperty{
+			DeploymentTargets: targets,
+			Regions:           jsii.Strings(regions...),
+		}
+		if instance.Subdomain != "" {
+			group.ParameterOverrides = &[]interface{}{
+				&awscloudformation.CfnStackSet_ParameterProperty{
+					ParameterKey:   jsii.String("Subdomain"),
+					ParameterValue: jsii.String(instance.Subdomain),
+				},
+			}
+		}
+		instances = append(instances, group)
+	}
+
+	permissionModel := "SELF_MANAGED"
+	var autoDeployment *awscloudformation.CfnStackSet_AutoDeploymentProperty
+	if serviceManaged {
+		// New accounts in the organizational units get their delegation automatically
+		permissionModel = "SERVICE_MANAGED"
+		autoDeployment = &awscloudformation.CfnStackSet_AutoDeploymentProperty{
+			Enabled:                      jsii.Bool(true),
+			RetainStacksOnAccountRemoval: jsii.Bool(false),
+		}
+	}
+
+	stackSetName := stackID(config.Namespace, "cftor53-delegation")
+	if stackSetConfig.Name != "" {
+		stackSetName = stackSetConfig.Name
+	}
+	maxConcurrent := 25
+	if stackSetConfig.MaxConcurrentPercentage > 0 {
+		maxConcurrent = stackSetConfig.MaxConcurrentPercentage
+	}
+
+	awscloudformation.NewCfnStackSet(stack, jsii.String("DelegationStackSet"), &awscloudformation.CfnStackSetProps{
+		StackSetName:    jsii.String(stackSetName),
+		Description:     jsii.String("Delegates subdomains of " + config.ParentDomain + " from Cloudflare to Route53"),
+		PermissionModel: jsii.String(permissionModel),
+		AutoDeployment:  autoDeployment,
+		Capabilities:    jsii.Strings("CAPABILITY_IAM"),
+		TemplateUrl:     template.HttpUrl(),
+		Parameters: &[]interface{}{
+			&awscloudformation.CfnStackSet_ParameterProperty{
+				ParameterKey:   jsii.String("Subdomain"),
+				ParameterValue: jsii.String(config.Subdomain),
+			},
+		},
+		StackInstancesGroup: &instances,
+		OperationPreferences: &awscloudformation.CfnStackSet_OperationPreferencesProperty{
+			MaxConcurrentPercentage:    jsii.Number(float64(maxConcurrent)),
+			FailureTolerancePercentage: jsii.Number(float64(stackSetConfig.FailureTolerancePercentage)),
+		},
+	})
+
+	return stack
+}
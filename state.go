@@ -0,0 +1,60 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// StateConfig records the Cloudflare records the Lambda function manages in DynamoDB, one
+// item per record keyed by the delegated name and the record ID
+type StateConfig struct {
+	Enabled bool `json:"enabled"`
+	// Existing table in the stack's region shared by the stacks, for an inventory of every
+	// delegation in the account, by default a table created by the stack
+	TableName string `json:"table_name,omitempty"`
+}
+
+// addStateTable returns the name of the state table, creating it unless an existing one is
+// configured, lets the Lambda function keep the items of the delegation in it and stores
+// its name in SSM Parameter Store for the CLI
+func addStateTable(stack awscdk.Stack, function awslambda.IFunction, config *ConfigFile, parentDomain, subdomain *string) *string {
+	var tableName, tableArn *string
+	if config.State.TableName != "" {
+		tableName = jsii.String(config.State.TableName)
+		tableArn = stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("dynamodb"),
+			Resource:     jsii.String("table"),
+			ResourceName: tableName,
+		})
+	} else {
+		// The NS records outlive the stack, and so does the record of them
+		table := awsdynamodb.NewTable(stack, jsii.String("CloudflareDNSStateTable"), &awsdynamodb.TableProps{
+			PartitionKey:  &awsdynamodb.Attribute{Name: jsii.String("Name"), Type: awsdynamodb.AttributeType_STRING},
+			SortKey:       &awsdynamodb.Attribute{Name: jsii.String("RecordId"), Type: awsdynamodb.AttributeType_STRING},
+			BillingMode:   awsdynamodb.BillingMode_PAY_PER_REQUEST,
+			RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
+		})
+		tableName = table.TableName()
+		tableArn = table.TableArn()
+	}
+
+	function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("dynamodb:Query", "dynamodb:PutItem", "dynamodb:DeleteItem"),
+		Resources: jsii.Strings(*tableArn),
+	}))
+
+	paramName := config.SsmParamPrefix + "/" + *subdomain + "/" + strings.ReplaceAll(*parentDomain, ".", "-") + "/stateTable"
+	awsssm.NewStringParameter(stack, jsii.String("StateTableSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(paramName),
+		SimpleName:    jsii.Bool(!strings.HasPrefix(paramName, "/")),
+		StringValue:   tableName,
+		Description:   jsii.String("DynamoDB table recording the Cloudflare records of " + *subdomain + "." + *parentDomain),
+	})
+	return tableName
+}
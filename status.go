@@ -0,0 +1,33 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// initialDelegationStatus is the value of the delegation status parameter until the Lambda
+// function first updates the NS records
+const initialDelegationStatus = `{"status":"PENDING"}`
+
+// addDelegationStatusParameter creates the SSM parameter the Lambda function refreshes with
+// the outcome of each NS record update, and returns its name. The stack owns the parameter,
+// so it is deleted with the stack after the custom resource referencing it.
+func addDelegationStatusParameter(stack awscdk.Stack, function awslambda.IFunction, config *ConfigFile, parentDomain, subdomain *string) *string {
+	paramName := config.SsmParamPrefix + "/" + *subdomain + "/" + strings.ReplaceAll(*parentDomain, ".", "-") + "/delegationStatus"
+	parameter := awsssm.NewStringParameter(stack, jsii.String("DelegationStatusSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(paramName),
+		SimpleName:    jsii.Bool(!strings.HasPrefix(paramName, "/")),
+		StringValue:   jsii.String(initialDelegationStatus),
+		Description:   jsii.String("Last NS record update of " + *subdomain + "." + *parentDomain + " by the Lambda function"),
+	})
+	function.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   jsii.Strings("ssm:PutParameter"),
+		Resources: jsii.Strings(*parameter.ParameterArn()),
+	}))
+	return parameter.ParameterName()
+}
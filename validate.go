@@ -0,0 +1,544 @@
+package cftor53
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ValidateConfig checks a configuration before synthesis and returns a ValidationError with
+// every problem of it. The constructors panic with this error on an invalid configuration.
+func ValidateConfig(config *ConfigFile) error {
+	if config == nil {
+		return &ValidationError{Problems: []string{"Config must be provided"}}
+	}
+
+	var problems []string
+	if config.Nag != nil {
+		problems = append(problems, nagProblems(config.Nag)...)
+	}
+	if len(config.Domains) > 0 {
+		problems = append(problems, domainsProblems(config)...)
+	}
+	if config.Pipeline != nil {
+		problems = append(problems, pipelineProblems(config)...)
+	}
+	if config.StackSet != nil {
+		problems = append(problems, stackSetProblems(config)...)
+	}
+
+	// The subdomains of domains share most of their settings, so a problem is reported once,
+	// for the first subdomain that has it
+	seen := map[string]bool{}
+	for _, delegation := range Delegations(config) {
+		for _, problem := range delegationProblems(&delegation.Config) {
+			if seen[problem] {
+				continue
+			}
+			seen[problem] = true
+			if len(config.Domains) > 0 {
+				problem = delegation.FullDomainName() + ": " + problem
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateProps returns a ValidationError when the required properties of a constructor are
+// missing, or else the error of ValidateConfig for its configuration
+func validateProps(config *ConfigFile, provided bool, required string) error {
+	if config == nil || !provided {
+		return &ValidationError{Problems: []string{required + " must be provided"}}
+	}
+	return ValidateConfig(config)
+}
+
+// delegationProblems returns the problems of the configuration of a single delegated subdomain
+func delegationProblems(config *ConfigFile) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	tokenSource := TokenSourceSecretsManager
+	if config.TokenSource != "" {
+		tokenSource = config.TokenSource
+	}
+	if tokenSource != TokenSourceSecretsManager && tokenSource != TokenSourceSSM {
+		add("Invalid token_source: " + tokenSource)
+	}
+	if tokenSource == TokenSourceSSM && config.TokenParameterName == "" {
+		add("token_parameter_name must be provided when token_source is ssm")
+	}
+	orchestration := OrchestrationCustomResources
+	if config.Orchestration != "" {
+		orchestration = config.Orchestration
+	}
+	if orchestration != OrchestrationCustomResources && orchestration != OrchestrationStepFunctions {
+		add("Invalid orchestration: " + orchestration)
+	}
+	stepFunctions := orchestration == OrchestrationStepFunctions
+
+	// Cloudflare accepts TTLs from 60 seconds to a day
+	if config.NSRecordTTL != 0 && (config.NSRecordTTL < 60 || config.NSRecordTTL > 86400) {
+		add("Invalid ns_record_ttl: " + strconv.Itoa(config.NSRecordTTL) + " (60 to 86400 seconds)")
+	}
+	if config.NSRecordMode != "" && config.NSRecordMode != NSRecordModeReplace && config.NSRecordMode != NSRecordModeAppend {
+		add("Invalid ns_record_mode: " + config.NSRecordMode + " (must be replace or append)")
+	}
+
+	if problem := idnProblem("parent_domain", config.ParentDomain); problem != "" {
+		add(problem)
+	}
+	if problem := idnProblem("subdomain", config.Subdomain); problem != "" {
+		add(problem)
+	}
+	if config.Namespace != "" && !namespacePattern.MatchString(config.Namespace) {
+		add("Invalid namespace: " + config.Namespace + " (lowercase letters, digits and hyphens)")
+	}
+	if config.Stage != "" && !namespacePattern.MatchString(config.Stage) {
+		add("Invalid stage: " + config.Stage + " (lowercase letters, digits and hyphens)")
+	}
+	problems = append(problems, exportsProblems(config.Exports)...)
+	problems = append(problems, tagProblems(config.Tags)...)
+	problems = append(problems, tagProblems(config.HostedZoneTags)...)
+	if len(config.HostedZoneComment) > maxHostedZoneCommentLength {
+		add("Invalid hosted_zone_comment: longer than " + strconv.Itoa(maxHostedZoneCommentLength) + " characters")
+	}
+	problems = append(problems, lambdaSettingsProblems(config.LambdaSettings)...)
+	if config.RemovalPolicy != nil {
+		if problem := removalPolicyProblem(config.RemovalPolicy.Secret); problem != "" {
+			add(problem)
+		}
+		if problem := removalPolicyProblem(config.RemovalPolicy.HostedZone); problem != "" {
+			add(problem)
+		}
+	}
+	if config.CloudFormation != nil && config.CloudFormation.AssetBucket == "" {
+		add("cloudformation.asset_bucket must be provided")
+	}
+
+	for _, reader := range config.SecretReaders {
+		if !validSecretReader(reader) {
+			add("Invalid secret_readers entry, expected an account ID or ARN: " + reader)
+		}
+	}
+	if len(config.SecretReaders) > 0 && (tokenSource != TokenSourceSecretsManager || config.SecretArn != "" || config.ExistingSecretOnly || config.PrivateZone != nil) {
+		add("secret_readers requires the token secret to be created by the secrets stack")
+	}
+
+	if config.PrivateZone != nil {
+		if config.AssumeRoleArn != "" || config.HostedZoneID != "" || config.DelegationSet != nil || stepFunctions {
+			add("private_zone cannot be combined with assume_role_arn, hosted_zone_id, delegation_set or step-functions orchestration")
+		}
+		if len(config.PrivateZone.Vpcs) == 0 {
+			add("private_zone.vpcs must not be empty")
+		}
+		for _, vpc := range config.PrivateZone.Vpcs {
+			if vpc.VpcID == "" {
+				add("private_zone.vpcs[].vpc_id must be provided")
+				break
+			}
+		}
+	}
+	if config.CertificateOnly {
+		if config.PrivateZone != nil || config.AssumeRoleArn != "" || config.HostedZoneID != "" || config.DelegationSet != nil ||
+			(config.QueryLogging != nil && config.QueryLogging.Enabled) || len(config.Records) > 0 || config.ZoneFile != "" || stepFunctions {
+			add("certificate_only cannot be combined with settings of the hosted zone or step-functions orchestration")
+		}
+		if !certificateEnabled(config.Certificate) || config.Certificate.Arn != "" || config.Certificate.Regional {
+			add("certificate_only requires an issued certificate without certificate.arn and certificate.regional")
+		}
+	}
+	if config.ExistingSecretOnly {
+		if config.ApiToken != "" {
+			add("api_token must not be set in config.json when existing_secret_only is enabled")
+		}
+		if tokenSource == TokenSourceSecretsManager && config.SecretArn == "" && config.SecretName == "" {
+			add("existing_secret_only requires secret_arn or secret_name of a pre-created secret")
+		}
+	}
+
+	hostedZoneID := strings.TrimPrefix(config.HostedZoneID, "/hostedzone/")
+	if hostedZoneID != "" {
+		if !hostedZoneIDPattern.MatchString(hostedZoneID) {
+			add("Invalid hosted_zone_id: " + config.HostedZoneID)
+		}
+		if stepFunctions {
+			add("hosted_zone_id is not supported with step-functions orchestration")
+		}
+		if config.HostedZoneComment != "" || len(config.HostedZoneTags) > 0 {
+			add("hosted_zone_comment and hosted_zone_tags only apply to a hosted zone created by the stack, without hosted_zone_id")
+		}
+	}
+	if config.DelegationSet != nil {
+		if !stepFunctions {
+			add("delegation_set requires step-functions orchestration")
+		}
+		if config.DelegationSet.Create == (config.DelegationSet.ID != "") {
+			add("delegation_set requires exactly one of id and create")
+		}
+	}
+	if config.AssumeRoleArn != "" {
+		if stepFunctions {
+			add("assume_role_arn is not supported with step-functions orchestration")
+		}
+		if roleAccount(config.AssumeRoleArn) == "" {
+			add("Invalid assume_role_arn: " + config.AssumeRoleArn)
+		}
+	}
+
+	records, problem := configRecords(config)
+	if problem != "" {
+		add(problem)
+	}
+	problems = append(problems, recordsProblems(records)...)
+	if len(records) > 0 && config.AssumeRoleArn != "" && hostedZoneID != "" {
+		add("records cannot be added to an existing hosted zone in the account of assume_role_arn")
+	}
+
+	if config.QueryLogging != nil && config.QueryLogging.Enabled {
+		if config.PrivateZone != nil || hostedZoneID != "" || stepFunctions {
+			add("query_logging requires a public hosted zone created by CloudFormation")
+		}
+		if days := config.QueryLogging.RetentionDays; days > 0 {
+			if _, ok := logRetentionDays[days]; !ok {
+				add("Invalid query_logging.retention_days: " + strconv.Itoa(days))
+			}
+		}
+	}
+	if config.Lock != nil && config.Lock.Enabled {
+		if config.PrivateZone != nil || config.CertificateOnly || stepFunctions {
+			add("lock requires a delegation by custom resources, without private_zone, certificate_only or step-functions orchestration")
+		}
+		if config.Lock.TableName != "" && !tableNamePattern.MatchString(config.Lock.TableName) {
+			add("Invalid lock.table_name: " + config.Lock.TableName)
+		}
+	}
+	if config.State != nil && config.State.Enabled {
+		if config.PrivateZone != nil || config.CertificateOnly || stepFunctions {
+			add("state requires a delegation by custom resources, without private_zone, certificate_only or step-functions orchestration")
+		}
+		if config.State.TableName != "" && !tableNamePattern.MatchString(config.State.TableName) {
+			add("Invalid state.table_name: " + config.State.TableName)
+		}
+	}
+	if config.ResponseSpill != nil && config.ResponseSpill.Enabled {
+		if config.PrivateZone != nil {
+			add("response_spill requires the Lambda function, without private_zone")
+		}
+		if config.ResponseSpill.BucketName != "" && !bucketNamePattern.MatchString(config.ResponseSpill.BucketName) {
+			add("Invalid response_spill.bucket_name: " + config.ResponseSpill.BucketName)
+		}
+		if config.ResponseSpill.ExpirationDays < 0 || config.ResponseSpill.BucketName != "" && config.ResponseSpill.ExpirationDays != 0 {
+			add("response_spill.expiration_days must be positive and only applies to the bucket created by the stack")
+		}
+	}
+	if config.Dashboard != nil && config.Dashboard.Enabled {
+		if config.Dashboard.Name != "" && !dashboardNamePattern.MatchString(config.Dashboard.Name) {
+			add("Invalid dashboard.name: " + config.Dashboard.Name)
+		}
+		for _, canary := range config.Dashboard.Canaries {
+			if !canaryNamePattern.MatchString(canary) {
+				add("Invalid dashboard.canaries: " + canary)
+			}
+		}
+	}
+	if config.Certificate != nil && config.Certificate.NegativeCacheWait {
+		if config.PrivateZone != nil || config.CertificateOnly || config.AssumeRoleArn != "" || hostedZoneID != "" || stepFunctions {
+			add("certificate.negative_cache_wait requires a delegation by custom resources, without private_zone, certificate_only, assume_role_arn, hosted_zone_id or step-functions orchestration")
+		}
+	}
+	if config.Propagation != nil && config.Propagation.Enabled {
+		if config.PrivateZone != nil || config.CertificateOnly || config.AssumeRoleArn != "" || hostedZoneID != "" {
+			add("propagation requires a delegation by custom resources or step-functions orchestration, without private_zone, certificate_only, assume_role_arn or hosted_zone_id")
+		}
+		// The Provider framework's isComplete queries the parent zone's name servers on port 53,
+		// which functions in a VPC usually can't reach
+		if !stepFunctions && config.LambdaSettings != nil && config.LambdaSettings.Vpc != nil {
+			add("propagation with lambda_settings.vpc requires step-functions orchestration, which verifies the delegation with DNS-over-HTTPS")
+		}
+		for _, resolver := range config.Propagation.Resolvers {
+			if !validDoHResolver(resolver) {
+				add("Invalid propagation.resolvers: " + resolver)
+			}
+		}
+	}
+	if problem := propagationTimingProblem(config.Propagation); problem != "" {
+		add(problem)
+	}
+	if problem := cloudflareRetryProblem(config.CloudflareRetry); problem != "" {
+		add(problem)
+	}
+	if config.Ses != nil && config.Ses.Enabled {
+		if config.PrivateZone != nil || config.CertificateOnly {
+			add("ses requires a public hosted zone, without certificate_only")
+		}
+		if problem := mailFromSubdomainProblem(config.Ses); problem != "" {
+			add(problem)
+		}
+	}
+
+	return append(problems, certificateProblems(config)...)
+}
+
+// certificateProblems returns the problems of the certificate and of the distributions using it
+func certificateProblems(config *ConfigFile) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	mainRegion, certRegion := configRegions(config)
+	cloudFront := config.CloudFront != nil && config.CloudFront.Enabled
+	website := config.Website != nil && config.Website.Enabled
+	apiGateway := config.ApiGateway != nil && config.ApiGateway.Enabled
+	regional := config.Certificate != nil && config.Certificate.Regional
+
+	// The names of the certificate are checked against the subdomain, if known
+	if settings := config.Certificate; settings != nil {
+		fullDomainName := ""
+		if config.Subdomain != "" {
+			fullDomainName = config.Subdomain + "." + config.ParentDomain
+		}
+		problems = append(problems, certificateSettingsProblems(settings, fullDomainName, certRegion, mainRegion)...)
+
+		// The certificate of certificate_only is in the certificate region, as is the main stack
+		alarmRegions := []string{certRegion}
+		if regional && !config.CertificateOnly {
+			alarmRegions = append(alarmRegions, mainRegion)
+		}
+		problems = append(problems, certificateAlarmProblems(settings.ExpiryAlarm, alarmRegions)...)
+	}
+	if config.PrivateZone != nil || config.CertificateOnly || !certificateEnabled(config.Certificate) {
+		if cloudFront || website || apiGateway {
+			add("cloudfront, website and api_gateway require a certificate for a public hosted zone, without certificate_only")
+		}
+		return problems
+	}
+	if regional && mainRegion == certRegion {
+		add("certificate.regional requires regions.main to differ from regions.certificate")
+	}
+	if (cloudFront && website) || (cloudFront && apiGateway) || (website && apiGateway) {
+		add("Only one of cloudfront, website and api_gateway can serve the subdomain")
+	}
+	if (cloudFront || website) && certRegion != cloudFrontCertificateRegion {
+		add("CloudFront requires regions.certificate to be " + cloudFrontCertificateRegion)
+	}
+	if cloudFront {
+		problems = append(problems, cloudFrontProblems(config.CloudFront)...)
+	}
+	if website {
+		problems = append(problems, websiteProblems(config.Website)...)
+	}
+	if apiGateway {
+		problems = append(problems, apiGatewayProblems(config.ApiGateway)...)
+		switch endpointType := apiGatewayEndpointType(config.ApiGateway); {
+		case endpointType == ApiGatewayEndpointEdge && certRegion != cloudFrontCertificateRegion:
+			add("api_gateway with an edge endpoint requires regions.certificate to be " + cloudFrontCertificateRegion)
+		case endpointType == ApiGatewayEndpointRegional && mainRegion != certRegion && !regional:
+			add("api_gateway with a regional endpoint requires certificate.regional, or regions.main to equal regions.certificate")
+		}
+	}
+	return problems
+}
+
+// domainsProblems returns the problems of Config.Domains that NewDelegatedDomains checks
+func domainsProblems(config *ConfigFile) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	if config.ParentDomain != "" || config.Subdomain != "" {
+		add("domains cannot be combined with parent_domain and subdomain")
+	}
+	if config.HostedZoneID != "" || len(config.Records) > 0 || config.ZoneFile != "" {
+		add("hosted_zone_id, records and zone_file cannot be combined with domains")
+	}
+	if config.SecretName != "" {
+		add("secret_name cannot be combined with domains, set domains[].secret_name instead")
+	}
+	if config.DelegationSet != nil && config.DelegationSet.Create {
+		add("delegation_set.create cannot be combined with domains, create the set in a deployment of its own and use delegation_set.id")
+	}
+	if config.Exports != nil && (config.Exports.Prefix != "" || len(config.Exports.Names) > 0) {
+		add("exports.prefix and exports.names cannot be combined with domains, whose subdomains would share them")
+	}
+
+	seenDomains := map[string]bool{}
+	seenStageSubdomains := map[string]bool{}
+	for _, domain := range config.Domains {
+		parentDomain := domainsParentDomain(domain)
+		if parentDomain == "" {
+			add("domains[].parent_domain must be provided")
+			continue
+		}
+		if seenDomains[parentDomain] {
+			add("Duplicate domain in domains[]: " + parentDomain)
+		}
+		seenDomains[parentDomain] = true
+		if len(domain.Subdomains) == 0 {
+			add("domains[].subdomains must not be empty for " + parentDomain)
+		}
+
+		seenSubdomains := map[string]bool{}
+		for _, subdomain := range domain.Subdomains {
+			name := domainsSubdomain(subdomain)
+			if name == "" {
+				add("domains[].subdomains[].name must be provided for " + parentDomain)
+				continue
+			}
+			if seenSubdomains[name] {
+				add("Duplicate subdomain in domains[]: " + name + "." + parentDomain)
+			}
+			seenSubdomains[name] = true
+
+			// The stacks of a stage are named after the subdomain alone, which must be unique
+			if config.Stage != "" {
+				if seenStageSubdomains[name] {
+					add("Duplicate subdomain in domains[] with stage: " + name + " (the stacks of a stage are named after the subdomain)")
+				}
+				seenStageSubdomains[name] = true
+			}
+		}
+	}
+	return problems
+}
+
+// pipelineProblems returns the problems of Config.Pipeline that NewDelegationPipeline checks,
+// including those of the stages' own settings
+func pipelineProblems(config *ConfigFile) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	pipelineConfig := config.Pipeline
+	if pipelineConfig.ConnectionArn == "" || pipelineConfig.Repository == "" {
+		add("pipeline.connection_arn and pipeline.repository must be provided")
+	}
+	if len(pipelineConfig.Stages) == 0 {
+		add("pipeline.stages must not be empty")
+	}
+	if len(config.Domains) > 0 {
+		add("domains is not supported when deploying through a pipeline")
+	}
+	if config.ApiToken != "" {
+		add("api_token must not be set in config.json when deploying through a pipeline")
+	}
+	if pipelineConfig.Account == "" && os.Getenv("CDK_DEFAULT_ACCOUNT") == "" {
+		add("pipeline.account must be provided when the CLI account is unknown")
+	}
+
+	// The problems the stages share with the configuration are reported for it alone
+	stageConfig := *config
+	stageConfig.Pipeline = nil
+	shared := map[string]bool{}
+	for _, problem := range delegationProblems(&stageConfig) {
+		shared[problem] = true
+	}
+	seen := map[string]bool{}
+	for _, stage := range pipelineConfig.Stages {
+		if stage.Name == "" {
+			add("pipeline.stages[].name must be provided")
+			continue
+		}
+		if seen[stage.Name] {
+			add("Duplicate pipeline stage: " + stage.Name)
+		}
+		seen[stage.Name] = true
+
+		// Without a token in the configuration, the stage must read an existing secret or parameter
+		stageDelegation := stageDelegationConfig(stageConfig, stage)
+		if stageDelegation.TokenSource != TokenSourceSSM && stageDelegation.SecretArn == "" && !stageDelegation.ExistingSecretOnly {
+			add("Pipeline stage " + stage.Name + " requires secret_arn, existing_secret_only or token_source ssm")
+		}
+		for _, problem := range delegationProblems(stageDelegation) {
+			if !shared[problem] {
+				add("Pipeline stage " + stage.Name + ": " + problem)
+			}
+		}
+	}
+	return problems
+}
+
+// stackSetProblems returns the problems of Config.StackSet that NewDelegationStackSet checks
+func stackSetProblems(config *ConfigFile) []string {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+
+	stackSetConfig := config.StackSet
+	if len(stackSetConfig.Instances) == 0 {
+		add("stack_set.instances must not be empty")
+	}
+	if len(config.Domains) > 0 {
+		add("domains is not supported with stack_set")
+	}
+	if config.CloudFormation == nil || config.CloudFormation.AssetBucket == "" {
+		add("stack_set requires cloudformation.asset_bucket for the Lambda assets of member accounts")
+	}
+
+	// The template is shared with every member account, so it must not contain the token
+	if config.ApiToken != "" {
+		add("api_token must not be set in config.json when deploying with a StackSet")
+	}
+	if config.TokenSource != TokenSourceSSM && config.SecretArn == "" && !config.ExistingSecretOnly {
+		add("stack_set requires secret_arn, existing_secret_only or token_source ssm")
+	}
+	if stackSetConfig.Account == "" && os.Getenv("CDK_DEFAULT_ACCOUNT") == "" {
+		add("stack_set.account must be provided when the CLI account is unknown")
+	}
+
+	// Organizational units are deployed to through Organizations, which can't target accounts
+	untargeted, accounts, organizationalUnits := false, false, false
+	for _, instance := range stackSetConfig.Instances {
+		untargeted = untargeted || len(instance.Accounts) == 0 && len(instance.OrganizationalUnitIDs) == 0
+		accounts = accounts || len(instance.Accounts) > 0
+		organizationalUnits = organizationalUnits || len(instance.OrganizationalUnitIDs) > 0
+	}
+	if untargeted {
+		add("stack_set.instances[] must target accounts or organizational_unit_ids")
+	}
+	if accounts && organizationalUnits {
+		add("stack_set.instances[] cannot mix accounts with organizational_unit_ids")
+	}
+
+	// The member template has only the delegation stack, so settings of the other stacks and
+	// those of resources in a single account would be dropped
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"secret_readers", len(config.SecretReaders) > 0},
+		{"assume_role_arn", config.AssumeRoleArn != ""},
+		{"hosted_zone_id", config.HostedZoneID != ""},
+		{"delegation_set", config.DelegationSet != nil},
+		{"private_zone", config.PrivateZone != nil},
+		{"query_logging", config.QueryLogging != nil},
+		{"records", len(config.Records) > 0},
+		{"zone_file", config.ZoneFile != ""},
+		{"termination_protection", config.TerminationProtection != nil},
+		{"certificate", config.Certificate != nil},
+		{"certificate_only", config.CertificateOnly},
+		{"exports", config.Exports != nil},
+		{"cloudfront", config.CloudFront != nil},
+		{"website", config.Website != nil},
+		{"api_gateway", config.ApiGateway != nil},
+		{"ses", config.Ses != nil},
+		{"dashboard", config.Dashboard != nil},
+	}
+	for _, setting := range unsupported {
+		if setting.set {
+			add(setting.name + " is not supported with stack_set")
+		}
+	}
+	return problems
+}
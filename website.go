@@ -0,0 +1,160 @@
+package cftor53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudfront"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudfrontorigins"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3deployment"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsssm"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// WebsiteConfig creates a static website for the subdomain, served from a private S3 bucket
+// by CloudFront with its certificate
+type WebsiteConfig struct {
+	Enabled bool `json:"enabled"`
+	// Object served for the subdomain itself, by default index.html
+	IndexDocument string `json:"index_document,omitempty"`
+	// Object served with status 404 for missing objects, e.g. 404.html
+	ErrorDocument string `json:"error_document,omitempty"`
+	// Serve the index document for missing objects, for client-side routing
+	SinglePageApp bool `json:"single_page_app,omitempty"`
+	// Directory uploaded to the bucket on every deployment, relative to the working directory
+	SourceDir string `json:"source_dir,omitempty"`
+	// "PriceClass_All" (default), "PriceClass_200" or "PriceClass_100"
+	PriceClass string `json:"price_class,omitempty"`
+	// Serve IPv6 with an AAAA alias record, by default true
+	IPv6 *bool `json:"ipv6,omitempty"`
+}
+
+// NewWebsiteStack creates a stack with a private S3 bucket for the website of the subdomain
+// and a CloudFront distribution reading it through an origin access control, using the
+// certificate and creating the alias records in the hosted zone
+func NewWebsiteStack(scope constructs.Construct, id string, props *CloudFrontStackProps) awscdk.Stack {
+	if props == nil {
+		props = &CloudFrontStackProps{}
+	}
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+
+	// Validate required properties and the configuration
+	provided := props.ParentDomain != nil && props.Subdomain != nil && props.HostedZoneId != nil && props.CertificateArn != nil && props.Config != nil && props.Config.Website != nil
+	if err := validateProps(props.Config, provided, "ParentDomain, Subdomain, HostedZoneId, CertificateArn and Config.Website"); err != nil {
+		panic(err)
+	}
+	settings := props.Config.Website
+	indexDocument := "index.html"
+	if settings.IndexDocument != "" {
+		indexDocument = strings.TrimPrefix(settings.IndexDocument, "/")
+	}
+
+	// The bucket is retained on stack deletion, like CDK's default, since it holds the content
+	bucket := awss3.NewBucket(stack, jsii.String("WebsiteBucket"), &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+	})
+
+	// S3Origin only supports origin access identities in this CDK version, so the origin
+	// access control is set on the CloudFormation resource
+	originAccessControl := awscloudfront.NewCfnOriginAccessControl(stack, jsii.String("OriginAccessControl"), &awscloudfront.CfnOriginAccessControlProps{
+		OriginAccessControlConfig: &awscloudfront.CfnOriginAccessControl_OriginAccessControlConfigProperty{
+			Name:                          jsii.String(*props.Subdomain + "." + *props.ParentDomain),
+			OriginAccessControlOriginType: jsii.String("s3"),
+			SigningBehavior:               jsii.String("always"),
+			SigningProtocol:               jsii.String("sigv4"),
+		},
+	})
+
+	// Objects the bucket doesn't have are 403 errors without s3:ListBucket
+	var errorResponses *[]*awscloudfront.ErrorResponse
+	if settings.SinglePageApp {
+		errorResponses = websiteErrorResponses("/"+indexDocument, 200)
+	} else if settings.ErrorDocument != "" {
+		errorResponses = websiteErrorResponses("/"+strings.TrimPrefix(settings.ErrorDocument, "/"), 404)
+	}
+
+	distribution := addDistribution(stack, props, &awscloudfront.DistributionProps{
+		DefaultBehavior: &awscloudfront.BehaviorOptions{
+			Origin:               awscloudfrontorigins.NewHttpOrigin(bucket.BucketRegionalDomainName(), nil),
+			ViewerProtocolPolicy: awscloudfront.ViewerProtocolPolicy_REDIRECT_TO_HTTPS,
+		},
+		DefaultRootObject: jsii.String(indexDocument),
+		ErrorResponses:    errorResponses,
+		PriceClass:        cloudFrontPriceClass(settings.PriceClass),
+	}, settings.IPv6)
+	cfnDistribution := distribution.Node().DefaultChild().(awscloudfront.CfnDistribution)
+	cfnDistribution.AddPropertyOverride(jsii.String("DistributionConfig.Origins.0.OriginAccessControlId"), originAccessControl.AttrId())
+	cfnDistribution.AddPropertyOverride(jsii.String("DistributionConfig.Origins.0.S3OriginConfig.OriginAccessIdentity"), "")
+	cfnDistribution.AddPropertyDeletionOverride(jsii.String("DistributionConfig.Origins.0.CustomOriginConfig"))
+
+	// Only the distribution may read the objects
+	bucket.AddToResourcePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Principals: &[]awsiam.IPrincipal{awsiam.NewServicePrincipal(jsii.String("cloudfront.amazonaws.com"), nil)},
+		Actions:    jsii.Strings("s3:GetObject"),
+		Resources:  jsii.Strings(*bucket.ArnForObjects(jsii.String("*"))),
+		Conditions: &map[string]interface{}{
+			"StringEquals": map[string]interface{}{
+				"AWS:SourceArn": stack.FormatArn(&awscdk.ArnComponents{
+					Service:      jsii.String("cloudfront"),
+					Region:       jsii.String(""),
+					Resource:     jsii.String("distribution"),
+					ResourceName: distribution.DistributionId(),
+				}),
+			},
+		},
+	}))
+
+	// Upload the content and invalidate the cached copies of the previous deployment
+	if settings.SourceDir != "" {
+		awss3deployment.NewBucketDeployment(stack, jsii.String("WebsiteDeployment"), &awss3deployment.BucketDeploymentProps{
+			DestinationBucket: bucket,
+			Sources:           &[]awss3deployment.ISource{awss3deployment.Source_Asset(jsii.String(settings.SourceDir), nil)},
+			Distribution:      distribution,
+			DistributionPaths: jsii.Strings("/*"),
+		})
+	}
+
+	// Store the bucket name in SSM Parameter Store for deployments of the content
+	bucketParamName := props.Config.SsmParamPrefix + "/" + *props.Subdomain + "/" + strings.ReplaceAll(*props.ParentDomain, ".", "-") + "/websiteBucketName"
+	awsssm.NewStringParameter(stack, jsii.String("WebsiteBucketNameSSMParam"), &awsssm.StringParameterProps{
+		ParameterName: jsii.String(bucketParamName),
+		StringValue:   bucket.BucketName(),
+		Description:   jsii.String("Website bucket for " + *props.Subdomain + "." + *props.ParentDomain),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("WebsiteBucketNameOutput"), &awscdk.CfnOutputProps{
+		Value:       bucket.BucketName(),
+		Description: jsii.String("S3 bucket with the website content"),
+	})
+
+	return stack
+}
+
+// websiteErrorResponses returns the error responses serving the page for missing objects
+func websiteErrorResponses(pagePath string, status float64) *[]*awscloudfront.ErrorResponse {
+	var responses []*awscloudfront.ErrorResponse
+	for _, errorStatus := range []float64{403, 404} {
+		responses = append(responses, &awscloudfront.ErrorResponse{
+			HttpStatus:         jsii.Number(errorStatus),
+			ResponseHttpStatus: jsii.Number(status),
+			ResponsePagePath:   jsii.String(pagePath),
+		})
+	}
+	return &responses
+}
+
+// websiteProblems returns the problems of the website settings
+func websiteProblems(settings *WebsiteConfig) []string {
+	var problems []string
+	if settings.SinglePageApp && settings.ErrorDocument != "" {
+		problems = append(problems, "website.error_document cannot be combined with single_page_app")
+	}
+	if problem := priceClassProblem("website.price_class", settings.PriceClass); problem != "" {
+		problems = append(problems, problem)
+	}
+	return problems
+}
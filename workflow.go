@@ -0,0 +1,297 @@
+package cftor53
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctionstasks"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Orchestration modes of the delegation workflow
+const (
+	// Chain of custom resources ordered by dependencies
+	OrchestrationCustomResources = "custom-resources"
+	// Step Functions state machine driven by a single custom resource
+	OrchestrationStepFunctions = "step-functions"
+)
+
+// addDelegationWorkflow creates the Step Functions state machine running check → zone →
+// update → verify, and the custom resource starting it. The hosted zone is created by the
+// state machine, so its ID and name servers are returned as attributes of the custom resource.
+func addDelegationWorkflow(scope constructs.Construct, provider *DelegationProvider, props *Cftor53StackProps, tokenProperties map[string]interface{}, fullDomainName *string) (hostedZoneId *string, nameServers *string) {
+	stack := awscdk.Stack_Of(scope)
+	lambdaSettings := constructLambdaSettings(props.Config.LambdaSettings)
+
+	// Each Lambda step may run for the whole function timeout
+	stepTimeout := awsstepfunctions.Timeout_Duration(awscdk.Duration_Seconds(jsii.Number(float64(lambdaSettings.TimeoutSeconds + 30))))
+	awsTimeout := awsstepfunctions.Timeout_Duration(awscdk.Duration_Minutes(jsii.Number(2)))
+	hostedZoneArn := stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("route53"),
+		Region:       jsii.String(""),
+		Account:      jsii.String(""),
+		Resource:     jsii.String("hostedzone"),
+		ResourceName: jsii.String("*"),
+	})
+
+	// lambdaStep invokes the delegation Lambda directly with a custom resource shaped event
+	lambdaStep := func(id, action string, extra map[string]interface{}) awsstepfunctionstasks.LambdaInvoke {
+		properties := map[string]interface{}{
+			"Domain":    *props.ParentDomain,
+			"Subdomain": *props.Subdomain,
+			"Action":    action,
+		}
+		for key, value := range tokenProperties {
+			properties[key] = value
+		}
+		for key, value := range extra {
+			properties[key] = value
+		}
+		return awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String(id), &awsstepfunctionstasks.LambdaInvokeProps{
+			LambdaFunction: provider.Function,
+			Payload: awsstepfunctions.TaskInput_FromObject(&map[string]interface{}{
+				"RequestType":        awsstepfunctions.JsonPath_StringAt(jsii.String("$.Event.RequestType")),
+				"ResourceProperties": properties,
+			}),
+			ResultPath:  awsstepfunctions.JsonPath_DISCARD(),
+			TaskTimeout: stepTimeout,
+		})
+	}
+
+	// respondStep reports the outcome to CloudFormation
+	respondStep := func(id string, extra map[string]interface{}) awsstepfunctionstasks.LambdaInvoke {
+		properties := map[string]interface{}{
+			"Action": "respond",
+			"Event":  awsstepfunctions.JsonPath_ObjectAt(jsii.String("$.Event")),
+		}
+		for key, value := range extra {
+			properties[key] = value
+		}
+		step := awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String(id), &awsstepfunctionstasks.LambdaInvokeProps{
+			LambdaFunction: provider.Function,
+			Payload: awsstepfunctions.TaskInput_FromObject(&map[string]interface{}{
+				"RequestType":        awsstepfunctions.JsonPath_StringAt(jsii.String("$.Event.RequestType")),
+				"ResourceProperties": properties,
+			}),
+			ResultPath:  awsstepfunctions.JsonPath_DISCARD(),
+			TaskTimeout: stepTimeout,
+		})
+		// CloudFormation waits for the response until the custom resource times out, so try hard
+		step.AddRetry(&awsstepfunctions.RetryProps{
+			Errors:      jsii.Strings(*awsstepfunctions.Errors_ALL()),
+			MaxAttempts: jsii.Number(5),
+			Interval:    awscdk.Duration_Seconds(jsii.Number(5)),
+			BackoffRate: jsii.Number(2),
+		})
+		return step
+	}
+
+	// findZoneStep looks up an existing hosted zone for the subdomain
+	findZoneStep := func(id string) awsstepfunctionstasks.CallAwsService {
+		step := awsstepfunctionstasks.NewCallAwsService(scope, jsii.String(id), &awsstepfunctionstasks.CallAwsServiceProps{
+			Service:      jsii.String("route53"),
+			Action:       jsii.String("listHostedZonesByName"),
+			IamAction:    jsii.String("route53:ListHostedZonesByName"),
+			IamResources: jsii.Strings("*"),
+			Parameters: &map[string]interface{}{
+				"DnsName":  *fullDomainName,
+				"MaxItems": "1",
+			},
+			ResultSelector: &map[string]interface{}{
+				"HostedZones": awsstepfunctions.JsonPath_ObjectAt(jsii.String("$.HostedZones")),
+			},
+			ResultPath:  jsii.String("$.Lookup"),
+			TaskTimeout: awsTimeout,
+		})
+		step.AddRetry(&awsstepfunctions.RetryProps{MaxAttempts: jsii.Number(3)})
+		return step
+	}
+
+	// zoneFound branches on whether the looked up hosted zone is the one for the subdomain
+	zoneFound := func(id string, found, notFound awsstepfunctions.IChainable) awsstepfunctions.Choice {
+		matches := awsstepfunctions.NewChoice(scope, jsii.String(id+"Name"), nil).
+			When(awsstepfunctions.Condition_StringEquals(jsii.String("$.Lookup.HostedZones[0].Name"), jsii.String(*fullDomainName+".")), found).
+			Otherwise(notFound)
+		return awsstepfunctions.NewChoice(scope, jsii.String(id), nil).
+			When(awsstepfunctions.Condition_IsPresent(jsii.String("$.Lookup.HostedZones[0]")), matches).
+			Otherwise(notFound)
+	}
+
+	zoneResult := &map[string]interface{}{
+		"Id":          awsstepfunctions.JsonPath_StringAt(jsii.String("$.HostedZone.Id")),
+		"NameServers": awsstepfunctions.JsonPath_ListAt(jsii.String("$.DelegationSet.NameServers")),
+	}
+
+	respondFailure := respondStep("RespondFailure", map[string]interface{}{
+		"Status": "FAILED",
+		"Reason": awsstepfunctions.JsonPath_JsonToString(awsstepfunctions.JsonPath_ObjectAt(jsii.String("$.Error"))),
+	})
+	catch := func(step awsstepfunctions.TaskStateBase) {
+		step.AddCatch(respondFailure, &awsstepfunctions.CatchProps{ResultPath: jsii.String("$.Error")})
+	}
+
+	// Create and Update: check → zone → update → verify
+	check := lambdaStep("CheckCollidingRecords", "check", nil)
+	check.AddRetry(&awsstepfunctions.RetryProps{MaxAttempts: jsii.Number(2)})
+	findZone := findZoneStep("FindHostedZone")
+	getZone := awsstepfunctionstasks.NewCallAwsService(scope, jsii.String("GetHostedZone"), &awsstepfunctionstasks.CallAwsServiceProps{
+		Service:      jsii.String("route53"),
+		Action:       jsii.String("getHostedZone"),
+		IamAction:    jsii.String("route53:GetHostedZone"),
+		IamResources: jsii.Strings(*hostedZoneArn),
+		Parameters: &map[string]interface{}{
+			"Id": awsstepfunctions.JsonPath_StringAt(jsii.String("$.Lookup.HostedZones[0].Id")),
+		},
+		ResultSelector: zoneResult,
+		ResultPath:     jsii.String("$.Zone"),
+		TaskTimeout:    awsTimeout,
+	})
+	getZone.AddRetry(&awsstepfunctions.RetryProps{MaxAttempts: jsii.Number(3)})
+	createZoneParameters := map[string]interface{}{
+		"Name":            *fullDomainName,
+		"CallerReference": awsstepfunctions.JsonPath_StringAt(jsii.String("$$.Execution.Name")),
+		"HostedZoneConfig": map[string]interface{}{
+			"Comment": hostedZoneComment(props.Config, defaultHostedZoneComment),
+		},
+	}
+	if props.Config.DelegationSet != nil && props.Config.DelegationSet.ID != "" {
+		// The zone gets the name servers of the reusable delegation set
+		createZoneParameters["DelegationSetId"] = props.Config.DelegationSet.ID
+	}
+	createZone := awsstepfunctionstasks.NewCallAwsService(scope, jsii.String("CreateHostedZone"), &awsstepfunctionstasks.CallAwsServiceProps{
+		Service:        jsii.String("route53"),
+		Action:         jsii.String("createHostedZone"),
+		IamAction:      jsii.String("route53:CreateHostedZone"),
+		IamResources:   jsii.Strings("*"),
+		Parameters:     &createZoneParameters,
+		ResultSelector: zoneResult,
+		ResultPath:     jsii.String("$.Zone"),
+		TaskTimeout:    awsTimeout,
+	})
+	// CreateHostedZone doesn't take tags, so they are set on new and existing zones alike,
+	// by the ID without the /hostedzone/ prefix
+	var zoneReady awsstepfunctions.TaskStateBase
+	if tags := props.Config.HostedZoneTags; len(tags) > 0 {
+		var addTags []interface{}
+		for _, key := range tagKeys(tags) {
+			addTags = append(addTags, map[string]interface{}{"Key": key, "Value": tags[key]})
+		}
+		zoneIDParts := "States.StringSplit($.Zone.Id, '/')"
+		zoneReady = awsstepfunctionstasks.NewCallAwsService(scope, jsii.String("TagHostedZone"), &awsstepfunctionstasks.CallAwsServiceProps{
+			Service:      jsii.String("route53"),
+			Action:       jsii.String("changeTagsForResource"),
+			IamAction:    jsii.String("route53:ChangeTagsForResource"),
+			IamResources: jsii.Strings(*hostedZoneArn),
+			Parameters: &map[string]interface{}{
+				"ResourceType": "hostedzone",
+				"ResourceId.$": "States.ArrayGetItem(" + zoneIDParts + ", States.MathAdd(States.ArrayLength(" + zoneIDParts + "), -1))",
+				"AddTags":      addTags,
+			},
+			ResultPath:  awsstepfunctions.JsonPath_DISCARD(),
+			TaskTimeout: awsTimeout,
+		})
+		zoneReady.AddRetry(&awsstepfunctions.RetryProps{MaxAttempts: jsii.Number(3)})
+	}
+	update := lambdaStep("UpdateNSRecords", "update", map[string]interface{}{
+		"NameServers": awsstepfunctions.JsonPath_ListAt(jsii.String("$.Zone.NameServers")),
+	})
+	update.AddRetry(&awsstepfunctions.RetryProps{MaxAttempts: jsii.Number(3)})
+	verifyProperties := map[string]interface{}{
+		"NameServers": awsstepfunctions.JsonPath_ListAt(jsii.String("$.Zone.NameServers")),
+	}
+	if props.Config.Propagation != nil && props.Config.Propagation.Enabled {
+		verifyProperties["DoHEndpoints"] = dohResolvers(props.Config.Propagation)
+		for key, value := range propagationTimingProperties(props.Config.Propagation) {
+			verifyProperties[key] = value
+		}
+	}
+	verify := lambdaStep("VerifyNSRecords", "verify", verifyProperties)
+	verify.AddRetry(&awsstepfunctions.RetryProps{
+		MaxAttempts: jsii.Number(5),
+		Interval:    awscdk.Duration_Seconds(jsii.Number(10)),
+		BackoffRate: jsii.Number(2),
+	})
+	respondSuccess := respondStep("RespondSuccess", map[string]interface{}{
+		"Status":       "SUCCESS",
+		"HostedZoneId": awsstepfunctions.JsonPath_StringAt(jsii.String("$.Zone.Id")),
+		"NameServers":  awsstepfunctions.JsonPath_ListAt(jsii.String("$.Zone.NameServers")),
+	})
+	for _, step := range []awsstepfunctions.TaskStateBase{check, findZone, getZone, createZone, update, verify} {
+		catch(step)
+	}
+	var updateAndVerify awsstepfunctions.IChainable = update.Next(verify).Next(respondSuccess)
+	if zoneReady != nil {
+		catch(zoneReady)
+		updateAndVerify = zoneReady.Next(updateAndVerify)
+	}
+	getZone.Next(updateAndVerify)
+	createZone.Next(updateAndVerify)
+	delegate := check.Next(findZone).Next(zoneFound("HostedZoneExists", getZone, createZone))
+
+	// Delete: remove the hosted zone, unless it is retained. The Cloudflare NS records
+	// are left in place, as with the custom resource orchestration.
+	respondDeleted := respondStep("RespondDeleted", map[string]interface{}{"Status": "SUCCESS"})
+	var remove awsstepfunctions.IChainable = respondDeleted
+	if hostedZoneRemovalPolicy(props.Config) != "retain" {
+		findZoneToDelete := findZoneStep("FindHostedZoneToDelete")
+		deleteZone := awsstepfunctionstasks.NewCallAwsService(scope, jsii.String("DeleteHostedZone"), &awsstepfunctionstasks.CallAwsServiceProps{
+			Service:      jsii.String("route53"),
+			Action:       jsii.String("deleteHostedZone"),
+			IamAction:    jsii.String("route53:DeleteHostedZone"),
+			IamResources: jsii.Strings(*hostedZoneArn),
+			Parameters: &map[string]interface{}{
+				"Id": awsstepfunctions.JsonPath_StringAt(jsii.String("$.Lookup.HostedZones[0].Id")),
+			},
+			ResultPath:  awsstepfunctions.JsonPath_DISCARD(),
+			TaskTimeout: awsTimeout,
+		})
+		catch(findZoneToDelete)
+		catch(deleteZone)
+		deleteZone.Next(respondDeleted)
+		remove = findZoneToDelete.Next(zoneFound("HostedZoneToDeleteExists", deleteZone, respondDeleted))
+	}
+
+	definition := awsstepfunctions.NewChoice(scope, jsii.String("IsDelete"), nil).
+		When(awsstepfunctions.Condition_StringEquals(jsii.String("$.Event.RequestType"), jsii.String("Delete")), remove).
+		Otherwise(delegate)
+
+	tracing := lambdaSettings.Powertools != nil && lambdaSettings.Powertools.Tracing
+	stateMachine := awsstepfunctions.NewStateMachine(scope, jsii.String("DelegationStateMachine"), &awsstepfunctions.StateMachineProps{
+		DefinitionBody: awsstepfunctions.DefinitionBody_FromChainable(definition),
+		// Custom resources time out after an hour
+		Timeout:        awscdk.Duration_Minutes(jsii.Number(50)),
+		TracingEnabled: jsii.Bool(tracing),
+	})
+
+	// Granted with a separate policy, since the function depends on its default policy and
+	// the state machine depends on the function
+	startPolicy := awsiam.NewPolicy(scope, jsii.String("DelegationWorkflowStartPolicy"), &awsiam.PolicyProps{
+		Roles: &[]awsiam.IRole{provider.Function.Role()},
+		Statements: &[]awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions:   jsii.Strings("states:StartExecution"),
+				Resources: jsii.Strings(*stateMachine.StateMachineArn()),
+			}),
+		},
+	})
+
+	// Single custom resource starting the state machine
+	properties := map[string]interface{}{
+		"Domain":          *props.ParentDomain,
+		"Subdomain":       *props.Subdomain,
+		"Action":          "workflow",
+		"StateMachineArn": stateMachine.StateMachineArn(),
+	}
+	for key, value := range tokenProperties {
+		properties[key] = value
+	}
+	workflow := awscdk.NewCustomResource(scope, jsii.String("CloudflareDelegationWorkflow"), &awscdk.CustomResourceProps{
+		ServiceToken: provider.ServiceToken,
+		Properties:   &properties,
+	})
+	workflow.Node().AddDependency(startPolicy)
+
+	nameServers = awscdk.Fn_Join(jsii.String(", "), awscdk.Fn_Split(jsii.String(","), workflow.GetAttString(jsii.String("NameServers")), nil))
+	return workflow.GetAttString(jsii.String("HostedZoneId")), nameServers
+}
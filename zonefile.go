@@ -0,0 +1,251 @@
+package cftor53
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// configRecords returns the records of the configuration and of its zone file, or those of
+// the configuration alone and the problem of a zone file that can't be read
+func configRecords(config *ConfigFile) ([]RecordConfig, string) {
+	if config.ZoneFile == "" {
+		return config.Records, ""
+	}
+	zoneFile, err := os.ReadFile(config.ZoneFile)
+	if err != nil {
+		return config.Records, "Failed to read zone_file: " + err.Error()
+	}
+	zoneFileRecords, err := parseZoneFile(string(zoneFile), config.Subdomain+"."+config.ParentDomain)
+	if err != nil {
+		return config.Records, "Failed to parse zone_file " + config.ZoneFile + ": " + err.Error()
+	}
+	return append(append([]RecordConfig{}, config.Records...), zoneFileRecords...), ""
+}
+
+// parseZoneFile parses a BIND zone file for the zone origin into records relative to the
+// origin. The SOA and the NS records of the origin are skipped, since Route53 manages them.
+func parseZoneFile(data, origin string) ([]RecordConfig, error) {
+	origin = strings.ToLower(strings.TrimSuffix(origin, ".")) + "."
+	zone := origin
+	defaultTTL := 0
+	lastOwner := ""
+
+	var records []RecordConfig
+	index := map[string]int{}
+	entries, err := zoneFileEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		tokens := entry.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN requires a domain name", entry.line)
+			}
+			origin = absoluteName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $TTL requires a TTL", entry.line)
+			}
+			ttl, ok := parseZoneTTL(tokens[1])
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid $TTL %s", entry.line, tokens[1])
+			}
+			defaultTTL = ttl
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, fmt.Errorf("line %d: %s is not supported", entry.line, tokens[0])
+		}
+
+		// A record without an owner belongs to the previous owner
+		owner := lastOwner
+		if !entry.continued {
+			owner = absoluteName(tokens[0], origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("line %d: record without an owner name", entry.line)
+		}
+		lastOwner = owner
+
+		// The TTL and class are optional and may come in either order
+		ttl := defaultTTL
+		for i := 0; i < 2 && len(tokens) > 0; i++ {
+			if value, ok := parseZoneTTL(tokens[0]); ok {
+				ttl = value
+				tokens = tokens[1:]
+			} else if class := strings.ToUpper(tokens[0]); class == "IN" || class == "CH" || class == "HS" {
+				if class != "IN" {
+					return nil, fmt.Errorf("line %d: class %s is not supported", entry.line, class)
+				}
+				tokens = tokens[1:]
+			}
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("line %d: record without type or data", entry.line)
+		}
+		recordType := strings.ToUpper(tokens[0])
+		rdata := tokens[1:]
+
+		name := ""
+		if owner != zone {
+			if !strings.HasSuffix(owner, "."+zone) {
+				return nil, fmt.Errorf("line %d: %s is outside of %s", entry.line, owner, zone)
+			}
+			name = strings.TrimSuffix(owner, "."+zone)
+		}
+		if recordType == "SOA" || (recordType == "NS" && name == "") {
+			continue
+		}
+		if _, ok := seedRecordTypes[recordType]; !ok {
+			return nil, fmt.Errorf("line %d: record type %s is not supported", entry.line, recordType)
+		}
+
+		// Domain names in the data are made absolute, since they are relative to the file's origin
+		switch recordType {
+		case "CNAME", "NS", "PTR":
+			rdata[0] = absoluteName(rdata[0], origin)
+		case "MX":
+			if len(rdata) == 2 {
+				rdata[1] = absoluteName(rdata[1], origin)
+			}
+		case "SRV":
+			if len(rdata) == 4 {
+				rdata[3] = absoluteName(rdata[3], origin)
+			}
+		}
+		value := strings.Join(rdata, " ")
+
+		key := recordType + " " + name
+		if i, ok := index[key]; ok {
+			records[i].Values = append(records[i].Values, value)
+			continue
+		}
+		index[key] = len(records)
+		records = append(records, RecordConfig{Name: name, Type: recordType, Values: []string{value}, TTL: ttl})
+	}
+	return records, nil
+}
+
+// zoneFileEntry is a record or directive of a zone file, joined across parentheses
+type zoneFileEntry struct {
+	line   int
+	tokens []string
+	// The entry starts with whitespace, so it has no owner name
+	continued bool
+}
+
+// zoneFileEntries splits a zone file into entries, removing comments and keeping quoted
+// strings, quotes included, as single tokens
+func zoneFileEntries(data string) ([]zoneFileEntry, error) {
+	var entries []zoneFileEntry
+	var current *zoneFileEntry
+	depth := 0
+	for number, line := range strings.Split(data, "\n") {
+		if current == nil {
+			current = &zoneFileEntry{
+				line:      number + 1,
+				continued: len(line) > 0 && (line[0] == ' ' || line[0] == '\t'),
+			}
+		}
+
+		var token strings.Builder
+		inQuotes := false
+		flush := func() {
+			if token.Len() > 0 {
+				current.tokens = append(current.tokens, token.String())
+				token.Reset()
+			}
+		}
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inQuotes:
+				token.WriteByte(c)
+				if c == '\\' && i+1 < len(line) {
+					i++
+					token.WriteByte(line[i])
+				} else if c == '"' {
+					inQuotes = false
+				}
+			case c == '"':
+				inQuotes = true
+				token.WriteByte(c)
+			case c == ';':
+				i = len(line)
+			case c == '(':
+				flush()
+				depth++
+			case c == ')':
+				flush()
+				if depth == 0 {
+					return nil, fmt.Errorf("line %d: unbalanced parentheses", number+1)
+				}
+				depth--
+			case unicode.IsSpace(rune(c)):
+				flush()
+			default:
+				token.WriteByte(c)
+			}
+		}
+		if inQuotes {
+			return nil, fmt.Errorf("line %d: unterminated quoted string", number+1)
+		}
+		flush()
+
+		if depth == 0 {
+			if len(current.tokens) > 0 {
+				entries = append(entries, *current)
+			}
+			current = nil
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", current.line)
+	}
+	return entries, nil
+}
+
+// absoluteName returns the fully qualified name, with a trailing dot, of a zone file name
+func absoluteName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "." + origin
+}
+
+// parseZoneTTL parses a TTL in seconds or with BIND units, e.g. 1h30m
+func parseZoneTTL(value string) (int, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return seconds, seconds >= 0
+	}
+	units := map[byte]int{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	total, number, digits := 0, 0, 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= '0' && c <= '9' {
+			number = number*10 + int(c-'0')
+			digits++
+			continue
+		}
+		unit, ok := units[byte(unicode.ToLower(rune(c)))]
+		if !ok || digits == 0 {
+			return 0, false
+		}
+		total += number * unit
+		number, digits = 0, 0
+	}
+	if digits > 0 {
+		return 0, false
+	}
+	return total, true
+}